@@ -131,6 +131,8 @@ func (a *nginxAccess) init(addr string, allow bool) {
 		}
 	} else if ip := net.ParseIP(addr); ip != nil {
 		a.match = a.matchIP(ip)
+	} else if _, n, err := net.ParseCIDR(addr); err == nil {
+		a.match = a.matchNet(n)
 	}
 }
 
@@ -150,6 +152,15 @@ func (a *nginxAccess) matchIP(ip net.IP) func(r *http.Request) bool {
 	}
 }
 
+func (a *nginxAccess) matchNet(n *net.IPNet) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		if ap := realIP(r); ap != nil {
+			return n.Contains(ap)
+		}
+		return false
+	}
+}
+
 func realIP(r *http.Request) net.IP {
 	return net.ParseIP(realIPString(r))
 }
@@ -47,5 +47,5 @@ func GetSlice() []byte {
 
 // PutSlice resets buf and puts it back info the pool
 func PutSlice(buf []byte) {
-	stringsBuf.Put(buf[:0])
+	sliceBuffer.Put(buf[:cap(buf)])
 }
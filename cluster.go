@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/raft"
+)
+
+// clusterForward is the first byte of connections forwarding commands to the
+// leader, raft rpc types are all lower.
+const clusterForward byte = 'F'
+
+// cluster is the raft node of vince, it replicates limit_req zones with sync
+// and cache purges to the other nodes.
+type cluster struct {
+	raft *raft.Raft
+	db   vinceDatabases
+}
+
+// startCluster starts the raft node configured in config and sets
+// config.limitSync and config.cacheSync. It returns nil when vince is not part
+// of a cluster.
+func startCluster(config *vinceConfiguration) (*cluster, error) {
+	o := config.cluster
+	if o.id == "" {
+		return nil, nil
+	}
+	servers, err := clusterServers(o.peers)
+	if err != nil {
+		return nil, err
+	}
+	var advertise raft.ServerAddress
+	for _, s := range servers {
+		if s.ID == raft.ServerID(o.id) {
+			advertise = s.Address
+		}
+	}
+	if advertise == "" {
+		return nil, fmt.Errorf("vince: cluster node %q is missing from cluster peers", o.id)
+	}
+	addr := o.addr
+	if addr == "" {
+		addr = string(advertise)
+	}
+	dir := o.dir
+	if dir == "" {
+		dir = filepath.Join(config.dir, "raft")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &cluster{}
+	opts := badger.DefaultOptions("")
+	if c.db.raft.stable, err = c.db.open(opts, dir, "stable"); err != nil {
+		c.db.Close()
+		return nil, err
+	}
+	if c.db.raft.logs, err = c.db.open(opts, dir, "logs"); err != nil {
+		c.db.Close()
+		return nil, err
+	}
+	if c.db.kv, err = c.db.open(opts, dir, "kv"); err != nil {
+		c.db.Close()
+		return nil, err
+	}
+	snaps, err := raft.NewFileSnapshotStore(dir, retainSnapshotCount, os.Stderr)
+	if err != nil {
+		c.db.Close()
+		return nil, err
+	}
+	ls, err := net.Listen("tcp", addr)
+	if err != nil {
+		c.db.Close()
+		return nil, err
+	}
+	stream := newClusterStream(ls, advertise)
+	transport := raft.NewNetworkTransport(stream, 3, raftTimeout, os.Stderr)
+	stable := &store{db: c.db.raft.stable}
+	logs := &store{db: c.db.raft.logs}
+	state := &kv{store: stable}
+	limits := newLimitSync(o.id, state)
+	caches := newCacheSync(o.id, state)
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(o.id)
+	conf.LogOutput = os.Stderr
+	conf.LogLevel = "WARN"
+	bootstrapped, err := raft.HasExistingState(logs, stable, snaps)
+	if err != nil {
+		transport.Close()
+		c.db.Close()
+		return nil, err
+	}
+	c.raft, err = raft.NewRaft(conf, &fsm{db: c.db.kv, limits: limits, caches: caches},
+		logs, stable, snaps, transport)
+	if err != nil {
+		transport.Close()
+		c.db.Close()
+		return nil, err
+	}
+	state.raft = c.raft
+	state.forward = func(cmd *command) error {
+		return stream.forward(c.raft.Leader(), cmd)
+	}
+	stream.serve(state.commit)
+	if !bootstrapped {
+		// every node bootstraps with the same peers so they agree on the
+		// first configuration.
+		err = c.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	config.limitSync = limits
+	config.cacheSync = caches
+	return c, nil
+}
+
+// close stops the raft node and closes its databases.
+func (c *cluster) close() error {
+	err := c.raft.Shutdown().Error()
+	if e := c.db.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// clusterServers parses cluster peers given as id=host:port.
+func clusterServers(peers []string) ([]raft.Server, error) {
+	var servers []raft.Server
+	seen := make(map[string]bool)
+	for _, p := range peers {
+		id := strings.Split(p, "=")
+		if len(id) != 2 || id[0] == "" {
+			return nil, fmt.Errorf("vince: invalid cluster peer %q", p)
+		}
+		if _, _, err := net.SplitHostPort(id[1]); err != nil {
+			return nil, fmt.Errorf("vince: invalid cluster peer %q %v", p, err)
+		}
+		if seen[id[0]] {
+			return nil, fmt.Errorf("vince: duplicate cluster peer %q", id[0])
+		}
+		seen[id[0]] = true
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(id[0]),
+			Address: raft.ServerAddress(id[1]),
+		})
+	}
+	return servers, nil
+}
+
+// clusterStream is the raft stream layer. Followers use the same listener to
+// forward commands to the leader, connections starting with clusterForward
+// are served by apply and the others are handed to raft.
+type clusterStream struct {
+	net.Listener
+	addr     clusterAddr
+	accepted chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+
+	// open are the accepted connections, they are closed with the stream so
+	// the address can be bound again.
+	mu   sync.Mutex
+	open map[net.Conn]bool
+}
+
+// forwardResult is the response to forwarded commands.
+type forwardResult struct {
+	Error string
+}
+
+type clusterAddr string
+
+func (a clusterAddr) Network() string { return "tcp" }
+
+func (a clusterAddr) String() string { return string(a) }
+
+func newClusterStream(ls net.Listener, advertise raft.ServerAddress) *clusterStream {
+	return &clusterStream{
+		Listener: ls,
+		addr:     clusterAddr(advertise),
+		accepted: make(chan net.Conn),
+		done:     make(chan struct{}),
+		open:     make(map[net.Conn]bool),
+	}
+}
+
+// serve accepts connections until the stream is closed.
+func (s *clusterStream) serve(apply func(*command) error) {
+	go func() {
+		for {
+			conn, err := s.Listener.Accept()
+			if err != nil {
+				s.Close()
+				return
+			}
+			go s.route(conn, apply)
+		}
+	}()
+}
+
+func (s *clusterStream) route(conn net.Conn, apply func(*command) error) {
+	if !s.track(conn) {
+		conn.Close()
+		return
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(raftTimeout))
+	b, err := r.Peek(1)
+	if err != nil {
+		s.close(conn)
+		return
+	}
+	if b[0] == clusterForward {
+		r.ReadByte()
+		s.forwarded(conn, r, apply)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	select {
+	case s.accepted <- &peekedConn{Conn: conn, r: r, s: s}:
+	case <-s.done:
+		s.close(conn)
+	}
+}
+
+// track adds conn to the open connections, it returns false when the stream
+// is closed.
+func (s *clusterStream) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open == nil {
+		return false
+	}
+	s.open[conn] = true
+	return true
+}
+
+// close closes conn and removes it from the open connections.
+func (s *clusterStream) close(conn net.Conn) error {
+	s.mu.Lock()
+	delete(s.open, conn)
+	s.mu.Unlock()
+	return conn.Close()
+}
+
+// forwarded applies a command sent by a follower and writes the result.
+func (s *clusterStream) forwarded(conn net.Conn, r *bufio.Reader, apply func(*command) error) {
+	defer s.close(conn)
+	conn.SetDeadline(time.Now().Add(2 * raftTimeout))
+	var c command
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return
+	}
+	var res forwardResult
+	if err := apply(&c); err != nil {
+		res.Error = err.Error()
+	}
+	json.NewEncoder(conn).Encode(res)
+}
+
+// forward applies c on the leader.
+func (s *clusterStream) forward(leader raft.ServerAddress, c *command) error {
+	if leader == "" {
+		return errNotLeader
+	}
+	conn, err := s.Dial(leader, raftTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * raftTimeout))
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append([]byte{clusterForward}, b...)); err != nil {
+		return err
+	}
+	var res forwardResult
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return err
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	return nil
+}
+
+// Accept returns the next raft connection.
+func (s *clusterStream) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.accepted:
+		return conn, nil
+	case <-s.done:
+		return nil, errors.New("vince: cluster stream closed")
+	}
+}
+
+func (s *clusterStream) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.Listener.Close()
+		s.mu.Lock()
+		open := s.open
+		s.open = nil
+		s.mu.Unlock()
+		for conn := range open {
+			conn.Close()
+		}
+	})
+	return err
+}
+
+func (s *clusterStream) Addr() net.Addr {
+	return s.addr
+}
+
+func (s *clusterStream) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", string(address), timeout)
+}
+
+// peekedConn reads the bytes peeked while routing the connection first.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+	s *clusterStream
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) Close() error {
+	return c.s.close(c.Conn)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCluster(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer backend.Close()
+	peers := []string{"0=127.0.0.1:8113", "1=127.0.0.1:8114", "2=127.0.0.1:8115"}
+	nodes := make([]*vinceConfiguration, len(peers))
+	for i := range nodes {
+		file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    limit_req_zone $remote_addr zone=rate:1m rate=1r/m sync;
+    limit_req_sync_interval 50ms;
+    proxy_cache_path {{.dir}}/cache levels=1:2 keys_zone=one:1m;
+    map $request_method $purge_method {
+        PURGE 1;
+        default 0;
+    }
+    server {
+        listen       127.0.0.1:%d;
+        location /limited {
+            limit_req zone=rate;
+        }
+        location /cached/ {
+            proxy_cache one;
+            proxy_cache_valid 200 1m;
+            proxy_cache_purge $purge_method;
+            add_header X-Cache-Status $upstream_cache_status;
+            proxy_pass %s/;
+        }
+    }
+}
+`, 8110+i, backend.URL)
+		c, clear, err := setup(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clear()
+		c.cluster.id = fmt.Sprint(i)
+		c.cluster.peers = peers
+		nodes[i] = c
+	}
+	host := func(i int) string {
+		return fmt.Sprintf("http://127.0.0.1:%d", 8110+i)
+	}
+	eventually := func(t *testing.T, msg string, ok func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	ran := false
+	cluster := func(ctx context.Context, t *testing.T) {
+		ran = true
+		for _, c := range nodes {
+			eventually(t, "no leader elected", func() bool {
+				return c.limitSync.kv.raft.Leader() != ""
+			})
+		}
+		t.Run("limit_req", func(t *testing.T) {
+			runHTTP(http.MethodGet, host(0)+"/limited", nil, checkCode(http.StatusNotFound))(ctx, t)
+			z := nodes[1].limitSync.zone("rate")
+			eventually(t, "requests were not synced", func() bool {
+				z.mu.Lock()
+				defer z.mu.Unlock()
+				_, ok := z.states["127.0.0.1"]
+				return ok
+			})
+			runHTTP(http.MethodGet, host(1)+"/limited", nil, checkCode(http.StatusServiceUnavailable))(ctx, t)
+		})
+		t.Run("purge", func(t *testing.T) {
+			runHTTP(http.MethodGet, host(1)+"/cached/a", nil, checkHeader("X-Cache-Status", cacheMiss))(ctx, t)
+			runHTTP(http.MethodGet, host(1)+"/cached/a", nil, checkHeader("X-Cache-Status", cacheHit))(ctx, t)
+			runHTTP("PURGE", host(0)+"/cached/*", nil, checkCode(http.StatusNoContent))(ctx, t)
+			z := nodes[1].cacheSync.zone("one")
+			eventually(t, "purge was not replicated", func() bool {
+				z.mu.Lock()
+				defer z.mu.Unlock()
+				return len(z.entries) == 0
+			})
+			runHTTP(http.MethodGet, host(1)+"/cached/a", nil, checkHeader("X-Cache-Status", cacheMiss))(ctx, t)
+		})
+	}
+	runTest(t, nodes[0], func(ctx context.Context, t *testing.T) {
+		runTest(t, nodes[1], func(ctx context.Context, t *testing.T) {
+			runTest(t, nodes[2], cluster)
+		})
+	})
+	if !ran {
+		t.Error("the cluster did not start")
+	}
+}
+
+func TestClusterServers(t *testing.T) {
+	for _, peers := range [][]string{
+		{"127.0.0.1:8113"},
+		{"=127.0.0.1:8113"},
+		{"0=localhost"},
+		{"0=127.0.0.1:8113", "0=127.0.0.1:8114"},
+	} {
+		if _, err := clusterServers(peers); err == nil {
+			t.Errorf("expected %q to be invalid", peers)
+		}
+	}
+	s, err := clusterServers([]string{"a=127.0.0.1:8113", "b=127.0.0.1:8114"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 2 || s[1].ID != "b" || s[1].Address != "127.0.0.1:8114" {
+		t.Errorf("unexpected servers %v", s)
+	}
+}
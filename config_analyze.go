@@ -453,6 +453,9 @@ var directives = map[string][]int{
 	"limit_conn": []int{
 		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConfTake2,
 		NGXStreamMainConf | NGXStreamSrvConf | NGXConfTake2},
+	"limit_conn_dry_run": []int{
+		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConfFlag,
+		NGXStreamMainConf | NGXStreamSrvConf | NGXConfFlag},
 	"limit_conn_log_level": []int{
 		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConfTake1,
 		NGXStreamMainConf | NGXStreamSrvConf | NGXConfTake1},
@@ -469,12 +472,16 @@ var directives = map[string][]int{
 		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXHttpLifConf | NGXConfTake1},
 	"limit_req": []int{
 		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConfTake123},
+	"limit_req_dry_run": []int{
+		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConfFlag},
 	"limit_req_log_level": []int{
 		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConfTake1},
 	"limit_req_status": []int{
 		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConfTake1},
+	"limit_req_sync_interval": []int{
+		NGXHttpMainConf | NGXConfTake1},
 	"limit_req_zone": []int{
-		NGXHttpMainConf | NGXConfTake3},
+		NGXHttpMainConf | NGXConfTake3 | NGXConfTake4},
 	"lingering_close": []int{
 		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConfTake1},
 	"lingering_time": []int{
@@ -657,6 +664,8 @@ var directives = map[string][]int{
 		NGXHttpMainConf | NGXConf2More},
 	"proxy_cache_revalidate": []int{
 		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConfFlag},
+	"proxy_cache_tag_header": []int{
+		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConfTake1},
 	"proxy_cache_use_stale": []int{
 		NGXHttpMainConf | NGXHttpSrvConf | NGXHttpLocConf | NGXConf1More},
 	"proxy_cache_valid": []int{
@@ -1487,7 +1496,9 @@ func analyze(filename string, stmt *Stmt, term string, ctx []string, strict bool
 		return nil
 	}
 	if checkCtx {
-		pass := true
+		// only directives of if blocks are checked, few of them are allowed
+		// there.
+		pass := len(ctx) == 0 || ctx[len(ctx)-1] != "if"
 		for _, m := range masks {
 			if m&ctxMask != 0 {
 				pass = true
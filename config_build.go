@@ -189,7 +189,7 @@ func buildBlock(output string, custom map[string]customBuilder, block []*Stmt, p
 				}
 			}
 			if directive == "if" {
-				built = " if" + strings.Join(args, " ") + ")"
+				built = "if (" + strings.Join(args, " ") + ")"
 			} else if args != nil {
 				built = directive + " " + strings.Join(args, " ")
 			} else {
@@ -55,3 +55,22 @@ http {
 		t.Errorf("===expected \n%s\n === got \n%s", expect, buf)
 	}
 }
+
+func TestBuildIf(t *testing.T) {
+	sample := []*Stmt{
+		&Stmt{
+			Directive: "if",
+			Args:      []string{"$request_method", "=", "POST"},
+			Blocks: []*Stmt{
+				&Stmt{Directive: "return", Args: []string{"405"}},
+			},
+		},
+	}
+	expect := `if ($request_method = POST) {
+    return 405;
+}`
+	buf := build(sample, 4, false)
+	if buf != expect {
+		t.Errorf("===expected \n%s\n === got \n%s", expect, buf)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ergongate/vince/templates"
+	"github.com/urfave/cli/v2"
+)
+
+// checkErrors is a list of configuration problems found by checkConfig.
+type checkErrors []error
+
+func (c checkErrors) Error() string {
+	var s []string
+	for _, e := range c {
+		s = append(s, e.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// loadConfig parses file with all includes expanded and returns the main block
+// ready to be passed to ruleFromStmt.
+func loadConfig(file string) (*Stmt, error) {
+	opts := defaultParseOpts()
+	opts.combine = true
+	p := parse(file, templates.IncludeFS, opts)
+	if p.Errors != nil {
+		return nil, checkErrors(p.Errors)
+	}
+	return &Stmt{Directive: "main", Blocks: p.Config[0].Parsed}, nil
+}
+
+// configCheck builds every directive that vince knows how to build without
+// binding any sockets and collects the errors.
+type configCheck struct {
+	port string
+	// cluster is true when vince is part of a cluster, zones can only be
+	// shared with the sync parameter then.
+	cluster bool
+	errs    []error
+	seen    map[string]bool
+}
+
+func checkConfig(core *rule, defaultPort int, cluster bool) error {
+	c := &configCheck{
+		port:    strconv.Itoa(defaultPort),
+		cluster: cluster,
+		seen:    make(map[string]bool),
+	}
+	c.walk(core)
+	c.healthChecks(core)
+	c.streams(core)
+	c.limits(core)
+	c.caches(core)
+	c.maps(core)
+	sort.SliceStable(c.errs, func(i, j int) bool {
+		a, b := c.errs[i].(NgxError), c.errs[j].(NgxError)
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Linenum < b.Linenum
+	})
+	if c.errs != nil {
+		return checkErrors(c.errs)
+	}
+	return nil
+}
+
+// healthChecks checks health_check directives, this needs all upstreams and
+// match blocks to be loaded.
+func (c *configCheck) healthChecks(core *rule) {
+	upstreams, err := collectUpstreams(core, "http")
+	if err != nil {
+		return
+	}
+	streamUpstreams, err := collectUpstreams(core, "stream")
+	if err != nil {
+		return
+	}
+	for _, b := range core.children {
+		if _, err := collectMatches(b); err != nil {
+			c.report(b, err)
+			return
+		}
+	}
+	if _, err := collectHealthChecks(core, upstreams, streamUpstreams); err != nil {
+		c.report(core, err)
+	}
+}
+
+// streams checks stream servers.
+func (c *configCheck) streams(core *rule) {
+	_, servers, err := collectStreamServers(core)
+	if err != nil {
+		c.report(core, err)
+		return
+	}
+	upstreams, err := collectUpstreams(core, "stream")
+	if err != nil {
+		return
+	}
+	zones, err := collectLimitConnZones(core, "stream", nil)
+	if err != nil {
+		c.report(core, err)
+		return
+	}
+	for _, srv := range servers {
+		if _, err := newStreamProxy(srv, upstreams, zones, nil, nil); err != nil {
+			c.report(srv, err)
+		}
+	}
+}
+
+// limits checks limit_req and limit_conn directives in the http block,
+// limit_conn in the stream block is checked with stream servers.
+func (c *configCheck) limits(core *rule) {
+	zones, err := collectLimitReqZones(core, nil)
+	if err != nil {
+		c.report(core, err)
+		return
+	}
+	if _, err := limitReqSyncInterval(core); err != nil {
+		c.report(core, err)
+	}
+	conns, err := collectLimitConnZones(core, "http", nil)
+	if err != nil {
+		c.report(core, err)
+		return
+	}
+	var walk func(r *rule)
+	walk = func(r *rule) {
+		for _, ch := range r.children {
+			switch ch.name {
+			case "limit_req_zone":
+				for _, a := range ch.args[1:] {
+					if a == "sync" && !c.cluster {
+						c.report(ch, errors.New("vince: limit_req_zone sync requires a cluster"))
+					}
+				}
+			case "limit_req":
+				if _, err := parseLimitReq(ch, zones); err != nil {
+					c.report(ch, err)
+				}
+			case "limit_req_status", "limit_req_log_level":
+				var o limitReqOption
+				c.report(ch, o.loadKey(ch))
+			case "limit_conn":
+				if !inStream(ch) {
+					_, err := parseLimitConn(ch, conns)
+					c.report(ch, err)
+				}
+			case "limit_conn_status", "limit_conn_log_level":
+				var o limitConnOption
+				c.report(ch, o.loadKey(ch))
+			}
+			walk(ch)
+		}
+	}
+	walk(core)
+}
+
+// caches checks proxy_cache_path zones and the proxy_cache directives using
+// them.
+func (c *configCheck) caches(core *rule) {
+	zones, err := collectCacheZones(core, nil)
+	if err != nil {
+		c.report(core, err)
+		return
+	}
+	var walk func(r *rule)
+	walk = func(r *rule) {
+		for _, ch := range r.children {
+			if ch.name == "proxy_cache" && ch.args[0] != "off" && zones[ch.args[0]] == nil {
+				c.report(ch, fmt.Errorf("vince: unknown proxy_cache zone %q", ch.args[0]))
+			}
+			walk(ch)
+		}
+	}
+	walk(core)
+}
+
+// maps checks map blocks in the http and stream blocks.
+func (c *configCheck) maps(core *rule) {
+	for _, block := range []string{"http", "stream"} {
+		if _, err := collectMaps(core, block); err != nil {
+			c.report(core, err)
+		}
+	}
+}
+
+// inStream returns true if r is inside the stream block.
+func inStream(r *rule) bool {
+	for p := r.parent; p != nil; p = p.parent {
+		if p.name == "stream" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *configCheck) walk(r *rule) {
+	for _, ch := range r.children {
+		c.report(ch, c.rule(ch))
+		if ch.name == "map" {
+			// entries are keys and values, not directives
+			continue
+		}
+		c.walk(ch)
+	}
+}
+
+func (c *configCheck) report(r *rule, err error) {
+	if err == nil {
+		return
+	}
+	err = r.wrap(err)
+	// the same ssl directive is loaded by every listen in the server.
+	if c.seen[err.Error()] {
+		return
+	}
+	c.seen[err.Error()] = true
+	c.errs = append(c.errs, err)
+}
+
+func (c *configCheck) rule(r *rule) error {
+	switch r.name {
+	case "listen":
+		ls, err := parseListen(r, c.port)
+		if err != nil {
+			return err
+		}
+		if ls.ssl {
+			_, err = ls.sslOpts.config()
+			return err
+		}
+	case "server_name":
+		for _, a := range r.args {
+			if a != "" && a[0] == '~' {
+				if _, err := compileServerName(a); err != nil {
+					return err
+				}
+			}
+		}
+	case "location":
+		_, err := newMatch(r)
+		return err
+	case "upstream":
+		var u upstreamConfig
+		return u.load(r)
+	case "proxy_pass":
+		if inStream(r) {
+			// checked with the stream server
+			return nil
+		}
+		_, err := parseProxyURL(r.args[0])
+		return err
+	case "proxy_next_upstream":
+		_, err := parseNextUpstream(r.args)
+		return err
+	case "proxy_next_upstream_tries":
+		_, err := strconv.ParseInt(r.args[0], 10, 64)
+		return err
+	case "proxy_next_upstream_timeout":
+		_, err := parseDuration(r.args[0])
+		return err
+	case "try_files", "autoindex_format":
+		var o staticOption
+		return o.loadKey(r)
+	case "rewrite", "return", "set", "break", "if":
+		if inStream(r) {
+			return nil
+		}
+		_, err := newRewriteStep(r)
+		return err
+	case "add_header", "add_trailer":
+		_, err := newAddHeader(r)
+		return err
+	case "expires":
+		_, err := newExpires(r)
+		return err
+	case "error_page":
+		_, err := newErrorPage(r)
+		return err
+	case "proxy_cache_valid":
+		_, err := newCacheValid(r)
+		return err
+	case "proxy_cache_methods", "proxy_cache_lock_timeout", "proxy_cache_use_stale":
+		var o proxyCacheOption
+		return o.loadKey(r)
+	case "fastcgi_param", "uwsgi_param", "scgi_param":
+		_, err := newCGIParam(r)
+		return err
+	case "fastcgi_split_path_info", "fastcgi_connect_timeout",
+		"fastcgi_send_timeout", "fastcgi_read_timeout":
+		var o fastcgiOption
+		return o.loadKey(r)
+	case "uwsgi_modifier1", "uwsgi_modifier2", "uwsgi_connect_timeout",
+		"uwsgi_send_timeout", "uwsgi_read_timeout", "scgi_connect_timeout",
+		"scgi_send_timeout", "scgi_read_timeout":
+		var o cgiPassOption
+		return o.loadKey(strings.SplitN(r.name, "_", 2)[0], r)
+	case "grpc_pass", "grpc_next_upstream", "grpc_next_upstream_tries",
+		"grpc_next_upstream_timeout", "grpc_connect_timeout", "grpc_read_timeout":
+		var o grpcOption
+		return o.loadKey(r)
+	case "grpc_set_header":
+		if len(r.args) != 2 {
+			return fmt.Errorf("vince: invalid number of arguments in %s", r.name)
+		}
+	case "limit_rate", "limit_rate_after":
+		var o limitRateOption
+		return o.loadKey(r)
+	case "root", "alias",
+		"client_body_buffer_size", "client_body_timeout", "client_max_body_size":
+		var h httpCoreConfig
+		return h.load(r)
+	case "allow", "deny":
+		a := r.args[0]
+		if a == "all" || a == "unix:" || net.ParseIP(a) != nil {
+			return nil
+		}
+		if _, _, err := net.ParseCIDR(a); err != nil {
+			return fmt.Errorf("vince: invalid address %q", a)
+		}
+	default:
+		if strings.HasPrefix(r.name, "ssl_") {
+			var ss sslOptions
+			return ss.load(r)
+		}
+	}
+	return nil
+}
+
+// check parses and validates configuration file. All problems found are
+// written to stderr, cluster allows directives that need a cluster.
+func check(file string, defaultPort int, cluster bool) error {
+	d, err := loadConfig(file)
+	if err == nil {
+		err = checkConfig(ruleFromStmt(d, nil), defaultPort, cluster)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return fmt.Errorf("vince: configuration file %s test failed", file)
+	}
+	fmt.Printf("vince: configuration file %s test is successful\n", file)
+	return nil
+}
+
+func checkCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "check",
+		Usage: "validates vince configuration file without starting the server",
+		Action: func(ctx *cli.Context) error {
+			a := ctx.Args().First()
+			if a == "" {
+				c, err := getConfig(ctx)
+				if err != nil {
+					return errors.New("missing file")
+				}
+				a = c.confFile
+			}
+			return check(a, ctx.Int("p"), ctx.String("cluster-id") != "")
+		},
+	}
+}
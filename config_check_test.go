@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	file := `events {
+}
+http {
+    upstream backend {
+        server 127.0.0.1:9001 weight=x;
+    }
+    server {
+        listen 127.0.0.1:9000 ssl;
+        server_name ~^(www\.)?(.+$;
+        ssl_certificate missing.crt;
+        location ~ ^/(images|js {
+            deny all;
+        }
+        location /ok {
+            allow 10.0.0.0/8;
+            proxy_pass http://backend;
+        }
+        location /addr {
+            deny 10.0.0.0/88;
+            proxy_next_upstream_timeout 10;
+            proxy_next_upstream_timeout 1x;
+        }
+    }
+    limit_req_zone $binary_remote_addr zone=one:1m rate=1r/s sync;
+}
+`
+	dir, err := ioutil.TempDir("", "vince-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "vince.conf")
+	if err := ioutil.WriteFile(name, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d, err := loadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkConfig(ruleFromStmt(d, nil), 80, false)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	errs := err.(checkErrors)
+	expect := []string{
+		name + ":5 ",
+		name + ":9 ",
+		name + ":10 ",
+		name + ":11 ",
+		name + ":19 ",
+		name + ":21 ",
+		name + ":24 ",
+	}
+	if len(errs) != len(expect) {
+		t.Fatalf("expected %d errors got %d\n%v", len(expect), len(errs), err)
+	}
+	for i, e := range errs {
+		if !strings.HasPrefix(e.Error(), expect[i]) {
+			t.Errorf("expected %q to start with %q", e.Error(), expect[i])
+		}
+	}
+}
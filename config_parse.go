@@ -307,8 +307,10 @@ func enterBlock(stmt *Stmt, ctx []string) []string {
 
 func prepareIfArgs(stmt *Stmt) {
 	if len(stmt.Args) > 0 && strings.HasPrefix(stmt.Args[0], "(") && strings.HasSuffix(stmt.Args[len(stmt.Args)-1], ")") {
-		stmt.Args[0] = strings.TrimLeft(stmt.Args[0], "(")
-		stmt.Args[len(stmt.Args)-1] = strings.TrimRight(stmt.Args[len(stmt.Args)-1], ")")
+		// only the enclosing parenthesis are removed, the condition can end
+		// with a regular expression like (\d+)
+		stmt.Args[0] = strings.TrimPrefix(stmt.Args[0], "(")
+		stmt.Args[len(stmt.Args)-1] = strings.TrimSuffix(stmt.Args[len(stmt.Args)-1], ")")
 		n := 0
 		for _, v := range stmt.Args {
 			if v != "" {
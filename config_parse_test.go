@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/ergongate/vince/templates"
@@ -54,3 +55,21 @@ func TestParseIncludesBlobbedCombined(t *testing.T) {
 		t.Error("failed to match expectation")
 	}
 }
+
+func TestPrepareIfArgs(t *testing.T) {
+	sample := []struct {
+		args, expect []string
+	}{
+		{[]string{"($a)"}, []string{"$a"}},
+		{[]string{"(", "$a", ")"}, []string{"$a"}},
+		{[]string{"($uri", "~", "^/(\\d+))"}, []string{"$uri", "~", "^/(\\d+)"}},
+		{[]string{"($arg_a", "~", "(a|b))"}, []string{"$arg_a", "~", "(a|b)"}},
+	}
+	for _, s := range sample {
+		stmt := &Stmt{Directive: "if", Args: append([]string(nil), s.args...)}
+		prepareIfArgs(stmt)
+		if !reflect.DeepEqual(stmt.Args, s.expect) {
+			t.Errorf("%q: expected %q got %q", s.args, s.expect, stmt.Args)
+		}
+	}
+}
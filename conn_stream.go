@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/ergongate/vince/buffers"
@@ -13,6 +15,9 @@ import (
 type connConfig struct {
 	readTimeout  time.Duration
 	writeTimeout time.Duration
+	// readRate is the number of bytes per second read from the connection,
+	// zero disables rate limiting.
+	readRate int64
 }
 
 type proxyConnOpts struct {
@@ -24,99 +29,111 @@ func histogramBucket() tally.Buckets {
 	return tally.DefaultBuckets
 }
 
-func proxyConn(ctx context.Context, opts proxyConnOpts, local, remote net.Conn) error {
-	var n int
-	var err error
-	var firstRemote, firstLocal atomic.Bool
-	firstRemote.Store(true)
-	firstLocal.Store(true)
-	var localRead, localWrite, remoteRead, remoteWrite int64
+// proxyStats are the number of bytes transferred by proxyConn.
+type proxyStats struct {
+	localRead, localWrite, remoteRead, remoteWrite int64
+}
+
+// proxyConn copies data between local and remote until one of them is closed,
+// a timeout expires or ctx is cancelled. Both connections are closed when it
+// returns.
+//
+// Read timeouts are only enforced when there was no activity in either
+// direction, so a connection that only receives data is not closed.
+//
+// Reading from a connection with readRate set is paused as needed to keep the
+// transfer under the rate.
+func proxyConn(ctx context.Context, opts proxyConnOpts, local, remote net.Conn) (proxyStats, error) {
+	var localRead, localWrite, remoteRead, remoteWrite atomic.Int64
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
 	start := time.Now()
+	// done stops directions waiting for the rate limit once proxying ends.
+	done := make(chan struct{})
 	defer func() {
 		v := []string{
 			local.LocalAddr().String(), local.RemoteAddr().String(),
 			remote.LocalAddr().String(), remote.RemoteAddr().String(),
 		}
-		tcpLocalBytesRead.WithLabelValues(v...).Observe(float64(localRead))
-		tcpLocalBytesWritten.WithLabelValues(v...).Observe(float64(localWrite))
-		tcpRemoteBytesRead.WithLabelValues(v...).Observe(float64(remoteRead))
-		tcpRemoteBytesWritten.WithLabelValues(v...).Observe(float64(remoteWrite))
-		tcpStreamDuration.WithLabelValues(v...).Observe(float64(time.Since(start)))
+		tcpLocalBytesRead.WithLabelValues(v...).Observe(float64(localRead.Load()))
+		tcpLocalBytesWritten.WithLabelValues(v...).Observe(float64(localWrite.Load()))
+		tcpRemoteBytesRead.WithLabelValues(v...).Observe(float64(remoteRead.Load()))
+		tcpRemoteBytesWritten.WithLabelValues(v...).Observe(float64(remoteWrite.Load()))
+		tcpStreamDuration.WithLabelValues(v...).Observe(time.Since(start).Seconds())
 	}()
-
-	go func() {
+	errs := make(chan error, 2)
+	pipe := func(dst, src net.Conn, in, out connConfig, read, written *atomic.Int64) {
 		buf := buffers.GetSlice()
-		defer func() {
-			buffers.PutSlice(buf)
-		}()
-		buf = buf[:0]
-		for {
-			if ctx.Err() != nil {
-				show(ctx, err)
+		defer buffers.PutSlice(buf)
+		var bucket *tokenBucket
+		if in.readRate > 0 {
+			bucket = newTokenBucket(in.readRate, 0, time.Now())
+			if int64(len(buf)) > in.readRate {
+				buf = buf[:in.readRate]
 			}
-			// read local and write remote
-			if opts.local.readTimeout != 0 {
-				local.SetReadDeadline(time.Now().Add(opts.local.readTimeout))
-			}
-			n, err = local.Read(buf)
-			if err != nil {
+		}
+		for {
+			if bucket != nil && !bucket.wait(0, done) {
+				errs <- nil
 				return
 			}
-			if firstLocal.Load() {
-				firstLocal.Store(false)
+			if in.readTimeout != 0 {
+				src.SetReadDeadline(time.Now().Add(in.readTimeout))
 			}
-			localRead += int64(n)
-
-			if opts.remote.writeTimeout != 0 {
-				remote.SetWriteDeadline(time.Now().Add(opts.remote.writeTimeout))
+			n, err := src.Read(buf)
+			if n > 0 {
+				read.Add(int64(n))
+				last.Store(time.Now().UnixNano())
+				if bucket != nil {
+					bucket.take(int64(n), time.Now())
+				}
+				if out.writeTimeout != 0 {
+					dst.SetWriteDeadline(time.Now().Add(out.writeTimeout))
+				}
+				m, werr := dst.Write(buf[:n])
+				written.Add(int64(m))
+				if werr != nil {
+					errs <- werr
+					return
+				}
 			}
-			n, err = remote.Write(buf[:n])
 			if err != nil {
+				if isTimeout(err) && time.Since(time.Unix(0, last.Load())) < in.readTimeout {
+					// the other direction is still active
+					continue
+				}
+				if err == io.EOF {
+					err = nil
+				}
+				errs <- err
 				return
 			}
-			if firstRemote.Load() {
-				firstRemote.Store(false)
-			}
-			remoteWrite += int64(n)
-		}
-	}()
-	buf := buffers.GetSlice()
-	defer func() {
-		buffers.PutSlice(buf)
-	}()
-	for {
-		if ctx.Err() != nil {
-			show(ctx, err)
-			return err
-		}
-		buf = buf[:0]
-		//read remote and write local
-		if opts.remote.readTimeout != 0 {
-			remote.SetReadDeadline(time.Now().Add(opts.remote.readTimeout))
-		}
-		n, err = remote.Read(buf)
-		if err != nil {
-			show(ctx, err)
-			return err
-		}
-		if firstRemote.Load() {
-			firstRemote.Store(false)
-		}
-		remoteRead += int64(n)
-
-		if opts.local.writeTimeout != 0 {
-			local.SetWriteDeadline(time.Now().Add(opts.local.writeTimeout))
-		}
-		n, err = local.Write(buf[:n])
-		if err != nil {
-			show(ctx, err)
-			return err
-		}
-		if firstLocal.Load() {
-			firstLocal.Store(false)
 		}
-		localWrite += int64(n)
 	}
+	go pipe(remote, local, opts.local, opts.remote, &localRead, &remoteWrite)
+	go pipe(local, remote, opts.remote, opts.local, &remoteRead, &localWrite)
+	var err error
+	pending := 2
+	select {
+	case err = <-errs:
+		pending--
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// closing both ends stops the other direction.
+	close(done)
+	local.Close()
+	remote.Close()
+	for ; pending > 0; pending-- {
+		<-errs
+	}
+	show(ctx, err)
+	return proxyStats{
+		localRead:   localRead.Load(),
+		localWrite:  localWrite.Load(),
+		remoteRead:  remoteRead.Load(),
+		remoteWrite: remoteWrite.Load(),
+	}, err
 }
 
 func configConn(conn net.Conn, opts connConfig) error {
@@ -133,64 +150,140 @@ func configConn(conn net.Conn, opts connConfig) error {
 	return nil
 }
 
+// stream handles connections accepted by a streamServer.
 type stream interface {
-	upstream() (net.Conn, error)
-	config() proxyConnOpts
+	serveConn(ctx context.Context, conn net.Conn)
 }
 
-func streamListener(ctx context.Context, ls net.Listener, srv stream) error {
+func streamListener(ctx context.Context, ls net.Listener, srv *streamServer) error {
 	for {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
-
 		l, err := ls.Accept()
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
 			return err
 		}
 		tcpTotalAcceptedConnection.WithLabelValues(
 			l.LocalAddr().String(), l.RemoteAddr().String(),
 		).Inc()
+		if !srv.track(l) {
+			l.Close()
+			return nil
+		}
 		go streamConn(ctx, l, srv)
 	}
 }
 
-func streamConn(ctx context.Context, conn net.Conn, srv stream) error {
+func streamConn(ctx context.Context, conn net.Conn, srv *streamServer) {
+	defer srv.untrack(conn)
+	defer conn.Close()
 	if ctx.Err() != nil {
-		return ctx.Err()
-	}
-	remote, err := srv.upstream()
-	if err != nil {
-		return err
+		return
 	}
-	defer remote.Close()
-	opts := srv.config()
-	return proxyConn(ctx, opts, conn, remote)
+	srv.load().serveConn(ctx, conn)
 }
 
 func show(ctx context.Context, err error) {
 	if err != nil {
-		// TODO log this error
+		logError(ctx, err.Error())
 	}
 }
 
+// streamServer accepts connections on a stream listener and passes them to
+// stream. The stream can be replaced while serving, connections already
+// accepted finish with the stream they started with.
 type streamServer struct {
-	stream stream
+	stream atomic.Value
 	ctx    context.Context
 	cancel func()
+
+	mu       sync.Mutex
+	ls       net.Listener
+	conns    map[net.Conn]struct{}
+	shutdown bool
+	wg       sync.WaitGroup
 }
 
 func (s *streamServer) init(ctx context.Context, sm stream, m *connManager) {
 	s.ctx, s.cancel = context.WithCancel(ctx)
-	s.stream = sm
+	s.conns = make(map[net.Conn]struct{})
+	s.store(sm)
+}
+
+func (s *streamServer) store(sm stream) {
+	s.stream.Store(sm)
+}
+
+func (s *streamServer) load() stream {
+	return s.stream.Load().(stream)
+}
+
+func (s *streamServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *streamServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
 }
 
 func (s *streamServer) Serve(ls net.Listener) error {
-	return streamListener(s.ctx, ls, s.stream)
+	s.mu.Lock()
+	s.ls = ls
+	s.mu.Unlock()
+	return streamListener(s.ctx, ls, s)
+}
+
+// Shutdown stops accepting new connections and waits for active ones to
+// finish. Connections still active when ctx is done are closed.
+func (s *streamServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	var err error
+	if s.ls != nil {
+		err = s.ls.Close()
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Close()
+		<-done
+	}
+	return err
 }
 
+// Close closes the listener and all active connections immediately.
 func (s *streamServer) Close() error {
 	s.cancel()
-	<-s.ctx.Done() // make sure we didn't mess up context
-	return nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown = true
+	var err error
+	if s.ls != nil {
+		err = s.ls.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
 }
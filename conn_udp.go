@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// maxDatagramSize is the largest udp payload.
+const maxDatagramSize = 64 << 10
+
+// udpServer proxies datagrams received on a packet connection. Datagrams from
+// the same client address belong to a session which has its own connection to
+// the upstream.
+type udpServer struct {
+	stream atomic.Value
+	ctx    context.Context
+	cancel func()
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	sessions map[string]*udpSession
+	shutdown bool
+	wg       sync.WaitGroup
+}
+
+func (s *udpServer) init(ctx context.Context, sm stream) {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.sessions = make(map[string]*udpSession)
+	s.store(sm)
+}
+
+func (s *udpServer) store(sm stream) {
+	s.stream.Store(sm)
+}
+
+func (s *udpServer) load() *streamProxy {
+	return s.stream.Load().(*streamProxy)
+}
+
+func (s *udpServer) Serve(pc net.PacketConn) error {
+	s.mu.Lock()
+	s.conn = pc
+	s.mu.Unlock()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		sess, err := s.session(addr)
+		if err != nil {
+			show(s.ctx, err)
+			continue
+		}
+		if sess == nil {
+			return nil
+		}
+		sess.send(s.ctx, buf[:n])
+	}
+}
+
+// session returns the session of client addr, a new session is started when
+// there is none.
+func (s *udpServer) session(addr net.Addr) (*udpSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return nil, nil
+	}
+	// a session whose upstream is closed is replaced, its run goroutine
+	// still finishes it
+	if sess, ok := s.sessions[addr.String()]; ok && !sess.done.Load() {
+		return sess, nil
+	}
+	sess, err := newUDPSession(s.ctx, s.load(), s.conn, addr)
+	if err != nil {
+		return nil, err
+	}
+	s.sessions[addr.String()] = sess
+	s.wg.Add(1)
+	udpTotalSessions.WithLabelValues(s.conn.LocalAddr().String()).Inc()
+	go s.run(sess)
+	return sess, nil
+}
+
+func (s *udpServer) run(sess *udpSession) {
+	defer s.wg.Done()
+	sess.receive(s.ctx)
+	s.mu.Lock()
+	if s.sessions[sess.client.String()] == sess {
+		delete(s.sessions, sess.client.String())
+	}
+	s.mu.Unlock()
+	sess.finish(s.ctx)
+}
+
+// Shutdown stops receiving datagrams and waits for active sessions to end.
+// Sessions still active when ctx is done are closed.
+func (s *udpServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shutdown = true
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Close()
+		<-done
+	}
+	return err
+}
+
+// Close closes the packet connection and all sessions immediately.
+func (s *udpServer) Close() error {
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown = true
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	for _, sess := range s.sessions {
+		sess.close()
+	}
+	return err
+}
+
+// udpSession is the state of datagrams exchanged between a client and the
+// upstream.
+type udpSession struct {
+	proxy    *streamProxy
+	conn     net.PacketConn
+	client   net.Addr
+	upstream net.Conn
+	v        *ngxVariables
+	start    time.Time
+	status   int
+
+	last                                                 atomic.Int64
+	requests, responses                                  atomic.Int64
+	clientRead, clientWrite, upstreamRead, upstreamWrite atomic.Int64
+	closed                                               sync.Once
+	done                                                 atomic.Bool
+}
+
+func newUDPSession(ctx context.Context, p *streamProxy, conn net.PacketConn, client net.Addr) (*udpSession, error) {
+	sess := &udpSession{
+		proxy:  p,
+		conn:   conn,
+		client: client,
+		v:      newStreamVariables(conn.LocalAddr(), client, "UDP"),
+		start:  time.Now(),
+		status: 200,
+	}
+	sess.v.maps = p.maps
+	sess.last.Store(sess.start.UnixNano())
+	up, err := p.connect(ctx, "udp", client, sess.v)
+	if err != nil {
+		sess.status = 502
+		sess.finish(ctx)
+		return nil, err
+	}
+	sess.v.Set(vUpstreamConnectTime, "0.000")
+	sess.upstream = up
+	return sess, nil
+}
+
+// send passes datagram b from the client to the upstream.
+func (u *udpSession) send(ctx context.Context, b []byte) {
+	u.last.Store(time.Now().UnixNano())
+	u.requests.Inc()
+	u.clientRead.Add(int64(len(b)))
+	n, err := u.upstream.Write(b)
+	u.upstreamWrite.Add(int64(n))
+	if err != nil {
+		show(ctx, err)
+		u.close()
+		return
+	}
+	if r := u.proxy.opts.responses; r.set && r.value == 0 {
+		// no response is expected
+		u.close()
+	}
+}
+
+// receive passes datagrams from the upstream to the client until the expected
+// number of responses was received or proxy_timeout expires.
+func (u *udpSession) receive(ctx context.Context) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			u.close()
+		case <-done:
+		}
+	}()
+	timeout := u.proxy.opts.timeout.value
+	expect := u.proxy.opts.responses
+	buf := make([]byte, maxDatagramSize)
+	for {
+		if timeout > 0 {
+			u.upstream.SetReadDeadline(time.Now().Add(timeout))
+		}
+		n, err := u.upstream.Read(buf)
+		if n > 0 {
+			u.last.Store(time.Now().UnixNano())
+			u.upstreamRead.Add(int64(n))
+			m, werr := u.conn.WriteTo(buf[:n], u.client)
+			u.clientWrite.Add(int64(m))
+			if werr != nil {
+				show(ctx, werr)
+				return
+			}
+			got := u.responses.Inc()
+			if expect.set && got >= u.requests.Load()*expect.value {
+				return
+			}
+		}
+		if err != nil {
+			if isTimeout(err) && time.Since(time.Unix(0, u.last.Load())) < timeout {
+				continue
+			}
+			if !isTimeout(err) && u.responses.Load() == 0 && u.requests.Load() > 0 {
+				// the upstream refused the datagrams
+				u.status = 502
+			}
+			return
+		}
+	}
+}
+
+func (u *udpSession) close() {
+	u.closed.Do(func() {
+		u.done.Store(true)
+		if u.upstream != nil {
+			u.upstream.Close()
+		}
+	})
+}
+
+// finish closes the session and records it in metrics and access log.
+func (u *udpSession) finish(ctx context.Context) {
+	u.close()
+	v := []string{u.conn.LocalAddr().String(), u.client.String(), "", ""}
+	if u.upstream != nil {
+		v[2], v[3] = u.upstream.LocalAddr().String(), u.upstream.RemoteAddr().String()
+	}
+	udpLocalBytesRead.WithLabelValues(v...).Observe(float64(u.clientRead.Load()))
+	udpLocalBytesWritten.WithLabelValues(v...).Observe(float64(u.clientWrite.Load()))
+	udpRemoteBytesRead.WithLabelValues(v...).Observe(float64(u.upstreamRead.Load()))
+	udpRemoteBytesWritten.WithLabelValues(v...).Observe(float64(u.upstreamWrite.Load()))
+	udpSessionDuration.WithLabelValues(v...).Observe(time.Since(u.start).Seconds())
+	u.v.Set(vStatus, strconv.Itoa(u.status))
+	u.v.Set(vBytesSent, strconv.FormatInt(u.clientWrite.Load(), 10))
+	u.v.Set(vBytesReceived, strconv.FormatInt(u.clientRead.Load(), 10))
+	u.v.Set(vUpstreamBytesSent, strconv.FormatInt(u.upstreamWrite.Load(), 10))
+	u.v.Set(vUpstreamBytesReceived, strconv.FormatInt(u.upstreamRead.Load(), 10))
+	u.v.Set(vSessionTime, formatSessionTime(time.Since(u.start)))
+	u.proxy.log(ctx, u.v)
+}
@@ -18,6 +18,9 @@ var errNotLeader = errors.New("kv: Not a leader")
 type kv struct {
 	store *store
 	raft  *raft.Raft
+	// forward applies commands on the leader when this node is a follower.
+	// Commands fail with errNotLeader on followers when it is nil.
+	forward func(*command) error
 }
 
 type command struct {
@@ -26,18 +29,40 @@ type command struct {
 }
 
 func (s *kv) Set(key, value string) error {
-	if s.raft.State() != raft.Leader {
-		return errNotLeader
-	}
-	c := &command{
+	return s.apply(&command{
 		Op:    "set",
 		Key:   key,
 		Value: value,
+	})
+}
+
+// apply replicates c to all nodes of the cluster.
+func (s *kv) apply(c *command) error {
+	if s.raft.State() != raft.Leader {
+		if s.forward != nil {
+			return s.forward(c)
+		}
+		return errNotLeader
+	}
+	return s.commit(c)
+}
+
+// commit replicates c when this node is the leader, it is used to apply
+// commands forwarded by followers.
+func (s *kv) commit(c *command) error {
+	if s.raft.State() != raft.Leader {
+		return errNotLeader
 	}
 	b, err := json.Marshal(c)
 	if err != nil {
 		return err
 	}
 	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
 }
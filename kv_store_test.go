@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/raft"
+)
+
+type testNode struct {
+	id     string
+	raft   *raft.Raft
+	kv     *kv
+	sync   *limitSync
+	caches *cacheSync
+	zones  map[string]*limitReqZone
+	db     *badger.DB
+}
+
+// testCluster starts a cluster of n raft nodes connected with in memory
+// transports. Every node has its own zone one defined with sync.
+func testCluster(t *testing.T, n int) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, n)
+	transports := make([]*raft.InmemTransport, n)
+	var servers []raft.Server
+	for i := range nodes {
+		addr, tr := raft.NewInmemTransport("")
+		transports[i] = tr
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(fmt.Sprint(i)),
+			Address: addr,
+		})
+	}
+	for i, a := range transports {
+		for j, b := range transports {
+			if i != j {
+				a.Connect(b.LocalAddr(), b)
+			}
+		}
+	}
+	byAddr := make(map[raft.ServerAddress]*testNode)
+	for i := range nodes {
+		db, err := badger.Open(badger.DefaultOptions("").
+			WithInMemory(true).
+			WithMaxTableSize(1 << 20).
+			WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := &testNode{id: fmt.Sprint(i), db: db}
+		node.zones, err = collectLimitReqZones(&rule{children: []*rule{{
+			name: "http",
+			children: []*rule{{
+				name: "limit_req_zone",
+				args: []string{"$remote_addr", "zone=one:1m", "rate=1r/m", "sync"},
+			}},
+		}}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.kv = &kv{}
+		node.sync = newLimitSync(node.id, node.kv)
+		node.sync.setZones(node.zones, time.Hour)
+		node.caches = newCacheSync(node.id, node.kv)
+		conf := raft.DefaultConfig()
+		conf.LocalID = servers[i].ID
+		conf.HeartbeatTimeout = 50 * time.Millisecond
+		conf.ElectionTimeout = 50 * time.Millisecond
+		conf.LeaderLeaseTimeout = 50 * time.Millisecond
+		conf.CommitTimeout = 5 * time.Millisecond
+		conf.LogOutput = ioutil.Discard
+		store := raft.NewInmemStore()
+		r, err := raft.NewRaft(conf, &fsm{db: db, limits: node.sync, caches: node.caches}, store, store,
+			raft.NewInmemSnapshotStore(), transports[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.raft = r
+		node.kv.raft = r
+		node.kv.forward = func(c *command) error {
+			leader, ok := byAddr[r.Leader()]
+			if !ok {
+				return errNotLeader
+			}
+			return leader.kv.apply(c)
+		}
+		byAddr[servers[i].Address] = node
+		nodes[i] = node
+	}
+	if err := nodes[0].raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for nodes[0].raft.Leader() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader was elected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nodes
+}
+
+func stopCluster(nodes []*testNode) {
+	for _, n := range nodes {
+		n.raft.Shutdown().Error()
+		n.db.Close()
+	}
+}
@@ -17,9 +17,16 @@ func main() {
 	app.Usage = "Modern reverse proxy for modern traffick"
 	app.Flags = []cli.Flag{
 		&configFlag,
+		&portFlag,
+		&managementAddrFlag,
+		&clusterIDFlag,
+		&clusterAddrFlag,
+		&clusterPeersFlag,
+		&clusterDirFlag,
 	}
 	app.Commands = []*cli.Command{
 		formatCommand(),
+		checkCommand(),
 	}
 	app.Action = start
 	err := app.Run(os.Args)
@@ -41,6 +48,46 @@ var configFlag = cli.StringFlag{
 	DefaultText: strings.Join(defaultConfigFiles(), " or "),
 }
 
+var portFlag = cli.IntFlag{
+	Name:    "p",
+	Usage:   "Default port of listen directives without a port",
+	EnvVars: []string{"VINCE_PORT"},
+	Value:   80,
+}
+
+var managementAddrFlag = cli.StringFlag{
+	Name:    "management-addr",
+	Usage:   "Address the management api listens on",
+	EnvVars: []string{"VINCE_MANAGEMENT_ADDR"},
+	Value:   "127.0.0.1",
+}
+
+var clusterIDFlag = cli.StringFlag{
+	Name:    "cluster-id",
+	Usage:   "Id of this node, vince joins a cluster when it is set",
+	EnvVars: []string{"VINCE_CLUSTER_ID"},
+}
+
+var clusterAddrFlag = cli.StringFlag{
+	Name:        "cluster-addr",
+	Usage:       "Address the cluster listens on",
+	EnvVars:     []string{"VINCE_CLUSTER_ADDR"},
+	DefaultText: "address of this node in cluster-peers",
+}
+
+var clusterPeersFlag = cli.StringSliceFlag{
+	Name:    "cluster-peers",
+	Usage:   "Nodes of the cluster as id=host:port, this node included",
+	EnvVars: []string{"VINCE_CLUSTER_PEERS"},
+}
+
+var clusterDirFlag = cli.StringFlag{
+	Name:        "cluster-dir",
+	Usage:       "Directory of raft logs and snapshots",
+	EnvVars:     []string{"VINCE_CLUSTER_DIR"},
+	DefaultText: "raft in the configuration directory",
+}
+
 func defaultWorkDirectories() []string {
 	return []string{"/usr/local/vince", " /etc/vince", "/usr/local/etc/vince"}
 }
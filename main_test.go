@@ -24,13 +24,19 @@ type testKase func(context.Context, *testing.T)
 func runTest(t *testing.T, v *vinceConfiguration, kase ...testKase) {
 	t.Helper()
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	ready := make(chan bool)
+	done := make(chan struct{})
+	defer func() {
+		// wait for servers to shut down so nothing logs after the test
+		cancel()
+		<-done
+	}()
 	go func() {
+		defer close(done)
 		err := startEverything(ctx, v, func() {
 			ready <- true
 		})
-		if err != nil {
+		if err != nil && err != context.Canceled {
 			t.Log(err)
 			ready <- false
 		}
@@ -30,6 +30,8 @@ func (m *management) init(ctx *serverCtx) {
 	h.GET("/", m.index)
 	h.GET("/assets/*", m.static())
 	h.GET("/metrics", echo.WrapHandler(http.HandlerFunc(metricsHandler)))
+	h.GET("/upstreams", m.upstreams)
+	m.api(h.Group("/api"))
 	var ops gitOpsOptions
 	ops.dir = filepath.Join(ctx.config.dir, "configs")
 	m.git.init(ops)
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// api registers the management rest api on g.
+//
+//	GET    /api/:kind/upstreams
+//	GET    /api/:kind/upstreams/:name
+//	POST   /api/:kind/upstreams/:name/servers
+//	PATCH  /api/:kind/upstreams/:name/servers/:id
+//	DELETE /api/:kind/upstreams/:name/servers/:id
+//	GET    /api/http/caches
+//	DELETE /api/http/caches/:name[?key=|prefix=|tag=]
+//
+// kind is either http or stream.
+func (m *management) api(g *echo.Group) {
+	g.GET("/:kind/upstreams", m.apiUpstreams)
+	g.GET("/:kind/upstreams/:name", m.apiUpstream)
+	g.POST("/:kind/upstreams/:name/servers", m.apiAddServer)
+	g.PATCH("/:kind/upstreams/:name/servers/:id", m.apiUpdateServer)
+	g.DELETE("/:kind/upstreams/:name/servers/:id", m.apiRemoveServer)
+	g.GET("/http/caches", m.apiCaches)
+	g.DELETE("/http/caches/:name", m.apiPurgeCache)
+}
+
+type apiErrorResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+func apiError(ctx echo.Context, code int, err error) error {
+	return ctx.JSON(code, apiErrorResponse{Status: code, Error: err.Error()})
+}
+
+// upstreamsOf returns upstreams of kind which is http or stream.
+func (m *management) upstreamsOf(kind string) (map[string]*upstreamConfig, bool) {
+	m.ctx.mu.RLock()
+	defer m.ctx.mu.RUnlock()
+	switch kind {
+	case "http":
+		return m.ctx.http.upstreams, true
+	case "stream":
+		return m.ctx.stream.upstreams, true
+	}
+	return nil, false
+}
+
+func (m *management) lookupUpstream(ctx echo.Context) (*upstreamConfig, error) {
+	kind := ctx.Param("kind")
+	all, ok := m.upstreamsOf(kind)
+	if !ok {
+		return nil, apiError(ctx, http.StatusNotFound, fmt.Errorf("vince: unknown kind %q", kind))
+	}
+	u, ok := all[ctx.Param("name")]
+	if !ok {
+		return nil, apiError(ctx, http.StatusNotFound, fmt.Errorf("vince: upstream %q not found", ctx.Param("name")))
+	}
+	return u, nil
+}
+
+func (m *management) apiUpstreams(ctx echo.Context) error {
+	kind := ctx.Param("kind")
+	all, ok := m.upstreamsOf(kind)
+	if !ok {
+		return apiError(ctx, http.StatusNotFound, fmt.Errorf("vince: unknown kind %q", kind))
+	}
+	o := make(map[string]upstreamStatus)
+	for name, u := range all {
+		o[name] = u.status(kind == "stream")
+	}
+	return ctx.JSON(http.StatusOK, o)
+}
+
+func (m *management) apiUpstream(ctx echo.Context) error {
+	u, err := m.lookupUpstream(ctx)
+	if u == nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, u.status(ctx.Param("kind") == "stream"))
+}
+
+// peerRequest is the body of requests that add or change upstream servers.
+// Fields that are not set are left unchanged.
+type peerRequest struct {
+	Server      string  `json:"server"`
+	Weight      *int64  `json:"weight"`
+	MaxConns    *int64  `json:"max_conns"`
+	MaxFails    *int64  `json:"max_fails"`
+	FailTimeout *string `json:"fail_timeout"`
+	SlowStart   *string `json:"slow_start"`
+	Backup      *bool   `json:"backup"`
+	Down        *bool   `json:"down"`
+	Drain       *bool   `json:"drain"`
+}
+
+func (r *peerRequest) apply(s *upstreamServer) error {
+	if r.Weight != nil {
+		if *r.Weight <= 0 {
+			return fmt.Errorf("vince: invalid weight %d", *r.Weight)
+		}
+		s.weight.store(*r.Weight)
+	}
+	if r.MaxConns != nil {
+		s.maxConn.store(*r.MaxConns)
+	}
+	if r.MaxFails != nil {
+		s.maxFails.store(*r.MaxFails)
+	}
+	if r.FailTimeout != nil {
+		d, err := parseDuration(*r.FailTimeout)
+		if err != nil {
+			return err
+		}
+		s.failTimeout.store(d)
+	}
+	if r.SlowStart != nil {
+		d, err := parseDuration(*r.SlowStart)
+		if err != nil {
+			return err
+		}
+		s.slowStart.store(d)
+	}
+	if r.Backup != nil {
+		s.backup.store(*r.Backup)
+	}
+	if r.Down != nil {
+		s.down.store(*r.Down)
+	}
+	if r.Drain != nil {
+		s.drain.store(*r.Drain)
+	}
+	return nil
+}
+
+func (m *management) apiAddServer(ctx echo.Context) error {
+	u, err := m.lookupUpstream(ctx)
+	if u == nil {
+		return err
+	}
+	var req peerRequest
+	if err := ctx.Bind(&req); err != nil {
+		return apiError(ctx, http.StatusBadRequest, err)
+	}
+	if req.Server == "" {
+		return apiError(ctx, http.StatusBadRequest, errors.New("vince: server is required"))
+	}
+	s := upstreamServer{url: req.Server}
+	if err := req.apply(&s); err != nil {
+		return apiError(ctx, http.StatusBadRequest, err)
+	}
+	p, err := u.add(s)
+	switch {
+	case err == errPeerExists:
+		return apiError(ctx, http.StatusConflict, err)
+	case err != nil:
+		return apiError(ctx, http.StatusInternalServerError, err)
+	}
+	return ctx.JSON(http.StatusCreated, p.status())
+}
+
+func (m *management) apiUpdateServer(ctx echo.Context) error {
+	u, err := m.lookupUpstream(ctx)
+	if u == nil {
+		return err
+	}
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return apiError(ctx, http.StatusBadRequest, err)
+	}
+	var req peerRequest
+	if err := ctx.Bind(&req); err != nil {
+		return apiError(ctx, http.StatusBadRequest, err)
+	}
+	if req.Server != "" {
+		return apiError(ctx, http.StatusBadRequest, errors.New("vince: server address can't be changed"))
+	}
+	err = u.update(id, req.apply)
+	switch {
+	case err == errPeerNotFound:
+		return apiError(ctx, http.StatusNotFound, err)
+	case err != nil:
+		return apiError(ctx, http.StatusBadRequest, err)
+	}
+	return ctx.JSON(http.StatusOK, u.peer(id).status())
+}
+
+func (m *management) apiRemoveServer(ctx echo.Context) error {
+	u, err := m.lookupUpstream(ctx)
+	if u == nil {
+		return err
+	}
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return apiError(ctx, http.StatusBadRequest, err)
+	}
+	err = u.remove(id)
+	switch {
+	case err == errPeerNotFound:
+		return apiError(ctx, http.StatusNotFound, err)
+	case err != nil:
+		return apiError(ctx, http.StatusInternalServerError, err)
+	}
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+// cacheStatus is the state of a proxy_cache_path zone.
+type cacheStatus struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	MaxSize int64  `json:"max_size"`
+	Entries int    `json:"entries"`
+}
+
+func (m *management) caches() map[string]*cacheZone {
+	m.ctx.mu.RLock()
+	defer m.ctx.mu.RUnlock()
+	return m.ctx.http.caches
+}
+
+func (m *management) apiCaches(ctx echo.Context) error {
+	o := make(map[string]cacheStatus)
+	for name, z := range m.caches() {
+		z.mu.Lock()
+		o[name] = cacheStatus{Path: z.path, Size: z.used, MaxSize: z.maxSize, Entries: z.lru.Len()}
+		z.mu.Unlock()
+	}
+	return ctx.JSON(http.StatusOK, o)
+}
+
+// cachePurgeResponse is the response of cache purges, Purged is the number of
+// responses removed from the zone of the node that received the purge.
+type cachePurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+// apiPurgeCache removes the responses with key, the keys starting with
+// prefix or tagged with tag. All responses are removed when none is given.
+func (m *management) apiPurgeCache(ctx echo.Context) error {
+	z, ok := m.caches()[ctx.Param("name")]
+	if !ok {
+		return apiError(ctx, http.StatusNotFound, fmt.Errorf("vince: cache %q not found", ctx.Param("name")))
+	}
+	p := &cachePurge{
+		Key:    ctx.QueryParam("key"),
+		Prefix: ctx.QueryParam("prefix"),
+		Tag:    ctx.QueryParam("tag"),
+	}
+	set := 0
+	for _, s := range []string{p.Key, p.Prefix, p.Tag} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return apiError(ctx, http.StatusBadRequest, errors.New("vince: only one of key, prefix and tag can be used"))
+	}
+	n, err := purgeCache(z, m.ctx.config.cacheSync, p)
+	if err != nil {
+		return apiError(ctx, http.StatusInternalServerError, err)
+	}
+	return ctx.JSON(http.StatusOK, cachePurgeResponse{Purged: n})
+}
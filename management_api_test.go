@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestManagementUpstreamAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vince-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	core := testRules(t, `http {
+    upstream backend {
+        server a:80;
+        server b:80;
+    }
+}`)
+	upstreams, err := collectUpstreams(core, "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srv serverCtx
+	srv.config = &vinceConfiguration{dir: dir}
+	srv.http.upstreams = upstreams
+	var m management
+	m.init(&srv)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := serverContext(r.Context(), &srv, httpListenOpts{net: "tcp"})
+		m.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	do := func(method, path, body string, code int, out interface{}) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != code {
+			b, _ := ioutil.ReadAll(res.Body)
+			t.Fatalf("%s %s: expected %d got %d %s", method, path, code, res.StatusCode, b)
+		}
+		if out != nil {
+			if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var all map[string]upstreamStatus
+	do("GET", "/api/http/upstreams", "", http.StatusOK, &all)
+	if n := len(all["backend"].Peers); n != 2 {
+		t.Fatalf("expected 2 peers got %d", n)
+	}
+	do("GET", "/api/tcp/upstreams", "", http.StatusNotFound, nil)
+	do("GET", "/api/http/upstreams/missing", "", http.StatusNotFound, nil)
+
+	var added peerStatus
+	do("POST", "/api/http/upstreams/backend/servers", `{"server":"c:80","weight":4}`, http.StatusCreated, &added)
+	if added.ID != 2 || added.Weight != 4 || added.State != "up" {
+		t.Errorf("unexpected peer %+v", added)
+	}
+	do("POST", "/api/http/upstreams/backend/servers", `{"server":"c:80"}`, http.StatusConflict, nil)
+	do("POST", "/api/http/upstreams/backend/servers", `{"server":"d:80","weight":0}`, http.StatusBadRequest, nil)
+
+	var changed peerStatus
+	do("PATCH", "/api/http/upstreams/backend/servers/0", `{"drain":true}`, http.StatusOK, &changed)
+	if !changed.Drain || changed.State != "draining" {
+		t.Errorf("expected peer to be draining got %+v", changed)
+	}
+	do("PATCH", "/api/http/upstreams/backend/servers/1", `{"down":true,"weight":2}`, http.StatusOK, &changed)
+	if !changed.Down || changed.Weight != 2 {
+		t.Errorf("expected peer to be down got %+v", changed)
+	}
+	do("PATCH", "/api/http/upstreams/backend/servers/9", `{"down":true}`, http.StatusNotFound, nil)
+	if p := upstreams["backend"].next("", nil); p == nil || p.addr != "c:80" {
+		t.Errorf("expected c:80 got %v", p)
+	}
+
+	do("DELETE", "/api/http/upstreams/backend/servers/2", "", http.StatusNoContent, nil)
+	do("DELETE", "/api/http/upstreams/backend/servers/2", "", http.StatusNotFound, nil)
+	var one upstreamStatus
+	do("GET", "/api/http/upstreams/backend", "", http.StatusOK, &one)
+	if len(one.Peers) != 2 {
+		t.Errorf("expected 2 peers got %+v", one.Peers)
+	}
+}
+
+func TestDefaultPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vince-port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, kase := range []struct {
+		args   []string
+		expect int
+	}{
+		{[]string{"vince", "-c", dir}, 80},
+		{[]string{"vince", "-c", dir, "-p", "8080"}, 8080},
+	} {
+		app := cli.NewApp()
+		app.Flags = []cli.Flag{&configFlag, &portFlag}
+		var port int
+		app.Action = func(ctx *cli.Context) error {
+			c, err := getConfig(ctx)
+			if err != nil {
+				return err
+			}
+			port = c.defaultPort
+			return nil
+		}
+		if err := app.Run(kase.args); err != nil {
+			t.Fatal(err)
+		}
+		if port != kase.expect {
+			t.Errorf("expected default port %d got %d", kase.expect, port)
+		}
+	}
+}
+
+func TestManagementAddr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vince-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, kase := range []struct {
+		args   []string
+		expect string
+	}{
+		{[]string{"vince", "-c", dir}, "127.0.0.1"},
+		{[]string{"vince", "-c", dir, "--management-addr", "0.0.0.0"}, "0.0.0.0"},
+	} {
+		app := cli.NewApp()
+		app.Flags = []cli.Flag{&configFlag, &managementAddrFlag}
+		var addr string
+		app.Action = func(ctx *cli.Context) error {
+			c, err := getConfig(ctx)
+			if err != nil {
+				return err
+			}
+			addr = c.management.addr
+			return nil
+		}
+		if err := app.Run(kase.args); err != nil {
+			t.Fatal(err)
+		}
+		if addr != kase.expect {
+			t.Errorf("expected management address %q got %q", kase.expect, addr)
+		}
+	}
+}
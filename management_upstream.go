@@ -0,0 +1,131 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/ergongate/vince/buffers"
+	"github.com/ergongate/vince/templates"
+	"github.com/labstack/echo/v4"
+)
+
+// peerStatus is the state of an upstream peer as shown by management.
+type peerStatus struct {
+	ID        int       `json:"id"`
+	Addr      string    `json:"server"`
+	Weight    int       `json:"weight"`
+	Backup    bool      `json:"backup"`
+	Down      bool      `json:"down"`
+	Drain     bool      `json:"drain"`
+	State     string    `json:"state"`
+	Conns     int64     `json:"active"`
+	Fails     int64     `json:"fails"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type upstreamStatus struct {
+	Name   string       `json:"name"`
+	Stream bool         `json:"stream"`
+	Peers  []peerStatus `json:"peers"`
+}
+
+func (p *upstreamPeer) status() peerStatus {
+	s := peerStatus{
+		ID:    p.id,
+		Addr:  p.addr,
+		Conns: atomic.LoadInt64(&p.conns),
+		State: "up",
+	}
+	p.mu.Lock()
+	s.Weight = p.weight
+	s.Backup = p.server.backup.value
+	s.Down = p.server.down.value
+	s.Drain = p.server.drain.value
+	s.Fails = p.fails
+	p.mu.Unlock()
+	p.health.mu.Lock()
+	s.LastCheck = p.health.lastCheck
+	s.LastError = p.health.lastErr
+	p.health.mu.Unlock()
+	switch {
+	case s.Down:
+		s.State = "down"
+	case s.Drain:
+		s.State = "draining"
+	case p.health.isDown():
+		s.State = "unhealthy"
+	case p.unhealthy(time.Now()):
+		s.State = "unavailable"
+	}
+	return s
+}
+
+func (u *upstreamConfig) status(stream bool) upstreamStatus {
+	us := upstreamStatus{Name: u.name, Stream: stream, Peers: []peerStatus{}}
+	for _, p := range u.all() {
+		us.Peers = append(us.Peers, p.status())
+	}
+	return us
+}
+
+// upstreamsStatus returns state of all http and stream upstreams sorted by
+// name.
+func (s *serverCtx) upstreamsStatus() []upstreamStatus {
+	var o []upstreamStatus
+	s.mu.RLock()
+	hu, su := s.http.upstreams, s.stream.upstreams
+	s.mu.RUnlock()
+	add := func(m map[string]*upstreamConfig, stream bool) {
+		for _, u := range m {
+			o = append(o, u.status(stream))
+		}
+	}
+	add(hu, false)
+	add(su, true)
+	sort.Slice(o, func(i, j int) bool {
+		if o[i].Stream != o[j].Stream {
+			return !o[i].Stream
+		}
+		return o[i].Name < o[j].Name
+	})
+	return o
+}
+
+var upstreamsTpl = template.Must(template.New("upstreams").Parse(`
+<div class="container-lg p-3">
+{{range .}}
+<h3>{{if .Stream}}stream{{else}}http{{end}} upstream {{.Name}}</h3>
+<table class="width-full mb-4">
+<thead><tr><th>server</th><th>weight</th><th>state</th><th>active</th><th>fails</th><th>last check</th><th>last error</th></tr></thead>
+<tbody>
+{{range .Peers}}
+<tr><td>{{.Addr}}{{if .Backup}} (backup){{end}}</td><td>{{.Weight}}</td><td>{{.State}}</td><td>{{.Conns}}</td><td>{{.Fails}}</td><td>{{if not .LastCheck.IsZero}}{{.LastCheck.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.LastError}}</td></tr>
+{{end}}
+</tbody>
+</table>
+{{else}}
+<p>No upstreams are configured.</p>
+{{end}}
+</div>
+`))
+
+func (m *management) upstreams(ctx echo.Context) error {
+	status := m.ctx.upstreamsStatus()
+	with := &templates.Context{Title: "vince - upstreams"}
+	buf := buffers.GetBytes()
+	defer buffers.PutBytes(buf)
+	if err := templates.ExecHTML(buf, "partial/header.html", with); err != nil {
+		return err
+	}
+	if err := upstreamsTpl.Execute(buf, status); err != nil {
+		return err
+	}
+	if err := templates.ExecHTML(buf, "partial/footer.html", with); err != nil {
+		return err
+	}
+	return ctx.HTML(http.StatusOK, buf.String())
+}
@@ -90,6 +90,70 @@ var (
 		},
 		[]string{"local_local", "local_remote", "remote_local", "remote_remote"},
 	)
+	udpLocalBytesRead = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "vince",
+			Subsystem: "stream",
+			Name:      "udp_local_bytes_read",
+		},
+		[]string{"local_local", "local_remote", "remote_local", "remote_remote"},
+	)
+	udpLocalBytesWritten = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "vince",
+			Subsystem: "stream",
+			Name:      "udp_local_bytes_written",
+		},
+		[]string{"local_local", "local_remote", "remote_local", "remote_remote"},
+	)
+	udpRemoteBytesRead = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "vince",
+			Subsystem: "stream",
+			Name:      "udp_remote_bytes_read",
+		},
+		[]string{"local_local", "local_remote", "remote_local", "remote_remote"},
+	)
+	udpRemoteBytesWritten = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "vince",
+			Subsystem: "stream",
+			Name:      "udp_remote_bytes_written",
+		},
+		[]string{"local_local", "local_remote", "remote_local", "remote_remote"},
+	)
+	udpSessionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "vince",
+			Subsystem: "stream",
+			Name:      "udp_session_duration",
+		},
+		[]string{"local_local", "local_remote", "remote_local", "remote_remote"},
+	)
+	udpTotalSessions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "vince",
+			Subsystem: "stream",
+			Name:      "udp_sessions",
+		},
+		[]string{"local_local"},
+	)
+	upstreamPeerHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "vince",
+			Subsystem: "upstream",
+			Name:      "peer_healthy",
+		},
+		[]string{"upstream", "peer"},
+	)
+	upstreamHealthChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "vince",
+			Subsystem: "upstream",
+			Name:      "health_checks",
+		},
+		[]string{"upstream", "peer", "result"},
+	)
 	tcpTotalAcceptedConnection = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "vince",
@@ -104,6 +168,10 @@ func init() {
 	prometheus.MustRegister(
 		httpTotalRequests, httpRequestDuration, httpRequestSize, httpResponseSize,
 		tcpLocalBytesRead, tcpLocalBytesWritten, tcpRemoteBytesRead, tcpRemoteBytesWritten,
+		tcpStreamDuration, tcpTotalAcceptedConnection,
+		udpLocalBytesRead, udpLocalBytesWritten, udpRemoteBytesRead, udpRemoteBytesWritten,
+		udpSessionDuration, udpTotalSessions,
+		upstreamPeerHealthy, upstreamHealthChecks,
 	)
 }
 
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cgiOption are the settings shared by fastcgi_pass, uwsgi_pass and
+// scgi_pass. Their directives have the name of the protocol as prefix.
+type cgiOption struct {
+	pass           stringTemplateValue
+	connectTimeout durationValue
+	sendTimeout    durationValue
+	readTimeout    durationValue
+	passBody       boolValue
+	passHeaders    boolValue
+	// buffering off sends the response to the client as soon as it is read.
+	buffering boolValue
+	// interceptErrors replaces responses with a status that has an error
+	// page by the page.
+	interceptErrors boolValue
+}
+
+func (o *cgiOption) defaults() {
+	o.connectTimeout.store(60 * time.Second)
+	o.sendTimeout.store(60 * time.Second)
+	o.readTimeout.store(60 * time.Second)
+	o.passBody.store(true)
+	o.passHeaders.store(true)
+	o.buffering.store(true)
+}
+
+// loadOption calls loadKey with the directives of location and of the blocks
+// it is in, outer blocks first.
+func loadOption(location *rule, loadKey func(r *rule) error) {
+	switch location.name {
+	case "http", "server", "location": //pass
+	default:
+		return
+	}
+	if location.parent != nil {
+		loadOption(location.parent, loadKey)
+	}
+	for _, v := range location.children {
+		// errors are reported by checkConfig
+		loadKey(v)
+	}
+}
+
+// loadKey loads r, a directive of protocol.
+func (o *cgiOption) loadKey(protocol string, r *rule) error {
+	if !strings.HasPrefix(r.name, protocol+"_") {
+		return nil
+	}
+	switch strings.TrimPrefix(r.name, protocol+"_") {
+	case "pass":
+		o.pass.store(r.args[0])
+	case "pass_request_body":
+		o.passBody.store(r.args[0] == "on")
+	case "pass_request_headers":
+		o.passHeaders.store(r.args[0] == "on")
+	case "buffering":
+		o.buffering.store(r.args[0] == "on")
+	case "intercept_errors":
+		o.interceptErrors.store(r.args[0] == "on")
+	case "connect_timeout", "send_timeout", "read_timeout":
+		d, err := parseDuration(r.args[0])
+		if err != nil {
+			return fmt.Errorf("vince: invalid value %q", r.args[0])
+		}
+		switch strings.TrimPrefix(r.name, protocol+"_") {
+		case "connect_timeout":
+			o.connectTimeout.store(d)
+		case "send_timeout":
+			o.sendTimeout.store(d)
+		default:
+			o.readTimeout.store(d)
+		}
+	}
+	return nil
+}
+
+// cgiParam is a parameter sent to the server with fastcgi_param, uwsgi_param
+// or scgi_param.
+type cgiParam struct {
+	name  string
+	value stringTemplateValue
+	// ifNotEmpty skips the parameter when its value is empty.
+	ifNotEmpty bool
+}
+
+func newCGIParam(r *rule) (*cgiParam, error) {
+	if len(r.args) < 2 || len(r.args) > 3 {
+		return nil, fmt.Errorf("vince: invalid number of arguments in %s", r.name)
+	}
+	p := &cgiParam{name: r.args[0]}
+	p.value.store(r.args[1])
+	if len(r.args) == 3 {
+		if r.args[2] != "if_not_empty" {
+			return nil, fmt.Errorf("vince: invalid parameter %q in %s", r.args[2], r.name)
+		}
+		p.ifNotEmpty = true
+	}
+	return p, nil
+}
+
+// compileCGIParams returns the parameters set with directive in block. Like
+// nginx they are inherited from the previous level only if there are none
+// defined on the current level.
+func compileCGIParams(block *rule, directive string) ([]*cgiParam, error) {
+	var params []*cgiParam
+	for _, ch := range innermost(block, directive) {
+		p, err := newCGIParam(ch)
+		if err != nil {
+			return nil, ch.wrap(err)
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
+// cgiVar is a parameter with its value.
+type cgiVar struct {
+	name, value string
+}
+
+// cgiVars evaluates params. When headers is true the fields of r are added as
+// HTTP_ parameters, unless a parameter with the same name is set.
+func cgiVars(params []*cgiParam, v *ngxVariables, r *http.Request, headers bool) []cgiVar {
+	var vars []cgiVar
+	set := make(map[string]bool)
+	for _, p := range params {
+		value := p.value.Value(v)
+		if value == "" && p.ifNotEmpty {
+			continue
+		}
+		vars = append(vars, cgiVar{p.name, value})
+		set[p.name] = true
+	}
+	if !headers {
+		return vars
+	}
+	if r.Host != "" && !set["HTTP_HOST"] {
+		vars = append(vars, cgiVar{"HTTP_HOST", r.Host})
+	}
+	for name, values := range r.Header {
+		key := "HTTP_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		if set[key] {
+			continue
+		}
+		vars = append(vars, cgiVar{key, strings.Join(values, ", ")})
+	}
+	return vars
+}
+
+// cgiHiddenHeaders are fields of CGI responses that are not passed to the
+// client.
+var cgiHiddenHeaders = []string{
+	"Status", "X-Accel-Expires", "X-Accel-Redirect", "X-Accel-Limit-Rate",
+	"X-Accel-Buffering", "X-Accel-Charset",
+}
+
+// readCGIHeader reads the header of a CGI response. The status is taken from
+// the status line of responses starting with one, like those of uWSGI, then
+// from the Status field. It is 302 for responses with a Location and 200
+// otherwise.
+func readCGIHeader(br *bufio.Reader) (int, http.Header, error) {
+	tp := textproto.NewReader(br)
+	code := 0
+	if b, _ := br.Peek(5); string(b) == "HTTP/" {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return 0, nil, err
+		}
+		f := strings.SplitN(line, " ", 3)
+		if len(f) < 2 {
+			return 0, nil, fmt.Errorf("vince: invalid status line %q", line)
+		}
+		if code, err = parseCGIStatus(f[1]); err != nil {
+			return 0, nil, err
+		}
+	}
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return 0, nil, err
+	}
+	header := http.Header(h)
+	switch s := header.Get("Status"); {
+	case s != "":
+		if i := strings.IndexByte(s, ' '); i != -1 {
+			s = s[:i]
+		}
+		if code, err = parseCGIStatus(s); err != nil {
+			return 0, nil, err
+		}
+	case code != 0:
+	case header.Get("Location") != "":
+		code = http.StatusFound
+	default:
+		code = http.StatusOK
+	}
+	for _, name := range cgiHiddenHeaders {
+		header.Del(name)
+	}
+	return code, header, nil
+}
+
+func parseCGIStatus(s string) (int, error) {
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 100 || code > 999 {
+		return 0, fmt.Errorf("vince: invalid status %q in response header", s)
+	}
+	return code, nil
+}
+
+// writeCGIResponse sends the response read from br to the client. Errors are
+// logged and returned so that the request can be aborted.
+func writeCGIResponse(w http.ResponseWriter, r *http.Request, br *bufio.Reader, o *cgiOption) error {
+	code, header, err := readCGIHeader(br)
+	if err != nil {
+		upstreamError(w, r, err)
+		return err
+	}
+	ctx := r.Context()
+	ctxVariables(ctx).Set(vUpstreamStatus, strconv.Itoa(code))
+	if !o.interceptErrors.value {
+		passErrorPages(ctx)
+	}
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(code)
+	switch {
+	case r.Method == http.MethodHead:
+		_, err = io.Copy(ioutil.Discard, br)
+	case !o.buffering.value:
+		err = copyFlush(w, br)
+	default:
+		_, err = io.Copy(w, br)
+	}
+	if err != nil {
+		logError(ctx, err.Error())
+	}
+	return err
+}
+
+// copyFlush copies src to w, flushing after each read.
+func copyFlush(w http.ResponseWriter, src io.Reader) error {
+	f, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if f != nil {
+				f.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// connectUpstream calls connect with the address of the server. When addr is
+// the name of an upstream its peers are tried in turn until connect succeeds
+// and the peer is returned, it must be released once the request is done.
+func connectUpstream(ctx context.Context, r *http.Request, upstreams map[string]*upstreamConfig, addr string, connect func(addr string) error) (*upstreamPeer, error) {
+	v := ctxVariables(ctx)
+	up, ok := upstreams[addr]
+	if !ok {
+		v.Set(vUpstreamAddr, addr)
+		return nil, connect(addr)
+	}
+	key := up.key(v, r.RemoteAddr)
+	tried := make(peerSet)
+	var (
+		addrs []string
+		err   error
+	)
+	for {
+		peer := up.next(key, tried)
+		if peer == nil {
+			if len(tried) == 0 {
+				return nil, fmt.Errorf("%v while connecting to upstream %q", errNoLiveUpstreams, up.name)
+			}
+			return nil, err
+		}
+		tried[peer] = true
+		addrs = append(addrs, peer.addr)
+		v.Set(vUpstreamAddr, strings.Join(addrs, ", "))
+		err = connect(peer.addr)
+		if err == nil {
+			peer.succeeded()
+			peer.acquire()
+			return peer, nil
+		}
+		peer.failed(time.Now())
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// dialCGI opens a connection to addr, this is either host:port or unix:path.
+func dialCGI(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	if strings.HasPrefix(addr, "unix:") {
+		return d.DialContext(ctx, "unix", addr[5:])
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
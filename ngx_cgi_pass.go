@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// cgiPass passes requests to uWSGI and SCGI servers, this is uwsgi_pass and
+// scgi_pass. Both protocols open a connection for each request, send the
+// parameters followed by the body and read the response until the server
+// closes the connection.
+type cgiPass struct {
+	// protocol is uwsgi or scgi.
+	protocol  string
+	opts      cgiPassOption
+	params    []*cgiParam
+	upstreams map[string]*upstreamConfig
+}
+
+type cgiPassOption struct {
+	cgiOption
+	// modifier1 and modifier2 are uwsgi_modifier1 and uwsgi_modifier2, the
+	// type of the uWSGI packets.
+	modifier1 intValue
+	modifier2 intValue
+}
+
+func (o *cgiPassOption) loadKey(protocol string, r *rule) error {
+	switch r.name {
+	case "uwsgi_modifier1", "uwsgi_modifier2":
+		n, err := strconv.ParseUint(r.args[0], 10, 8)
+		if err != nil {
+			return fmt.Errorf("vince: invalid value %q", r.args[0])
+		}
+		if r.name == "uwsgi_modifier1" {
+			o.modifier1.store(int64(n))
+		} else {
+			o.modifier2.store(int64(n))
+		}
+		return nil
+	}
+	return o.cgiOption.loadKey(protocol, r)
+}
+
+func newCGIPass(protocol string, location *rule, upstreams map[string]*upstreamConfig) (*cgiPass, error) {
+	c := &cgiPass{protocol: protocol, upstreams: upstreams}
+	c.opts.defaults()
+	loadOption(location, func(r *rule) error {
+		return c.opts.loadKey(protocol, r)
+	})
+	params, err := compileCGIParams(location, protocol+"_param")
+	if err != nil {
+		return nil, err
+	}
+	c.params = params
+	return c, nil
+}
+
+// body returns the request body and its length. Bodies of unknown length are
+// read first as both protocols need the length before the body.
+func (c *cgiPass) body(r *http.Request) (io.Reader, int64, error) {
+	if !c.opts.passBody.value || r.Body == nil || r.Body == http.NoBody {
+		return nil, 0, nil
+	}
+	if r.ContentLength >= 0 {
+		return r.Body, r.ContentLength, nil
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(b), int64(len(b)), nil
+}
+
+// encode returns the parameters of the request in the protocol format. The
+// CONTENT_LENGTH parameter is the length of the body sent.
+func (c *cgiPass) encode(vars []cgiVar, length int64) ([]byte, error) {
+	n := 0
+	for _, p := range vars {
+		if p.name != "CONTENT_LENGTH" && !(c.protocol == "scgi" && p.name == "SCGI") {
+			vars[n] = p
+			n++
+		}
+	}
+	vars = vars[:n]
+	if c.protocol == "scgi" {
+		return encodeSCGI(vars, length), nil
+	}
+	if length > 0 {
+		vars = append(vars, cgiVar{"CONTENT_LENGTH", strconv.FormatInt(length, 10)})
+	}
+	return encodeUWSGI(vars, uint8(c.opts.modifier1.value), uint8(c.opts.modifier2.value))
+}
+
+// encodeSCGI returns the netstring of vars. CONTENT_LENGTH and SCGI must be
+// the first parameters.
+func encodeSCGI(vars []cgiVar, length int64) []byte {
+	var h []byte
+	h = append(h, "CONTENT_LENGTH\x00"...)
+	h = strconv.AppendInt(h, length, 10)
+	h = append(h, "\x00SCGI\x001\x00"...)
+	for _, p := range vars {
+		h = append(h, p.name...)
+		h = append(h, 0)
+		h = append(h, p.value...)
+		h = append(h, 0)
+	}
+	b := strconv.AppendInt(nil, int64(len(h)), 10)
+	b = append(b, ':')
+	b = append(b, h...)
+	return append(b, ',')
+}
+
+var errUWSGITooBig = errors.New("vince: uwsgi request is too big")
+
+// encodeUWSGI returns the uWSGI packet of vars, the size of the parameters is
+// limited to 64k.
+func encodeUWSGI(vars []cgiVar, modifier1, modifier2 uint8) ([]byte, error) {
+	b := make([]byte, 4)
+	for _, p := range vars {
+		if len(p.name) > 0xffff || len(p.value) > 0xffff {
+			return nil, errUWSGITooBig
+		}
+		b = append(b, byte(len(p.name)), byte(len(p.name)>>8))
+		b = append(b, p.name...)
+		b = append(b, byte(len(p.value)), byte(len(p.value)>>8))
+		b = append(b, p.value...)
+	}
+	size := len(b) - 4
+	if size > 0xffff {
+		return nil, errUWSGITooBig
+	}
+	b[0] = modifier1
+	binary.LittleEndian.PutUint16(b[1:], uint16(size))
+	b[3] = modifier2
+	return b, nil
+}
+
+// deadlineConn sets the deadline of every read and write of a connection,
+// these are the read and send timeouts of the protocol.
+type deadlineConn struct {
+	conn  net.Conn
+	read  time.Duration
+	write time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.read > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.read))
+	}
+	return c.conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.write > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.write))
+	}
+	return c.conn.Write(p)
+}
+
+func (c *cgiPass) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	v := ctxVariables(ctx)
+	body, length, err := c.body(r)
+	if err != nil {
+		logError(ctx, err.Error())
+		eRender(w, http.StatusBadRequest)
+		return
+	}
+	head, err := c.encode(cgiVars(c.params, v, r, c.opts.passHeaders.value), length)
+	if err != nil {
+		errorHandler(err).ServeHTTP(w, r)
+		return
+	}
+	var conn net.Conn
+	peer, err := connectUpstream(ctx, r, c.upstreams, c.opts.pass.Value(v), func(addr string) error {
+		var err error
+		conn, err = dialCGI(ctx, addr, c.opts.connectTimeout.value)
+		return err
+	})
+	if err != nil {
+		upstreamError(w, r, err)
+		return
+	}
+	if peer != nil {
+		defer peer.release()
+	}
+	defer conn.Close()
+	dc := &deadlineConn{
+		conn:  conn,
+		read:  c.opts.readTimeout.value,
+		write: c.opts.sendTimeout.value,
+	}
+	if _, err := dc.Write(head); err != nil {
+		upstreamError(w, r, err)
+		return
+	}
+	if body != nil {
+		if _, err := io.Copy(dc, body); err != nil {
+			upstreamError(w, r, err)
+			return
+		}
+	}
+	writeCGIResponse(w, r, bufio.NewReader(dc), &c.opts.cgiOption)
+}
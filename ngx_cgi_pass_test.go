@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveConns calls handle with the connections accepted by ln.
+func serveConns(ln net.Listener, handle func(br *bufio.Reader, w io.Writer)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			handle(bufio.NewReader(conn), conn)
+		}()
+	}
+}
+
+// uwsgiApp echoes uWSGI requests.
+func uwsgiApp(br *bufio.Reader, w io.Writer) {
+	var h [4]byte
+	if _, err := io.ReadFull(br, h[:]); err != nil {
+		return
+	}
+	b := make([]byte, binary.LittleEndian.Uint16(h[1:]))
+	if _, err := io.ReadFull(br, b); err != nil {
+		return
+	}
+	vars := make(map[string]string)
+	for len(b) > 0 {
+		n := int(binary.LittleEndian.Uint16(b))
+		name := string(b[2 : 2+n])
+		b = b[2+n:]
+		n = int(binary.LittleEndian.Uint16(b))
+		vars[name] = string(b[2 : 2+n])
+		b = b[2+n:]
+	}
+	length, _ := strconv.Atoi(vars["CONTENT_LENGTH"])
+	body := make([]byte, length)
+	io.ReadFull(br, body)
+	_, https := vars["HTTPS"]
+	fmt.Fprintf(w, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n")
+	fmt.Fprintf(w, "modifier=%d %s %s https=%v test=%s body=%s",
+		h[0], vars["REQUEST_METHOD"], vars["REQUEST_URI"], https, vars["HTTP_X_TEST"], body)
+}
+
+// scgiApp echoes SCGI requests.
+func scgiApp(br *bufio.Reader, w io.Writer) {
+	s, err := br.ReadString(':')
+	if err != nil {
+		return
+	}
+	n, _ := strconv.Atoi(strings.TrimSuffix(s, ":"))
+	b := make([]byte, n+1)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return
+	}
+	fields := strings.Split(string(b[:n]), "\x00")
+	vars := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		vars[fields[i]] = fields[i+1]
+	}
+	length, _ := strconv.Atoi(vars["CONTENT_LENGTH"])
+	body := make([]byte, length)
+	io.ReadFull(br, body)
+	fmt.Fprintf(w, "Status: 201 Created\r\nContent-Type: text/plain\r\n\r\n")
+	fmt.Fprintf(w, "first=%s scgi=%s %s %s test=%s body=%s",
+		fields[0], vars["SCGI"], vars["REQUEST_METHOD"], vars["REQUEST_URI"], vars["HTTP_X_TEST"], body)
+}
+
+func TestCGIPass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vince-cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "uwsgi.sock")
+	uwsgi, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uwsgi.Close()
+	go serveConns(uwsgi, uwsgiApp)
+	scgi, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer scgi.Close()
+	go serveConns(scgi, scgiApp)
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    upstream python {
+        server unix:%s;
+    }
+    server {
+        listen       127.0.0.1:8106;
+        server_name  localhost;
+        location /uwsgi/ {
+            uwsgi_param REQUEST_METHOD $request_method;
+            uwsgi_param REQUEST_URI $request_uri;
+            uwsgi_param CONTENT_LENGTH $content_length;
+            uwsgi_param HTTPS $https if_not_empty;
+            uwsgi_modifier1 5;
+            uwsgi_pass python;
+        }
+        location /scgi/ {
+            scgi_param REQUEST_METHOD $request_method;
+            scgi_param REQUEST_URI $request_uri;
+            scgi_param SCGI 1;
+            scgi_pass %s;
+        }
+    }
+}
+`, sock, scgi.Addr())
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	host := "http://localhost:8106"
+	get := func(method, uri string, body io.Reader, checks ...httpCheckFn) testKase {
+		return func(ctx context.Context, t *testing.T) {
+			t.Run(method+" "+uri, func(t *testing.T) {
+				r, _ := http.NewRequest(method, host+uri, body)
+				r.Header.Set("X-Test", "hello")
+				res, err := http.DefaultClient.Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				for _, f := range checks {
+					f(ctx, t, res)
+				}
+			})
+		}
+	}
+	// a reader of unknown length is sent chunked
+	chunked := func(s string) io.Reader {
+		return io.MultiReader(bytes.NewBufferString(s))
+	}
+	runTest(t, c,
+		get("GET", "/uwsgi/a?x=1", nil,
+			checkCode(http.StatusOK),
+			checkBodyString("modifier=5 GET /uwsgi/a?x=1 https=false test=hello body=")),
+		get("POST", "/uwsgi/a", strings.NewReader("hello"),
+			checkBodyString("modifier=5 POST /uwsgi/a https=false test=hello body=hello")),
+		get("POST", "/uwsgi/chunked", chunked("chunked"),
+			checkBodyString("modifier=5 POST /uwsgi/chunked https=false test=hello body=chunked")),
+		get("GET", "/scgi/b", nil,
+			checkCode(http.StatusCreated),
+			checkBodyString("first=CONTENT_LENGTH scgi=1 GET /scgi/b test=hello body=")),
+		get("POST", "/scgi/b", chunked("hello"),
+			checkBodyString("first=CONTENT_LENGTH scgi=1 POST /scgi/b test=hello body=hello")),
+	)
+}
@@ -2,8 +2,7 @@ package main
 
 import (
 	"context"
-	"net/http"
-	"os"
+	"net"
 )
 
 // time formats
@@ -19,11 +18,11 @@ const (
 	vAncientBrowser          = "$ancient_browser"
 	vArg                     = "$arg"
 	vArgs                    = "$args"
-	vBinaryRemoteAddress     = "$binary_remote_addr "
+	vBinaryRemoteAddress     = "$binary_remote_addr"
 	vBodyBytesSent           = "$body_bytes_sent"
 	vBytesReceived           = "$bytes_received"
 	vBytesSent               = "$bytes_sent"
-	vConnection              = "$connection "
+	vConnection              = "$connection"
 	vConnectionRequests      = "$connection_requests"
 	vConnectionActive        = "$connections_active"
 	vConnectionReading       = "$connections_reading"
@@ -37,8 +36,9 @@ const (
 	vDocumentRoot            = "$document_root"
 	vDocumentURI             = "$document_uri"
 	vFastCGIPathInfo         = "$fastcgi_path_info"
-	vGeoIPAreaCode           = "$geoip_area_code "
-	vGeoIPCity               = "$geoip_city  "
+	vFastCGIScriptName       = "$fastcgi_script_name"
+	vGeoIPAreaCode           = "$geoip_area_code"
+	vGeoIPCity               = "$geoip_city"
 	vGeoIPCityContinentCode  = "$geoip_city_continent_code"
 	vGeoIPCityCountryCode    = "$geoip_city_country_code"
 	vGeoIPCityCountryCode3   = "$geoip_city_country_code3"
@@ -82,9 +82,9 @@ const (
 	vProxyProtocolServerAddr = "$proxy_protocol_server_addr"
 	vProxyProtocolServerPort = "$proxy_protocol_server_port"
 	vQueryString             = "$query_string"
-	vRealIPRemoteAddr        = "$realip_remote_addr "
-	vRealIPRemotePort        = "$realip_remote_port "
-	vRealPathRoot            = "$realpath_root "
+	vRealIPRemoteAddr        = "$realip_remote_addr"
+	vRealIPRemotePort        = "$realip_remote_port"
+	vRealPathRoot            = "$realpath_root"
 	vRemoteAddr              = "$remote_addr"
 	vRemotePort              = "$remote_port"
 	vRemoteUser              = "$remote_user"
@@ -161,62 +161,26 @@ const (
 	vUpstreamTrailer         = "$upstream_trailer"
 	vURI                     = "$uri"
 )
-const (
-	vRequestMatchKind = "request_match_kind"
-)
 
 // extra ctx keys
 type (
 	requestID struct{}
 )
 
-func setVariable(ctx context.Context, key string, value interface{}) {
-	if v := ctx.Value(variables{}); v != nil {
-		v.(map[string]interface{})[key] = value
-	}
+// setVariable sets variable key of the request or session handled with ctx.
+func setVariable(ctx context.Context, key string, value string) {
+	ctxVariables(ctx).Set(key, value)
 }
 
-func setRequestVariables(m map[string]interface{}, r *http.Request) {
-	// seeting query variables
-	query := r.URL.Query()
-	for k := range query {
-		// setting $arg_{query_name}
-		m[vArg+"_"+k] = query.Get(k)
-	}
-	m[vArgs] = r.URL.RawQuery
-	m[vContentLength] = r.Header.Get("Content-Length")
-	m[vContentType] = r.Header.Get("Content-Type")
-	for _, cookie := range r.Cookies() {
-		m[vCookie+"_"+cookie.Name] = cookie.Value
-	}
-	ctx := r.Context()
-	root := ""
-	if v := ctx.Value(rootKey{}); v != nil {
-		root = v.(string)
-	} else if v := ctx.Value(aliasKey{}); v != nil {
-		root = v.(string)
-	}
-	m[vDocumentRoot] = root
-	m[vDocumentURI] = r.URL
-	m[vURI] = r.URL
-	host := r.Host
-	if host == "" {
-		host = r.Header.Get("Host")
-	}
-	if host == "" {
-		if v := ctx.Value(serverNameKey{}); v != nil {
-			host = v.(string)
-		}
-	}
-	m[vHost] = host
-	n, _ := os.Hostname() //TODO: handle errors
-	m[vHostname] = n
-	for h := range r.Header {
-		m[vHTTP+"_"+h] = r.Header.Get(h)
+// binaryAddr returns ip address host in binary form, this is 4 bytes long for
+// ipv4 and 16 bytes for ipv6 addresses.
+func binaryAddr(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
 	}
-	a := ""
-	if len(query) > 0 {
-		a = "?"
+	if v4 := ip.To4(); v4 != nil {
+		return string(v4)
 	}
-	m[vIsArgs] = a
+	return string(ip)
 }
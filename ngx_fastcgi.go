@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// fastcgi passes requests to a FastCGI server, this is fastcgi_pass.
+type fastcgi struct {
+	opts      fastcgiOption
+	params    []*cgiParam
+	upstreams map[string]*upstreamConfig
+}
+
+type fastcgiOption struct {
+	cgiOption
+	index stringValue
+	// splitPathInfo is fastcgi_split_path_info, its captures are the values
+	// of $fastcgi_script_name and $fastcgi_path_info.
+	splitPathInfo *regexp.Regexp
+	keepConn      boolValue
+}
+
+func (o *fastcgiOption) loadKey(r *rule) error {
+	switch r.name {
+	case "fastcgi_index":
+		o.index.store(r.args[0])
+	case "fastcgi_split_path_info":
+		re, err := regexp.Compile(r.args[0])
+		if err != nil {
+			return err
+		}
+		if re.NumSubexp() != 2 {
+			return fmt.Errorf("vince: fastcgi_split_path_info %q must have 2 captures", r.args[0])
+		}
+		o.splitPathInfo = re
+	case "fastcgi_keep_conn":
+		o.keepConn.store(r.args[0] == "on")
+	default:
+		return o.cgiOption.loadKey("fastcgi", r)
+	}
+	return nil
+}
+
+func (f *fastcgi) init(location *rule) error {
+	f.opts = fastcgiOption{}
+	f.opts.defaults()
+	loadOption(location, f.opts.loadKey)
+	params, err := compileCGIParams(location, "fastcgi_param")
+	if err != nil {
+		return err
+	}
+	f.params = params
+	return nil
+}
+
+// scriptName returns $fastcgi_script_name and $fastcgi_path_info of uri.
+func (f *fastcgi) scriptName(uri string) (script, pathInfo string) {
+	script = uri
+	if re := f.opts.splitPathInfo; re != nil {
+		if m := re.FindStringSubmatch(uri); m != nil {
+			script, pathInfo = m[1], m[2]
+		}
+	}
+	if strings.HasSuffix(script, "/") {
+		script += f.opts.index.value
+	}
+	return script, pathInfo
+}
+
+// encodeParams returns the encoded parameters of r.
+func (f *fastcgi) encodeParams(v *ngxVariables, r *http.Request) []byte {
+	var b []byte
+	for _, p := range cgiVars(f.params, v, r, f.opts.passHeaders.value) {
+		b = appendPair(b, p.name, p.value)
+	}
+	return b
+}
+
+func (f *fastcgi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.opts.pass.set {
+		errorHandler(errors.New("vince: fastcgi_pass address not set")).ServeHTTP(w, r)
+		return
+	}
+	ctx := r.Context()
+	v := ctxVariables(ctx)
+	script, pathInfo := f.scriptName(r.URL.Path)
+	v.Set(vFastCGIScriptName, script)
+	v.Set(vFastCGIPathInfo, pathInfo)
+	req := &fcgiRequest{
+		stdout: newFastCGIStream(f.opts.readTimeout.value),
+		stderr: func(b []byte) {
+			msg := strings.TrimSpace(string(b))
+			logError(ctx, fmt.Sprintf("FastCGI sent in stderr: %q while reading response from upstream", msg))
+		},
+	}
+	peer, err := f.connect(ctx, r, req, f.encodeParams(v, r))
+	if err != nil {
+		upstreamError(w, r, err)
+		return
+	}
+	if peer != nil {
+		defer peer.release()
+	}
+	var body io.Reader
+	if f.opts.passBody.value && r.Body != nil && r.Body != http.NoBody {
+		body = r.Body
+	}
+	if err := req.conn.sendStdin(req, body); err != nil {
+		upstreamError(w, r, err)
+		return
+	}
+	br := bufio.NewReader(req.stdout)
+	if err := writeCGIResponse(w, r, br, &f.opts.cgiOption); err != nil {
+		req.conn.abort(req)
+	}
+}
+
+// connect sends the begin request record and params of req to the FastCGI
+// server, the upstream peer used is returned.
+func (f *fastcgi) connect(ctx context.Context, r *http.Request, req *fcgiRequest, params []byte) (*upstreamPeer, error) {
+	o := fcgiDialOption{
+		keep:           f.opts.keepConn.value,
+		connectTimeout: f.opts.connectTimeout.value,
+		sendTimeout:    f.opts.sendTimeout.value,
+	}
+	addr := f.opts.pass.Value(ctxVariables(ctx))
+	return connectUpstream(ctx, r, f.upstreams, addr, func(addr string) error {
+		return fastcgiPool.begin(ctx, addr, req, params, o)
+	})
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// FastCGI record types and values, see https://fast-cgi.github.io/spec
+const (
+	fcgiVersion = 1
+
+	fcgiBeginRequest    = 1
+	fcgiAbortRequest    = 2
+	fcgiEndRequest      = 3
+	fcgiParams          = 4
+	fcgiStdin           = 5
+	fcgiStdout          = 6
+	fcgiStderr          = 7
+	fcgiGetValues       = 9
+	fcgiGetValuesResult = 10
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	fcgiRequestComplete = 0
+	fcgiCantMpxConn     = 1
+	fcgiOverloaded      = 2
+	fcgiUnknownRole     = 3
+
+	fcgiHeaderSize = 8
+	fcgiMaxContent = 65535
+	fcgiMpxsConns  = "FCGI_MPXS_CONNS"
+
+	// fcgiMaxRequests is the number of request ids, 0 is reserved.
+	fcgiMaxRequests = 1<<16 - 1
+)
+
+// fcgiMaxIdle is the number of idle connections kept open for each FastCGI
+// server and fcgiIdleTimeout how long they are kept.
+var (
+	fcgiMaxIdle     = 16
+	fcgiIdleTimeout = time.Minute
+)
+
+var errFastCGIClosed = errors.New("vince: FastCGI server closed the connection")
+
+// fcgiTimeoutError is returned when the FastCGI server does not send anything
+// during fastcgi_read_timeout.
+type fcgiTimeoutError struct{}
+
+func (fcgiTimeoutError) Error() string   { return "vince: FastCGI server timed out" }
+func (fcgiTimeoutError) Timeout() bool   { return true }
+func (fcgiTimeoutError) Temporary() bool { return true }
+
+// writeRecord writes a record of type typ for request id to w. content must
+// not be longer than fcgiMaxContent, it is padded to a multiple of 8 bytes.
+func writeRecord(w io.Writer, typ uint8, id uint16, content []byte) error {
+	pad := -len(content) & 7
+	b := make([]byte, fcgiHeaderSize+len(content)+pad)
+	b[0] = fcgiVersion
+	b[1] = typ
+	binary.BigEndian.PutUint16(b[2:], id)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(content)))
+	b[6] = uint8(pad)
+	copy(b[fcgiHeaderSize:], content)
+	_, err := w.Write(b)
+	return err
+}
+
+// readRecord reads the next record from r.
+func readRecord(r io.Reader) (typ uint8, id uint16, content []byte, err error) {
+	var h [fcgiHeaderSize]byte
+	if _, err = io.ReadFull(r, h[:]); err != nil {
+		return
+	}
+	if h[0] != fcgiVersion {
+		err = fmt.Errorf("vince: invalid FastCGI version %d", h[0])
+		return
+	}
+	typ = h[1]
+	id = binary.BigEndian.Uint16(h[2:])
+	n := int(binary.BigEndian.Uint16(h[4:]))
+	content = make([]byte, n+int(h[6]))
+	if _, err = io.ReadFull(r, content); err != nil {
+		return
+	}
+	content = content[:n]
+	return
+}
+
+// appendPair appends the name-value pair encoding of name and value to b.
+func appendPair(b []byte, name, value string) []byte {
+	b = appendPairLength(b, len(name))
+	b = appendPairLength(b, len(value))
+	b = append(b, name...)
+	return append(b, value...)
+}
+
+func appendPairLength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return append(b, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+}
+
+// readPairs decodes name-value pairs.
+func readPairs(b []byte) (map[string]string, error) {
+	m := make(map[string]string)
+	length := func() (int, error) {
+		if len(b) == 0 {
+			return 0, errors.New("vince: invalid FastCGI name-value pair")
+		}
+		if b[0] < 128 {
+			n := int(b[0])
+			b = b[1:]
+			return n, nil
+		}
+		if len(b) < 4 {
+			return 0, errors.New("vince: invalid FastCGI name-value pair")
+		}
+		n := int(binary.BigEndian.Uint32(b) & 0x7fffffff)
+		b = b[4:]
+		return n, nil
+	}
+	for len(b) > 0 {
+		name, err := length()
+		if err != nil {
+			return nil, err
+		}
+		value, err := length()
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < name+value {
+			return nil, errors.New("vince: invalid FastCGI name-value pair")
+		}
+		m[string(b[:name])] = string(b[name : name+value])
+		b = b[name+value:]
+	}
+	return m, nil
+}
+
+// fcgiStream holds the content of the stdout records of a request until it is
+// read, so that the reader of a multiplexed connection never waits for a slow
+// client.
+type fcgiStream struct {
+	mu     sync.Mutex
+	chunks [][]byte
+	err    error
+	ready  chan struct{}
+	// timeout is fastcgi_read_timeout, the longest time Read waits.
+	timeout time.Duration
+}
+
+func newFastCGIStream(timeout time.Duration) *fcgiStream {
+	return &fcgiStream{ready: make(chan struct{}, 1), timeout: timeout}
+}
+
+func (s *fcgiStream) write(b []byte) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.chunks = append(s.chunks, b)
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+// close ends the stream, err is returned by Read once the content is read.
+func (s *fcgiStream) close(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *fcgiStream) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (s *fcgiStream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.chunks) > 0 {
+			n := copy(p, s.chunks[0])
+			s.chunks[0] = s.chunks[0][n:]
+			if len(s.chunks[0]) == 0 {
+				s.chunks = s.chunks[1:]
+			}
+			s.mu.Unlock()
+			return n, nil
+		}
+		err := s.err
+		s.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if s.timeout <= 0 {
+			<-s.ready
+			continue
+		}
+		t := time.NewTimer(s.timeout)
+		select {
+		case <-s.ready:
+			t.Stop()
+		case <-t.C:
+			return 0, fcgiTimeoutError{}
+		}
+	}
+}
+
+// fcgiRequest is a request sent on a connection.
+type fcgiRequest struct {
+	id     uint16
+	conn   *fcgiConn
+	stdout *fcgiStream
+	// stderr receives the content of stderr records.
+	stderr func([]byte)
+	// status is the protocol status of the end request record.
+	status uint8
+}
+
+// fcgiConn is a connection to a FastCGI server. Records of all requests are
+// read by a single goroutine and dispatched to the requests by id.
+type fcgiConn struct {
+	pool *fcgiPool
+	addr string
+	conn net.Conn
+	keep bool
+
+	// wmu serializes the records of concurrent requests.
+	wmu     sync.Mutex
+	timeout time.Duration
+
+	mu     sync.Mutex
+	reqs   map[uint16]*fcgiRequest
+	lastID uint16
+	// mpxs is true when the server accepts concurrent requests on the
+	// connection, this is asked with a get values record when it is opened.
+	mpxs bool
+	err  error
+	idle time.Time
+}
+
+// write sends a record, content longer than a record is split.
+func (c *fcgiConn) write(typ uint8, id uint16, content []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	for {
+		n := len(content)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		if err := writeRecord(c.conn, typ, id, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+		if len(content) == 0 {
+			return nil
+		}
+	}
+}
+
+// read dispatches the records sent by the server until the connection is
+// closed.
+func (c *fcgiConn) read() {
+	br := bufio.NewReader(c.conn)
+	for {
+		typ, id, content, err := readRecord(br)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if typ == fcgiGetValuesResult {
+			m, err := readPairs(content)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if v, ok := m[fcgiMpxsConns]; ok {
+				// some servers end the values with an empty record
+				c.mu.Lock()
+				c.mpxs = v == "1"
+				c.mu.Unlock()
+			}
+			continue
+		}
+		c.mu.Lock()
+		req := c.reqs[id]
+		c.mu.Unlock()
+		if req == nil {
+			// records of aborted requests
+			continue
+		}
+		switch typ {
+		case fcgiStdout:
+			if len(content) > 0 {
+				req.stdout.write(content)
+			}
+		case fcgiStderr:
+			if len(content) > 0 && req.stderr != nil {
+				req.stderr(content)
+			}
+		case fcgiEndRequest:
+			if len(content) >= 5 {
+				req.status = content[4]
+			}
+			c.end(req)
+		}
+	}
+}
+
+// end removes req from the connection once the server ended it.
+func (c *fcgiConn) end(req *fcgiRequest) {
+	err := io.EOF
+	switch req.status {
+	case fcgiCantMpxConn:
+		c.mu.Lock()
+		c.mpxs = false
+		c.mu.Unlock()
+		err = errors.New("vince: FastCGI server can not multiplex connections")
+	case fcgiOverloaded:
+		err = errors.New("vince: FastCGI server is overloaded")
+	case fcgiUnknownRole:
+		err = errors.New("vince: FastCGI server does not support the responder role")
+	}
+	req.stdout.close(err)
+	c.mu.Lock()
+	delete(c.reqs, req.id)
+	last := len(c.reqs) == 0
+	if last {
+		c.idle = time.Now()
+	}
+	c.mu.Unlock()
+	if !c.keep {
+		c.conn.Close()
+		return
+	}
+	if last {
+		c.pool.release(c)
+	}
+}
+
+// fail closes the connection and ends all its requests with err.
+func (c *fcgiConn) fail(err error) {
+	if err == io.EOF {
+		err = errFastCGIClosed
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	reqs := c.reqs
+	c.reqs = nil
+	c.mu.Unlock()
+	c.conn.Close()
+	for _, req := range reqs {
+		req.stdout.close(err)
+	}
+	if c.keep {
+		c.pool.remove(c)
+	}
+}
+
+// reserve adds a request to the connection, false is returned when the
+// connection can not take more requests.
+func (c *fcgiConn) reserve(req *fcgiRequest) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.reqs == nil || (len(c.reqs) > 0 && !c.mpxs) {
+		return false
+	}
+	if len(c.reqs) >= fcgiMaxRequests {
+		return false
+	}
+	for {
+		c.lastID++
+		if c.lastID != 0 && c.reqs[c.lastID] == nil {
+			break
+		}
+	}
+	req.id = c.lastID
+	req.conn = c
+	c.reqs[req.id] = req
+	return true
+}
+
+// abort tells the server to stop processing req, its remaining records are
+// ignored.
+func (c *fcgiConn) abort(req *fcgiRequest) {
+	c.mu.Lock()
+	_, ok := c.reqs[req.id]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	req.stdout.close(context.Canceled)
+	if !c.keep {
+		c.conn.Close()
+		return
+	}
+	if err := c.write(fcgiAbortRequest, req.id, nil); err != nil {
+		c.fail(err)
+	}
+}
+
+// fcgiPool keeps connections to FastCGI servers opened with fastcgi_keep_conn
+// so that they are used by the following requests.
+type fcgiPool struct {
+	mu    sync.Mutex
+	conns map[string][]*fcgiConn
+}
+
+var fastcgiPool = &fcgiPool{conns: make(map[string][]*fcgiConn)}
+
+// fcgiDialOption are the settings of the connection of a request.
+type fcgiDialOption struct {
+	keep           bool
+	connectTimeout time.Duration
+	sendTimeout    time.Duration
+}
+
+// dial opens a connection to addr, this is either host:port or unix:path.
+func (p *fcgiPool) dial(ctx context.Context, addr string, o fcgiDialOption) (*fcgiConn, error) {
+	conn, err := dialCGI(ctx, addr, o.connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &fcgiConn{
+		pool:    p,
+		addr:    addr,
+		conn:    conn,
+		keep:    o.keep,
+		timeout: o.sendTimeout,
+		reqs:    make(map[uint16]*fcgiRequest),
+	}
+	if o.keep {
+		query := appendPair(nil, fcgiMpxsConns, "")
+		if err := c.write(fcgiGetValues, 0, query); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	go c.read()
+	return c, nil
+}
+
+// get returns a connection to addr with req added to it. Idle connections and
+// connections to servers multiplexing requests are used first.
+func (p *fcgiPool) get(ctx context.Context, addr string, req *fcgiRequest, o fcgiDialOption) (c *fcgiConn, reused bool, err error) {
+	if o.keep {
+		p.mu.Lock()
+		now := time.Now()
+		conns := p.conns[addr]
+		var alive []*fcgiConn
+		for _, c := range conns {
+			c.mu.Lock()
+			expired := len(c.reqs) == 0 && now.Sub(c.idle) >= fcgiIdleTimeout
+			c.mu.Unlock()
+			if expired {
+				c.conn.Close()
+				continue
+			}
+			alive = append(alive, c)
+		}
+		p.conns[addr] = alive
+		for _, c := range alive {
+			if c.reserve(req) {
+				p.mu.Unlock()
+				return c, true, nil
+			}
+		}
+		p.mu.Unlock()
+	}
+	c, err = p.dial(ctx, addr, o)
+	if err != nil {
+		return nil, false, err
+	}
+	c.reserve(req)
+	if o.keep {
+		p.mu.Lock()
+		p.conns[addr] = append(p.conns[addr], c)
+		p.mu.Unlock()
+	}
+	return c, false, nil
+}
+
+// release closes c when there are too many idle connections to its server.
+func (p *fcgiPool) release(c *fcgiConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle := 0
+	for _, o := range p.conns[c.addr] {
+		o.mu.Lock()
+		if len(o.reqs) == 0 {
+			idle++
+		}
+		o.mu.Unlock()
+	}
+	if idle > fcgiMaxIdle {
+		p.removeLocked(c)
+		c.conn.Close()
+	}
+}
+
+func (p *fcgiPool) remove(c *fcgiConn) {
+	p.mu.Lock()
+	p.removeLocked(c)
+	p.mu.Unlock()
+}
+
+func (p *fcgiPool) removeLocked(c *fcgiConn) {
+	conns := p.conns[c.addr]
+	for i, o := range conns {
+		if o == c {
+			p.conns[c.addr] = append(conns[:i:i], conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// begin sends the begin request record and params of req. A connection from
+// the pool may have been closed by the server, the request is then sent on a
+// new connection.
+func (p *fcgiPool) begin(ctx context.Context, addr string, req *fcgiRequest, params []byte, o fcgiDialOption) error {
+	for {
+		c, reused, err := p.get(ctx, addr, req, o)
+		if err != nil {
+			return err
+		}
+		err = c.send(req, params)
+		if err == nil {
+			return nil
+		}
+		c.fail(err)
+		if !reused {
+			return err
+		}
+		req.stdout = newFastCGIStream(req.stdout.timeout)
+	}
+}
+
+func (c *fcgiConn) send(req *fcgiRequest, params []byte) error {
+	var flags byte
+	if c.keep {
+		flags = fcgiKeepConn
+	}
+	begin := []byte{0, fcgiResponder, flags, 0, 0, 0, 0, 0}
+	if err := c.write(fcgiBeginRequest, req.id, begin); err != nil {
+		return err
+	}
+	if len(params) > 0 {
+		if err := c.write(fcgiParams, req.id, params); err != nil {
+			return err
+		}
+	}
+	return c.write(fcgiParams, req.id, nil)
+}
+
+// sendStdin streams body to the server, an empty stdin record ends it.
+func (c *fcgiConn) sendStdin(req *fcgiRequest, body io.Reader) error {
+	if body != nil {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				if err := c.write(fcgiStdin, req.id, buf[:n]); err != nil {
+					c.fail(err)
+					return err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				c.abort(req)
+				return err
+			}
+		}
+	}
+	if err := c.write(fcgiStdin, req.id, nil); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countListener counts accepted connections.
+type countListener struct {
+	net.Listener
+	n int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.n, 1)
+	}
+	return c, err
+}
+
+func TestFastCGI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vince-fastcgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// both requests to /wait.php must be handled at the same time
+	var wait sync.WaitGroup
+	wait.Add(2)
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		switch r.URL.Path {
+		case "/status.php":
+			w.Header().Set("X-Accel-Redirect", "/internal")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case "/wait.php":
+			wait.Done()
+			wait.Wait()
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		_, query := env["QUERY"]
+		fmt.Fprintf(w, "%s %s path=%s query=%v test=%s body=%s",
+			r.Method, env["SCRIPT_FILENAME"], env["FASTCGI_PATH_INFO"], query, r.Header.Get("X-Test"), b)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := &countListener{Listener: ln}
+	defer tcp.Close()
+	go fcgi.Serve(tcp, app)
+	sock := filepath.Join(dir, "fcgi.sock")
+	unix, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+	go fcgi.Serve(unix, app)
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    fastcgi_param REQUEST_METHOD $request_method;
+    fastcgi_param SERVER_PROTOCOL $server_protocol;
+    fastcgi_param REQUEST_URI $request_uri;
+    fastcgi_param CONTENT_TYPE $content_type;
+    fastcgi_param CONTENT_LENGTH $content_length;
+    fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+    fastcgi_param FASTCGI_PATH_INFO $fastcgi_path_info;
+    fastcgi_param QUERY $query_string if_not_empty;
+    fastcgi_index index.php;
+    fastcgi_keep_conn on;
+    server {
+        listen       127.0.0.1:8105;
+        server_name  localhost;
+        root /www;
+        location / {
+            fastcgi_split_path_info ^(.+\.php)(/.+)$;
+            fastcgi_pass %s;
+        }
+        location /unix/ {
+            fastcgi_pass unix:%s;
+        }
+    }
+}
+`, ln.Addr(), sock)
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	host := "http://localhost:8105"
+	get := func(method, uri, body string, checks ...httpCheckFn) testKase {
+		return func(ctx context.Context, t *testing.T) {
+			t.Run(method+" "+uri, func(t *testing.T) {
+				r, _ := http.NewRequest(method, host+uri, strings.NewReader(body))
+				r.Header.Set("X-Test", "hello")
+				res, err := http.DefaultClient.Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				for _, f := range checks {
+					f(ctx, t, res)
+				}
+			})
+		}
+	}
+	concurrent := func(ctx context.Context, t *testing.T) {
+		var g sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			g.Add(1)
+			go func() {
+				defer g.Done()
+				get("GET", "/wait.php", "", checkCode(http.StatusOK))(ctx, t)
+			}()
+		}
+		g.Wait()
+	}
+	runTest(t, c,
+		get("GET", "/app.php/extra?a=b", "",
+			checkBodyString("GET /www/app.php path=/extra query=true test=hello body=")),
+		get("GET", "/dir/", "",
+			checkBodyString("GET /www/dir/index.php path= query=false test=hello body=")),
+		get("POST", "/app.php", "hello",
+			checkBodyString("POST /www/app.php path= query=false test=hello body=hello")),
+		get("GET", "/status.php", "",
+			checkCode(http.StatusNotFound), checkHeader("X-Accel-Redirect", "")),
+		get("GET", "/unix/app.php", "",
+			checkBodyString("GET /www/unix/app.php path= query=false test=hello body=")),
+		concurrent,
+	)
+	// requests are multiplexed on a single connection
+	if n := atomic.LoadInt32(&tcp.n); n != 1 {
+		t.Errorf("expected 1 connection got %d", n)
+	}
+}
+
+// testLogger records error logs.
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *testLogger) Println(file string, level string, message []byte) {
+	l.mu.Lock()
+	l.logs = append(l.logs, level+" "+string(message))
+	l.mu.Unlock()
+}
+
+func TestFastCGIStderr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			typ, id, content, err := readRecord(conn)
+			if err != nil {
+				return
+			}
+			if typ != fcgiStdin || len(content) > 0 {
+				continue
+			}
+			writeRecord(conn, fcgiStderr, id, []byte("PHP Warning: oops\n"))
+			writeRecord(conn, fcgiStdout, id, []byte("Status: 500 Internal Server Error\r\nContent-Type: text/plain\r\n\r\nfailed"))
+			writeRecord(conn, fcgiEndRequest, id, make([]byte, 8))
+			return
+		}
+	}()
+	f := new(fastcgi)
+	f.opts.defaults()
+	f.opts.pass.store(ln.Addr().String())
+	lg := new(testLogger)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx := context.WithValue(r.Context(), errorLogKey{}, "error.log")
+	ctx = context.WithValue(ctx, ngxLoggerKey{}, lg)
+	w, r := withVariables(httptest.NewRecorder(), r.WithContext(ctx))
+	f.ServeHTTP(w, r)
+	res := w.(*variableWriter).ResponseWriter.(*httptest.ResponseRecorder)
+	if res.Code != http.StatusInternalServerError || res.Body.String() != "failed" {
+		t.Errorf("unexpected response %d %q", res.Code, res.Body.String())
+	}
+	expect := `error FastCGI sent in stderr: "PHP Warning: oops" while reading response from upstream`
+	if len(lg.logs) != 1 || lg.logs[0] != expect {
+		t.Errorf("expected log %q got %q", expect, lg.logs)
+	}
+}
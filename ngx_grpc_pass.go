@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// grpcProxy passes requests to gRPC servers over HTTP/2, this is grpc_pass.
+// grpc:// servers are reached with h2c and grpcs:// servers with TLS.
+type grpcProxy struct {
+	opts      grpcOption
+	headers   *proxyHeaders
+	upstreams map[string]*upstreamConfig
+	rev       *httputil.ReverseProxy
+	// h2c and tls are the transports of grpc:// and grpcs:// servers.
+	h2c *http.Transport
+	tls *http.Transport
+}
+
+type grpcOption struct {
+	pass           stringTemplateValue
+	next           nextUpstreamOption
+	connectTimeout durationValue
+	// readTimeout is grpc_read_timeout, the longest time between two reads
+	// of the upstream response.
+	readTimeout     durationValue
+	interceptErrors boolValue
+	ssl             struct {
+		verify         boolValue
+		name           stringValue
+		trusted        stringValue
+		certificate    stringValue
+		certificateKey stringValue
+	}
+}
+
+func (o *grpcOption) defaults() {
+	o.next.defaults()
+	o.connectTimeout.store(60 * time.Second)
+	o.readTimeout.store(60 * time.Second)
+}
+
+func (o *grpcOption) loadKey(r *rule) error {
+	switch r.name {
+	case "grpc_pass":
+		if _, err := parseGRPCURL(r.args[0]); err != nil {
+			return err
+		}
+		o.pass.store(r.args[0])
+	case "grpc_intercept_errors":
+		o.interceptErrors.store(r.args[0] == "on")
+	case "grpc_next_upstream":
+		n, err := parseNextUpstream(r.args)
+		if err != nil {
+			return err
+		}
+		o.next.when = n
+	case "grpc_next_upstream_tries":
+		n, err := strconv.ParseInt(r.args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("vince: invalid value %q", r.args[0])
+		}
+		o.next.tries.store(n)
+	case "grpc_next_upstream_timeout", "grpc_connect_timeout", "grpc_read_timeout":
+		d, err := parseDuration(r.args[0])
+		if err != nil {
+			return fmt.Errorf("vince: invalid value %q", r.args[0])
+		}
+		switch r.name {
+		case "grpc_next_upstream_timeout":
+			o.next.timeout.store(d)
+		case "grpc_connect_timeout":
+			o.connectTimeout.store(d)
+		default:
+			o.readTimeout.store(d)
+		}
+	case "client_body_buffer_size":
+		n, err := parseSize(r.args[0])
+		if err != nil {
+			return err
+		}
+		o.next.bodyBuffer.store(n)
+	case "grpc_ssl_verify":
+		o.ssl.verify.store(r.args[0] == "on")
+	case "grpc_ssl_name":
+		o.ssl.name.store(r.args[0])
+	case "grpc_ssl_trusted_certificate":
+		o.ssl.trusted.store(r.args[0])
+	case "grpc_ssl_certificate":
+		o.ssl.certificate.store(r.args[0])
+	case "grpc_ssl_certificate_key":
+		o.ssl.certificateKey.store(r.args[0])
+	}
+	return nil
+}
+
+// tlsConfig returns the tls configuration used to connect to grpcs:// servers.
+// Like nginx the certificate of the server is not verified unless
+// grpc_ssl_verify is on.
+func (o *grpcOption) tlsConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: !o.ssl.verify.value,
+		ServerName:         o.ssl.name.value,
+	}
+	if o.ssl.trusted.set {
+		b, err := ioutil.ReadFile(o.ssl.trusted.value)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("vince: no certificate found in %q", o.ssl.trusted.value)
+		}
+	}
+	if o.ssl.certificate.set {
+		cert, err := tls.LoadX509KeyPair(o.ssl.certificate.value, o.ssl.certificateKey.value)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// parseGRPCURL returns the url of the grpc_pass address s. It is either a
+// grpc:// or grpcs:// url, or an address without scheme which is grpc://.
+func parseGRPCURL(s string) (*url.URL, error) {
+	scheme := "grpc"
+	switch {
+	case strings.HasPrefix(s, "grpc://"):
+		s = s[7:]
+	case strings.HasPrefix(s, "grpcs://"):
+		scheme, s = "grpcs", s[8:]
+	case strings.Contains(s, "://"):
+		return nil, fmt.Errorf("vince: invalid grpc_pass address %q", s)
+	}
+	if s == "" || strings.ContainsAny(s, "/?#") && !strings.HasPrefix(s, "unix:") {
+		return nil, fmt.Errorf("vince: invalid grpc_pass address %q", s)
+	}
+	return &url.URL{Scheme: scheme, Host: s}, nil
+}
+
+func newGRPCProxy(location *rule, upstreams map[string]*upstreamConfig) (*grpcProxy, error) {
+	g := &grpcProxy{upstreams: upstreams}
+	g.opts.defaults()
+	loadOption(location, g.opts.loadKey)
+	headers, err := compileUpstreamHeaders(location, "grpc", vHost)
+	if err != nil {
+		return nil, err
+	}
+	g.headers = headers
+	g.h2c, err = grpcTransports.get(&g.opts, false)
+	if err != nil {
+		return nil, err
+	}
+	g.tls, err = grpcTransports.get(&g.opts, true)
+	if err != nil {
+		return nil, err
+	}
+	g.rev = &httputil.ReverseProxy{
+		Director:       g.director,
+		Transport:      roundTripFunc(g.roundTrip),
+		ModifyResponse: g.modifyResponse,
+		ErrorHandler:   g.errorHandler,
+		// messages are streamed both ways
+		FlushInterval: -1,
+	}
+	return g, nil
+}
+
+// grpcIdleConnTimeout is how long connections to gRPC servers are kept idle.
+const grpcIdleConnTimeout = 90 * time.Second
+
+// grpcTransportPool keeps the transports of grpc_pass so that locations with
+// the same settings share their connections to gRPC servers.
+type grpcTransportPool struct {
+	mu         sync.Mutex
+	transports map[grpcTransportKey]*http.Transport
+}
+
+var grpcTransports = &grpcTransportPool{transports: make(map[grpcTransportKey]*http.Transport)}
+
+// grpcTransportKey are the settings of a transport.
+type grpcTransportKey struct {
+	tls            bool
+	connectTimeout time.Duration
+	verify         bool
+	name           string
+	trusted        string
+	certificate    string
+	certificateKey string
+}
+
+// get returns the transport for the settings of o, it uses TLS when secure is
+// true.
+func (p *grpcTransportPool) get(o *grpcOption, secure bool) (*http.Transport, error) {
+	key := grpcTransportKey{
+		tls:            secure,
+		connectTimeout: o.connectTimeout.value,
+	}
+	if secure {
+		key.verify = o.ssl.verify.value
+		key.name = o.ssl.name.value
+		key.trusted = o.ssl.trusted.value
+		key.certificate = o.ssl.certificate.value
+		key.certificateKey = o.ssl.certificateKey.value
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.transports[key]; ok {
+		return t, nil
+	}
+	var c *tls.Config
+	if secure {
+		var err error
+		c, err = o.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	t := newGRPCTransport(c, key.connectTimeout)
+	p.transports[key] = t
+	return t, nil
+}
+
+// reset drops all transports and closes their idle connections, this is
+// called on reload so that certificates are loaded again. Requests in flight
+// keep their transport.
+func (p *grpcTransportPool) reset() {
+	p.mu.Lock()
+	transports := p.transports
+	p.transports = make(map[grpcTransportKey]*http.Transport)
+	p.mu.Unlock()
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// newGRPCTransport returns an HTTP/2 only transport, it uses TLS when c is not
+// nil.
+func newGRPCTransport(c *tls.Config, timeout time.Duration) *http.Transport {
+	p := new(http.Protocols)
+	if c == nil {
+		p.SetUnencryptedHTTP2(true)
+	} else {
+		p.SetHTTP2(true)
+	}
+	return &http.Transport{
+		Protocols:       p,
+		TLSClientConfig: c,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialCGI(ctx, addr, timeout)
+		},
+		TLSHandshakeTimeout: timeout,
+		IdleConnTimeout:     grpcIdleConnTimeout,
+	}
+}
+
+func (g *grpcProxy) director(r *http.Request) {
+	v := ctxVariables(r.Context())
+	u, _ := parseGRPCURL(g.opts.pass.Value(v))
+	out := &url.URL{Scheme: "http", Host: u.Host, Path: r.URL.Path, RawPath: r.URL.RawPath}
+	if u.Scheme == "grpcs" {
+		out.Scheme = "https"
+	}
+	v.Set(vUpstreamAddr, u.Host)
+	r.URL = out
+	g.headers.request(r, v)
+}
+
+func (g *grpcProxy) roundTrip(r *http.Request) (*http.Response, error) {
+	transport := g.h2c
+	if r.URL.Scheme == "https" {
+		transport = g.tls
+	}
+	d := g.opts.readTimeout.value
+	if d <= 0 {
+		return upstreamRoundTrip(r, transport, g.opts.next)
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	t := &readTimer{d: d, cancel: cancel}
+	t.timer = time.AfterFunc(d, t.expire)
+	res, err := upstreamRoundTrip(r.WithContext(ctx), transport, g.opts.next)
+	if err != nil {
+		t.stop()
+		if t.expired() {
+			return nil, errGRPCTimeout
+		}
+		return nil, err
+	}
+	res.Body = &readTimerBody{ReadCloser: res.Body, t: t}
+	return res, nil
+}
+
+// grpcTimeoutError is returned when the gRPC server does not send anything
+// during grpc_read_timeout.
+type grpcTimeoutError struct{}
+
+func (grpcTimeoutError) Error() string   { return "vince: gRPC server timed out" }
+func (grpcTimeoutError) Timeout() bool   { return true }
+func (grpcTimeoutError) Temporary() bool { return true }
+
+var errGRPCTimeout error = grpcTimeoutError{}
+
+// readTimer cancels a request when it is not reset within d.
+type readTimer struct {
+	d      time.Duration
+	cancel context.CancelFunc
+	timer  *time.Timer
+	mu     sync.Mutex
+	done   bool
+}
+
+func (t *readTimer) expire() {
+	t.mu.Lock()
+	t.done = true
+	t.mu.Unlock()
+	t.cancel()
+}
+
+func (t *readTimer) expired() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done
+}
+
+func (t *readTimer) reset() {
+	t.timer.Reset(t.d)
+}
+
+func (t *readTimer) stop() {
+	t.timer.Stop()
+	t.cancel()
+}
+
+// readTimerBody resets its timer on every read of the response body.
+type readTimerBody struct {
+	io.ReadCloser
+	t *readTimer
+}
+
+func (b *readTimerBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.t.expired() {
+		return n, errGRPCTimeout
+	}
+	if err == io.EOF {
+		b.t.timer.Stop()
+	} else {
+		b.t.reset()
+	}
+	return n, err
+}
+
+func (b *readTimerBody) Close() error {
+	b.t.stop()
+	return b.ReadCloser.Close()
+}
+
+// grpcHTTPStatus maps the status of HTTP responses without grpc-status to
+// gRPC status codes, as done by gRPC clients.
+var grpcHTTPStatus = map[int]int{
+	http.StatusBadRequest:         grpcInternal,
+	http.StatusUnauthorized:       grpcUnauthenticated,
+	http.StatusForbidden:          grpcPermissionDenied,
+	http.StatusNotFound:           grpcUnimplemented,
+	http.StatusTooManyRequests:    grpcUnavailable,
+	http.StatusBadGateway:         grpcUnavailable,
+	http.StatusServiceUnavailable: grpcUnavailable,
+	http.StatusGatewayTimeout:     grpcUnavailable,
+}
+
+// gRPC status codes.
+const (
+	grpcUnknown          = 2
+	grpcDeadlineExceeded = 4
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+func (g *grpcProxy) modifyResponse(res *http.Response) error {
+	g.headers.response(res.Header)
+	if g.opts.interceptErrors.value {
+		// responses with an error page are replaced by the page
+		recordTrailers(res)
+		return nil
+	}
+	passErrorPages(res.Request.Context())
+	if res.StatusCode != http.StatusOK && res.Header.Get("Grpc-Status") == "" {
+		code, ok := grpcHTTPStatus[res.StatusCode]
+		if !ok {
+			code = grpcUnknown
+		}
+		res.Body.Close()
+		res.Body = http.NoBody
+		res.ContentLength = 0
+		res.Header = grpcStatusHeader(code, fmt.Sprintf("upstream responded with status %d", res.StatusCode))
+		res.StatusCode = http.StatusOK
+		res.Status = "200 OK"
+		return nil
+	}
+	recordTrailers(res)
+	return nil
+}
+
+// errorHandler responds with a trailers-only gRPC response, the status is
+// DEADLINE_EXCEEDED for timeouts and UNAVAILABLE otherwise.
+func (g *grpcProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	logError(r.Context(), err.Error())
+	code := grpcUnavailable
+	if isTimeout(err) {
+		code = grpcDeadlineExceeded
+	}
+	h := w.Header()
+	for name, values := range grpcStatusHeader(code, err.Error()) {
+		h[name] = values
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func grpcStatusHeader(code int, msg string) http.Header {
+	return http.Header{
+		"Content-Type": {"application/grpc"},
+		"Grpc-Status":  {strconv.Itoa(code)},
+		"Grpc-Message": {grpcEncodeMessage(msg)},
+	}
+}
+
+// grpcEncodeMessage percent encodes msg as required for grpc-message.
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func (g *grpcProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.opts.pass.set {
+		errorHandler(errors.New("vince: grpc_pass address not set")).ServeHTTP(w, r)
+		return
+	}
+	ctx := r.Context()
+	u, err := parseGRPCURL(g.opts.pass.Value(ctxVariables(ctx)))
+	if err != nil {
+		g.errorHandler(w, r, err)
+		return
+	}
+	if up, ok := g.upstreams[u.Host]; ok {
+		r = r.WithContext(context.WithValue(ctx, upstreamKey{}, up))
+	}
+	g.rev.ServeHTTP(w, r)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGRPCPass(t *testing.T) {
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case "/slow":
+			time.Sleep(time.Second)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		fmt.Fprintf(w, "%s %s tls=%v authority=%s test=%s te=%s body=%s",
+			r.Proto, r.URL.Path, r.TLS != nil, r.Host, r.Header.Get("X-Test"), r.Header.Get("Te"), b)
+		w.Header().Set("Grpc-Status", "0")
+	})
+	h2c := httptest.NewUnstartedServer(app)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	tls := httptest.NewUnstartedServer(app)
+	tls.EnableHTTP2 = true
+	tls.StartTLS()
+	defer tls.Close()
+	// nothing listens on closed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    upstream backend {
+        server %s;
+    }
+    server {
+        listen       127.0.0.1:8107 http2;
+        server_name  localhost;
+        location / {
+            grpc_set_header X-Test $http_x_test-$request_method;
+            grpc_read_timeout 200ms;
+            add_trailer X-Upstream-Status $upstream_trailer_grpc_status;
+            grpc_pass grpc://backend;
+        }
+        location /tls/ {
+            grpc_pass grpcs://%s;
+        }
+        location /closed/ {
+            grpc_pass %s;
+        }
+    }
+}
+`, h2c.Listener.Addr(), tls.Listener.Addr(), closed)
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	client := &http.Client{Transport: &http.Transport{Protocols: h2c.Config.Protocols}}
+	defer client.CloseIdleConnections()
+	host := "http://localhost:8107"
+	post := func(uri string, checks ...httpCheckFn) testKase {
+		return func(ctx context.Context, t *testing.T) {
+			t.Run(uri, func(t *testing.T) {
+				r, _ := http.NewRequest(http.MethodPost, host+uri, strings.NewReader("message"))
+				r.Header.Set("Content-Type", "application/grpc")
+				r.Header.Set("Te", "trailers")
+				r.Header.Set("X-Test", "hello")
+				res, err := client.Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				for _, f := range checks {
+					f(ctx, t, res)
+				}
+			})
+		}
+	}
+	checkTrailer := func(name, value string) httpCheckFn {
+		return func(ctx context.Context, t *testing.T, res *http.Response) {
+			ioutil.ReadAll(res.Body)
+			if got := res.Trailer.Get(name); got != value {
+				t.Errorf("check trailer %q: expected %q got %q", name, value, got)
+			}
+		}
+	}
+	runTest(t, c,
+		post("/echo",
+			checkCode(http.StatusOK),
+			checkBodyString("HTTP/2.0 /echo tls=false authority=localhost test=hello-POST te=trailers body=message"),
+			checkTrailer("Grpc-Status", "0"),
+			checkTrailer("X-Upstream-Status", "0"),
+		),
+		post("/tls/echo",
+			checkBodyString("HTTP/2.0 /tls/echo tls=true authority=localhost test=hello te=trailers body=message"),
+			checkTrailer("Grpc-Status", "0"),
+		),
+		post("/unavailable",
+			checkCode(http.StatusOK),
+			checkHeader("Content-Type", "application/grpc"),
+			checkHeader("Grpc-Status", "14"),
+			checkHeader("Grpc-Message", "upstream responded with status 503"),
+		),
+		post("/slow", checkCode(http.StatusOK), checkHeader("Grpc-Status", "4")),
+		post("/closed/", checkCode(http.StatusOK), checkHeader("Grpc-Status", "14")),
+	)
+}
+
+func TestGRPCEncodeMessage(t *testing.T) {
+	s := grpcEncodeMessage("100% done\nhé")
+	if expect := "100%25 done%0Ah%C3%A9"; s != expect {
+		t.Errorf("expected %q got %q", expect, s)
+	}
+}
+
+func TestGRPCTransports(t *testing.T) {
+	var a, b grpcOption
+	a.defaults()
+	b.defaults()
+	p := &grpcTransportPool{transports: make(map[grpcTransportKey]*http.Transport)}
+	ta, err := p.get(&a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ta.IdleConnTimeout == 0 {
+		t.Error("expected idle connections to expire")
+	}
+	if tb, _ := p.get(&b, false); tb != ta {
+		t.Error("expected locations with the same settings to share a transport")
+	}
+	if tb, _ := p.get(&b, true); tb == ta {
+		t.Error("expected grpcs:// servers to use another transport")
+	}
+	b.connectTimeout.store(time.Second)
+	if tb, _ := p.get(&b, false); tb == ta {
+		t.Error("expected another transport for another grpc_connect_timeout")
+	}
+	p.reset()
+	if tb, _ := p.get(&a, false); tb == ta {
+		t.Error("expected transports to be created again after reset")
+	}
+}
@@ -37,6 +37,19 @@ type httpListenOpts struct {
 	sslOpts sslOptions
 }
 
+// tlsConfig returns the tls configuration of an ssl listener, h2 is offered
+// first with ALPN when the listener has the http2 parameter.
+func (o httpListenOpts) tlsConfig() (*tls.Config, error) {
+	c, err := o.sslOpts.config()
+	if err != nil {
+		return nil, err
+	}
+	if o.http2 {
+		c.NextProtos = append([]string{"h2", "http/1.1"}, c.NextProtos...)
+	}
+	return c, nil
+}
+
 var _ tls.ClientSessionCache = tlsClientCache{}
 
 type tlsClientCache struct{}
@@ -487,7 +500,7 @@ func defaultPort() int {
 	return p
 }
 
-func parseListen(r *rule, defaultPort string) httpListenOpts {
+func parseListen(r *rule, defaultPort string) (httpListenOpts, error) {
 	var ls httpListenOpts
 	if len(r.args) > 0 {
 		a := r.args[0]
@@ -519,6 +532,9 @@ func parseListen(r *rule, defaultPort string) httpListenOpts {
 				}
 			}
 		}
+		if ls.net == "" || ls.addrPort == "" {
+			return ls, fmt.Errorf("vince: invalid listen address %q", a)
+		}
 		if len(r.args) > 1 {
 			for _, a := range r.args[1:] {
 				switch a {
@@ -532,6 +548,11 @@ func parseListen(r *rule, defaultPort string) httpListenOpts {
 					ls.spdy = true
 				case "proxy_protocol":
 					ls.proxyProtocol = true
+				case "udp":
+					// only used by stream servers
+					if ls.net == "tcp" {
+						ls.net = "udp"
+					}
 				}
 			}
 		}
@@ -542,18 +563,16 @@ func parseListen(r *rule, defaultPort string) httpListenOpts {
 		httpRule := serverRule.parent
 		for _, b := range httpRule.children {
 			if err := ls.sslOpts.load(b); err != nil {
-				//TODO: return error?
-				break
+				return ls, b.wrap(err)
 			}
 		}
 		for _, b := range serverRule.children {
 			if err := ls.sslOpts.load(b); err != nil {
-				//TODO: return error?
-				break
+				return ls, b.wrap(err)
 			}
 		}
 	}
-	return ls
+	return ls, nil
 }
 
 type httpCoreConfig struct {
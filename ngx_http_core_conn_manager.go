@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -13,6 +15,8 @@ import (
 
 type (
 	vinceConfigKey struct{}
+	// connKey stores the net.Conn a request was received on.
+	connKey struct{}
 )
 
 type connManager struct {
@@ -24,6 +28,23 @@ type connManager struct {
 type connInfo struct {
 	id    int64
 	state http.ConnState
+
+	mu     sync.Mutex
+	closed bool
+	// onClose are called when the connection is closed.
+	onClose []func()
+}
+
+// close marks the connection as closed and calls onClose functions.
+func (i *connInfo) close() {
+	i.mu.Lock()
+	fns := i.onClose
+	i.onClose = nil
+	i.closed = true
+	i.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
 }
 
 type httpConnStatus struct {
@@ -100,6 +121,7 @@ func (m *connManager) manageConnState(conn net.Conn, state http.ConnState) {
 				m.dec(http.StateNew)
 			}
 			i.state = state
+			i.close()
 		})
 		m.conns.Delete(conn)
 	}
@@ -114,10 +136,70 @@ func (m *connManager) CloseConn(conn net.Conn) {
 			m.dec(s.state)
 			m.dec(http.StateNew)
 			m.conns.Delete(conn)
+			s.close()
 		}
 	}
 }
 
+// OnClose arranges for fn to be called when conn is closed. For hijacked
+// connections this happens when CloseConn is called. fn is called immediately
+// if conn is not managed or already closed.
+func (m *connManager) OnClose(conn net.Conn, fn func()) {
+	if v, ok := m.conns.Load(conn); ok {
+		s := v.(*connInfo)
+		s.mu.Lock()
+		if !s.closed {
+			s.onClose = append(s.onClose, fn)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+	fn()
+}
+
+// hijackWriter reports connections hijacked from it to the connManager, so
+// that closing them is tracked like for connections closed by the server.
+type hijackWriter struct {
+	http.ResponseWriter
+	m        *connManager
+	hijacked bool
+}
+
+func (w *hijackWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("vince: connection does not support hijacking")
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return &hijackedConn{Conn: conn, m: w.m}, rw, nil
+}
+
+// hijackedConn calls CloseConn when closed.
+type hijackedConn struct {
+	net.Conn
+	m    *connManager
+	once sync.Once
+}
+
+func (c *hijackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.m.CloseConn(c.Conn)
+	})
+	return err
+}
+
 func (m *connManager) Close() error {
 	var errs []string
 	m.conns.Range(func(key, value interface{}) bool {
@@ -191,12 +273,14 @@ func (m *connManager) connContext(baseCtx context.Context, conn net.Conn) contex
 		id: reqID,
 	})
 	baseCtx = context.WithValue(baseCtx, requestID{}, reqID)
-	setVariable(baseCtx, vRequestID, reqID)
+	baseCtx = context.WithValue(baseCtx, connKey{}, conn)
 	return baseCtx
 }
 
+// baseCtx returns the context of listener ls. Variables are not stored here,
+// every request gets its own storage.
 func (c *connManager) baseCtx(ctx context.Context, ls net.Listener) context.Context {
-	return context.WithValue(ctx, variables{}, make(map[string]interface{}))
+	return ctx
 }
 
 func (m *connManager) getID(conn net.Conn) int64 {
@@ -205,3 +289,20 @@ func (m *connManager) getID(conn net.Conn) int64 {
 	}
 	return 0
 }
+
+// noResponse closes the connection of r without sending a response, this is
+// what status 444 means. The connection is hijacked through the connManager so
+// that closing it is tracked, when hijacking is not possible like with HTTP/2
+// the handler is aborted instead.
+func noResponse(w http.ResponseWriter, r *http.Request) {
+	if srv, ok := r.Context().Value(serverCtxKey{}).(*serverCtx); ok && srv.http.connManager != nil {
+		w = &hijackWriter{ResponseWriter: w, m: srv.http.connManager}
+	}
+	if h, ok := w.(http.Hijacker); ok {
+		if conn, _, err := h.Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	panic(http.ErrAbortHandler)
+}
@@ -24,7 +24,10 @@ func TestParseListen(t *testing.T) {
 	for _, s := range sample {
 		t.Run(s.args[0], func(ts *testing.T) {
 			stmt.args = s.args
-			o := parseListen(stmt, "8000")
+			o, err := parseListen(stmt, "8000")
+			if err != nil {
+				ts.Fatal(err)
+			}
 			if o.net != s.net {
 				ts.Errorf("net: expected %q got %q", s.net, o.net)
 			}
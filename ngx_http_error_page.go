@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type (
+	// errorPageWriterKey stores the *errorPageWriter of the block serving the
+	// request.
+	errorPageWriterKey struct{}
+	// errorPageStatusKey stores the status of the response that was replaced by
+	// an error page.
+	errorPageStatusKey struct{}
+)
+
+// errorPage is an error_page directive.
+type errorPage struct {
+	codes []int
+	// status is the status of the response sent with the page. 0 keeps the
+	// status of the error and -1 uses the status of the page.
+	status int
+	uri    stringTemplateValue
+}
+
+func newErrorPage(r *rule) (*errorPage, error) {
+	if len(r.args) < 2 {
+		return nil, errors.New("vince: invalid number of arguments in error_page")
+	}
+	p := &errorPage{}
+	codes := r.args[:len(r.args)-1]
+	if last := codes[len(codes)-1]; strings.HasPrefix(last, "=") {
+		codes = codes[:len(codes)-1]
+		p.status = -1
+		if len(last) > 1 {
+			n, err := strconv.Atoi(last[1:])
+			if err != nil || n < 100 || n > 999 {
+				return nil, fmt.Errorf("vince: invalid response code %q", last)
+			}
+			p.status = n
+		}
+	}
+	if len(codes) == 0 {
+		return nil, errors.New("vince: invalid number of arguments in error_page")
+	}
+	for _, a := range codes {
+		n, err := strconv.Atoi(a)
+		if err != nil || n < 300 || n > 599 {
+			return nil, fmt.Errorf("vince: value %q must be between 300 and 599", a)
+		}
+		p.codes = append(p.codes, n)
+	}
+	p.uri.store(r.args[len(r.args)-1])
+	return p, nil
+}
+
+// errorPages are error_page directives used by a block.
+type errorPages struct {
+	pages []*errorPage
+	// recursive is recursive_error_pages, when false requests that were
+	// already redirected to an error page are not redirected again.
+	recursive bool
+}
+
+// compileErrorPages returns the error pages of block. Like nginx error_page
+// directives are inherited from the previous level only if there are none
+// defined on the current level.
+func compileErrorPages(block *rule) (*errorPages, error) {
+	e := &errorPages{}
+	for _, ch := range innermost(block, "error_page") {
+		p, err := newErrorPage(ch)
+		if err != nil {
+			return nil, ch.wrap(err)
+		}
+		e.pages = append(e.pages, p)
+	}
+	for _, ch := range block.collect(nil) {
+		if ch.name == "recursive_error_pages" {
+			e.recursive = ch.args[0] == "on"
+		}
+	}
+	return e, nil
+}
+
+func (e *errorPages) find(code int) *errorPage {
+	for _, p := range e.pages {
+		for _, c := range p.codes {
+			if c == code {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// interceptErrors returns w wrapped so that responses with a status that has
+// an error page in pages are held back, sendErrorPage sends the page once the
+// handler returns. ep is nil when no response is held back.
+func interceptErrors(w http.ResponseWriter, r *http.Request, pages *errorPages) (http.ResponseWriter, *http.Request, *errorPageWriter) {
+	ctx := r.Context()
+	if prev, ok := ctx.Value(errorPageWriterKey{}).(*errorPageWriter); ok {
+		// the request moved to another block, its error pages are used
+		// instead.
+		prev.pass = true
+	}
+	if pages == nil || len(pages.pages) == 0 {
+		return w, r, nil
+	}
+	if _, ok := ctx.Value(errorPageStatusKey{}).(int); ok && !pages.recursive {
+		return w, r, nil
+	}
+	ep := &errorPageWriter{ResponseWriter: w, pages: pages, header: make(http.Header)}
+	return ep, r.WithContext(context.WithValue(ctx, errorPageWriterKey{}, ep)), ep
+}
+
+// passErrorPages sends the response of the request with context ctx as is,
+// even if there is an error page for its status. This is used for responses of
+// upstream servers without proxy_intercept_errors.
+func passErrorPages(ctx context.Context) {
+	if ep, ok := ctx.Value(errorPageWriterKey{}).(*errorPageWriter); ok {
+		ep.pass = true
+	}
+}
+
+// sendErrorPage sends the error page of the response held back by ep to w.
+func sendErrorPage(w http.ResponseWriter, r *http.Request, ep *errorPageWriter) {
+	if ep == nil || ep.page == nil {
+		return
+	}
+	ep.page.send(w, r, ep.code)
+}
+
+// send responds to r with the page for a response with status code.
+func (p *errorPage) send(w http.ResponseWriter, r *http.Request, code int) {
+	ctx := r.Context()
+	uri := p.uri.Value(ctxVariables(ctx))
+	if isRedirectURL(uri) {
+		status := http.StatusFound
+		switch p.status {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			status = p.status
+		}
+		redirect(w, uri, status)
+		return
+	}
+	switch {
+	case p.status == 0:
+		w = &errorStatusWriter{ResponseWriter: w, code: code}
+	case p.status > 0:
+		w = &errorStatusWriter{ResponseWriter: w, code: p.status}
+	}
+	r = r.WithContext(context.WithValue(ctx, errorPageStatusKey{}, code))
+	if strings.HasPrefix(uri, "@") {
+		// like nginx the uri and method are kept for named locations
+		namedRedirect(w, r, uri)
+		return
+	}
+	if r.Method != http.MethodHead {
+		r.Method = http.MethodGet
+	}
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	// arguments of the request are replaced by the ones of uri
+	u := *r.URL
+	u.RawQuery = ""
+	r.URL = &u
+	internalRedirect(w, r, uri)
+}
+
+// errorPageWriter holds back responses with a status that has an error page.
+// Headers are kept apart until the status is known so that the ones set for
+// the error are not sent with the page.
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages  *errorPages
+	header http.Header
+	wrote  bool
+	// pass is true when the response must be sent as is.
+	pass bool
+	page *errorPage
+	code int
+}
+
+func (w *errorPageWriter) Header() http.Header {
+	if w.wrote && w.page == nil {
+		// trailers are set after the header was sent
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *errorPageWriter) WriteHeader(code int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	if !w.pass {
+		if p := w.pages.find(code); p != nil {
+			w.page, w.code = p, code
+			return
+		}
+	}
+	h := w.ResponseWriter.Header()
+	for k, v := range w.header {
+		h[k] = v
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.page != nil {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorPageWriter) Flush() {
+	if w.page != nil {
+		return
+	}
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *errorPageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("vince: connection does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// errorStatusWriter sends the response of an error page with status code.
+type errorStatusWriter struct {
+	http.ResponseWriter
+	code  int
+	wrote bool
+}
+
+func (w *errorStatusWriter) WriteHeader(int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+func (w *errorStatusWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(w.code)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorStatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorPage(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream error", http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    server {
+        listen       127.0.0.1:8102;
+        server_name  localhost;
+        root {{.dir}};
+        error_page 404 /404.html;
+        if ($arg_deny) {
+            return 404;
+        }
+        location / {
+        }
+        location /fallback/ {
+            error_page 500 = @fallback;
+            return 500;
+        }
+        location @fallback {
+            return 200 "fallback $request_method $uri";
+        }
+        location /empty/ {
+            error_page 404 =200 /empty.txt;
+        }
+        location /code/ {
+            error_page 403 = /echo;
+            return 403;
+        }
+        location = /echo {
+            return 201 echo;
+        }
+        location /redirect/ {
+            error_page 403 https://example.com/forbidden;
+            return 403;
+        }
+        location /moved/ {
+            error_page 403 =301 https://example.com$uri;
+            return 403;
+        }
+        location /many/ {
+            error_page 502 503 /50x.html;
+            return 503;
+        }
+        location /upstream/ {
+            error_page 500 /50x.html;
+            proxy_pass %s;
+        }
+        location /intercept/ {
+            error_page 500 /50x.html;
+            proxy_intercept_errors on;
+            proxy_pass %s;
+        }
+        location /recursive/ {
+            error_page 403 = /recursive2/;
+            return 403;
+        }
+        location /recursive2/ {
+            recursive_error_pages on;
+            error_page 404 =200 /empty.txt;
+            return 404;
+        }
+        location /norecursive/ {
+            error_page 403 = /plain/;
+            return 403;
+        }
+        location /plain/ {
+            error_page 404 =200 /empty.txt;
+            return 404 "plain";
+        }
+    }
+}
+`, backend.URL, backend.URL)
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	for k, v := range map[string]string{
+		"404.html":  "not found\n",
+		"50x.html":  "server error\n",
+		"empty.txt": "empty\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(c.dir, k), []byte(v), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host := "http://localhost:8102"
+	runTest(t, c,
+		runHTTP(http.MethodGet, host+"/missing.txt", nil,
+			checkCode(http.StatusNotFound),
+			checkBody(filepath.Join(c.dir, "404.html")),
+		),
+		runHTTP(http.MethodGet, host+"/empty.txt?deny=1", nil,
+			checkCode(http.StatusNotFound),
+			checkBody(filepath.Join(c.dir, "404.html")),
+		),
+		runHTTP(http.MethodPost, host+"/fallback/", strings.NewReader("data"),
+			checkCode(http.StatusOK),
+			checkBodyString("fallback POST /fallback/"),
+		),
+		runHTTP(http.MethodGet, host+"/empty/a.gif", nil,
+			checkCode(http.StatusOK),
+			checkBody(filepath.Join(c.dir, "empty.txt")),
+		),
+		runHTTP(http.MethodGet, host+"/code/", nil, checkCode(http.StatusCreated), checkBodyString("echo")),
+		runRedirect(host+"/redirect/", http.StatusFound, "https://example.com/forbidden"),
+		runRedirect(host+"/moved/a", http.StatusMovedPermanently, "https://example.com/moved/a"),
+		runHTTP(http.MethodGet, host+"/many/", nil,
+			checkCode(http.StatusServiceUnavailable),
+			checkBody(filepath.Join(c.dir, "50x.html")),
+		),
+		runHTTP(http.MethodGet, host+"/upstream/", nil,
+			checkCode(http.StatusInternalServerError),
+			checkBodyString("upstream error\n"),
+		),
+		runHTTP(http.MethodGet, host+"/intercept/", nil,
+			checkCode(http.StatusInternalServerError),
+			checkBody(filepath.Join(c.dir, "50x.html")),
+		),
+		runHTTP(http.MethodGet, host+"/recursive/", nil,
+			checkCode(http.StatusOK),
+			checkBody(filepath.Join(c.dir, "empty.txt")),
+		),
+		runHTTP(http.MethodGet, host+"/norecursive/", nil, checkCode(http.StatusNotFound), checkBodyString("plain")),
+	)
+}
+
+func TestNewErrorPage(t *testing.T) {
+	sample := []struct {
+		args   []string
+		codes  []int
+		status int
+		err    string
+	}{
+		{args: []string{"404", "/404.html"}, codes: []int{404}},
+		{args: []string{"500", "502", "=200", "/50x.html"}, codes: []int{500, 502}, status: 200},
+		{args: []string{"500", "=", "@fallback"}, codes: []int{500}, status: -1},
+		{args: []string{"200", "/ok.html"}, err: `vince: value "200" must be between 300 and 599`},
+		{args: []string{"=200", "/ok.html"}, err: "vince: invalid number of arguments in error_page"},
+		{args: []string{"404", "=x", "/x"}, err: `vince: invalid response code "=x"`},
+	}
+	for _, s := range sample {
+		p, err := newErrorPage(&rule{name: "error_page", args: s.args})
+		if s.err != "" {
+			if err == nil || err.Error() != s.err {
+				t.Errorf("%v: expected error %q got %v", s.args, s.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", s.args, err)
+			continue
+		}
+		if fmt.Sprint(p.codes) != fmt.Sprint(s.codes) || p.status != s.status {
+			t.Errorf("%v: expected %v %d got %v %d", s.args, s.codes, s.status, p.codes, p.status)
+		}
+	}
+}
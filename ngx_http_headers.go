@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headersWriterKey stores the *headersWriter of the block serving the request.
+type headersWriterKey struct{}
+
+// addHeader is an add_header or add_trailer directive.
+type addHeader struct {
+	name  string
+	value stringTemplateValue
+	// always adds the field whatever the status of the response is.
+	always bool
+}
+
+func newAddHeader(r *rule) (*addHeader, error) {
+	if len(r.args) < 2 || len(r.args) > 3 {
+		return nil, fmt.Errorf("vince: invalid number of arguments in %s", r.name)
+	}
+	h := &addHeader{name: http.CanonicalHeaderKey(r.args[0])}
+	if len(r.args) == 3 {
+		if r.args[2] != "always" {
+			return nil, fmt.Errorf("vince: invalid parameter %q", r.args[2])
+		}
+		h.always = true
+	}
+	h.value.store(r.args[1])
+	return h, nil
+}
+
+type expiresKind uint
+
+const (
+	expiresOff expiresKind = iota
+	expiresEpoch
+	expiresMax
+	expiresAccess
+	expiresModified
+	expiresDaily
+)
+
+// expires is the expires directive.
+type expires struct {
+	kind expiresKind
+	// d is the time added to the time of the request or the last
+	// modification, for daily it is the time of the day.
+	d time.Duration
+}
+
+func newExpires(r *rule) (*expires, error) {
+	args := r.args
+	e := &expires{kind: expiresAccess}
+	if len(args) == 2 {
+		if args[0] != "modified" {
+			return nil, fmt.Errorf("vince: invalid value %q", args[0])
+		}
+		e.kind = expiresModified
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return nil, errors.New("vince: invalid number of arguments in expires")
+	}
+	a := args[0]
+	switch {
+	case a == "off" && e.kind == expiresAccess:
+		e.kind = expiresOff
+		return e, nil
+	case a == "epoch" && e.kind == expiresAccess:
+		e.kind = expiresEpoch
+		return e, nil
+	case a == "max" && e.kind == expiresAccess:
+		e.kind = expiresMax
+		return e, nil
+	case strings.HasPrefix(a, "@"):
+		if e.kind == expiresModified {
+			return nil, errors.New("vince: daily time can not be used with \"modified\" parameter")
+		}
+		e.kind = expiresDaily
+		a = a[1:]
+	}
+	neg := strings.HasPrefix(a, "-")
+	d, err := parseDuration(strings.TrimLeft(a, "+-"))
+	if err != nil {
+		return nil, fmt.Errorf("vince: invalid value %q", args[0])
+	}
+	if e.kind == expiresDaily && (neg || d >= 24*time.Hour) {
+		return nil, fmt.Errorf("vince: daily time value %q must be less than 24 hours", args[0])
+	}
+	if neg {
+		d = -d
+	}
+	e.d = d
+	return e, nil
+}
+
+var (
+	expiresEpochTime = time.Unix(1, 0)
+	expiresMaxTime   = time.Date(2037, time.December, 31, 23, 55, 55, 0, time.UTC)
+)
+
+// set adds Expires and Cache-Control fields to h for a response sent at now.
+func (e *expires) set(h http.Header, now time.Time) {
+	now = now.Truncate(time.Second)
+	var at time.Time
+	switch e.kind {
+	case expiresOff:
+		return
+	case expiresEpoch:
+		h.Set("Expires", expiresEpochTime.UTC().Format(http.TimeFormat))
+		h.Set("Cache-Control", "no-cache")
+		return
+	case expiresMax:
+		h.Set("Expires", expiresMaxTime.Format(http.TimeFormat))
+		h.Set("Cache-Control", "max-age=315360000")
+		return
+	case expiresAccess:
+		at = now.Add(e.d)
+	case expiresModified:
+		at = now
+		if m, err := http.ParseTime(h.Get(HeaderLastModified)); err == nil {
+			at = m
+		}
+		at = at.Add(e.d)
+	case expiresDaily:
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		at = day.Add(e.d)
+		if !at.After(now) {
+			at = at.Add(24 * time.Hour)
+		}
+	}
+	h.Set("Expires", at.UTC().Format(http.TimeFormat))
+	age := at.Sub(now)
+	if age < 0 || (e.kind != expiresAccess && age == 0) {
+		h.Set("Cache-Control", "no-cache")
+		return
+	}
+	h.Set("Cache-Control", "max-age="+strconv.FormatInt(int64(age/time.Second), 10))
+}
+
+// responseHeaders are add_header, add_trailer and expires directives used by a
+// block.
+type responseHeaders struct {
+	headers  []*addHeader
+	trailers []*addHeader
+	expires  *expires
+}
+
+// compileResponseHeaders returns response fields added by block. Like nginx
+// add_header and add_trailer directives are inherited from the previous level
+// only if there are none defined on the current level.
+func compileResponseHeaders(block *rule) (*responseHeaders, error) {
+	h := &responseHeaders{}
+	for _, ch := range innermost(block, "add_header") {
+		a, err := newAddHeader(ch)
+		if err != nil {
+			return nil, ch.wrap(err)
+		}
+		h.headers = append(h.headers, a)
+	}
+	for _, ch := range innermost(block, "add_trailer") {
+		a, err := newAddHeader(ch)
+		if err != nil {
+			return nil, ch.wrap(err)
+		}
+		h.trailers = append(h.trailers, a)
+	}
+	for _, ch := range block.collect(nil) {
+		if ch.name == "expires" {
+			e, err := newExpires(ch)
+			if err != nil {
+				return nil, ch.wrap(err)
+			}
+			h.expires = e
+		}
+	}
+	return h, nil
+}
+
+func (h *responseHeaders) empty() bool {
+	return len(h.headers) == 0 && len(h.trailers) == 0 &&
+		(h.expires == nil || h.expires.kind == expiresOff)
+}
+
+// addsHeaders returns true if fields are added to responses with status code
+// without the always parameter.
+func addsHeaders(code int) bool {
+	switch code {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent,
+		http.StatusPartialContent, http.StatusMovedPermanently, http.StatusFound,
+		http.StatusSeeOther, http.StatusNotModified,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// withResponseHeaders returns w wrapped so that fields in h are added to the
+// response. hw is nil when there is nothing to add.
+func withResponseHeaders(w http.ResponseWriter, r *http.Request, h *responseHeaders) (http.ResponseWriter, *http.Request, *headersWriter) {
+	ctx := r.Context()
+	if prev, ok := ctx.Value(headersWriterKey{}).(*headersWriter); ok {
+		// the request moved to another block, only its fields are added.
+		prev.off = true
+	}
+	if h == nil || h.empty() {
+		return w, r, nil
+	}
+	hw := &headersWriter{ResponseWriter: w, h: h, v: ctxVariables(ctx)}
+	return hw, r.WithContext(context.WithValue(ctx, headersWriterKey{}, hw)), hw
+}
+
+// headersWriter adds fields of add_header and expires to the response header
+// and the ones of add_trailer once the handler is done.
+type headersWriter struct {
+	http.ResponseWriter
+	h     *responseHeaders
+	v     *ngxVariables
+	off   bool
+	wrote bool
+	code  int
+}
+
+func (w *headersWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		w.code = code
+		if !w.off {
+			w.header(code)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headersWriter) header(code int) {
+	h := w.Header()
+	ok := addsHeaders(code)
+	if ok && w.h.expires != nil {
+		w.h.expires.set(h, time.Now())
+	}
+	for _, a := range w.h.headers {
+		if !ok && !a.always {
+			continue
+		}
+		if value := a.value.Value(w.v); value != "" {
+			h.Add(a.name, value)
+		}
+	}
+	for _, a := range w.h.trailers {
+		if ok || a.always {
+			h.Add("Trailer", a.name)
+		}
+	}
+}
+
+// finish adds the trailers, it is called when the handler returns.
+func (w *headersWriter) finish() {
+	if w == nil || w.off || !w.wrote {
+		return
+	}
+	ok := addsHeaders(w.code)
+	h := w.Header()
+	for _, a := range w.h.trailers {
+		if !ok && !a.always {
+			continue
+		}
+		if value := a.value.Value(w.v); value != "" {
+			h.Set(http.TrailerPrefix+a.name, value)
+		}
+	}
+}
+
+func (w *headersWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headersWriter) Flush() {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *headersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("vince: connection does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// proxyHeaders are proxy_set_header, proxy_hide_header and proxy_pass_header
+// directives used by a block.
+type proxyHeaders struct {
+	set  []*addHeader
+	hide map[string]bool
+}
+
+// proxyHiddenHeaders are fields of upstream responses that are not passed to
+// the client unless allowed with proxy_pass_header.
+var proxyHiddenHeaders = []string{
+	"Date", "Server", "X-Pad", "X-Accel-Expires", "X-Accel-Redirect",
+	"X-Accel-Limit-Rate", "X-Accel-Buffering", "X-Accel-Charset",
+}
+
+// compileProxyHeaders returns the proxy header configuration of block. Like
+// nginx the default fields set are Host and Connection, the latter is managed
+// by the transport.
+func compileProxyHeaders(block *rule) (*proxyHeaders, error) {
+	return compileUpstreamHeaders(block, "proxy", vProxyHost)
+}
+
+// compileUpstreamHeaders returns the header configuration of block for the
+// directives of protocol, like grpc_set_header for grpc. host is the default
+// value of the Host field.
+func compileUpstreamHeaders(block *rule, protocol, host string) (*proxyHeaders, error) {
+	p := &proxyHeaders{hide: make(map[string]bool)}
+	h := &addHeader{name: "Host"}
+	h.value.store(host)
+	p.set = append(p.set, h)
+	for _, ch := range innermost(block, protocol+"_set_header") {
+		if len(ch.args) != 2 {
+			return nil, ch.wrap(fmt.Errorf("vince: invalid number of arguments in %s", ch.name))
+		}
+		a := &addHeader{name: http.CanonicalHeaderKey(ch.args[0])}
+		a.value.store(ch.args[1])
+		if a.name == "Host" {
+			p.set[0] = a
+			continue
+		}
+		p.set = append(p.set, a)
+	}
+	for _, name := range proxyHiddenHeaders {
+		p.hide[name] = true
+	}
+	for _, ch := range innermost(block, protocol+"_pass_header") {
+		delete(p.hide, http.CanonicalHeaderKey(ch.args[0]))
+	}
+	for _, ch := range innermost(block, protocol+"_hide_header") {
+		p.hide[http.CanonicalHeaderKey(ch.args[0])] = true
+	}
+	return p, nil
+}
+
+// sets returns true if field name is set with proxy_set_header.
+func (p *proxyHeaders) sets(name string) bool {
+	for _, a := range p.set {
+		if a.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// request sets the fields of r, the request sent to the upstream server. Fields
+// with an empty value are removed.
+func (p *proxyHeaders) request(r *http.Request, v *ngxVariables) {
+	for _, a := range p.set {
+		a.request(r, v)
+	}
+}
+
+// field sets field name of r when it is set with proxy_set_header.
+func (p *proxyHeaders) field(r *http.Request, v *ngxVariables, name string) {
+	for _, a := range p.set {
+		if a.name == name {
+			a.request(r, v)
+		}
+	}
+}
+
+func (a *addHeader) request(r *http.Request, v *ngxVariables) {
+	value := a.value.Value(v)
+	switch a.name {
+	case "Host":
+		r.Host = value
+	case "Connection":
+		// hop by hop fields are handled by the transport
+	default:
+		if value == "" {
+			r.Header.Del(a.name)
+			return
+		}
+		r.Header.Set(a.name, value)
+	}
+}
+
+// response removes hidden fields from h, the header of the upstream response.
+func (p *proxyHeaders) response(h http.Header) {
+	for name := range p.hide {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestExpires(t *testing.T) {
+	now := time.Date(2020, time.May, 10, 12, 0, 0, 0, time.UTC)
+	modified := now.Add(-time.Hour).Format(http.TimeFormat)
+	sample := []struct {
+		args                  []string
+		expires, cacheControl string
+	}{
+		{[]string{"1h"}, "Sun, 10 May 2020 13:00:00 GMT", "max-age=3600"},
+		{[]string{"+1d"}, "Mon, 11 May 2020 12:00:00 GMT", "max-age=86400"},
+		{[]string{"-1"}, "Sun, 10 May 2020 11:59:59 GMT", "no-cache"},
+		{[]string{"epoch"}, "Thu, 01 Jan 1970 00:00:01 GMT", "no-cache"},
+		{[]string{"max"}, "Thu, 31 Dec 2037 23:55:55 GMT", "max-age=315360000"},
+		{[]string{"modified", "+2h"}, "Sun, 10 May 2020 13:00:00 GMT", "max-age=3600"},
+		{[]string{"@15h30m"}, "Sun, 10 May 2020 15:30:00 GMT", "max-age=12600"},
+		{[]string{"@6h"}, "Mon, 11 May 2020 06:00:00 GMT", "max-age=64800"},
+		{[]string{"off"}, "", ""},
+	}
+	for _, s := range sample {
+		e, err := newExpires(&rule{name: "expires", args: s.args})
+		if err != nil {
+			t.Errorf("%v: %v", s.args, err)
+			continue
+		}
+		h := make(http.Header)
+		h.Set(HeaderLastModified, modified)
+		e.set(h, now)
+		if got := h.Get("Expires"); got != s.expires {
+			t.Errorf("%v: expected Expires %q got %q", s.args, s.expires, got)
+		}
+		if got := h.Get("Cache-Control"); got != s.cacheControl {
+			t.Errorf("%v: expected Cache-Control %q got %q", s.args, s.cacheControl, got)
+		}
+	}
+	for _, args := range [][]string{{"modified", "epoch"}, {"modified", "@1h"}, {"@25h"}, {"soon"}} {
+		if _, err := newExpires(&rule{name: "expires", args: args}); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Secret", "secret")
+		w.Header().Set("X-Powered-By", "go")
+		fmt.Fprintf(w, "host=%s real=%s xff=%s debug=%s proxy=%s",
+			r.Host, r.Header.Get("X-Real-IP"), r.Header.Get("X-Forwarded-For"),
+			r.Header.Get("X-Debug"), r.Header.Get("X-Proxy"),
+		)
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    server {
+        listen       127.0.0.1:8103;
+        server_name  localhost;
+        add_header X-Server server;
+        location / {
+            return 200 ok;
+        }
+        location /override/ {
+            add_header X-Location $uri;
+            add_header X-Always always always;
+            return 404 missing;
+        }
+        location /expires/ {
+            expires 1h;
+            return 200 ok;
+        }
+        location /trailer/ {
+            add_trailer X-Method $request_method;
+            return 200 ok;
+        }
+        location /proxy/ {
+            proxy_set_header X-Real-IP $remote_addr;
+            proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+            proxy_set_header X-Debug "";
+            proxy_set_header X-Proxy $proxy_host:$proxy_port;
+            proxy_hide_header X-Secret;
+            proxy_pass_header Server;
+            proxy_pass %s;
+        }
+        location /host/ {
+            proxy_set_header Host $host;
+            proxy_pass %s;
+        }
+    }
+}
+`, backend.URL, backend.URL)
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	host := "http://localhost:8103"
+	get := func(uri string, checks ...httpCheckFn) testKase {
+		return func(ctx context.Context, t *testing.T) {
+			t.Run(uri, func(t *testing.T) {
+				r, _ := http.NewRequest(http.MethodGet, host+uri, nil)
+				r.Header.Set("X-Forwarded-For", "10.0.0.1")
+				r.Header.Set("X-Debug", "1")
+				res, err := http.DefaultClient.Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				for _, f := range checks {
+					f(ctx, t, res)
+				}
+			})
+		}
+	}
+	checkTrailer := func(name, value string) httpCheckFn {
+		return func(ctx context.Context, t *testing.T, res *http.Response) {
+			ioutil.ReadAll(res.Body)
+			if got := res.Trailer.Get(name); got != value {
+				t.Errorf("check trailer %q: expected %q got %q", name, value, got)
+			}
+		}
+	}
+	runTest(t, c,
+		get("/", checkCode(http.StatusOK), checkHeader("X-Server", "server")),
+		get("/override/",
+			checkCode(http.StatusNotFound),
+			checkHeader("X-Server", ""),
+			checkHeader("X-Location", ""),
+			checkHeader("X-Always", "always"),
+		),
+		get("/expires/",
+			checkHeader("X-Server", "server"),
+			checkHeader("Cache-Control", "max-age=3600"),
+		),
+		get("/trailer/", checkHeader("X-Server", "server"), checkTrailer("X-Method", "GET")),
+		get("/proxy/",
+			checkCode(http.StatusOK),
+			checkHeader("Server", "backend"),
+			checkHeader("X-Secret", ""),
+			checkHeader("X-Powered-By", "go"),
+			checkBodyString(fmt.Sprintf("host=%s real=127.0.0.1 xff=10.0.0.1, 127.0.0.1 debug= proxy=%s:%s",
+				u.Host, u.Host, u.Port())),
+		),
+		get("/host/",
+			checkHeader("Server", ""),
+			checkHeader("X-Secret", "secret"),
+			checkBodyString("host=localhost real= xff=10.0.0.1, 127.0.0.1 debug=1 proxy="),
+		),
+	)
+}
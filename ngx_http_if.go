@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type ifOperator uint
+
+const (
+	// ifTrue is true when the variable is not empty or "0".
+	ifTrue ifOperator = iota
+	ifEqual
+	ifMatch
+	ifFile
+	ifDir
+	ifExists
+	ifExecutable
+)
+
+// ifCondition is the condition of an if block. Arguments are the ones left by
+// prepareIfArgs, without the enclosing parenthesis.
+type ifCondition struct {
+	op    ifOperator
+	not   bool
+	left  stringTemplateValue
+	right stringTemplateValue
+	re    *regexp.Regexp
+}
+
+var ifFileTests = map[string]ifOperator{
+	"-f": ifFile,
+	"-d": ifDir,
+	"-e": ifExists,
+	"-x": ifExecutable,
+}
+
+func newIfCondition(args []string) (*ifCondition, error) {
+	c := &ifCondition{}
+	switch len(args) {
+	case 1:
+		if !strings.HasPrefix(args[0], "$") {
+			return nil, fmt.Errorf("vince: invalid condition %q", args[0])
+		}
+		c.op = ifTrue
+		c.left.store(args[0])
+	case 2:
+		op := args[0]
+		if strings.HasPrefix(op, "!") {
+			c.not = true
+			op = op[1:]
+		}
+		t, ok := ifFileTests[op]
+		if !ok {
+			return nil, fmt.Errorf("vince: invalid condition %q", strings.Join(args, " "))
+		}
+		c.op = t
+		c.left.store(args[1])
+	case 3:
+		if !strings.HasPrefix(args[0], "$") {
+			return nil, fmt.Errorf("vince: invalid condition %q", args[0])
+		}
+		c.left.store(args[0])
+		switch args[1] {
+		case "=", "!=":
+			c.op = ifEqual
+			c.not = args[1] == "!="
+			c.right.store(args[2])
+		case "~", "~*", "!~", "!~*":
+			c.op = ifMatch
+			c.not = strings.HasPrefix(args[1], "!")
+			expr := args[2]
+			if strings.HasSuffix(args[1], "*") {
+				expr = "(?i)" + expr
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			c.re = re
+		default:
+			return nil, fmt.Errorf("vince: unexpected %q in condition", args[1])
+		}
+	default:
+		return nil, errors.New("vince: invalid number of arguments in if")
+	}
+	return c, nil
+}
+
+// eval returns true if the condition holds for v. Captures of a matching
+// regular expression are stored in v.
+func (c *ifCondition) eval(v *ngxVariables) bool {
+	left := c.left.Value(v)
+	var ok bool
+	switch c.op {
+	case ifTrue:
+		ok = left != "" && left != "0"
+	case ifEqual:
+		ok = left == c.right.Value(v)
+	case ifMatch:
+		sub := c.re.FindStringSubmatch(left)
+		if sub != nil && !c.not {
+			v.setMatch(c.re, sub)
+		}
+		ok = sub != nil
+	default:
+		ok = fileTest(c.op, left)
+	}
+	return ok != c.not
+}
+
+func fileTest(op ifOperator, name string) bool {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	switch op {
+	case ifFile:
+		return fi.Mode().IsRegular()
+	case ifDir:
+		return fi.IsDir()
+	case ifExecutable:
+		return !fi.IsDir() && fi.Mode().Perm()&0111 != 0
+	}
+	return true
+}
+
+// ifLocation returns the configuration used by requests for which the
+// condition of if block r, which is inside a location, is true. Like nginx
+// this is the configuration of the location with directives of the if block
+// replacing the ones with the same name.
+func ifLocation(r *rule) *rule {
+	loc := r.parent
+	n := &rule{
+		parent: loc.parent,
+		name:   loc.name,
+		args:   loc.args,
+		file:   r.file,
+		line:   r.line,
+	}
+	names := make(map[string]bool)
+	for _, ch := range r.children {
+		names[ch.name] = true
+	}
+	for _, ch := range loc.children {
+		switch {
+		case ch.name == "if", ch.name == "location", names[ch.name]:
+		default:
+			n.children = append(n.children, ch)
+		}
+	}
+	for _, ch := range r.children {
+		c := *ch
+		c.parent = n
+		n.children = append(n.children, &c)
+	}
+	return n
+}
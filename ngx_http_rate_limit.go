@@ -1,93 +1,494 @@
 package main
 
 import (
+	"container/list"
+	"context"
 	"errors"
+	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-type limiter interface {
-	take() bool
+// values of $limit_req_status
+const (
+	limitReqPassed         = "PASSED"
+	limitReqDelayed        = "DELAYED"
+	limitReqRejected       = "REJECTED"
+	limitReqDelayedDryRun  = "DELAYED_DRY_RUN"
+	limitReqRejectedDryRun = "REJECTED_DRY_RUN"
+)
+
+// limitReqStateSize is the approximate memory used by the state of one key, it
+// is used to turn zone size into the number of keys a zone can hold.
+const limitReqStateSize = 128
+
+// limitReqZone is a shared memory zone defined by limit_req_zone. It tracks
+// request rate of each key with the leaky bucket algorithm used by nginx.
+type limitReqZone struct {
+	name string
+	key  stringTemplateValue
+	// rate is the number of requests per second.
+	rate float64
+	size int64
+	// sync is true when the zone is shared with other nodes of the cluster.
+	sync bool
+
+	mu     sync.Mutex
+	states map[string]*list.Element
+	lru    *list.List
+	max    int
+	// hits are requests accounted since the last time they were sent to the
+	// cluster.
+	hits map[string]int64
 }
 
-type leaky struct {
-	capacity  int
-	remaining int
-	reset     time.Time
-	rate      time.Duration
-	amount    int
-	mutex     sync.Mutex
+type limitReqState struct {
+	key string
+	// excess is the number of requests above rate that are waiting to leak.
+	excess float64
+	last   time.Time
 }
 
-func (l *leaky) take() bool {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	if time.Now().After(l.reset) {
-		l.reset = time.Now().Add(l.rate)
-		l.remaining = l.capacity
+func newLimitReqZone(r *rule) (*limitReqZone, error) {
+	if len(r.args) < 3 {
+		return nil, errors.New("vince: limit_req_zone requires key, zone and rate")
+	}
+	z := &limitReqZone{}
+	z.key.store(r.args[0])
+	for _, a := range r.args[1:] {
+		switch {
+		case strings.HasPrefix(a, "zone="):
+			name, size, err := parseZone(strings.TrimPrefix(a, "zone="))
+			if err != nil {
+				return nil, err
+			}
+			z.name, z.size = name, size
+		case strings.HasPrefix(a, "rate="):
+			rate, err := parseRate(strings.TrimPrefix(a, "rate="))
+			if err != nil {
+				return nil, err
+			}
+			z.rate = rate
+		case a == "sync":
+			z.sync = true
+		default:
+			return nil, fmt.Errorf("vince: invalid parameter %q", a)
+		}
 	}
-	if l.amount > l.remaining {
-		return false
+	if z.name == "" {
+		return nil, errors.New("vince: limit_req_zone requires zone")
 	}
-	l.remaining -= l.amount
-	return true
+	if z.rate == 0 {
+		return nil, errors.New("vince: limit_req_zone requires rate")
+	}
+	z.init()
+	return z, nil
 }
 
-type limitReqOpts struct {
-	key  string
-	zone string
-	rate int
+func (z *limitReqZone) init() {
+	z.states = make(map[string]*list.Element)
+	z.hits = make(map[string]int64)
+	z.lru = list.New()
+	z.max = int(z.size / limitReqStateSize)
+	if z.max < 1 {
+		z.max = 1
+	}
 }
 
-type rateLimiterManager struct {
-	zones *sync.Map
+// parseZone parses zone=name:size parameters.
+func parseZone(s string) (string, int64, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("vince: invalid zone size %q", s)
+	}
+	size, err := parseSize(s[i+1:])
+	if err != nil {
+		return "", 0, err
+	}
+	if size == 0 {
+		return "", 0, fmt.Errorf("vince: zone %q is too small", s[:i])
+	}
+	return s[:i], size, nil
 }
 
-func newRateManager() *rateLimiterManager {
-	return &rateLimiterManager{zones: new(sync.Map)}
+// compatible returns true if the state of z can be kept by zone n of a reloaded
+// configuration.
+func (z *limitReqZone) compatible(n *limitReqZone) bool {
+	return z.key.value == n.key.value && z.rate == n.rate && z.size == n.size &&
+		z.sync == n.sync
 }
 
-func (r *rateLimiterManager) setup(key, zone string, rate int) limiter {
-	if z, ok := r.zones.Load(zone); ok {
-		if l, ok := z.(*sync.Map).Load(key); ok {
-			return l.(limiter)
+// take accounts a request for key at now. ok is false when the number of
+// requests above rate is more than burst, in that case nothing is accounted.
+func (z *limitReqZone) take(key string, burst float64, now time.Time) (excess float64, ok bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	s, found := z.state(key, now)
+	if found {
+		// as nginx, the bucket may leak below zero before the request is added
+		if excess = z.leak(s, now) + 1; excess < 0 {
+			excess = 0
 		}
-		lmt := &leaky{
-			capacity:  rate,
-			remaining: rate,
-			reset:     time.Now().Add(time.Second),
-			rate:      time.Second,
+		if excess > burst {
+			return excess, false
 		}
-		z.(*sync.Map).Store(key, lmt)
-		return lmt
 	}
-	z := new(sync.Map)
-	lmt := &leaky{}
-	z.Store(key, lmt)
-	r.zones.Store(zone, z)
-	return lmt
+	s.excess = excess
+	s.last = now
+	if z.sync {
+		z.hits[key]++
+	}
+	return excess, true
 }
 
-// parses rate that is defined in nginx format eg 1r/s 10r/m and return the
-// number of request per second.
-func parseRate(s string) (int, error) {
-	parts := strings.Split(s, "/")
-	if len(parts) != 2 {
-		return 0, errors.New("vince: invalid rate value")
+// state returns the state of key, found is false if a new state was created.
+// The least recently used key is evicted when the zone is full.
+func (z *limitReqZone) state(key string, now time.Time) (s *limitReqState, found bool) {
+	if e, ok := z.states[key]; ok {
+		z.lru.MoveToFront(e)
+		return e.Value.(*limitReqState), true
 	}
-	r := strings.TrimSuffix(parts[0], "r")
-	if parts[1] == "s" {
-		return strconv.Atoi(r)
+	if z.lru.Len() >= z.max {
+		old := z.lru.Back()
+		z.lru.Remove(old)
+		delete(z.states, old.Value.(*limitReqState).key)
 	}
-	duration, err := time.ParseDuration("1" + parts[1])
-	if err != nil {
-		return 0, err
+	s = &limitReqState{key: key, last: now}
+	z.states[key] = z.lru.PushFront(s)
+	return s, false
+}
+
+// leak returns excess of s at now, the result is negative when the bucket
+// leaked more than it held.
+func (z *limitReqZone) leak(s *limitReqState, now time.Time) float64 {
+	elapsed := now.Sub(s.last).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return s.excess - z.rate*elapsed
+}
+
+// merge accounts n requests for key that were accepted by other nodes of the
+// cluster. They are accounted as if they arrived at now.
+func (z *limitReqZone) merge(key string, n int64, now time.Time) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	s, found := z.state(key, now)
+	if found {
+		excess := z.leak(s, now)
+		if excess < 0 {
+			excess = 0
+		}
+		s.excess = excess + float64(n)
+	} else {
+		// the first request of a key is not excess
+		s.excess = float64(n - 1)
+	}
+	s.last = now
+}
+
+// drain returns requests accounted since the last call.
+func (z *limitReqZone) drain() map[string]int64 {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	hits := z.hits
+	z.hits = make(map[string]int64)
+	return hits
+}
+
+// undrain adds back hits that could not be sent to the cluster.
+func (z *limitReqZone) undrain(hits map[string]int64) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for k, n := range hits {
+		z.hits[k] += n
+	}
+}
+
+// refund removes a request accounted by take for key. This is used when the
+// request was rejected by another limit.
+func (z *limitReqZone) refund(key string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if e, ok := z.states[key]; ok {
+		s := e.Value.(*limitReqState)
+		if s.excess -= 1; s.excess < 0 {
+			s.excess = 0
+		}
+	}
+	if z.hits[key] > 0 {
+		if z.hits[key]--; z.hits[key] == 0 {
+			delete(z.hits, key)
+		}
 	}
-	v, err := strconv.Atoi(r)
+}
+
+// collectLimitReqZones returns zones defined with limit_req_zone in the http
+// block. State of compatible zones in old is kept.
+func collectLimitReqZones(core *rule, old map[string]*limitReqZone) (map[string]*limitReqZone, error) {
+	zones := make(map[string]*limitReqZone)
+	for _, base := range core.children {
+		if base.name != "http" {
+			continue
+		}
+		for _, r := range base.children {
+			if r.name != "limit_req_zone" {
+				continue
+			}
+			z, err := newLimitReqZone(r)
+			if err != nil {
+				return nil, r.wrap(err)
+			}
+			if _, ok := zones[z.name]; ok {
+				return nil, r.wrap(fmt.Errorf("vince: duplicate zone %q", z.name))
+			}
+			if o, ok := old[z.name]; ok && o.compatible(z) {
+				z = o
+			}
+			zones[z.name] = z
+		}
+	}
+	return zones, nil
+}
+
+// limitReq is a limit_req directive.
+type limitReq struct {
+	zone  *limitReqZone
+	burst float64
+	// delay is the number of excess requests that are not delayed.
+	delay float64
+}
+
+func parseLimitReq(r *rule, zones map[string]*limitReqZone) (limitReq, error) {
+	var l limitReq
+	nodelay := false
+	delay := int64(-1)
+	for _, a := range r.args {
+		switch {
+		case strings.HasPrefix(a, "zone="):
+			name := strings.TrimPrefix(a, "zone=")
+			z, ok := zones[name]
+			if !ok {
+				return l, fmt.Errorf("vince: unknown limit_req_zone %q", name)
+			}
+			l.zone = z
+		case strings.HasPrefix(a, "burst="):
+			n, err := strconv.ParseInt(strings.TrimPrefix(a, "burst="), 10, 64)
+			if err != nil || n < 0 {
+				return l, fmt.Errorf("vince: invalid burst value %q", a)
+			}
+			l.burst = float64(n)
+		case strings.HasPrefix(a, "delay="):
+			n, err := strconv.ParseInt(strings.TrimPrefix(a, "delay="), 10, 64)
+			if err != nil || n < 0 {
+				return l, fmt.Errorf("vince: invalid delay value %q", a)
+			}
+			delay = n
+		case a == "nodelay":
+			nodelay = true
+		default:
+			return l, fmt.Errorf("vince: invalid parameter %q", a)
+		}
+	}
+	if l.zone == nil {
+		return l, errors.New("vince: limit_req requires zone")
+	}
+	switch {
+	case nodelay:
+		l.delay = l.burst
+	case delay >= 0:
+		l.delay = float64(delay)
+	}
+	return l, nil
+}
+
+type limitReqOption struct {
+	status   intValue
+	logLevel stringValue
+	dryRun   boolValue
+}
+
+func (o *limitReqOption) defaults() {
+	o.status.store(http.StatusServiceUnavailable)
+	o.logLevel.store("error")
+}
+
+func (o *limitReqOption) load(location *rule) error {
+	switch location.name {
+	case "http", "server", "location":
+	default:
+		return nil
+	}
+	if location.parent != nil {
+		if err := o.load(location.parent); err != nil {
+			return err
+		}
+	}
+	for _, v := range location.children {
+		if err := o.loadKey(v); err != nil {
+			return v.wrap(err)
+		}
+	}
+	return nil
+}
+
+func (o *limitReqOption) loadKey(r *rule) error {
+	switch r.name {
+	case "limit_req_status":
+		n, err := strconv.ParseInt(r.args[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		if n < 400 || n > 599 {
+			return fmt.Errorf("vince: value must be between 400 and 599")
+		}
+		o.status.store(n)
+	case "limit_req_log_level":
+		switch r.args[0] {
+		case "info", "notice", "warn", "error":
+			o.logLevel.store(r.args[0])
+		default:
+			return fmt.Errorf("vince: invalid log level %q", r.args[0])
+		}
+	case "limit_req_dry_run":
+		o.dryRun.store(r.args[0] == "on")
+	}
+	return nil
+}
+
+// delayLogLevel is the level used to log delayed requests, it is one level
+// lower than limit_req_log_level.
+func (o *limitReqOption) delayLogLevel() string {
+	switch o.logLevel.value {
+	case "error":
+		return "warn"
+	case "warn":
+		return "notice"
+	default:
+		return "info"
+	}
+}
+
+// limitReqHandler applies all limit_req directives of a configuration level.
+type limitReqHandler struct {
+	limits []limitReq
+	opts   limitReqOption
+}
+
+func newLimitReqHandler(r *rule, zones map[string]*limitReqZone) (*limitReqHandler, error) {
+	h := &limitReqHandler{}
+	h.opts.defaults()
+	if err := h.opts.load(r.parent); err != nil {
+		return nil, err
+	}
+	for _, ch := range r.parent.children {
+		if ch.name != "limit_req" {
+			continue
+		}
+		l, err := parseLimitReq(ch, zones)
+		if err != nil {
+			return nil, ch.wrap(err)
+		}
+		h.limits = append(h.limits, l)
+	}
+	return h, nil
+}
+
+func (h *limitReqHandler) handle(next handler) handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		status, delay, ok := h.limit(ctx, time.Now())
+		setVariable(ctx, vLimitReqStatus, status)
+		if !ok {
+			eRender(w, int(h.opts.status.value))
+			return
+		}
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limit accounts the request against all limits and returns the value of
+// $limit_req_status and how long the request must be delayed.
+func (h *limitReqHandler) limit(ctx context.Context, now time.Time) (string, time.Duration, bool) {
+	data := ctxVariables(ctx)
+	type taken struct {
+		zone *limitReqZone
+		key  string
+	}
+	var accounted []taken
+	var delay time.Duration
+	for _, l := range h.limits {
+		key := l.zone.key.Value(data)
+		if key == "" {
+			// requests with an empty key are not accounted
+			continue
+		}
+		excess, ok := l.zone.take(key, l.burst, now)
+		if !ok {
+			for _, t := range accounted {
+				t.zone.refund(t.key)
+			}
+			errorLog(ctx, h.opts.logLevel.value, fmt.Sprintf(
+				"limiting requests, excess: %.3f by zone %q", excess, l.zone.name,
+			))
+			if h.opts.dryRun.value {
+				return limitReqRejectedDryRun, 0, true
+			}
+			return limitReqRejected, 0, false
+		}
+		accounted = append(accounted, taken{zone: l.zone, key: key})
+		if excess > l.delay {
+			d := time.Duration((excess - l.delay) / l.zone.rate * float64(time.Second))
+			if d > delay {
+				delay = d
+			}
+			errorLog(ctx, h.opts.delayLogLevel(), fmt.Sprintf(
+				"delaying request, excess: %.3f, by zone %q", excess, l.zone.name,
+			))
+		}
+	}
+	switch {
+	case delay == 0:
+		return limitReqPassed, 0, true
+	case h.opts.dryRun.value:
+		return limitReqDelayedDryRun, 0, true
+	default:
+		return limitReqDelayed, delay, true
+	}
+}
+
+// parseRate parses rate that is defined in nginx format eg 1r/s 10r/m and
+// returns the number of requests per second.
+func parseRate(s string) (float64, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || !strings.HasSuffix(parts[0], "r") {
+		return 0, fmt.Errorf("vince: invalid rate %q", s)
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(parts[0], "r"), 10, 64)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("vince: invalid rate %q", s)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("vince: invalid rate %q", s)
+	}
+	switch parts[1] {
+	case "s":
+		return float64(n), nil
+	case "m":
+		return float64(n) / 60, nil
+	default:
+		return 0, fmt.Errorf("vince: invalid rate %q", s)
 	}
-	return int(v / int(duration.Seconds())), nil
 }
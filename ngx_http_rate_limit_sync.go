@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultLimitReqSyncInterval is how often requests accounted by zones with
+// sync are sent to the cluster.
+const defaultLimitReqSyncInterval = time.Second
+
+// limitSync shares limit_req zones with the sync parameter between the nodes of
+// a cluster.
+//
+// Each node accounts requests in its own zone and periodically replicates the
+// number of requests it accepted for every key through raft. Other nodes add
+// them to their zones, so a zone converges to the requests received by the
+// whole cluster. Between two syncs a client can exceed its quota by the requests
+// it sends to other nodes, a shorter limit_req_sync_interval trades more raft
+// traffic for better accuracy.
+type limitSync struct {
+	node string
+	kv   *kv
+
+	mu       sync.Mutex
+	zones    map[string]*limitReqZone
+	interval time.Duration
+}
+
+// limitSyncMessage is the value of limit_req commands.
+type limitSyncMessage struct {
+	Node string
+	Hits map[string]int64
+}
+
+func newLimitSync(node string, store *kv) *limitSync {
+	return &limitSync{
+		node:     node,
+		kv:       store,
+		zones:    make(map[string]*limitReqZone),
+		interval: defaultLimitReqSyncInterval,
+	}
+}
+
+// setZones replaces the zones that are shared, zones without sync are ignored.
+func (s *limitSync) setZones(zones map[string]*limitReqZone, interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones = make(map[string]*limitReqZone)
+	for k, z := range zones {
+		if z.sync {
+			s.zones[k] = z
+		}
+	}
+	s.interval = interval
+}
+
+func (s *limitSync) zone(name string) *limitReqZone {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.zones[name]
+}
+
+// run publishes accounted requests every interval until ctx is done.
+func (s *limitSync) run(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		d := s.interval
+		s.mu.Unlock()
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+			s.publish(ctx)
+		}
+	}
+}
+
+// publish sends requests accounted since the last call to the cluster.
+// Requests that could not be sent are retried on the next call.
+func (s *limitSync) publish(ctx context.Context) {
+	s.mu.Lock()
+	zones := make([]*limitReqZone, 0, len(s.zones))
+	for _, z := range s.zones {
+		zones = append(zones, z)
+	}
+	s.mu.Unlock()
+	for _, z := range zones {
+		hits := z.drain()
+		if len(hits) == 0 {
+			continue
+		}
+		b, err := json.Marshal(limitSyncMessage{Node: s.node, Hits: hits})
+		if err != nil {
+			show(ctx, err)
+			continue
+		}
+		err = s.kv.apply(&command{Op: "limit_req", Key: z.name, Value: string(b)})
+		if err != nil {
+			show(ctx, err)
+			z.undrain(hits)
+		}
+	}
+}
+
+// apply merges requests accepted by another node, this is called by the fsm
+// on every node.
+func (s *limitSync) apply(c *command) error {
+	var m limitSyncMessage
+	if err := json.Unmarshal([]byte(c.Value), &m); err != nil {
+		return err
+	}
+	if m.Node == s.node {
+		// already accounted
+		return nil
+	}
+	z := s.zone(c.Key)
+	if z == nil {
+		return nil
+	}
+	now := time.Now()
+	for k, n := range m.Hits {
+		z.merge(k, n, now)
+	}
+	return nil
+}
+
+// limitReqSyncInterval returns limit_req_sync_interval of the http block.
+func limitReqSyncInterval(core *rule) (time.Duration, error) {
+	d := defaultLimitReqSyncInterval
+	for _, base := range core.children {
+		if base.name != "http" {
+			continue
+		}
+		for _, r := range base.children {
+			if r.name != "limit_req_sync_interval" {
+				continue
+			}
+			v, err := parseDuration(r.args[0])
+			if err != nil {
+				return 0, r.wrap(err)
+			}
+			if v <= 0 {
+				return 0, r.wrap(errors.New("vince: invalid limit_req_sync_interval"))
+			}
+			d = v
+		}
+	}
+	return d, nil
+}
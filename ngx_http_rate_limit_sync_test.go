@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// replicate publishes hits of all nodes and waits until every node applied
+// them.
+func replicate(t *testing.T, nodes []*testNode) {
+	t.Helper()
+	for _, n := range nodes {
+		n.sync.publish(context.Background())
+	}
+	var last uint64
+	for _, n := range nodes {
+		if i := n.raft.LastIndex(); i > last {
+			last = i
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, n := range nodes {
+		for n.raft.AppliedIndex() < last {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %s did not apply index %d", n.id, last)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestLimitReqSync(t *testing.T) {
+	nodes := testCluster(t, 3)
+	defer stopCluster(nodes)
+	now := time.Now()
+	take := func(n *testNode) bool {
+		_, ok := n.zones["one"].take("client", 5, now)
+		return ok
+	}
+	t.Run("synced", func(t *testing.T) {
+		// a client spreading requests over all nodes gets the quota of one
+		// node, the first request and a burst of 5.
+		accepted := 0
+		for i := 0; i < 12; i++ {
+			if take(nodes[i%len(nodes)]) {
+				accepted++
+			}
+			replicate(t, nodes)
+		}
+		if accepted != 6 {
+			t.Errorf("expected 6 requests to be accepted got %d", accepted)
+		}
+	})
+	t.Run("stale", func(t *testing.T) {
+		// between syncs nodes only know about their own requests
+		accepted := 0
+		for i := 0; i < 30; i++ {
+			if _, ok := nodes[i%len(nodes)].zones["one"].take("other", 5, now); ok {
+				accepted++
+			}
+		}
+		if accepted != 18 {
+			t.Errorf("expected every node to accept 6 requests got %d", accepted)
+		}
+		replicate(t, nodes)
+		for _, n := range nodes {
+			if _, ok := n.zones["one"].take("other", 5, now); ok {
+				t.Errorf("expected node %s to reject requests after sync", n.id)
+			}
+		}
+	})
+}
@@ -1,15 +1,22 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
 
 func TestParseRate(t *testing.T) {
 	sample := []struct {
 		r      string
-		expect int
+		expect float64
 	}{
 		{"1r/s", 1},
 		{"300r/m", 5},
 		{"5r/s", 5},
+		{"30r/m", 0.5},
 	}
 	for _, v := range sample {
 		got, err := parseRate(v.r)
@@ -17,7 +24,154 @@ func TestParseRate(t *testing.T) {
 			t.Fatal(err)
 		}
 		if got != v.expect {
-			t.Errorf("%s: expected %d got %d", v.r, v.expect, got)
+			t.Errorf("%s: expected %v got %v", v.r, v.expect, got)
 		}
 	}
+	for _, v := range []string{"0r/s", "1r/h", "1/s", "r/s"} {
+		if _, err := parseRate(v); err == nil {
+			t.Errorf("%s: expected an error", v)
+		}
+	}
+}
+
+func limitReqTestHandler(t *testing.T, zone string, args ...string) *limitReqHandler {
+	t.Helper()
+	z, err := newLimitReqZone(&rule{name: "limit_req_zone", args: []string{"$remote_addr", zone, "rate=10r/s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := &rule{name: "location"}
+	parent.children = append(parent.children, &rule{
+		parent: parent,
+		name:   "limit_req",
+		args:   append([]string{"zone=" + z.name}, args...),
+	})
+	h, err := newLimitReqHandler(parent.children[0], map[string]*limitReqZone{z.name: z})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestLimitReq(t *testing.T) {
+	ctx := context.WithValue(context.Background(), variables{},
+		testVariables(vRemoteAddr, "127.0.0.1"),
+	)
+	type result struct {
+		status string
+		delay  time.Duration
+		ok     bool
+	}
+	check := func(t *testing.T, h *limitReqHandler, now time.Time, expect ...result) {
+		t.Helper()
+		for i, e := range expect {
+			status, delay, ok := h.limit(ctx, now)
+			got := result{status, delay, ok}
+			if got != e {
+				t.Errorf("%d: expected %+v got %+v", i, e, got)
+			}
+		}
+	}
+	now := time.Now()
+	t.Run("no burst", func(t *testing.T) {
+		h := limitReqTestHandler(t, "zone=one:1m")
+		check(t, h, now,
+			result{limitReqPassed, 0, true},
+			result{limitReqRejected, 0, false},
+		)
+		// the bucket leaks at rate
+		check(t, h, now.Add(100*time.Millisecond), result{limitReqPassed, 0, true})
+	})
+	t.Run("burst", func(t *testing.T) {
+		h := limitReqTestHandler(t, "zone=one:1m", "burst=2")
+		check(t, h, now,
+			result{limitReqPassed, 0, true},
+			result{limitReqDelayed, 100 * time.Millisecond, true},
+			result{limitReqDelayed, 200 * time.Millisecond, true},
+			result{limitReqRejected, 0, false},
+		)
+	})
+	t.Run("nodelay", func(t *testing.T) {
+		h := limitReqTestHandler(t, "zone=one:1m", "burst=2", "nodelay")
+		check(t, h, now,
+			result{limitReqPassed, 0, true},
+			result{limitReqPassed, 0, true},
+			result{limitReqPassed, 0, true},
+			result{limitReqRejected, 0, false},
+		)
+	})
+	t.Run("delay", func(t *testing.T) {
+		h := limitReqTestHandler(t, "zone=one:1m", "burst=3", "delay=1")
+		check(t, h, now,
+			result{limitReqPassed, 0, true},
+			result{limitReqPassed, 0, true},
+			result{limitReqDelayed, 100 * time.Millisecond, true},
+			result{limitReqDelayed, 200 * time.Millisecond, true},
+			result{limitReqRejected, 0, false},
+		)
+	})
+	t.Run("dry run", func(t *testing.T) {
+		h := limitReqTestHandler(t, "zone=one:1m", "burst=1")
+		h.opts.dryRun.store(true)
+		check(t, h, now,
+			result{limitReqPassed, 0, true},
+			result{limitReqDelayedDryRun, 0, true},
+			result{limitReqRejectedDryRun, 0, true},
+		)
+	})
+	t.Run("lru", func(t *testing.T) {
+		z, err := newLimitReqZone(&rule{args: []string{"$remote_addr", "zone=small:256", "rate=1r/s"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			z.take(fmt.Sprint(i), 0, now)
+		}
+		if z.lru.Len() != 2 {
+			t.Fatalf("expected zone to hold 2 keys got %d", z.lru.Len())
+		}
+		if _, ok := z.states["0"]; ok {
+			t.Error("expected least recently used key to be evicted")
+		}
+		if _, ok := z.take("0", 0, now); !ok {
+			t.Error("expected evicted key to start with an empty bucket")
+		}
+	})
+}
+
+func TestLimitReqServer(t *testing.T) {
+	file := `daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    limit_req_zone $binary_remote_addr zone=one:1m rate=1r/m;
+    limit_req_zone $binary_remote_addr zone=two:1m rate=1r/m;
+    limit_req_status 429;
+    server {
+        listen       127.0.0.1:8080;
+        limit_req zone=one;
+        location /strict {
+        }
+        location /burst {
+            limit_req zone=two burst=1 nodelay;
+            limit_req_status 503;
+        }
+    }
+}
+`
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	host := "http://127.0.0.1:8080"
+	runTest(t, c,
+		runHTTP(http.MethodGet, host+"/strict", nil, checkCode(http.StatusNotFound)),
+		runHTTP(http.MethodGet, host+"/strict", nil, checkCode(http.StatusTooManyRequests)),
+		// limit_req of the location replaces the one of the server
+		runHTTP(http.MethodGet, host+"/burst", nil, checkCode(http.StatusNotFound)),
+		runHTTP(http.MethodGet, host+"/burst", nil, checkCode(http.StatusNotFound)),
+		runHTTP(http.MethodGet, host+"/burst", nil, checkCode(http.StatusServiceUnavailable)),
+	)
 }
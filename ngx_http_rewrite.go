@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rewriteAction tells the location handler how to continue after the rewrite
+// module directives of a block were executed.
+type rewriteAction uint
+
+const (
+	// rewriteNext continues processing the request in the current location.
+	rewriteNext rewriteAction = iota
+	// rewriteLast searches a location for the changed uri.
+	rewriteLast
+	// rewriteDone means that a response was sent.
+	rewriteDone
+	// rewriteStop stops executing the script, it is only used while the
+	// script runs and is reported as rewriteNext.
+	rewriteStop
+)
+
+type rewriteKind uint
+
+const (
+	rewriteURI rewriteKind = iota
+	rewriteReturn
+	rewriteSet
+	rewriteBreak
+	rewriteIf
+)
+
+// rewriteStep is one of rewrite, return, set, break or if directives.
+type rewriteStep struct {
+	kind rewriteKind
+	rule *rule
+
+	// rewrite
+	re          *regexp.Regexp
+	replacement stringTemplateValue
+	flag        string
+
+	// return
+	code int
+	text stringTemplateValue
+
+	// set
+	name  string
+	value stringTemplateValue
+
+	// if
+	cond     *ifCondition
+	body     rewriteScript
+	location *rule
+}
+
+// rewriteScript is the list of rewrite module directives of a server or
+// location block in the order they are defined. Directives are not inherited
+// by nested blocks.
+type rewriteScript []*rewriteStep
+
+func compileRewrite(block *rule) (rewriteScript, error) {
+	var s rewriteScript
+	for _, ch := range block.children {
+		switch ch.name {
+		case "rewrite", "return", "set", "break", "if":
+			step, err := newRewriteStep(ch)
+			if err != nil {
+				return nil, ch.wrap(err)
+			}
+			s = append(s, step)
+		}
+	}
+	return s, nil
+}
+
+func newRewriteStep(r *rule) (*rewriteStep, error) {
+	s := &rewriteStep{rule: r}
+	switch r.name {
+	case "rewrite":
+		if len(r.args) < 2 || len(r.args) > 3 {
+			return nil, errors.New("vince: invalid number of arguments in rewrite")
+		}
+		s.kind = rewriteURI
+		re, err := regexp.Compile(r.args[0])
+		if err != nil {
+			return nil, err
+		}
+		s.re = re
+		s.replacement.store(r.args[1])
+		if len(r.args) == 3 {
+			switch r.args[2] {
+			case "last", "break", "redirect", "permanent":
+				s.flag = r.args[2]
+			default:
+				return nil, fmt.Errorf("vince: invalid rewrite flag %q", r.args[2])
+			}
+		}
+	case "return":
+		if len(r.args) < 1 || len(r.args) > 2 {
+			return nil, errors.New("vince: invalid number of arguments in return")
+		}
+		s.kind = rewriteReturn
+		code, err := strconv.Atoi(r.args[0])
+		if err != nil {
+			if len(r.args) == 2 || !isRedirectURL(r.args[0]) {
+				return nil, fmt.Errorf("vince: invalid return code %q", r.args[0])
+			}
+			s.code = http.StatusFound
+			s.text.store(r.args[0])
+			return s, nil
+		}
+		if code < 0 || code > 999 {
+			return nil, fmt.Errorf("vince: invalid return code %q", r.args[0])
+		}
+		s.code = code
+		if len(r.args) == 2 {
+			s.text.store(r.args[1])
+		}
+	case "set":
+		if len(r.args) != 2 {
+			return nil, errors.New("vince: invalid number of arguments in set")
+		}
+		if !strings.HasPrefix(r.args[0], "$") || len(r.args[0]) == 1 {
+			return nil, fmt.Errorf("vince: invalid variable name %q", r.args[0])
+		}
+		s.kind = rewriteSet
+		s.name = variableName(r.args[0])
+		s.value.store(r.args[1])
+	case "break":
+		s.kind = rewriteBreak
+	case "if":
+		s.kind = rewriteIf
+		c, err := newIfCondition(r.args)
+		if err != nil {
+			return nil, err
+		}
+		s.cond = c
+		s.body, err = compileRewrite(r)
+		if err != nil {
+			return nil, err
+		}
+		if r.parent != nil && r.parent.name == "location" {
+			s.location = ifLocation(r)
+		}
+	default:
+		return nil, fmt.Errorf("vince: %q is not a rewrite directive", r.name)
+	}
+	return s, nil
+}
+
+// isRedirectURL returns true if replacement of rewrite or the text of return
+// is an absolute url that the client must be redirected to.
+func isRedirectURL(s string) bool {
+	return strings.HasPrefix(s, "http://") ||
+		strings.HasPrefix(s, "https://") ||
+		strings.HasPrefix(s, "$scheme")
+}
+
+// rewriteState is the state of a request going through a script.
+type rewriteState struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	v       *ngxVariables
+	changed bool
+	// location is the configuration of the last if block whose condition
+	// was true.
+	location *rule
+}
+
+// run executes the script for r. The returned request has the uri changed by
+// rewrite directives. The returned rule is not nil when the request must be
+// served with the configuration of an if block.
+func (s rewriteScript) run(w http.ResponseWriter, r *http.Request) (*http.Request, *rule, rewriteAction) {
+	st := &rewriteState{w: w, r: r, v: ctxVariables(r.Context())}
+	action := s.exec(st)
+	switch action {
+	case rewriteStop:
+		action = rewriteNext
+	case rewriteNext:
+		if st.changed {
+			action = rewriteLast
+		}
+	}
+	return st.r, st.location, action
+}
+
+func (s rewriteScript) exec(st *rewriteState) rewriteAction {
+	for _, step := range s {
+		if a := step.exec(st); a != rewriteNext {
+			return a
+		}
+	}
+	return rewriteNext
+}
+
+func (s *rewriteStep) exec(st *rewriteState) rewriteAction {
+	v := st.v
+	switch s.kind {
+	case rewriteURI:
+		sub := s.re.FindStringSubmatch(st.r.URL.Path)
+		if sub == nil {
+			return rewriteNext
+		}
+		v.setMatch(s.re, sub)
+		uri, args := s.target(v, st.r.URL.RawQuery)
+		if s.flag == "redirect" || s.flag == "permanent" ||
+			isRedirectURL(s.replacement.value) {
+			code := http.StatusFound
+			if s.flag == "permanent" {
+				code = http.StatusMovedPermanently
+			}
+			if args != "" {
+				uri += "?" + args
+			}
+			redirect(st.w, uri, code)
+			return rewriteDone
+		}
+		st.r = rewriteRequest(st.r, uri, args)
+		v.setRequest(st.r)
+		switch s.flag {
+		case "last":
+			return rewriteLast
+		case "break":
+			return rewriteStop
+		}
+		st.changed = true
+	case rewriteReturn:
+		s.respond(st.w, st.r, v)
+		return rewriteDone
+	case rewriteSet:
+		v.Set(s.name, s.value.Value(v))
+	case rewriteBreak:
+		return rewriteStop
+	case rewriteIf:
+		if !s.cond.eval(v) {
+			return rewriteNext
+		}
+		if s.location != nil {
+			st.location = s.location
+		}
+		return s.body.exec(st)
+	}
+	return rewriteNext
+}
+
+// target returns the uri and arguments the request is rewritten to. Arguments
+// of the original request are appended unless the replacement ends with ?.
+func (s *rewriteStep) target(v *ngxVariables, orig string) (uri, args string) {
+	uri = s.replacement.Value(v)
+	keep := true
+	if strings.HasSuffix(s.replacement.value, "?") {
+		uri = uri[:len(uri)-1]
+		keep = false
+	}
+	if i := strings.IndexByte(uri, '?'); i != -1 {
+		uri, args = uri[:i], uri[i+1:]
+	}
+	if keep && orig != "" {
+		if args != "" {
+			args += "&"
+		}
+		args += orig
+	}
+	return uri, args
+}
+
+// respond sends the response of return directive.
+func (s *rewriteStep) respond(w http.ResponseWriter, r *http.Request, v *ngxVariables) {
+	if s.code == statusNoResponse {
+		noResponse(w, r)
+		return
+	}
+	switch s.code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		if s.text.set {
+			redirect(w, s.text.Value(v), s.code)
+			return
+		}
+	default:
+		if s.text.set {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(s.code)
+			if r.Method != http.MethodHead {
+				io.WriteString(w, s.text.Value(v))
+			}
+			return
+		}
+	}
+	if s.code >= http.StatusBadRequest {
+		eRender(w, s.code)
+		return
+	}
+	w.WriteHeader(s.code)
+}
+
+func redirect(w http.ResponseWriter, location string, code int) {
+	w.Header().Set("Location", location)
+	eRender(w, code)
+}
+
+// rewriteRequest returns a copy of r with uri and args replaced.
+func rewriteRequest(r *http.Request, uri, args string) *http.Request {
+	u := *r.URL
+	u.Path = uri
+	u.RawPath = ""
+	u.RawQuery = args
+	r = r.WithContext(r.Context())
+	r.URL = &u
+	return r
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	file := `daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    server {
+        listen       127.0.0.1:8100;
+        server_name  localhost;
+        rewrite ^/old/(.*)$ /new/$1 last;
+        location / {
+        }
+        location /new/ {
+            return 200 "new $uri";
+        }
+        location ~ ^/user/(\d+)$ {
+            return 200 "user $1";
+        }
+        location ~ ^/item/(?P<id>\d+)$ {
+            return 200 "item $id";
+        }
+        location /set/ {
+            set $greeting hello;
+            set $who $arg_name;
+            return 200 "$greeting $who";
+        }
+        location /permanent/ {
+            rewrite ^/permanent/(.*)$ /new/$1 permanent;
+        }
+        location /absolute/ {
+            rewrite ^ https://example.com$request_uri;
+        }
+        location /break/ {
+            rewrite ^/break/(.*)$ /$1 break;
+            return 403;
+        }
+        location /flagless/ {
+            rewrite ^/flagless/(.*)$ /new/$1;
+            set $flag none;
+        }
+        location /args/ {
+            rewrite ^ /echo?a=1 last;
+        }
+        location /noargs/ {
+            rewrite ^ /echo?a=1? last;
+        }
+        location = /echo {
+            return 200 $args;
+        }
+        location /loop {
+            rewrite ^ /loop last;
+        }
+        location /close {
+            return 444;
+        }
+    }
+}
+`
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	if err := ioutil.WriteFile(filepath.Join(c.dir, "hello.txt"), []byte("hello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	host := "http://localhost:8100"
+	runTest(t, c,
+		runHTTP(http.MethodGet, host+"/old/a", nil, checkCode(http.StatusOK), checkBodyString("new /new/a")),
+		runHTTP(http.MethodGet, host+"/user/42", nil, checkCode(http.StatusOK), checkBodyString("user 42")),
+		runHTTP(http.MethodGet, host+"/item/7", nil, checkCode(http.StatusOK), checkBodyString("item 7")),
+		runHTTP(http.MethodGet, host+"/set/?name=vince", nil, checkCode(http.StatusOK), checkBodyString("hello vince")),
+		runRedirect(host+"/permanent/a?x=1", http.StatusMovedPermanently, "/new/a?x=1"),
+		runRedirect(host+"/absolute/a", http.StatusFound, "https://example.com/absolute/a"),
+		runHTTP(http.MethodGet, host+"/break/hello.txt", nil,
+			checkCode(http.StatusOK),
+			checkBody(filepath.Join(c.dir, "hello.txt")),
+		),
+		runHTTP(http.MethodGet, host+"/flagless/a", nil, checkCode(http.StatusOK), checkBodyString("new /new/a")),
+		runHTTP(http.MethodGet, host+"/args/?b=2", nil, checkCode(http.StatusOK), checkBodyString("a=1&b=2")),
+		runHTTP(http.MethodGet, host+"/noargs/?b=2", nil, checkCode(http.StatusOK), checkBodyString("a=1")),
+		runHTTP(http.MethodGet, host+"/loop", nil, checkCode(http.StatusInternalServerError)),
+		func(ctx context.Context, t *testing.T) {
+			res, err := http.Get(host + "/close")
+			if err == nil {
+				res.Body.Close()
+				t.Errorf("expected the connection to be closed got %d", res.StatusCode)
+			}
+		},
+	)
+}
+
+func runRedirect(uri string, code int, location string) testKase {
+	return func(ctx context.Context, t *testing.T) {
+		t.Run(uri, func(t *testing.T) {
+			client := &http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			res, err := client.Get(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			checkCode(code)(ctx, t, res)
+			checkHeader("Location", location)(ctx, t, res)
+		})
+	}
+}
+
+func TestIf(t *testing.T) {
+	file := `daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    server {
+        listen       127.0.0.1:8101;
+        server_name  localhost;
+        if ($http_x_block) {
+            return 403;
+        }
+        location / {
+            if (-f $request_filename) {
+                return 200 "file";
+            }
+            if (!-e $request_filename) {
+                return 200 "missing";
+            }
+            if (-d $request_filename) {
+                return 200 "dir";
+            }
+        }
+        location /equal {
+            if ($arg_name = vince) {
+                return 200 "equal";
+            }
+            if ($arg_name != vince) {
+                return 200 "not equal";
+            }
+        }
+        location /match {
+            set $kind none;
+            if ($http_user_agent ~* ^(curl|wget)/(\d+)) {
+                set $kind $1-$2;
+            }
+            if ($http_user_agent !~ bot) {
+                return 200 $kind;
+            }
+            return 200 bot;
+        }
+        location /root/ {
+            root {{.dir}}/files;
+            if ($arg_sub) {
+                root {{.dir}}/sub;
+            }
+        }
+    }
+}
+`
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	for _, d := range []string{"sub/root", "files/root"} {
+		if err := os.MkdirAll(filepath.Join(c.dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k, v := range map[string]string{
+		"hello.txt":        "hello\n",
+		"files/root/a.txt": "files\n",
+		"sub/root/a.txt":   "sub\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(c.dir, k), []byte(v), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host := "http://localhost:8101"
+	get := func(uri string, header http.Header, body string) testKase {
+		return func(ctx context.Context, t *testing.T) {
+			t.Run(uri, func(t *testing.T) {
+				r, _ := http.NewRequest(http.MethodGet, host+uri, nil)
+				for k, v := range header {
+					r.Header[k] = v
+				}
+				res, err := http.DefaultClient.Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				checkBodyString(body)(ctx, t, res)
+			})
+		}
+	}
+	ua := func(v string) http.Header {
+		return http.Header{"User-Agent": {v}}
+	}
+	runTest(t, c,
+		get("/hello.txt", nil, "file"),
+		get("/nothing", nil, "missing"),
+		get("/sub", nil, "dir"),
+		get("/equal?name=vince", nil, "equal"),
+		get("/equal?name=other", nil, "not equal"),
+		get("/match", ua("Curl/7"), "Curl-7"),
+		get("/match", ua("browser"), "none"),
+		get("/match", ua("a bot"), "bot"),
+		get("/root/a.txt", nil, "files\n"),
+		get("/root/a.txt?sub=1", nil, "sub\n"),
+		runHTTP(http.MethodGet, host+"/hello.txt", nil, checkCode(http.StatusOK)),
+		func(ctx context.Context, t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, host+"/hello.txt", nil)
+			r.Header.Set("X-Block", "1")
+			res, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			checkCode(http.StatusForbidden)(ctx, t, res)
+		},
+	)
+}
+
+func TestIfDirectives(t *testing.T) {
+	file := `events {
+}
+http {
+    server {
+        location / {
+            if ($arg_a) {
+                limit_req zone=one;
+            }
+            if ($arg_b ~ "(") {
+            }
+            if ($arg_c) {
+                rewrite ^ /c last;
+                proxy_pass http://127.0.0.1:9000;
+            }
+        }
+    }
+}
+`
+	dir, err := ioutil.TempDir("", "vince-if")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "vince.conf")
+	if err := ioutil.WriteFile(name, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfig(name)
+	if err == nil || !strings.Contains(err.Error(), `"limit_req" directive is not allowed here`) {
+		t.Fatalf("expected limit_req to be rejected got %v", err)
+	}
+	// contexts are not checked outside if blocks
+	outside := strings.Replace(file, "location / {", "proxy_pass http://127.0.0.1:9000;\n        location / {", 1)
+	outside = strings.Replace(outside, "limit_req zone=one;", "", 1)
+	if err := ioutil.WriteFile(name, []byte(outside), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(name); err != nil {
+		t.Fatalf("expected proxy_pass in server to be loaded got %v", err)
+	}
+	// remove the directive that is not allowed
+	file = strings.Replace(file, "limit_req zone=one;", "set $a 1;", 1)
+	if err := ioutil.WriteFile(name, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d, err := loadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkConfig(ruleFromStmt(d, nil), 80, false)
+	if err == nil || !strings.HasPrefix(err.Error(), name+":9 ") {
+		t.Fatalf("expected invalid regular expression on line 9 got %v", err)
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// defaultTypes is used when no types block is configured.
+var defaultTypes = map[string]string{
+	"html": "text/html",
+	"gif":  "image/gif",
+	"jpg":  "image/jpeg",
+}
+
+// staticOption are settings for serving files from disk. This covers
+// ngx_http_static_module, ngx_http_index_module, ngx_http_autoindex_module and
+// the parts of ngx_http_core_module that deal with files.
+type staticOption struct {
+	core      httpCoreConfig
+	index     stringSliceValue
+	tryFiles  []*stringTemplateValue
+	autoindex struct {
+		on        boolValue
+		format    stringValue
+		exactSize boolValue
+		localtime boolValue
+	}
+	defaultType stringValue
+	types       map[string]string
+	etag        boolValue
+}
+
+func (o *staticOption) defaults() {
+	o.index.store("index.html")
+	o.autoindex.format.store("html")
+	o.autoindex.exactSize.store(true)
+	o.defaultType.store("text/plain")
+	o.etag.store(true)
+}
+
+func (o *staticOption) load(location *rule) error {
+	switch location.name {
+	case "http", "server", "location": //pass
+	default:
+		return nil
+	}
+	if location.parent != nil {
+		if err := o.load(location.parent); err != nil {
+			return err
+		}
+	}
+	for _, v := range location.children {
+		if err := o.loadKey(v); err != nil {
+			return v.wrap(err)
+		}
+	}
+	return nil
+}
+
+func (o *staticOption) loadKey(r *rule) error {
+	switch r.name {
+	case "root":
+		o.core.alias = stringValue{}
+		return o.core.load(r)
+	case "alias":
+		o.core.root = stringValue{}
+		return o.core.load(r)
+	case "index":
+		o.index = stringSliceValue{}
+		o.index.store(r.args...)
+	case "try_files":
+		if len(r.args) < 2 {
+			return errors.New("vince: invalid number of arguments in try_files")
+		}
+		last := r.args[len(r.args)-1]
+		if strings.HasPrefix(last, "=") {
+			code, err := strconv.Atoi(last[1:])
+			if err != nil || code < 100 || code > 999 {
+				return fmt.Errorf("vince: invalid code %q in try_files", last)
+			}
+		}
+		o.tryFiles = nil
+		for _, a := range r.args {
+			t := new(stringTemplateValue)
+			t.store(a)
+			o.tryFiles = append(o.tryFiles, t)
+		}
+	case "autoindex":
+		o.autoindex.on.store(r.args[0] == "on")
+	case "autoindex_format":
+		switch r.args[0] {
+		case "html", "json", "xml":
+			o.autoindex.format.store(r.args[0])
+		default:
+			return fmt.Errorf("vince: unsupported autoindex_format %q", r.args[0])
+		}
+	case "autoindex_exact_size":
+		o.autoindex.exactSize.store(r.args[0] == "on")
+	case "autoindex_localtime":
+		o.autoindex.localtime.store(r.args[0] == "on")
+	case "default_type":
+		o.defaultType.store(r.args[0])
+	case "etag":
+		o.etag.store(r.args[0] == "on")
+	case "types":
+		// types defined in inner blocks replaces everything inherited.
+		o.types = make(map[string]string)
+		for _, ch := range r.children {
+			for _, ext := range ch.args {
+				o.types[strings.ToLower(ext)] = ch.name
+			}
+		}
+	}
+	return nil
+}
+
+// contentType returns mime type for file name based on its extension.
+func (o *staticOption) contentType(name string) string {
+	types := o.types
+	if types == nil {
+		types = defaultTypes
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if t, ok := types[ext]; ok {
+		return t
+	}
+	return o.defaultType.value
+}
+
+// staticHandler serves files for a location.
+type staticHandler struct {
+	opts  staticOption
+	match *match
+	// prefix is used to resolve relative root and alias paths.
+	prefix string
+	cache  *readWriterCloserCache
+}
+
+// content returns the handler that generates the response for location m
+// when no other handler has done so.
+func (s *serverCtx) content(m *match) handler {
+	h := &staticHandler{match: m, cache: s.fileCache}
+	if s.config != nil {
+		h.prefix = s.config.dir
+	}
+	h.opts.defaults()
+	if err := h.opts.load(m.rule); err != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logError(r.Context(), err.Error())
+			eRender(w, http.StatusInternalServerError)
+		})
+	}
+	return h
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+	default:
+		eRender(w, http.StatusMethodNotAllowed)
+		return
+	}
+	if len(h.opts.tryFiles) > 0 {
+		h.try(w, r)
+		return
+	}
+	h.serve(w, r, r.URL.Path)
+}
+
+// try implements try_files directive.
+func (h *staticHandler) try(w http.ResponseWriter, r *http.Request) {
+	data := ctxVariables(r.Context())
+	files := h.opts.tryFiles
+	for _, f := range files[:len(files)-1] {
+		uri := f.Value(data)
+		dir := strings.HasSuffix(uri, "/")
+		_, name := h.filename(uri)
+		fi, err := os.Stat(name)
+		if err != nil || fi.IsDir() != dir {
+			continue
+		}
+		h.serve(w, r, uri)
+		return
+	}
+	last := files[len(files)-1].Value(data)
+	switch {
+	case strings.HasPrefix(last, "="):
+		code, _ := strconv.Atoi(last[1:])
+		eRender(w, code)
+	case strings.HasPrefix(last, "@"):
+		namedRedirect(w, r, last)
+	default:
+		internalRedirect(w, r, last)
+	}
+}
+
+// filename maps uri to a file on disk, it returns the document root used and
+// the path to the file.
+func (h *staticHandler) filename(uri string) (root, name string) {
+	if h.opts.core.alias.set {
+		alias := h.resolve(h.opts.core.alias.value)
+		switch h.match.kind {
+		case matchExact:
+			return alias, alias
+		case matchRegexp:
+			idx := h.match.re.FindStringSubmatchIndex(uri)
+			if idx == nil {
+				return alias, alias
+			}
+			name = filepath.Clean(string(h.match.re.ExpandString(nil, alias, uri, idx)))
+			if !insideAlias(alias, name) {
+				// captures with .. don't leave the alias directory, the
+				// empty name is not found.
+				return alias, ""
+			}
+			return name, name
+		case matchPrefix, matchCaret:
+			p := strings.TrimPrefix(uri, h.match.prefix())
+			return alias, filepath.Join(alias, filepath.FromSlash(path.Clean("/"+p)))
+		}
+	}
+	root = "html"
+	if h.opts.core.root.set {
+		root = h.opts.core.root.value
+	}
+	root = h.resolve(root)
+	return root, filepath.Join(root, filepath.FromSlash(path.Clean("/"+uri)))
+}
+
+// insideAlias returns true if name, the expansion of alias with captures of a
+// regular expression location, is in the directory of alias before its first
+// variable.
+func insideAlias(alias, name string) bool {
+	i := strings.IndexByte(alias, '$')
+	if i == -1 {
+		return true
+	}
+	dir := alias[:i]
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir = filepath.Dir(dir)
+	}
+	dir = filepath.Clean(dir)
+	return name == dir || strings.HasPrefix(name, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// staticFilename returns the document root and file name for the uri of the
+// request with root or alias of the selected location. This is used by
+// $document_root and $request_filename before the file is served.
+func staticFilename(v *ngxVariables) (root, name string, ok bool) {
+	if v.request == nil || v.match == nil {
+		return "", "", false
+	}
+	var content handler
+	ctx := v.request.Context()
+	if l, ok := ctx.Value(locationHandlerKey{}).(*locationHandler); ok {
+		content = l.handler(v.match).content
+	} else if srv, ok := ctx.Value(serverCtxKey{}).(*serverCtx); ok {
+		content = srv.content(v.match)
+	}
+	h, ok := content.(*staticHandler)
+	if !ok {
+		return "", "", false
+	}
+	root, name = h.filename(v.request.URL.Path)
+	return root, name, true
+}
+
+func (h *staticHandler) resolve(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(h.prefix, p)
+}
+
+func (h *staticHandler) serve(w http.ResponseWriter, r *http.Request, uri string) {
+	root, name := h.filename(uri)
+	variable := ctxVariables(r.Context())
+	variable.Set(vDocumentRoot, root)
+	variable.Set(vRequestFilename, name)
+	fi, err := os.Stat(name)
+	if err != nil {
+		h.error(w, r, err)
+		return
+	}
+	if !fi.IsDir() {
+		h.serveFile(w, r, name, fi)
+		return
+	}
+	if !strings.HasSuffix(uri, "/") {
+		u := uri + "/"
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, u, http.StatusMovedPermanently)
+		return
+	}
+	for _, idx := range h.opts.index.value {
+		if strings.HasPrefix(idx, "/") {
+			internalRedirect(w, r, idx)
+			return
+		}
+		if _, err := os.Stat(filepath.Join(name, idx)); err == nil {
+			internalRedirect(w, r, uri+idx)
+			return
+		}
+	}
+	if h.opts.autoindex.on.value {
+		h.autoindexDir(w, r, name, uri)
+		return
+	}
+	eRender(w, http.StatusForbidden)
+}
+
+func (h *staticHandler) error(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case os.IsNotExist(err):
+		eRender(w, http.StatusNotFound)
+	case os.IsPermission(err):
+		eRender(w, http.StatusForbidden)
+	default:
+		logError(r.Context(), err.Error())
+		eRender(w, http.StatusInternalServerError)
+	}
+}
+
+func (h *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, name string, fi os.FileInfo) {
+	if r.Method == http.MethodPost {
+		eRender(w, http.StatusMethodNotAllowed)
+		return
+	}
+	f, done, err := h.open(name, fi)
+	if err != nil {
+		h.error(w, r, err)
+		return
+	}
+	defer done()
+	if h.opts.etag.value {
+		w.Header().Set("Etag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().Unix(), fi.Size()))
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", h.opts.contentType(name))
+	}
+	http.ServeContent(w, r, "", fi.ModTime(), io.NewSectionReader(f, 0, fi.Size()))
+}
+
+// open returns file name from the open file cache. The cached file is reopened
+// when it no longer matches fi. done must be called once the file is read,
+// until then the cache does not close it.
+func (h *staticHandler) open(name string, fi os.FileInfo) (io.ReaderAt, func(), error) {
+	if h.cache == nil {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { f.Close() }, nil
+	}
+	if v, release, ok := h.cache.Acquire(name); ok {
+		if f, ok := v.(*os.File); ok {
+			if cfi, err := f.Stat(); err == nil && sameFile(cfi, fi) {
+				return f, release, nil
+			}
+		}
+		release()
+	}
+	v, release, err := h.cache.PutAcquire(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, ok := v.(*os.File)
+	if !ok {
+		release()
+		return nil, nil, fmt.Errorf("vince: can't read %s from file cache", name)
+	}
+	return f, release, nil
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+type autoindexEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	MTime string `json:"mtime"`
+	Size  *int64 `json:"size,omitempty"`
+
+	info os.FileInfo
+}
+
+func (h *staticHandler) autoindexDir(w http.ResponseWriter, r *http.Request, name, uri string) {
+	ls, err := ioutil.ReadDir(name)
+	if err != nil {
+		h.error(w, r, err)
+		return
+	}
+	var entries []autoindexEntry
+	for _, fi := range ls {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		e := autoindexEntry{
+			Name:  fi.Name(),
+			Type:  "file",
+			MTime: fi.ModTime().UTC().Format(http.TimeFormat),
+			info:  fi,
+		}
+		if fi.IsDir() {
+			e.Type = "directory"
+		} else {
+			size := fi.Size()
+			e.Size = &size
+		}
+		entries = append(entries, e)
+	}
+	// directories are listed first
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].info.IsDir() && !entries[j].info.IsDir()
+	})
+	switch h.opts.autoindex.format.value {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		if entries == nil {
+			entries = []autoindexEntry{}
+		}
+		json.NewEncoder(w).Encode(entries)
+	case "xml":
+		w.Header().Set("Content-Type", "text/xml")
+		io.WriteString(w, "<?xml version=\"1.0\"?>\n<list>\n")
+		for _, e := range entries {
+			mtime := e.info.ModTime().UTC().Format(time.RFC3339)
+			if e.info.IsDir() {
+				fmt.Fprintf(w, "<directory mtime=%q>", mtime)
+				xml.EscapeText(w, []byte(e.Name))
+				io.WriteString(w, "</directory>\n")
+				continue
+			}
+			fmt.Fprintf(w, "<file mtime=%q size=\"%d\">", mtime, e.info.Size())
+			xml.EscapeText(w, []byte(e.Name))
+			io.WriteString(w, "</file>\n")
+		}
+		io.WriteString(w, "</list>\n")
+	default:
+		w.Header().Set("Content-Type", "text/html")
+		title := html.EscapeString(uri)
+		fmt.Fprintf(w, "<html>\n<head><title>Index of %s</title></head>\n<body>\n<h1>Index of %s</h1><hr><pre><a href=\"../\">../</a>\n", title, title)
+		for _, e := range entries {
+			n := e.Name
+			if e.info.IsDir() {
+				n += "/"
+			}
+			mtime := e.info.ModTime()
+			if !h.opts.autoindex.localtime.value {
+				mtime = mtime.UTC()
+			}
+			size := "-"
+			if !e.info.IsDir() {
+				if h.opts.autoindex.exactSize.value {
+					size = strconv.FormatInt(e.info.Size(), 10)
+				} else {
+					size = bytefmt.ByteSize(uint64(e.info.Size()))
+				}
+			}
+			ref := (&url.URL{Path: n}).EscapedPath()
+			fmt.Fprintf(w, "<a href=\"%s\">%s</a>%s %s %20s\n",
+				html.EscapeString(ref), html.EscapeString(n),
+				strings.Repeat(" ", padding(len(n))),
+				mtime.Format("02-Jan-2006 15:04"), size,
+			)
+		}
+		io.WriteString(w, "</pre><hr></body>\n</html>\n")
+	}
+}
+
+// padding returns number of spaces used to align autoindex columns.
+func padding(n int) int {
+	if n >= 50 {
+		return 1
+	}
+	return 51 - n
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatic(t *testing.T) {
+	file := `daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    include mime.types;
+    server {
+        listen       127.0.0.1:8092;
+        server_name  localhost;
+        location / {
+        }
+        location /alias/ {
+            alias {{.dir}}/files/;
+        }
+        location /list/ {
+            alias {{.dir}}/files/;
+            autoindex on;
+            autoindex_format json;
+        }
+        location /try/ {
+            try_files $uri $uri/ @fallback;
+        }
+        location /status/ {
+            try_files $uri =410;
+        }
+        location /loop/ {
+            try_files $uri /loop/;
+        }
+        location ~ ^/dl/(.*)$ {
+            alias {{.dir}}/files/$1;
+        }
+        location @fallback {
+            try_files /index.html =404;
+        }
+    }
+}
+`
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	files := map[string]string{
+		"index.html":         "root index\n",
+		"style.css":          "body {}\n",
+		"files/hello.txt":    "hello, world\n",
+		"try/index.html":     "try index\n",
+		"try/dir/index.html": "try dir index\n",
+		"secret.txt":         "secret\n",
+	}
+	for k, v := range files {
+		name := filepath.Join(c.dir, k)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(v), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(c.dir, "style.css"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := fmt.Sprintf(`"%x-%x"`, fi.ModTime().Unix(), fi.Size())
+	host := "http://localhost:8092"
+	runTest(t, c,
+		runHTTP(http.MethodGet, host+"/", nil,
+			checkCode(http.StatusOK),
+			checkHeader("Content-Type", "text/html"),
+			checkBody(filepath.Join(c.dir, "index.html")),
+		),
+		runHTTP(http.MethodGet, host+"/style.css", nil,
+			checkCode(http.StatusOK),
+			checkHeader("Content-Type", "text/css"),
+			checkHeader("Etag", etag),
+		),
+		runHTTP(http.MethodPost, host+"/style.css", nil, checkCode(http.StatusMethodNotAllowed)),
+		runHTTP(http.MethodGet, host+"/missing.css", nil, checkCode(http.StatusNotFound)),
+		runHTTP(http.MethodGet, host+"/try", nil,
+			checkCode(http.StatusOK),
+			checkBody(filepath.Join(c.dir, "try/index.html")),
+		),
+		runHTTP(http.MethodGet, host+"/alias/hello.txt", nil,
+			checkCode(http.StatusOK),
+			checkHeader("Content-Type", "text/plain"),
+			checkBody(filepath.Join(c.dir, "files/hello.txt")),
+		),
+		runHTTP(http.MethodGet, host+"/alias/", nil, checkCode(http.StatusForbidden)),
+		runHTTP(http.MethodGet, host+"/dl/hello.txt", nil,
+			checkCode(http.StatusOK),
+			checkBody(filepath.Join(c.dir, "files/hello.txt")),
+		),
+		runRawPath(host, "/dl/../secret.txt", checkCode(http.StatusNotFound)),
+		runRawPath(host, "/dl/%2e%2e/secret.txt", checkCode(http.StatusNotFound)),
+		runHTTP(http.MethodGet, host+"/list/", nil,
+			checkCode(http.StatusOK),
+			checkHeader("Content-Type", "application/json"),
+		),
+		runHTTP(http.MethodGet, host+"/try/dir/", nil,
+			checkCode(http.StatusOK),
+			checkBody(filepath.Join(c.dir, "try/dir/index.html")),
+		),
+		runHTTP(http.MethodGet, host+"/try/nothing", nil,
+			checkCode(http.StatusOK),
+			checkBody(filepath.Join(c.dir, "index.html")),
+		),
+		runHTTP(http.MethodGet, host+"/status/nothing", nil, checkCode(http.StatusGone)),
+		runHTTP(http.MethodGet, host+"/loop/nothing", nil, checkCode(http.StatusInternalServerError)),
+		runStatic(host+"/style.css", "If-None-Match", etag, checkCode(http.StatusNotModified)),
+		runStatic(host+"/style.css", "If-Modified-Since", fi.ModTime().UTC().Format(http.TimeFormat),
+			checkCode(http.StatusNotModified),
+		),
+		runStatic(host+"/style.css", "Range", "bytes=0-3",
+			checkCode(http.StatusPartialContent),
+			checkHeader("Content-Range", fmt.Sprintf("bytes 0-3/%d", fi.Size())),
+		),
+	)
+}
+
+func runStatic(uri, header, value string, checks ...httpCheckFn) testKase {
+	return func(ctx context.Context, t *testing.T) {
+		t.Run(header, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, uri, nil)
+			r.Header.Set(header, value)
+			res, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			for _, f := range checks {
+				f(ctx, t, res)
+			}
+		})
+	}
+}
+
+// runRawPath requests uri as is, without the cleaning done by the client.
+func runRawPath(host, uri string, checks ...httpCheckFn) testKase {
+	return func(ctx context.Context, t *testing.T) {
+		t.Run(uri, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, host, nil)
+			r.URL.Opaque = uri
+			res, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			for _, f := range checks {
+				f(ctx, t, res)
+			}
+		})
+	}
+}
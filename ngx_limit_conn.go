@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// values of $limit_conn_status
+const (
+	limitConnPassed         = "PASSED"
+	limitConnRejected       = "REJECTED"
+	limitConnRejectedDryRun = "REJECTED_DRY_RUN"
+)
+
+// limitConnStateSize is the approximate memory used by the counter of one key.
+const limitConnStateSize = 64
+
+// limitConnZone is a zone defined by limit_conn_zone. It counts connections
+// that are being processed for each key.
+type limitConnZone struct {
+	name string
+	key  stringTemplateValue
+	size int64
+
+	mu    sync.Mutex
+	conns map[string]int64
+	max   int
+}
+
+func newLimitConnZone(r *rule) (*limitConnZone, error) {
+	if len(r.args) != 2 || !strings.HasPrefix(r.args[1], "zone=") {
+		return nil, errors.New("vince: limit_conn_zone requires key and zone")
+	}
+	name, size, err := parseZone(strings.TrimPrefix(r.args[1], "zone="))
+	if err != nil {
+		return nil, err
+	}
+	z := &limitConnZone{name: name, size: size, conns: make(map[string]int64)}
+	z.key.store(r.args[0])
+	z.max = int(size / limitConnStateSize)
+	if z.max < 1 {
+		z.max = 1
+	}
+	return z, nil
+}
+
+// acquire counts a connection for key. This returns false when key already has
+// limit connections or when the zone is full.
+func (z *limitConnZone) acquire(key string, limit int64) bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	n, ok := z.conns[key]
+	if !ok && len(z.conns) >= z.max {
+		return false
+	}
+	if n >= limit {
+		return false
+	}
+	z.conns[key] = n + 1
+	return true
+}
+
+func (z *limitConnZone) release(key string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if n := z.conns[key] - 1; n > 0 {
+		z.conns[key] = n
+	} else {
+		delete(z.conns, key)
+	}
+}
+
+// collectLimitConnZones returns zones defined with limit_conn_zone in the http
+// or stream block. Compatible zones in old are kept so that connections that
+// are still active are counted.
+func collectLimitConnZones(core *rule, block string, old map[string]*limitConnZone) (map[string]*limitConnZone, error) {
+	zones := make(map[string]*limitConnZone)
+	for _, base := range core.children {
+		if base.name != block {
+			continue
+		}
+		for _, r := range base.children {
+			if r.name != "limit_conn_zone" {
+				continue
+			}
+			z, err := newLimitConnZone(r)
+			if err != nil {
+				return nil, r.wrap(err)
+			}
+			if _, ok := zones[z.name]; ok {
+				return nil, r.wrap(fmt.Errorf("vince: duplicate zone %q", z.name))
+			}
+			if o, ok := old[z.name]; ok && o.key.value == z.key.value && o.size == z.size {
+				z = o
+			}
+			zones[z.name] = z
+		}
+	}
+	return zones, nil
+}
+
+// limitConn is a limit_conn directive.
+type limitConn struct {
+	zone  *limitConnZone
+	limit int64
+}
+
+func parseLimitConn(r *rule, zones map[string]*limitConnZone) (limitConn, error) {
+	var l limitConn
+	if len(r.args) != 2 {
+		return l, errors.New("vince: limit_conn requires zone and number")
+	}
+	z, ok := zones[r.args[0]]
+	if !ok {
+		return l, fmt.Errorf("vince: unknown limit_conn_zone %q", r.args[0])
+	}
+	n, err := strconv.ParseInt(r.args[1], 10, 64)
+	if err != nil || n <= 0 {
+		return l, fmt.Errorf("vince: invalid number of connections %q", r.args[1])
+	}
+	return limitConn{zone: z, limit: n}, nil
+}
+
+type limitConnOption struct {
+	status   intValue
+	logLevel stringValue
+	dryRun   boolValue
+}
+
+func (o *limitConnOption) defaults() {
+	o.status.store(http.StatusServiceUnavailable)
+	o.logLevel.store("error")
+}
+
+func (o *limitConnOption) load(r *rule) error {
+	switch r.name {
+	case "http", "server", "location", "stream":
+	default:
+		return nil
+	}
+	if r.parent != nil {
+		if err := o.load(r.parent); err != nil {
+			return err
+		}
+	}
+	for _, v := range r.children {
+		if err := o.loadKey(v); err != nil {
+			return v.wrap(err)
+		}
+	}
+	return nil
+}
+
+func (o *limitConnOption) loadKey(r *rule) error {
+	switch r.name {
+	case "limit_conn_status":
+		n, err := strconv.ParseInt(r.args[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		if n < 400 || n > 599 {
+			return fmt.Errorf("vince: value must be between 400 and 599")
+		}
+		o.status.store(n)
+	case "limit_conn_log_level":
+		switch r.args[0] {
+		case "info", "notice", "warn", "error":
+			o.logLevel.store(r.args[0])
+		default:
+			return fmt.Errorf("vince: invalid log level %q", r.args[0])
+		}
+	case "limit_conn_dry_run":
+		o.dryRun.store(r.args[0] == "on")
+	}
+	return nil
+}
+
+// limitConnHandler applies all limit_conn directives of a configuration level.
+type limitConnHandler struct {
+	limits []limitConn
+	opts   limitConnOption
+}
+
+// newLimitConnHandler returns a handler for limit_conn directives of block.
+// Like nginx directives are inherited from the previous level only if there are
+// none in block.
+func newLimitConnHandler(block *rule, zones map[string]*limitConnZone) (*limitConnHandler, error) {
+	h := &limitConnHandler{}
+	h.opts.defaults()
+	if err := h.opts.load(block); err != nil {
+		return nil, err
+	}
+	for b := block; b != nil && h.limits == nil; b = b.parent {
+		for _, ch := range b.children {
+			if ch.name != "limit_conn" {
+				continue
+			}
+			l, err := parseLimitConn(ch, zones)
+			if err != nil {
+				return nil, ch.wrap(err)
+			}
+			h.limits = append(h.limits, l)
+		}
+	}
+	return h, nil
+}
+
+// acquire counts a connection in all zones. It returns the value of
+// $limit_conn_status and release that must be called when the connection is
+// done. ok is false when the connection must be rejected.
+func (h *limitConnHandler) acquire(ctx context.Context, v *ngxVariables) (status string, release func(), ok bool) {
+	var held []func()
+	release = func() {
+		for _, fn := range held {
+			fn()
+		}
+	}
+	for _, l := range h.limits {
+		key := l.zone.key.Value(v)
+		if key == "" {
+			continue
+		}
+		if !l.zone.acquire(key, l.limit) {
+			errorLog(ctx, h.opts.logLevel.value, fmt.Sprintf(
+				"limiting connections by zone %q", l.zone.name,
+			))
+			release()
+			if h.opts.dryRun.value {
+				return limitConnRejectedDryRun, func() {}, true
+			}
+			return limitConnRejected, func() {}, false
+		}
+		z := l.zone
+		held = append(held, func() { z.release(key) })
+	}
+	return limitConnPassed, release, true
+}
+
+func (h *limitConnHandler) handle(next handler) handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		status, release, ok := h.acquire(ctx, ctxVariables(ctx))
+		setVariable(ctx, vLimitConnStatus, status)
+		if !ok {
+			eRender(w, int(h.opts.status.value))
+			return
+		}
+		srv, _ := ctx.Value(serverCtxKey{}).(*serverCtx)
+		conn, _ := ctx.Value(connKey{}).(net.Conn)
+		if srv == nil || conn == nil {
+			defer release()
+			next.ServeHTTP(w, r)
+			return
+		}
+		hw := &hijackWriter{ResponseWriter: w, m: srv.http.connManager}
+		// deferred so that handlers aborting with a panic release the
+		// connection too.
+		defer func() {
+			if hw.hijacked {
+				// the connection is still in use, it is counted until it
+				// is closed.
+				srv.http.connManager.OnClose(conn, release)
+				return
+			}
+			release()
+		}()
+		next.ServeHTTP(hw, r)
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimitConnZone(t *testing.T) {
+	z, err := newLimitConnZone(&rule{args: []string{"$remote_addr", "zone=addr:128"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &limitConnHandler{limits: []limitConn{{zone: z, limit: 1}}}
+	h.opts.defaults()
+	a := testVariables(vRemoteAddr, "10.0.0.1")
+	b := testVariables(vRemoteAddr, "10.0.0.2")
+	c := testVariables(vRemoteAddr, "10.0.0.3")
+	ctx := context.Background()
+
+	status, release, ok := h.acquire(ctx, a)
+	if !ok || status != limitConnPassed {
+		t.Fatalf("expected first connection to pass got %s", status)
+	}
+	if status, _, ok := h.acquire(ctx, a); ok || status != limitConnRejected {
+		t.Errorf("expected second connection to be rejected got %s", status)
+	}
+	_, releaseB, ok := h.acquire(ctx, b)
+	if !ok {
+		t.Error("expected connection of another key to pass")
+	}
+	// the zone has room for two keys
+	if _, _, ok := h.acquire(ctx, c); ok {
+		t.Error("expected connection to be rejected when the zone is full")
+	}
+	release()
+	releaseB()
+	if len(z.conns) != 0 {
+		t.Errorf("expected released keys to be removed got %v", z.conns)
+	}
+
+	h.opts.dryRun.store(true)
+	_, release, _ = h.acquire(ctx, a)
+	defer release()
+	if status, _, ok := h.acquire(ctx, a); !ok || status != limitConnRejectedDryRun {
+		t.Errorf("expected dry run to pass the connection got %s", status)
+	}
+}
+
+func TestLimitConnAbort(t *testing.T) {
+	z, err := newLimitConnZone(&rule{args: []string{"$remote_addr", "zone=addr:128"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &limitConnHandler{limits: []limitConn{{zone: z, limit: 1}}}
+	h.opts.defaults()
+	client, conn := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+	ctx := context.WithValue(context.Background(), variables{}, testVariables(vRemoteAddr, "10.0.0.1"))
+	ctx = context.WithValue(ctx, serverCtxKey{}, new(serverCtx))
+	ctx = context.WithValue(ctx, connKey{}, conn)
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	aborted := h.handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ReverseProxy aborts like this when the client goes away
+		panic(http.ErrAbortHandler)
+	}))
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if v := recover(); v != http.ErrAbortHandler {
+					t.Fatalf("expected the handler to abort got %v", v)
+				}
+			}()
+			aborted.ServeHTTP(httptest.NewRecorder(), r)
+		}()
+	}
+	if len(z.conns) != 0 {
+		t.Errorf("expected aborted connections to be released got %v", z.conns)
+	}
+}
+
+// upgradeBackend accepts upgrade requests and echoes data on the upgraded
+// connection.
+func upgradeBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+}
+
+// upgrade sends an upgrade request to addr and returns the status code.
+func upgrade(addr, path string) (net.Conn, int, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", path)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	return conn, res.StatusCode, nil
+}
+
+func TestLimitConn(t *testing.T) {
+	backend := upgradeBackend()
+	defer backend.Close()
+	echo := echoBackend(t, "echo")
+	defer echo.Close()
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    limit_conn_zone $binary_remote_addr zone=addr:1m;
+    server {
+        listen       127.0.0.1:8080;
+        location /ws {
+            limit_conn addr 1;
+            limit_conn_status 429;
+            proxy_pass %s;
+        }
+    }
+}
+stream {
+    limit_conn_zone $binary_remote_addr zone=addr:1m;
+    server {
+        listen 127.0.0.1:8095;
+        limit_conn addr 1;
+        proxy_pass %s;
+    }
+}
+`, backend.URL, echo.Addr())
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	runTest(t, c, func(_ context.Context, t *testing.T) {
+		conn, code, err := upgrade("127.0.0.1:8080", "/ws")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusSwitchingProtocols {
+			t.Fatalf("expected %d got %d", http.StatusSwitchingProtocols, code)
+		}
+		// the upgraded connection is counted until it is closed
+		_, code, err = upgrade("127.0.0.1:8080", "/ws")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusTooManyRequests {
+			t.Errorf("expected %d got %d", http.StatusTooManyRequests, code)
+		}
+		conn.Close()
+		time.Sleep(100 * time.Millisecond)
+		conn, code, err = upgrade("127.0.0.1:8080", "/ws")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if code != http.StatusSwitchingProtocols {
+			t.Errorf("expected connection to be released got %d", code)
+		}
+	}, func(_ context.Context, t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:8095")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		fmt.Fprintln(conn, "a")
+		if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "echo:a\n" {
+			t.Fatalf("expected echo:a got %q", line)
+		}
+		if _, err := streamRoundTrip("127.0.0.1:8095", "b"); err == nil {
+			t.Error("expected second session to be closed")
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// limitRateChunk is the largest write done at once by a rate limited writer,
+// smaller writes keep the transfer smooth for high rates.
+const limitRateChunk = 16 << 10
+
+// tokenBucket limits the number of bytes transferred per second. The bucket
+// starts with burst tokens and is refilled with rate tokens per second up to one
+// second worth of data.
+type tokenBucket struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: float64(burst), last: now}
+}
+
+// take removes n tokens from the bucket and returns how long the caller must
+// wait before transferring the n bytes. The bucket can go into debt, which is
+// paid back by the wait.
+func (b *tokenBucket) take(n int64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		refill := elapsed.Seconds() * float64(b.rate)
+		max := float64(b.rate)
+		switch {
+		case b.tokens+refill <= max:
+			b.tokens += refill
+		case b.tokens < max:
+			b.tokens = max
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// wait blocks until n bytes can be transferred. It returns false if done is
+// closed before that.
+func (b *tokenBucket) wait(n int64, done <-chan struct{}) bool {
+	d := b.take(n, time.Now())
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+type limitRateOption struct {
+	rate  intValue
+	after intValue
+}
+
+// load loads limit_rate and limit_rate_after of block r, directives in outer
+// blocks are loaded first.
+func (o *limitRateOption) load(r *rule) error {
+	switch r.name {
+	case "http", "server", "location":
+	default:
+		return nil
+	}
+	if r.parent != nil {
+		if err := o.load(r.parent); err != nil {
+			return err
+		}
+	}
+	for _, v := range r.children {
+		if err := o.loadKey(v); err != nil {
+			return v.wrap(err)
+		}
+	}
+	return nil
+}
+
+func (o *limitRateOption) loadKey(r *rule) error {
+	switch r.name {
+	case "limit_rate":
+		n, err := parseSize(r.args[0])
+		if err != nil {
+			return err
+		}
+		o.rate.store(n)
+	case "limit_rate_after":
+		n, err := parseSize(r.args[0])
+		if err != nil {
+			return err
+		}
+		o.after.store(n)
+	}
+	return nil
+}
+
+// limitRateValue converts the value of $limit_rate to bytes per second.
+func limitRateValue(v string) int64 {
+	n, err := parseSize(v)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// limitRate returns w throttled to the rate in $limit_rate. $limit_rate
+// defaults to the limit_rate of location, a value set with the set directive
+// takes precedence. It is read again on every write so that changing the
+// variable while processing the request applies to the response.
+func limitRate(w http.ResponseWriter, r *http.Request, location *rule) http.ResponseWriter {
+	var o limitRateOption
+	if err := o.load(location); err != nil {
+		logError(r.Context(), err.Error())
+	}
+	if v := ctxVariables(r.Context()); v != nil {
+		v.limitRate = o.rate.value
+	}
+	if lw, ok := w.(*limitRateWriter); ok {
+		// internal redirect, the bytes already sent are kept.
+		lw.after = o.after.value
+		return lw
+	}
+	return &limitRateWriter{ResponseWriter: w, ctx: r.Context(), after: o.after.value}
+}
+
+// limitRateWriter is a http.ResponseWriter that sends the response body at
+// $limit_rate bytes per second once limit_rate_after bytes have been sent.
+type limitRateWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	after  int64
+	sent   int64
+	bucket *tokenBucket
+}
+
+func (w *limitRateWriter) rate() int64 {
+	return limitRateValue(ctxVariables(w.ctx).String(vLimitRate))
+}
+
+func (w *limitRateWriter) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		rate := w.rate()
+		if rate <= 0 {
+			m, err := w.ResponseWriter.Write(b)
+			w.sent += int64(m)
+			return n + m, err
+		}
+		if w.bucket == nil {
+			burst := w.after - w.sent
+			if burst < 0 {
+				burst = 0
+			}
+			w.bucket = newTokenBucket(rate, burst, time.Now())
+		}
+		w.bucket.rate = rate
+		chunk := b
+		if max := int(min64(rate, limitRateChunk)); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		if !w.bucket.wait(int64(len(chunk)), w.ctx.Done()) {
+			return n, w.ctx.Err()
+		}
+		m, err := w.ResponseWriter.Write(chunk)
+		w.sent += int64(m)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return n, nil
+}
+
+func (w *limitRateWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *limitRateWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("vince: connection does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+func (w *limitRateWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(1000, 500, now)
+	if d := b.take(500, now); d != 0 {
+		t.Errorf("expected burst to pass got %v", d)
+	}
+	if d := b.take(500, now); d != 500*time.Millisecond {
+		t.Errorf("expected 500ms got %v", d)
+	}
+	// the debt is paid after 500ms
+	now = now.Add(500 * time.Millisecond)
+	if d := b.take(0, now); d != 0 {
+		t.Errorf("expected no wait got %v", d)
+	}
+	// idle time does not accumulate more than one second of data
+	now = now.Add(10 * time.Second)
+	if d := b.take(2000, now); d != time.Second {
+		t.Errorf("expected 1s got %v", d)
+	}
+}
+
+func TestLimitRateWriter(t *testing.T) {
+	core := testRules(t, `http {
+    limit_rate 2k;
+    server {
+        location / {
+            limit_rate_after 1k;
+        }
+    }
+}`)
+	location := core.children[0].children[1].children[0]
+	v := newVariables()
+	ctx := context.WithValue(context.Background(), variables{}, v)
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	w := limitRate(rec, r, location)
+	if n := limitRateValue(v.String(vLimitRate)); n != 2048 {
+		t.Fatalf("expected $limit_rate to be 2048 got %d", n)
+	}
+	body := bytes.Repeat([]byte("a"), 1024+1024)
+	start := time.Now()
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 900*time.Millisecond {
+		t.Errorf("expected the body to take about 500ms got %v", d)
+	}
+	if rec.Body.Len() != len(body) {
+		t.Errorf("expected %d bytes got %d", len(body), rec.Body.Len())
+	}
+
+	// changing $limit_rate applies to the rest of the response
+	v.Set(vLimitRate, "0")
+	start = time.Now()
+	w.Write(bytes.Repeat([]byte("a"), 8192))
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("expected the response not to be limited got %v", d)
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	file := `daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    server {
+        listen       127.0.0.1:8109;
+        server_name  localhost;
+        limit_rate 1k;
+        add_header X-Limit-Rate $limit_rate;
+        location / {
+        }
+        location /fast/ {
+            set $limit_rate 0;
+        }
+    }
+}
+`
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	body := strings.Repeat("a", 4096)
+	files := map[string]string{
+		"small.txt":      "small",
+		"fast/large.txt": body,
+	}
+	for k, v := range files {
+		name := filepath.Join(c.dir, k)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(v), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	host := "http://127.0.0.1:8109"
+	runTest(t, c,
+		runHTTP(http.MethodGet, host+"/small.txt", nil,
+			checkCode(http.StatusOK), checkHeader("X-Limit-Rate", "1024"),
+		),
+		func(ctx context.Context, t *testing.T) {
+			// set $limit_rate takes precedence over limit_rate
+			start := time.Now()
+			runHTTP(http.MethodGet, host+"/fast/large.txt", nil,
+				checkCode(http.StatusOK), checkHeader("X-Limit-Rate", "0"),
+				checkBodyString(body),
+			)(ctx, t)
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("expected the response not to be limited got %v", d)
+			}
+		},
+	)
+}
+
+func TestProxyConnRate(t *testing.T) {
+	client, local := net.Pipe()
+	remote, backend := net.Pipe()
+	opts := proxyConnOpts{local: connConfig{readRate: 1000}}
+	done := make(chan proxyStats)
+	go func() {
+		stats, _ := proxyConn(context.Background(), opts, local, remote)
+		done <- stats
+	}()
+	start := time.Now()
+	go func() {
+		client.Write(bytes.Repeat([]byte("a"), 1500))
+		client.Close()
+	}()
+	b := make([]byte, 1500)
+	if _, err := io.ReadFull(backend, b); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Errorf("expected upload to be limited got %v", d)
+	}
+	backend.Close()
+	if stats := <-done; stats.localRead != 1500 {
+		t.Errorf("expected 1500 bytes read got %d", stats.localRead)
+	}
+}
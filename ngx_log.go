@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -138,8 +137,23 @@ func logAlert(ctx context.Context, msg string) {
 	errorLog(ctx, "alert", msg)
 }
 
+// logTemplates are log formats compiled on first use.
+type logTemplates struct {
+	m sync.Map
+}
+
+func (l *logTemplates) get(format string) *stringTemplateValue {
+	if v, ok := l.m.Load(format); ok {
+		return v.(*stringTemplateValue)
+	}
+	s := new(stringTemplateValue)
+	s.store(format)
+	v, _ := l.m.LoadOrStore(format, s)
+	return v.(*stringTemplateValue)
+}
+
 func accessLog(next echo.HandlerFunc) echo.HandlerFunc {
-	tpls := make(map[string]*stringTemplateValue)
+	tpls := new(logTemplates)
 	return func(echoCtx echo.Context) error {
 		ctx := echoCtx.Request().Context()
 		dest := ctx.Value(accessLogPathKey{})
@@ -157,35 +171,29 @@ func accessLog(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 		if v := ctx.Value(ngxLoggerKey{}); v != nil {
 			ngx := v.(ngxLogger)
-			start := time.Now()
 			if err := next(echoCtx); err != nil {
 				echoCtx.Error(err)
 			}
-			duration := time.Since(start)
-			m := ctx.Value(variables{}).(map[string]interface{})
-			m[vRequestTime] = duration.Milliseconds()
 			format := defaultLogFormat
 			if f := ctx.Value(accessLogFormat{}); f != nil {
 				format = f.(string)
 			}
-			formatTpl, ok := tpls[format]
-			if !ok {
-				s := new(stringTemplateValue)
-				s.store(format)
-				tpls[format] = s
-				formatTpl = s
-			}
-			ngx.Println(destPath, level, []byte(formatTpl.Value(m)))
+			ngx.Println(destPath, level, []byte(tpls.get(format).Value(ctxVariables(ctx))))
 		}
 		return nil
 	}
 }
 
 func accessLogMiddlewareFunc() func(handler) handler {
-	tpls := make(map[string]*stringTemplateValue)
+	tpls := new(logTemplates)
 	return func(next handler) handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
+			if ctx.Value(internalRedirectKey{}) != nil {
+				// logged by the handler that started the redirect
+				next.ServeHTTP(w, r)
+				return
+			}
 			dest := ctx.Value(accessLogPathKey{})
 			if dest == nil {
 				next.ServeHTTP(w, r)
@@ -202,23 +210,12 @@ func accessLogMiddlewareFunc() func(handler) handler {
 			}
 			if v := ctx.Value(ngxLoggerKey{}); v != nil {
 				ngx := v.(ngxLogger)
-				start := time.Now()
 				next.ServeHTTP(w, r)
-				duration := time.Since(start)
-				m := ctx.Value(variables{}).(map[string]interface{})
-				m[vRequestTime] = duration.Milliseconds()
 				format := defaultLogFormat
 				if f := ctx.Value(accessLogFormat{}); f != nil {
 					format = f.(string)
 				}
-				formatTpl, ok := tpls[format]
-				if !ok {
-					s := new(stringTemplateValue)
-					s.store(format)
-					tpls[format] = s
-					formatTpl = s
-				}
-				ngx.Println(destPath, level, []byte(formatTpl.Value(m)))
+				ngx.Println(destPath, level, []byte(tpls.get(format).Value(ctxVariables(ctx))))
 			}
 		})
 	}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ngxMaps are variables created by map blocks of http or stream, by name
+// without the leading $.
+type ngxMaps map[string]*ngxMap
+
+// ngxMap is a map block. The value of its variable depends on the value of
+// source and is computed the first time the variable is used.
+type ngxMap struct {
+	name      string
+	source    stringTemplateValue
+	hostnames bool
+	volatile  bool
+	def       *stringTemplateValue
+	exact     map[string]*stringTemplateValue
+	wildcards []mapWildcard
+	regexps   []mapRegexp
+}
+
+type mapWildcard struct {
+	pattern string
+	value   *stringTemplateValue
+}
+
+type mapRegexp struct {
+	re    *regexp.Regexp
+	value *stringTemplateValue
+}
+
+func newMap(r *rule) (*ngxMap, error) {
+	if len(r.args) != 2 {
+		return nil, errors.New("vince: invalid number of arguments in map")
+	}
+	if !strings.HasPrefix(r.args[1], "$") || len(r.args[1]) == 1 {
+		return nil, fmt.Errorf("vince: invalid variable name %q", r.args[1])
+	}
+	m := &ngxMap{
+		name:  variableName(r.args[1]),
+		exact: make(map[string]*stringTemplateValue),
+	}
+	m.source.store(r.args[0])
+	for _, ch := range r.children {
+		if err := m.load(ch); err != nil {
+			return nil, ch.wrap(err)
+		}
+	}
+	// like nginx masks at the start are checked before masks at the end and
+	// longer masks first.
+	sort.SliceStable(m.wildcards, func(i, j int) bool {
+		a, b := m.wildcards[i].pattern, m.wildcards[j].pattern
+		if sa, sb := strings.HasPrefix(a, "*"), strings.HasPrefix(b, "*"); sa != sb {
+			return sa
+		}
+		return len(a) > len(b)
+	})
+	return m, nil
+}
+
+// load adds entry r of the map block.
+func (m *ngxMap) load(r *rule) error {
+	switch r.name {
+	case "hostnames":
+		m.hostnames = true
+		return nil
+	case "volatile":
+		m.volatile = true
+		return nil
+	}
+	if len(r.args) != 1 {
+		return fmt.Errorf("vince: invalid number of arguments in map entry %q", r.name)
+	}
+	value := new(stringTemplateValue)
+	value.store(r.args[0])
+	key := r.name
+	switch {
+	case key == "default":
+		m.def = value
+	case strings.HasPrefix(key, "~"):
+		expr := key[1:]
+		if strings.HasPrefix(expr, "*") {
+			expr = "(?i)" + expr[1:]
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		m.regexps = append(m.regexps, mapRegexp{re: re, value: value})
+	default:
+		// a leading \ allows keys that are also keywords like \default
+		key = strings.ToLower(strings.TrimPrefix(key, "\\"))
+		if m.hostnames {
+			if strings.HasPrefix(key, ".") {
+				// .example.com matches example.com and all its sub domains
+				m.addExact(key[1:], value)
+				m.wildcards = append(m.wildcards, mapWildcard{pattern: "*" + key, value: value})
+				return nil
+			}
+			if isWildCard(key) {
+				m.wildcards = append(m.wildcards, mapWildcard{pattern: key, value: value})
+				return nil
+			}
+		}
+		m.addExact(key, value)
+	}
+	return nil
+}
+
+func (m *ngxMap) addExact(key string, value *stringTemplateValue) {
+	if _, ok := m.exact[key]; !ok {
+		m.exact[key] = value
+	}
+}
+
+// value returns the value of the map variable for the request or session with
+// variables v. Captures of a matching regular expression are stored in v.
+func (m *ngxMap) value(v *ngxVariables) string {
+	key := m.source.Value(v)
+	if m.hostnames {
+		key = strings.TrimSuffix(key, ".")
+	}
+	low := strings.ToLower(key)
+	if value, ok := m.exact[low]; ok {
+		return value.Value(v)
+	}
+	for _, w := range m.wildcards {
+		if matchWildCard(low, w.pattern) {
+			return w.value.Value(v)
+		}
+	}
+	for _, e := range m.regexps {
+		if sub := e.re.FindStringSubmatch(key); sub != nil {
+			v.setMatch(e.re, sub)
+			return e.value.Value(v)
+		}
+	}
+	if m.def != nil {
+		return m.def.Value(v)
+	}
+	return ""
+}
+
+// collectMaps returns variables defined with map in the http or stream block.
+func collectMaps(core *rule, block string) (ngxMaps, error) {
+	maps := make(ngxMaps)
+	for _, base := range core.children {
+		if base.name != block {
+			continue
+		}
+		for _, r := range base.children {
+			if r.name != "map" {
+				continue
+			}
+			m, err := newMap(r)
+			if err != nil {
+				return nil, r.wrap(err)
+			}
+			if _, ok := variableDefs[m.name]; ok {
+				return nil, r.wrap(fmt.Errorf("vince: duplicate %q variable", m.name))
+			}
+			if _, ok := maps[m.name]; ok {
+				return nil, r.wrap(fmt.Errorf("vince: duplicate %q variable", m.name))
+			}
+			maps[m.name] = m
+		}
+	}
+	return maps, nil
+}
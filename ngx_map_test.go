@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vince-map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := `api.example.com api;
+static.example.com static;
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "keys.conf"), []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := `events {
+}
+http {
+    map $http_host $backend {
+        hostnames;
+        default default;
+        include keys.conf;
+        example.com main;
+        .example.org org;
+        *.example.com wild;
+        *.b.example.com wild-b;
+        mail.* mail;
+        \default keyword;
+        ~^(?P<name>\w+)\.example\.net$ $name-net;
+        ~*^www\.(.+)$ www-$1;
+    }
+    map $uri $kind {
+        volatile;
+        ~^/img/ image;
+        default other;
+    }
+    map $undefined $empty {
+    }
+    map $loop $loop {
+    }
+}
+stream {
+    map $remote_addr $pool {
+        127.0.0.1 local;
+    }
+}
+`
+	name := filepath.Join(dir, "vince.conf")
+	if err := ioutil.WriteFile(name, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d, err := loadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core := ruleFromStmt(d, nil)
+	maps, err := collectMaps(core, "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := map[string]string{
+		"api.example.com":    "api",
+		"STATIC.example.com": "static",
+		"example.com":        "main",
+		"example.com.":       "main",
+		"example.org":        "org",
+		"a.example.org":      "org",
+		"a.example.com":      "wild",
+		"a.b.example.com":    "wild-b",
+		"mail.example.io":    "mail",
+		"vince.example.net":  "vince-net",
+		"WWW.vince.io":       "www-vince.io",
+		"default":            "keyword",
+		"unknown.io":         "default",
+	}
+	for host, expect := range hosts {
+		v := testVariables("$http_host", host)
+		v.maps = maps
+		if got := v.String("$backend"); got != expect {
+			t.Errorf("%s: expected %q got %q", host, expect, got)
+		}
+	}
+
+	var tpl stringTemplateValue
+	tpl.store("http://$backend")
+	v := testVariables("$http_host", "api.example.com")
+	v.maps = maps
+	if got := tpl.Value(v); got != "http://api" {
+		t.Errorf("expected http://api got %q", got)
+	}
+
+	// values of volatile maps are not kept
+	r, _ := http.NewRequest(http.MethodGet, "/img/a.png", nil)
+	v = newRequestVariables(r)
+	v.maps = maps
+	if got := v.String("$kind"); got != "image" {
+		t.Errorf("expected image got %q", got)
+	}
+	r.URL.Path = "/index.html"
+	v.setRequest(r)
+	if got := v.String("$kind"); got != "other" {
+		t.Errorf("expected other got %q", got)
+	}
+	if s, ok := v.Get("$empty"); !ok || s != "" {
+		t.Errorf("expected empty value got %q %v", s, ok)
+	}
+	if got := v.String("$loop"); got != "" {
+		t.Errorf("expected empty value for a map using itself got %q", got)
+	}
+
+	streamMaps, err := collectMaps(core, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v = testVariables("$remote_addr", "127.0.0.1")
+	v.maps = streamMaps
+	if got := v.String("$pool"); got != "local" {
+		t.Errorf("expected local got %q", got)
+	}
+}
+
+func TestMatchWildCard(t *testing.T) {
+	sample := []struct {
+		name, wild string
+		match      bool
+	}{
+		{"www.example.com", "*.example.com", true},
+		{"a.b.example.com", "*.example.com", true},
+		{"example.com", "*.example.com", false},
+		{"www.example.org", "*.example.com", false},
+		{"mail.example.com", "mail.*", true},
+		{"mail", "mail.*", false},
+		{"www.mail.com", "mail.*", false},
+	}
+	for _, s := range sample {
+		if got := matchWildCard(s.name, s.wild); got != s.match {
+			t.Errorf("%s %s: expected %v got %v", s.name, s.wild, s.match, got)
+		}
+	}
+}
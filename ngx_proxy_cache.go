@@ -0,0 +1,917 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of $upstream_cache_status.
+const (
+	cacheMiss     = "MISS"
+	cacheBypass   = "BYPASS"
+	cacheExpired  = "EXPIRED"
+	cacheStale    = "STALE"
+	cacheUpdating = "UPDATING"
+	cacheHit      = "HIT"
+)
+
+// cacheKeySize is the approximate memory used by the index entry of one key, it
+// is used to turn the size of keys_zone into a number of keys.
+const cacheKeySize = 128
+
+// cacheManagerInterval is the time between two runs of the cache manager.
+var cacheManagerInterval = time.Second
+
+// cacheZone is a cache defined by proxy_cache_path. Responses are stored in
+// files under path, the index of the files is kept in memory and rebuilt from
+// the files when the zone starts.
+type cacheZone struct {
+	name     string
+	path     string
+	levels   []int
+	size     int64
+	maxSize  int64
+	inactive time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	max     int
+	used    int64
+	locks   map[string]*cacheLock
+	cancel  context.CancelFunc
+}
+
+// cacheEntry is the index entry of a cached response.
+type cacheEntry struct {
+	hash   string
+	key    string
+	tags   []string
+	size   int64
+	access time.Time
+}
+
+// cacheLock is held by the request that fetches a response to be cached.
+type cacheLock struct {
+	done chan struct{}
+}
+
+// wait blocks until l is released, ctx is done or timeout elapsed. It returns
+// true if the lock was released.
+func (l *cacheLock) wait(ctx context.Context, timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-l.done:
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// cacheMeta is stored as a json line at the start of cache files, the body of
+// the response follows.
+type cacheMeta struct {
+	Key    string      `json:"key"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	// Valid is the time until which the response is fresh.
+	Valid time.Time `json:"valid"`
+	// Vary are the request fields listed in the Vary header of the response
+	// and their values.
+	Vary map[string]string `json:"vary,omitempty"`
+	// Tags are the values of proxy_cache_tag_header used to purge the
+	// response.
+	Tags []string `json:"tags,omitempty"`
+}
+
+func newCacheZone(r *rule) (*cacheZone, error) {
+	if len(r.args) < 2 {
+		return nil, errors.New("vince: invalid number of arguments in proxy_cache_path")
+	}
+	z := &cacheZone{path: r.args[0], inactive: 10 * time.Minute}
+	for _, a := range r.args[1:] {
+		switch {
+		case strings.HasPrefix(a, "levels="):
+			for _, l := range strings.Split(a[len("levels="):], ":") {
+				n, err := strconv.Atoi(l)
+				if err != nil || n < 1 || n > 2 {
+					return nil, fmt.Errorf("vince: invalid %q", a)
+				}
+				z.levels = append(z.levels, n)
+			}
+			if len(z.levels) > 3 {
+				return nil, fmt.Errorf("vince: invalid %q", a)
+			}
+		case strings.HasPrefix(a, "keys_zone="):
+			name, size, err := parseZone(a[len("keys_zone="):])
+			if err != nil {
+				return nil, err
+			}
+			z.name, z.size = name, size
+		case strings.HasPrefix(a, "inactive="):
+			d, err := parseDuration(a[len("inactive="):])
+			if err != nil {
+				return nil, fmt.Errorf("vince: invalid inactive value %q", a)
+			}
+			z.inactive = d
+		case strings.HasPrefix(a, "max_size="):
+			n, err := parseSize(a[len("max_size="):])
+			if err != nil {
+				return nil, fmt.Errorf("vince: invalid max_size value %q", a)
+			}
+			z.maxSize = n
+		case a == "use_temp_path=on", a == "use_temp_path=off":
+			// temporary files are always written in path
+		default:
+			return nil, fmt.Errorf("vince: invalid parameter %q", a)
+		}
+	}
+	if z.name == "" {
+		return nil, errors.New("vince: proxy_cache_path requires keys_zone")
+	}
+	z.init()
+	return z, nil
+}
+
+func (z *cacheZone) init() {
+	z.entries = make(map[string]*list.Element)
+	z.locks = make(map[string]*cacheLock)
+	z.lru = list.New()
+	z.max = int(z.size / cacheKeySize)
+	if z.max < 1 {
+		z.max = 1
+	}
+}
+
+// compatible returns true if the index of z can be kept by zone n of a reloaded
+// configuration.
+func (z *cacheZone) compatible(n *cacheZone) bool {
+	return z.path == n.path && fmt.Sprint(z.levels) == fmt.Sprint(n.levels) &&
+		z.size == n.size && z.maxSize == n.maxSize && z.inactive == n.inactive
+}
+
+// collectCacheZones returns zones defined with proxy_cache_path in the http
+// block. Compatible zones in old are kept.
+func collectCacheZones(core *rule, old map[string]*cacheZone) (map[string]*cacheZone, error) {
+	zones := make(map[string]*cacheZone)
+	paths := make(map[string]bool)
+	for _, base := range core.children {
+		if base.name != "http" {
+			continue
+		}
+		for _, r := range base.children {
+			if r.name != "proxy_cache_path" {
+				continue
+			}
+			z, err := newCacheZone(r)
+			if err != nil {
+				return nil, r.wrap(err)
+			}
+			if _, ok := zones[z.name]; ok {
+				return nil, r.wrap(fmt.Errorf("vince: duplicate zone %q", z.name))
+			}
+			if paths[z.path] {
+				return nil, r.wrap(fmt.Errorf("vince: duplicate cache path %q", z.path))
+			}
+			paths[z.path] = true
+			if o, ok := old[z.name]; ok && o.compatible(z) {
+				z = o
+			}
+			zones[z.name] = z
+		}
+	}
+	return zones, nil
+}
+
+// startCacheZones starts the loader and manager of zones that are not running.
+// Zones of old that are not in zones are stopped.
+func startCacheZones(ctx context.Context, zones, old map[string]*cacheZone) {
+	for name, z := range old {
+		if zones[name] != z {
+			z.stop()
+		}
+	}
+	for _, z := range zones {
+		z.start(ctx)
+	}
+}
+
+// start loads the index from the files of the zone and runs the cache manager
+// in the background until stop is called or ctx is cancelled.
+func (z *cacheZone) start(ctx context.Context) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.cancel != nil {
+		return
+	}
+	ctx, z.cancel = context.WithCancel(ctx)
+	go z.run(ctx)
+}
+
+func (z *cacheZone) stop() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.cancel != nil {
+		z.cancel()
+		z.cancel = nil
+	}
+}
+
+func (z *cacheZone) run(ctx context.Context) {
+	z.load()
+	t := time.NewTicker(cacheManagerInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			z.manage(now)
+		}
+	}
+}
+
+// load is the cache loader, it adds the files of the zone to the index.
+// Incomplete temporary files are removed.
+func (z *cacheZone) load() {
+	filepath.Walk(z.path, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(name)
+			return nil
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return nil
+		}
+		meta, _, err := readCacheMeta(f)
+		f.Close()
+		hash := filepath.Base(name)
+		if err != nil || cacheHash(meta.Key) != hash || z.filename(hash) != name {
+			return nil
+		}
+		z.mu.Lock()
+		if _, ok := z.entries[hash]; !ok {
+			z.add(&cacheEntry{
+				hash: hash, key: meta.Key, tags: meta.Tags,
+				size: info.Size(), access: info.ModTime(),
+			})
+		}
+		z.mu.Unlock()
+		return nil
+	})
+	z.manage(time.Now())
+}
+
+// manage is the cache manager, it removes entries that were not accessed for
+// inactive and the least recently used ones while the zone uses more than
+// max_size.
+func (z *cacheZone) manage(now time.Time) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for e := z.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if c := e.Value.(*cacheEntry); now.Sub(c.access) >= z.inactive {
+			z.remove(c.hash)
+		}
+		e = prev
+	}
+	for z.maxSize > 0 && z.used > z.maxSize && z.lru.Len() > 0 {
+		z.remove(z.lru.Back().Value.(*cacheEntry).hash)
+	}
+}
+
+// add adds e to the index, the least recently used entry is removed when the
+// zone has no room for more keys. z.mu must be held.
+func (z *cacheZone) add(e *cacheEntry) {
+	if old, ok := z.entries[e.hash]; ok {
+		z.used -= old.Value.(*cacheEntry).size
+		z.lru.Remove(old)
+	}
+	for z.lru.Len() >= z.max {
+		z.remove(z.lru.Back().Value.(*cacheEntry).hash)
+	}
+	z.entries[e.hash] = z.lru.PushFront(e)
+	z.used += e.size
+}
+
+// remove deletes the entry and file of hash. z.mu must be held.
+func (z *cacheZone) remove(hash string) {
+	if e, ok := z.entries[hash]; ok {
+		z.used -= e.Value.(*cacheEntry).size
+		z.lru.Remove(e)
+		delete(z.entries, hash)
+	}
+	os.Remove(z.filename(hash))
+}
+
+// cacheHash returns the name of the cache file of key.
+func cacheHash(key string) string {
+	sum := md5.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// filename returns the path of the cache file of hash. Like nginx directories
+// of levels are named after the last characters of hash.
+func (z *cacheZone) filename(hash string) string {
+	parts := []string{z.path}
+	end := len(hash)
+	for _, l := range z.levels {
+		parts = append(parts, hash[end-l:end])
+		end -= l
+	}
+	return filepath.Join(append(parts, hash)...)
+}
+
+// lock returns the lock of key, owner is true if it was acquired by the caller
+// which must release it with unlock.
+func (z *cacheZone) lock(key string) (l *cacheLock, owner bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if l, ok := z.locks[key]; ok {
+		return l, false
+	}
+	l = &cacheLock{done: make(chan struct{})}
+	z.locks[key] = l
+	return l, true
+}
+
+func (z *cacheZone) unlock(key string, l *cacheLock) {
+	if l == nil {
+		return
+	}
+	z.mu.Lock()
+	if z.locks[key] == l {
+		delete(z.locks, key)
+	}
+	z.mu.Unlock()
+	close(l.done)
+}
+
+func readCacheMeta(f *os.File) (*cacheMeta, int64, error) {
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, 0, err
+	}
+	meta := &cacheMeta{}
+	if err := json.Unmarshal(line, meta); err != nil {
+		return nil, 0, err
+	}
+	return meta, int64(len(line)), nil
+}
+
+// lookup returns the cached response of key for r, it is nil if there is none.
+// fresh is false when the response expired.
+func (z *cacheZone) lookup(key string, r *http.Request, now time.Time) (res *http.Response, fresh bool) {
+	hash := cacheHash(key)
+	z.mu.Lock()
+	e, ok := z.entries[hash]
+	if ok {
+		e.Value.(*cacheEntry).access = now
+		z.lru.MoveToFront(e)
+	}
+	z.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(z.filename(hash))
+	if err != nil {
+		z.mu.Lock()
+		z.remove(hash)
+		z.mu.Unlock()
+		return nil, false
+	}
+	meta, off, err := readCacheMeta(f)
+	if err != nil || meta.Key != key || !meta.matches(r) {
+		f.Close()
+		return nil, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false
+	}
+	size := info.Size() - off
+	res = &http.Response{
+		Status:        fmt.Sprintf("%d %s", meta.Status, http.StatusText(meta.Status)),
+		StatusCode:    meta.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        meta.Header,
+		ContentLength: size,
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(f, off, size), f},
+		Request: r,
+	}
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	return res, now.Before(meta.Valid)
+}
+
+// matches returns true if the fields of r listed in Vary have the values of
+// the request that was cached.
+func (m *cacheMeta) matches(r *http.Request) bool {
+	for name, value := range m.Vary {
+		if strings.Join(r.Header[name], ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// store returns res with a body that writes the response to the cache as it
+// is read. The entry is added once the body was read completely, l is released
+// when the body was read or closed.
+func (z *cacheZone) store(key string, r *http.Request, res *http.Response, valid time.Time, tags []string, l *cacheLock) *http.Response {
+	meta := &cacheMeta{Key: key, Status: res.StatusCode, Header: res.Header.Clone(), Valid: valid, Tags: tags}
+	for _, v := range res.Header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if meta.Vary == nil {
+				meta.Vary = make(map[string]string)
+			}
+			name = http.CanonicalHeaderKey(name)
+			meta.Vary[name] = strings.Join(r.Header[name], ",")
+		}
+	}
+	line, err := json.Marshal(meta)
+	if err != nil {
+		z.unlock(key, l)
+		return res
+	}
+	if err := os.MkdirAll(z.path, 0700); err != nil {
+		z.unlock(key, l)
+		return res
+	}
+	f, err := ioutil.TempFile(z.path, "*.tmp")
+	if err != nil {
+		z.unlock(key, l)
+		return res
+	}
+	w := bufio.NewWriter(f)
+	w.Write(append(line, '\n'))
+	res.Body = &cacheBody{ReadCloser: res.Body, z: z, key: key, tags: tags, f: f, w: w, l: l}
+	return res
+}
+
+// commit moves the temporary file tmp to the cache file of key.
+func (z *cacheZone) commit(key string, tags []string, tmp string) error {
+	hash := cacheHash(key)
+	name := z.filename(hash)
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	z.mu.Lock()
+	z.add(&cacheEntry{hash: hash, key: key, tags: tags, size: info.Size(), access: time.Now()})
+	z.mu.Unlock()
+	return nil
+}
+
+// cacheBody copies the body of an upstream response to a temporary file.
+type cacheBody struct {
+	io.ReadCloser
+	z    *cacheZone
+	key  string
+	tags []string
+	f    *os.File
+	w    *bufio.Writer
+	l    *cacheLock
+	err  error
+	eof  bool
+	once sync.Once
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.err == nil {
+		_, b.err = b.w.Write(p[:n])
+	}
+	if err == io.EOF {
+		// the response is stored before the end of the body is sent to the
+		// client.
+		b.eof = true
+		b.once.Do(b.finish)
+	}
+	return n, err
+}
+
+func (b *cacheBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.finish)
+	return err
+}
+
+// finish adds the response to the cache if the body was read completely.
+func (b *cacheBody) finish() {
+	defer b.z.unlock(b.key, b.l)
+	name := b.f.Name()
+	if b.err == nil {
+		b.err = b.w.Flush()
+	}
+	if err := b.f.Close(); b.err == nil {
+		b.err = err
+	}
+	if b.eof && b.err == nil && b.z.commit(b.key, b.tags, name) == nil {
+		return
+	}
+	os.Remove(name)
+}
+
+// cacheValid is a proxy_cache_valid directive.
+type cacheValid struct {
+	// codes are the status codes the time applies to, nil means any.
+	codes []int
+	d     time.Duration
+}
+
+func newCacheValid(r *rule) (*cacheValid, error) {
+	d, err := parseDuration(r.args[len(r.args)-1])
+	if err != nil {
+		return nil, fmt.Errorf("vince: invalid time value %q", r.args[len(r.args)-1])
+	}
+	v := &cacheValid{d: d}
+	codes := r.args[:len(r.args)-1]
+	if len(codes) == 0 {
+		v.codes = []int{http.StatusOK, http.StatusMovedPermanently, http.StatusFound}
+		return v, nil
+	}
+	for _, a := range codes {
+		if a == "any" {
+			v.codes = nil
+			return v, nil
+		}
+		n, err := strconv.Atoi(a)
+		if err != nil || n < 100 || n > 599 {
+			return nil, fmt.Errorf("vince: invalid status code %q", a)
+		}
+		v.codes = append(v.codes, n)
+	}
+	return v, nil
+}
+
+func (v *cacheValid) matches(code int) bool {
+	if v.codes == nil {
+		return true
+	}
+	for _, c := range v.codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheUseStale is proxy_cache_use_stale.
+type cacheUseStale struct {
+	when     nextUpstream
+	updating bool
+}
+
+func parseCacheUseStale(args []string) (cacheUseStale, error) {
+	var s cacheUseStale
+	for _, a := range args {
+		if a == "updating" {
+			s.updating = true
+			continue
+		}
+		v, ok := nextUpstreamNames[a]
+		if !ok || v == nextUpstreamNonIdempotent {
+			return cacheUseStale{}, fmt.Errorf("vince: invalid value %q in proxy_cache_use_stale", a)
+		}
+		s.when |= v
+	}
+	if s.when&nextUpstreamOff != 0 && (s.when != nextUpstreamOff || s.updating) {
+		return cacheUseStale{}, errors.New(`vince: "off" can't be combined with other values in proxy_cache_use_stale`)
+	}
+	return s, nil
+}
+
+// proxyCacheOption are the proxy_cache directives of a location.
+type proxyCacheOption struct {
+	zone        stringValue
+	key         stringTemplateValue
+	methods     map[string]bool
+	lock        boolValue
+	lockTimeout durationValue
+	useStale    cacheUseStale
+	background  boolValue
+	tagHeader   stringValue
+	valid       []*cacheValid
+	bypass      []stringTemplateValue
+	noCache     []stringTemplateValue
+	purge       []stringTemplateValue
+}
+
+func (o *proxyCacheOption) defaults() {
+	o.key.store("$scheme$proxy_host$request_uri")
+	o.methods = map[string]bool{http.MethodGet: true, http.MethodHead: true}
+	o.lockTimeout.store(5 * time.Second)
+	o.tagHeader.store("Surrogate-Key")
+}
+
+func (o *proxyCacheOption) loadKey(r *rule) error {
+	switch r.name {
+	case "proxy_cache":
+		o.zone.store(r.args[0])
+	case "proxy_cache_key":
+		o.key.store(r.args[0])
+	case "proxy_cache_methods":
+		o.methods = map[string]bool{http.MethodGet: true, http.MethodHead: true}
+		for _, a := range r.args {
+			switch a {
+			case http.MethodGet, http.MethodHead, http.MethodPost:
+				o.methods[a] = true
+			default:
+				return fmt.Errorf("vince: invalid value %q in proxy_cache_methods", a)
+			}
+		}
+	case "proxy_cache_lock":
+		o.lock.store(r.args[0] == "on")
+	case "proxy_cache_lock_timeout":
+		d, err := parseDuration(r.args[0])
+		if err != nil {
+			return fmt.Errorf("vince: invalid value %q", r.args[0])
+		}
+		o.lockTimeout.store(d)
+	case "proxy_cache_use_stale":
+		s, err := parseCacheUseStale(r.args)
+		if err != nil {
+			return err
+		}
+		o.useStale = s
+	case "proxy_cache_background_update":
+		o.background.store(r.args[0] == "on")
+	case "proxy_cache_tag_header":
+		o.tagHeader.store(r.args[0])
+	}
+	return nil
+}
+
+// loadLists loads proxy_cache_valid, proxy_cache_bypass, proxy_no_cache and
+// proxy_cache_purge of location. Like nginx they are inherited from the previous level only if
+// there are none defined on the current level.
+func (o *proxyCacheOption) loadLists(location *rule) error {
+	for _, ch := range innermost(location, "proxy_cache_valid") {
+		v, err := newCacheValid(ch)
+		if err != nil {
+			return ch.wrap(err)
+		}
+		o.valid = append(o.valid, v)
+	}
+	lists := map[string]*[]stringTemplateValue{
+		"proxy_cache_bypass": &o.bypass,
+		"proxy_no_cache":     &o.noCache,
+		"proxy_cache_purge":  &o.purge,
+	}
+	for name, list := range lists {
+		for _, ch := range innermost(location, name) {
+			for _, a := range ch.args {
+				var s stringTemplateValue
+				s.store(a)
+				*list = append(*list, s)
+			}
+		}
+	}
+	return nil
+}
+
+// anyOf returns true if one of values is not empty and not "0".
+func anyOf(values []stringTemplateValue, v *ngxVariables) bool {
+	for i := range values {
+		if s := values[i].Value(v); s != "" && s != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// validUntil returns the time until which res is fresh, ok is false when res
+// must not be cached. Like nginx Cache-Control and Expires take precedence over
+// proxy_cache_valid.
+func (o *proxyCacheOption) validUntil(res *http.Response, now time.Time) (valid time.Time, ok bool) {
+	h := res.Header
+	if len(h["Set-Cookie"]) > 0 {
+		return valid, false
+	}
+	for _, v := range h["Vary"] {
+		if strings.Contains(v, "*") {
+			return valid, false
+		}
+	}
+	if cc := h.Get("Cache-Control"); cc != "" {
+		age, shared := -1, -1
+		for _, d := range strings.Split(cc, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			switch {
+			case d == "no-cache", d == "no-store", d == "private":
+				return valid, false
+			case strings.HasPrefix(d, "max-age="):
+				if n, err := strconv.Atoi(d[len("max-age="):]); err == nil {
+					age = n
+				}
+			case strings.HasPrefix(d, "s-maxage="):
+				if n, err := strconv.Atoi(d[len("s-maxage="):]); err == nil {
+					shared = n
+				}
+			}
+		}
+		if shared >= 0 {
+			age = shared
+		}
+		if age == 0 {
+			return valid, false
+		}
+		if age > 0 {
+			return now.Add(time.Duration(age) * time.Second), true
+		}
+	}
+	if e := h.Get("Expires"); e != "" {
+		t, err := http.ParseTime(e)
+		if err != nil || !t.After(now) {
+			return valid, false
+		}
+		return t, true
+	}
+	for _, v := range o.valid {
+		if v.matches(res.StatusCode) {
+			return now.Add(v.d), v.d > 0
+		}
+	}
+	return valid, false
+}
+
+// tags returns the values of proxy_cache_tag_header in h, they are separated
+// by spaces.
+func (o *proxyCacheOption) tags(h http.Header) []string {
+	if o.tagHeader.value == "off" {
+		return nil
+	}
+	var tags []string
+	for _, v := range h[http.CanonicalHeaderKey(o.tagHeader.value)] {
+		tags = append(tags, strings.Fields(v)...)
+	}
+	return tags
+}
+
+// detachedContext keeps the values of a request context without its
+// cancellation, it is used by background cache updates that outlive the
+// request.
+type detachedContext struct{ context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// cacheRoundTrip serves r from the cache of the location when possible and
+// passes it to the upstream otherwise.
+func (p *proxy) cacheRoundTrip(r *http.Request) (*http.Response, error) {
+	c := &p.opts.cache
+	z, ok := p.caches[c.zone.value]
+	if !ok || !c.methods[r.Method] {
+		return p.roundTrip(r)
+	}
+	v := ctxVariables(r.Context())
+	key := c.key.Value(v)
+	if anyOf(c.bypass, v) {
+		v.Set(vUpstreamCacheStatu, cacheBypass)
+		l, owner := z.lock(key)
+		if !owner {
+			l = nil
+		}
+		return p.fetch(z, key, r, l)
+	}
+	waited := false
+	for {
+		stale, fresh := z.lookup(key, r, time.Now())
+		if fresh {
+			v.Set(vUpstreamCacheStatu, cacheHit)
+			return stale, nil
+		}
+		l, owner := z.lock(key)
+		if owner {
+			if stale != nil && c.useStale.updating && c.background.value {
+				go p.update(z, key, detachRequest(r), l)
+				v.Set(vUpstreamCacheStatu, cacheUpdating)
+				return stale, nil
+			}
+			return p.fetchOrStale(z, key, r, l, stale)
+		}
+		if stale != nil && c.useStale.updating {
+			v.Set(vUpstreamCacheStatu, cacheUpdating)
+			return stale, nil
+		}
+		if stale != nil {
+			stale.Body.Close()
+		}
+		switch {
+		case !c.lock.value:
+			// without proxy_cache_lock all requests are passed to the
+			// upstream and each of them may update the cache.
+			v.Set(vUpstreamCacheStatu, cacheMiss)
+			return p.fetch(z, key, r, nil)
+		case waited || !l.wait(r.Context(), c.lockTimeout.value):
+			// like nginx the response is not cached after the lock timed out
+			v.Set(vUpstreamCacheStatu, cacheMiss)
+			return p.roundTrip(r)
+		}
+		waited = true
+	}
+}
+
+// fetchOrStale fetches the response of r while holding l, stale is used
+// instead when the upstream fails in a way listed by proxy_cache_use_stale.
+func (p *proxy) fetchOrStale(z *cacheZone, key string, r *http.Request, l *cacheLock, stale *http.Response) (*http.Response, error) {
+	v := ctxVariables(r.Context())
+	if stale == nil {
+		v.Set(vUpstreamCacheStatu, cacheMiss)
+		return p.fetch(z, key, r, l)
+	}
+	v.Set(vUpstreamCacheStatu, cacheExpired)
+	res, err := p.fetch(z, key, r, l)
+	if cs, _ := nextUpstream(0).check(res, err); cs&p.opts.cache.useStale.when != 0 {
+		if res != nil {
+			res.Body.Close()
+		}
+		v.Set(vUpstreamCacheStatu, cacheStale)
+		return stale, nil
+	}
+	stale.Body.Close()
+	return res, err
+}
+
+// fetch passes r to the upstream and stores the response in z if it can be
+// cached. l is released once the response is stored.
+func (p *proxy) fetch(z *cacheZone, key string, r *http.Request, l *cacheLock) (*http.Response, error) {
+	out := r
+	if r.Method == http.MethodHead {
+		// like nginx with proxy_cache_convert_head the full response is
+		// fetched so that it can be cached.
+		out = new(http.Request)
+		*out = *r
+		out.Method = http.MethodGet
+	}
+	res, err := p.roundTrip(out)
+	if err != nil {
+		z.unlock(key, l)
+		return nil, err
+	}
+	res.Request = r
+	c := &p.opts.cache
+	valid, ok := c.validUntil(res, time.Now())
+	if !ok || anyOf(c.noCache, ctxVariables(r.Context())) {
+		z.unlock(key, l)
+		return res, nil
+	}
+	return z.store(key, r, res, valid, c.tags(res.Header), l), nil
+}
+
+// detachRequest returns a copy of r that is not cancelled with r and has its
+// own variables.
+func detachRequest(r *http.Request) *http.Request {
+	ctx := detachedContext{r.Context()}
+	return r.WithContext(context.WithValue(ctx, variables{}, ctxVariables(ctx).clone()))
+}
+
+// update refreshes the cached response of r in the background while clients
+// are served the stale one, r must be detached from the client request.
+func (p *proxy) update(z *cacheZone, key string, r *http.Request, l *cacheLock) {
+	res, err := p.fetch(z, key, r, l)
+	if err != nil {
+		logError(r.Context(), err.Error())
+		return
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// cachePurge selects cached responses to remove. Key and Prefix match cache
+// keys and Tag matches the values of proxy_cache_tag_header stored with the
+// responses. A purge without any of them removes the whole zone.
+type cachePurge struct {
+	Zone   string `json:"zone"`
+	Key    string `json:"key,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+}
+
+func (p *cachePurge) matches(e *cacheEntry) bool {
+	switch {
+	case p.Key != "":
+		return e.key == p.Key
+	case p.Prefix != "":
+		return strings.HasPrefix(e.key, p.Prefix)
+	case p.Tag != "":
+		for _, t := range e.tags {
+			if t == p.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// purge removes the responses matching p and returns their number.
+func (z *cacheZone) purge(p *cachePurge) int {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if p.Key != "" {
+		hash := cacheHash(p.Key)
+		if _, ok := z.entries[hash]; !ok {
+			return 0
+		}
+		z.remove(hash)
+		return 1
+	}
+	n := 0
+	for hash, e := range z.entries {
+		if p.matches(e.Value.(*cacheEntry)) {
+			z.remove(hash)
+			n++
+		}
+	}
+	return n
+}
+
+// cacheSync replicates purges of cache zones to the nodes of a cluster.
+//
+// Purges are applied on the node that received them first, so that the number
+// of removed responses can be reported, then they go through raft and every
+// other node applies them to its own zone with the same name.
+type cacheSync struct {
+	node string
+	kv   *kv
+
+	mu    sync.Mutex
+	zones map[string]*cacheZone
+}
+
+// cacheSyncMessage is the value of cache_purge commands.
+type cacheSyncMessage struct {
+	Node  string
+	Purge *cachePurge
+}
+
+func newCacheSync(node string, store *kv) *cacheSync {
+	return &cacheSync{
+		node:  node,
+		kv:    store,
+		zones: make(map[string]*cacheZone),
+	}
+}
+
+// setZones replaces the zones purges are applied to.
+func (s *cacheSync) setZones(zones map[string]*cacheZone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones = zones
+}
+
+func (s *cacheSync) zone(name string) *cacheZone {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.zones[name]
+}
+
+// publish sends p to the cluster.
+func (s *cacheSync) publish(p *cachePurge) error {
+	b, err := json.Marshal(cacheSyncMessage{Node: s.node, Purge: p})
+	if err != nil {
+		return err
+	}
+	return s.kv.apply(&command{Op: "cache_purge", Key: p.Zone, Value: string(b)})
+}
+
+// apply purges the zone of a node, this is called by the fsm on every node.
+func (s *cacheSync) apply(c *command) error {
+	var m cacheSyncMessage
+	if err := json.Unmarshal([]byte(c.Value), &m); err != nil {
+		return err
+	}
+	if m.Node == s.node || m.Purge == nil {
+		// already purged
+		return nil
+	}
+	if z := s.zone(m.Purge.Zone); z != nil {
+		z.purge(m.Purge)
+	}
+	return nil
+}
+
+// purgeCache removes the responses of z matching p and returns their number.
+// The purge is replicated to the cluster when s is not nil.
+func purgeCache(z *cacheZone, s *cacheSync, p *cachePurge) (int, error) {
+	p.Zone = z.name
+	n := z.purge(p)
+	if s == nil {
+		return n, nil
+	}
+	return n, s.publish(p)
+}
+
+// purging returns true if r must purge the cache with proxy_cache_purge.
+func (p *proxy) purging(r *http.Request) bool {
+	c := &p.opts.cache
+	if _, ok := p.caches[c.zone.value]; !ok {
+		return false
+	}
+	return anyOf(c.purge, ctxVariables(r.Context()))
+}
+
+// purge removes the cached response of r. Like nginx a cache key ending with
+// an asterisk removes all responses with keys starting with the rest of it.
+func (p *proxy) purge(w http.ResponseWriter, r *http.Request) {
+	c := &p.opts.cache
+	z := p.caches[c.zone.value]
+	v := ctxVariables(r.Context())
+	if u, err := parseProxyURL(p.opts.pass.uri.Value(v)); err == nil {
+		// the key may use variables set when the request is proxied
+		v.Set(vProxyHost, u.Host)
+		v.Set(vProxyPort, proxyPort(u))
+	}
+	key := c.key.Value(v)
+	purge := &cachePurge{Key: key}
+	if strings.HasSuffix(key, "*") {
+		purge = &cachePurge{Prefix: strings.TrimSuffix(key, "*")}
+	}
+	n, err := purgeCache(z, p.sync, purge)
+	switch {
+	case err != nil:
+		logError(r.Context(), err.Error())
+		eRender(w, http.StatusInternalServerError)
+	case n == 0 && purge.Key != "":
+		eRender(w, http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
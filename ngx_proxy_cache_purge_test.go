@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCacheZone returns zone one stored in dir with responses for keys, the
+// tags of a key are the Surrogate-Key field of its response.
+func testCacheZone(t *testing.T, dir string, keys map[string]string) *cacheZone {
+	t.Helper()
+	z, err := newCacheZone(&rule{name: "proxy_cache_path", args: []string{dir, "keys_zone=one:1m"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o proxyCacheOption
+	o.defaults()
+	for key, tags := range keys {
+		res := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Surrogate-Key": {tags}},
+			Body:       ioutil.NopCloser(strings.NewReader(key)),
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		res = z.store(key, r, res, time.Now().Add(time.Hour), o.tags(res.Header), nil)
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	return z
+}
+
+var testCacheKeys = map[string]string{
+	"/img/a.png": "img product-1",
+	"/img/b.png": "img product-2",
+	"/product/1": "product-1",
+	"/product/2": "product-2",
+}
+
+func cachedKeys(z *cacheZone) string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var keys []string
+	for e := z.lru.Back(); e != nil; e = e.Prev() {
+		keys = append(keys, e.Value.(*cacheEntry).key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, " ")
+}
+
+func TestCachePurgeSync(t *testing.T) {
+	nodes := testCluster(t, 3)
+	defer stopCluster(nodes)
+	zones := make([]*cacheZone, len(nodes))
+	for i, n := range nodes {
+		dir, err := ioutil.TempDir("", "vince-cache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		zones[i] = testCacheZone(t, dir, testCacheKeys)
+		n.caches.setZones(map[string]*cacheZone{"one": zones[i]})
+	}
+	sample := []struct {
+		purge  cachePurge
+		purged int
+		keys   string
+	}{
+		{cachePurge{Tag: "product-1"}, 2, "/img/b.png /product/2"},
+		{cachePurge{Key: "/product/2"}, 1, "/img/b.png"},
+		{cachePurge{Key: "/product/2"}, 0, "/img/b.png"},
+		{cachePurge{Prefix: "/img/"}, 1, ""},
+	}
+	for i, s := range sample {
+		// purges are sent from every node in turn
+		n, err := purgeCache(zones[i%len(nodes)], nodes[i%len(nodes)].caches, &s.purge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != s.purged {
+			t.Errorf("%+v: expected %d purged got %d", s.purge, s.purged, n)
+		}
+		replicate(t, nodes)
+		for j, z := range zones {
+			if got := cachedKeys(z); got != s.keys {
+				t.Errorf("%+v: expected node %d to have %q got %q", s.purge, j, s.keys, got)
+			}
+		}
+	}
+}
+
+func TestManagementCacheAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vince-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var srv serverCtx
+	srv.config = &vinceConfiguration{dir: dir}
+	srv.http.caches = map[string]*cacheZone{"one": testCacheZone(t, filepath.Join(dir, "cache"), testCacheKeys)}
+	var m management
+	m.init(&srv)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := serverContext(r.Context(), &srv, httpListenOpts{net: "tcp"})
+		m.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+	do := func(method, path string, code int, out interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != code {
+			b, _ := ioutil.ReadAll(res.Body)
+			t.Fatalf("%s %s: expected %d got %d %s", method, path, code, res.StatusCode, b)
+		}
+		if out != nil {
+			if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var all map[string]cacheStatus
+	do("GET", "/api/http/caches", http.StatusOK, &all)
+	if all["one"].Entries != 4 || all["one"].Size == 0 {
+		t.Errorf("unexpected status %+v", all["one"])
+	}
+	var purged cachePurgeResponse
+	do("DELETE", "/api/http/caches/one?tag=img", http.StatusOK, &purged)
+	if purged.Purged != 2 {
+		t.Errorf("expected 2 purged got %d", purged.Purged)
+	}
+	do("DELETE", "/api/http/caches/one?key=/product/1", http.StatusOK, &purged)
+	if purged.Purged != 1 {
+		t.Errorf("expected 1 purged got %d", purged.Purged)
+	}
+	do("DELETE", "/api/http/caches/one?key=/a&tag=b", http.StatusBadRequest, nil)
+	do("DELETE", "/api/http/caches/missing", http.StatusNotFound, nil)
+	do("DELETE", "/api/http/caches/one", http.StatusOK, &purged)
+	if purged.Purged != 1 {
+		t.Errorf("expected 1 purged got %d", purged.Purged)
+	}
+	do("GET", "/api/http/caches", http.StatusOK, &all)
+	if all["one"].Entries != 0 || all["one"].Size != 0 {
+		t.Errorf("expected an empty cache got %+v", all["one"])
+	}
+}
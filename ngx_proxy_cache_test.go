@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyCache(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		n := hits[r.URL.Path]
+		mu.Unlock()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/max-age"):
+			w.Header().Set("Cache-Control", "max-age=60")
+		case strings.HasSuffix(r.URL.Path, "/private"):
+			w.Header().Set("Cache-Control", "private")
+		case strings.HasSuffix(r.URL.Path, "/cookie"):
+			w.Header().Set("Set-Cookie", "id=1")
+		case strings.HasSuffix(r.URL.Path, "/vary"):
+			w.Header().Set("Vary", "X-Lang")
+		}
+		fmt.Fprintf(w, "%s %d %s", r.Method, n, r.Header.Get("X-Lang"))
+	}))
+	defer backend.Close()
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    proxy_cache_path {{.dir}}/cache levels=1:2 keys_zone=one:1m;
+    map $request_method $purge_method {
+        PURGE 1;
+        default 0;
+    }
+    server {
+        listen       127.0.0.1:8104;
+        server_name  localhost;
+        proxy_cache one;
+        add_header X-Cache-Status $upstream_cache_status;
+        location /headers/ {
+            proxy_pass %s/;
+        }
+        location /valid/ {
+            proxy_cache_valid 200 1m;
+            proxy_cache_bypass $arg_bypass;
+            proxy_no_cache $arg_nocache;
+            proxy_cache_purge $purge_method;
+            proxy_pass %s/;
+        }
+        location /off/ {
+            proxy_cache off;
+            proxy_cache_valid 1m;
+            proxy_pass %s/;
+        }
+    }
+}
+`, backend.URL, backend.URL, backend.URL)
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	host := "http://localhost:8104"
+	get := func(method, uri, lang string, checks ...httpCheckFn) testKase {
+		return func(ctx context.Context, t *testing.T) {
+			t.Run(method+" "+uri, func(t *testing.T) {
+				r, _ := http.NewRequest(method, host+uri, nil)
+				if lang != "" {
+					r.Header.Set("X-Lang", lang)
+				}
+				res, err := http.DefaultClient.Do(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				for _, f := range checks {
+					f(ctx, t, res)
+				}
+			})
+		}
+	}
+	status := func(s string) httpCheckFn {
+		return checkHeader("X-Cache-Status", s)
+	}
+	runTest(t, c,
+		get("GET", "/headers/max-age", "", status(cacheMiss), checkBodyString("GET 1 ")),
+		get("GET", "/headers/max-age", "", status(cacheHit), checkBodyString("GET 1 ")),
+		get("HEAD", "/headers/max-age", "", status(cacheHit), checkCode(http.StatusOK)),
+		get("GET", "/headers/none", "", status(cacheMiss), checkBodyString("GET 1 ")),
+		get("GET", "/headers/none", "", status(cacheMiss), checkBodyString("GET 2 ")),
+		get("GET", "/valid/a", "", status(cacheMiss), checkBodyString("GET 1 ")),
+		get("GET", "/valid/a", "", status(cacheHit), checkBodyString("GET 1 ")),
+		get("GET", "/valid/a?bypass=1", "", status(cacheBypass), checkBodyString("GET 2 ")),
+		get("GET", "/valid/a", "", status(cacheHit), checkBodyString("GET 1 ")),
+		get("HEAD", "/valid/head", "", status(cacheMiss)),
+		get("GET", "/valid/head", "", status(cacheHit), checkBodyString("GET 1 ")),
+		get("GET", "/valid/b?nocache=1", "", status(cacheMiss), checkBodyString("GET 1 ")),
+		get("GET", "/valid/b?nocache=1", "", status(cacheMiss), checkBodyString("GET 2 ")),
+		get("GET", "/valid/private", "", status(cacheMiss), checkBodyString("GET 1 ")),
+		get("GET", "/valid/private", "", status(cacheMiss), checkBodyString("GET 2 ")),
+		get("GET", "/valid/cookie", "", status(cacheMiss), checkBodyString("GET 1 ")),
+		get("GET", "/valid/cookie", "", status(cacheMiss), checkBodyString("GET 2 ")),
+		get("GET", "/valid/vary", "en", status(cacheMiss), checkBodyString("GET 1 en")),
+		get("GET", "/valid/vary", "en", status(cacheHit), checkBodyString("GET 1 en")),
+		get("GET", "/valid/vary", "fr", status(cacheMiss), checkBodyString("GET 2 fr")),
+		get("POST", "/valid/a", "", status(""), checkBodyString("POST 3 ")),
+		get("GET", "/off/z", "", status(""), checkBodyString("GET 1 ")),
+		get("GET", "/off/z", "", status(""), checkBodyString("GET 2 ")),
+		get("PURGE", "/valid/vary", "", checkCode(http.StatusNoContent)),
+		get("GET", "/valid/vary", "fr", status(cacheMiss), checkBodyString("GET 3 fr")),
+		get("PURGE", "/valid/missing", "", checkCode(http.StatusNotFound)),
+		get("PURGE", "/valid/*", "", checkCode(http.StatusNoContent)),
+		get("GET", "/valid/a", "", status(cacheMiss), checkBodyString("GET 4 ")),
+		get("GET", "/headers/max-age", "", status(cacheHit), checkBodyString("GET 1 ")),
+	)
+}
+
+// testCacheProxy returns a proxy caching in z responses of backend.
+func testCacheProxy(z *cacheZone, backend string) *proxy {
+	p := &proxy{transport: http.DefaultTransport, caches: map[string]*cacheZone{z.name: z}}
+	p.opts.cache.defaults()
+	p.opts.cache.zone.store(z.name)
+	p.opts.cache.key.store("$uri")
+	p.opts.pass.uri.store(backend)
+	return p
+}
+
+func cacheGet(t *testing.T, p *proxy, uri string) (status, body string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, uri, nil)
+	_, r = withVariables(httptest.NewRecorder(), r)
+	r.RequestURI = ""
+	r.URL.Scheme, r.URL.Host = "http", strings.TrimPrefix(p.opts.pass.uri.value, "http://")
+	res, err := p.cacheRoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctxVariables(r.Context()).String(vUpstreamCacheStatu), string(b)
+}
+
+func TestProxyCacheStale(t *testing.T) {
+	var hits, fail int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Header().Set("Cache-Control", "max-age=1")
+		fmt.Fprint(w, n)
+	}))
+	defer backend.Close()
+	dir, err := ioutil.TempDir("", "vince-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	z, err := newCacheZone(&rule{name: "proxy_cache_path", args: []string{dir, "keys_zone=stale:1m"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := testCacheProxy(z, backend.URL)
+	p.opts.cache.useStale, _ = parseCacheUseStale([]string{"error", "http_500"})
+
+	expect := func(status, body string) {
+		t.Helper()
+		if s, b := cacheGet(t, p, "/stale"); s != status || b != body {
+			t.Errorf("expected %s %q got %s %q", status, body, s, b)
+		}
+	}
+	expect(cacheMiss, "1")
+	expect(cacheHit, "1")
+	time.Sleep(1100 * time.Millisecond)
+	atomic.StoreInt32(&fail, 1)
+	expect(cacheStale, "1")
+	atomic.StoreInt32(&fail, 0)
+
+	// the stale response is sent while the cache is updated in the background
+	p.opts.cache.useStale.updating = true
+	p.opts.cache.background.store(true)
+	expect(cacheUpdating, "1")
+	deadline := time.Now().Add(time.Second)
+	for {
+		s, b := cacheGet(t, p, "/stale")
+		if s == cacheHit && b == "3" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the background update to be cached got %s %q", s, b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// concurrent misses are collapsed into one upstream request
+	p.opts.cache.lock.store(true)
+	atomic.StoreInt32(&hits, 0)
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, bodies[i] = cacheGet(t, p, "/slow")
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expected one upstream request got %d", n)
+	}
+	for _, b := range bodies {
+		if b != "1" {
+			t.Errorf("expected all responses to be 1 got %v", bodies)
+			break
+		}
+	}
+}
+
+func TestCacheZoneManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vince-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zone := func(args ...string) *cacheZone {
+		z, err := newCacheZone(&rule{name: "proxy_cache_path", args: append([]string{dir}, args...)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return z
+	}
+	z := zone("levels=1:2", "keys_zone=one:1m", "inactive=1h")
+	store := func(z *cacheZone, key string) {
+		r := httptest.NewRequest(http.MethodGet, key, nil)
+		res := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100))),
+		}
+		res = z.store(key, r, res, time.Now().Add(time.Hour), nil, nil)
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	for _, key := range []string{"/a", "/b", "/c"} {
+		store(z, key)
+	}
+	hash := cacheHash("/a")
+	name := filepath.Join(dir, hash[31:], hash[29:31], hash)
+	if _, err := os.Stat(name); err != nil {
+		t.Fatal(err)
+	}
+
+	// the loader rebuilds the index after a restart
+	loaded := zone("levels=1:2", "keys_zone=one:1m", "inactive=1h")
+	ioutil.WriteFile(filepath.Join(dir, "partial.tmp"), []byte("{"), 0600)
+	loaded.load()
+	if n := len(loaded.entries); n != 3 {
+		t.Fatalf("expected 3 entries got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial.tmp")); !os.IsNotExist(err) {
+		t.Error("expected temporary files to be removed")
+	}
+	r := httptest.NewRequest(http.MethodGet, "/a", nil)
+	res, fresh := loaded.lookup("/a", r, time.Now())
+	if res == nil || !fresh {
+		t.Fatal("expected a fresh response")
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if len(b) != 100 {
+		t.Errorf("expected a body of 100 bytes got %d", len(b))
+	}
+
+	// least recently used entries are removed above max_size
+	limited := zone("levels=1:2", "keys_zone=one:1m", "max_size=1k")
+	limited.load()
+	for _, key := range []string{"/d", "/e", "/f", "/g", "/h", "/i", "/j", "/k"} {
+		store(limited, key)
+	}
+	limited.manage(time.Now())
+	if limited.used > limited.maxSize {
+		t.Errorf("expected at most %d bytes got %d", limited.maxSize, limited.used)
+	}
+	if _, ok := limited.entries[cacheHash("/a")]; ok {
+		t.Error("expected /a to be removed")
+	}
+	if _, ok := limited.entries[cacheHash("/k")]; !ok {
+		t.Error("expected /k to be kept")
+	}
+
+	// entries that were not accessed for inactive are removed
+	limited.manage(time.Now().Add(11 * time.Minute))
+	if len(limited.entries) != 0 || limited.used != 0 {
+		t.Errorf("expected no entries got %d using %d bytes", len(limited.entries), limited.used)
+	}
+	if _, err := os.Stat(z.filename(cacheHash("/k"))); !os.IsNotExist(err) {
+		t.Error("expected the file of /k to be removed")
+	}
+}
+
+func TestNewCacheZone(t *testing.T) {
+	sample := []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{"/tmp/c", "keys_zone=one:10m", "levels=1:2", "inactive=1d", "max_size=1g"}},
+		{args: []string{"/tmp/c", "levels=1:2"}, err: "vince: proxy_cache_path requires keys_zone"},
+		{args: []string{"/tmp/c", "keys_zone=one:1m", "levels=3"}, err: `vince: invalid "levels=3"`},
+		{args: []string{"/tmp/c", "keys_zone=one:1m", "size=1m"}, err: `vince: invalid parameter "size=1m"`},
+	}
+	for _, s := range sample {
+		_, err := newCacheZone(&rule{name: "proxy_cache_path", args: s.args})
+		if s.err == "" && err != nil {
+			t.Errorf("%v: %v", s.args, err)
+		}
+		if s.err != "" && (err == nil || err.Error() != s.err) {
+			t.Errorf("%v: expected error %q got %v", s.args, s.err, err)
+		}
+	}
+	if _, err := parseCacheUseStale([]string{"off", "updating"}); err == nil {
+		t.Error("expected an error combining off with updating")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nextUpstream are the cases in which a request should be passed to the next
+// server of the upstream, see proxy_next_upstream.
+type nextUpstream uint
+
+const (
+	nextUpstreamError nextUpstream = 1 << iota
+	nextUpstreamTimeout
+	nextUpstreamInvalidHeader
+	nextUpstreamHTTP500
+	nextUpstreamHTTP502
+	nextUpstreamHTTP503
+	nextUpstreamHTTP504
+	nextUpstreamHTTP403
+	nextUpstreamHTTP404
+	nextUpstreamHTTP429
+	nextUpstreamNonIdempotent
+	nextUpstreamOff
+)
+
+var nextUpstreamNames = map[string]nextUpstream{
+	"error":          nextUpstreamError,
+	"timeout":        nextUpstreamTimeout,
+	"invalid_header": nextUpstreamInvalidHeader,
+	"http_500":       nextUpstreamHTTP500,
+	"http_502":       nextUpstreamHTTP502,
+	"http_503":       nextUpstreamHTTP503,
+	"http_504":       nextUpstreamHTTP504,
+	"http_403":       nextUpstreamHTTP403,
+	"http_404":       nextUpstreamHTTP404,
+	"http_429":       nextUpstreamHTTP429,
+	"non_idempotent": nextUpstreamNonIdempotent,
+	"off":            nextUpstreamOff,
+}
+
+func parseNextUpstream(args []string) (nextUpstream, error) {
+	var n nextUpstream
+	for _, a := range args {
+		v, ok := nextUpstreamNames[a]
+		if !ok {
+			return 0, fmt.Errorf("vince: invalid value %q in proxy_next_upstream", a)
+		}
+		n |= v
+	}
+	if n&nextUpstreamOff != 0 && n != nextUpstreamOff {
+		return 0, errors.New(`vince: "off" can't be combined with other values in proxy_next_upstream`)
+	}
+	return n, nil
+}
+
+var statusNextUpstream = map[int]nextUpstream{
+	http.StatusInternalServerError: nextUpstreamHTTP500,
+	http.StatusBadGateway:          nextUpstreamHTTP502,
+	http.StatusServiceUnavailable:  nextUpstreamHTTP503,
+	http.StatusGatewayTimeout:      nextUpstreamHTTP504,
+	http.StatusForbidden:           nextUpstreamHTTP403,
+	http.StatusNotFound:            nextUpstreamHTTP404,
+	http.StatusTooManyRequests:     nextUpstreamHTTP429,
+}
+
+// check returns the case that res or err falls into. failure is true if the
+// attempt counts as unsuccessful for the peer.
+//
+// Like nginx errors, timeouts and invalid headers are always failures while
+// http_403 and http_404 never are.
+func (n nextUpstream) check(res *http.Response, err error) (c nextUpstream, failure bool) {
+	if err != nil {
+		switch {
+		case isTimeout(err):
+			return nextUpstreamTimeout, true
+		case strings.Contains(err.Error(), "malformed HTTP"):
+			return nextUpstreamInvalidHeader, true
+		default:
+			return nextUpstreamError, true
+		}
+	}
+	c = statusNextUpstream[res.StatusCode]
+	switch c {
+	case 0, nextUpstreamHTTP403, nextUpstreamHTTP404:
+		return c, false
+	}
+	return c, n&c != 0
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPatch, "LOCK":
+		return false
+	}
+	return true
+}
+
+var errNoLiveUpstreams = errors.New("vince: no live upstreams")
+
+// nextUpstreamOption are the *_next_upstream, *_next_upstream_tries and
+// *_next_upstream_timeout directives of a location.
+type nextUpstreamOption struct {
+	when    nextUpstream
+	tries   intValue
+	timeout durationValue
+	// bodyBuffer is client_body_buffer_size, request bodies are kept in
+	// memory to be sent again only up to this size. Requests with larger
+	// bodies or bodies of unknown length are not retried.
+	bodyBuffer intValue
+}
+
+func (o *nextUpstreamOption) defaults() {
+	o.when = nextUpstreamError | nextUpstreamTimeout
+	o.bodyBuffer.store(16 * 1024)
+}
+
+// buffered returns true if the body of r can be kept to retry r.
+func (o *nextUpstreamOption) buffered(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	return r.ContentLength >= 0 && r.ContentLength <= o.bodyBuffer.value
+}
+
+// roundTrip sends r to a peer of the upstream stored in the request context.
+func (p *proxy) roundTrip(r *http.Request) (*http.Response, error) {
+	if p.headers != nil && p.headers.sets(HeaderXForwardedFor) {
+		p.headers.field(r, ctxVariables(r.Context()), HeaderXForwardedFor)
+	}
+	return upstreamRoundTrip(r, p.transport, p.opts.next)
+}
+
+// upstreamRoundTrip sends r with transport to a peer of the upstream stored in
+// the request context, or to the server of the request url when there is none.
+// Failed attempts are recorded on the peer and the request is retried on the
+// next peer according to next.
+func upstreamRoundTrip(r *http.Request, transport http.RoundTripper, next nextUpstreamOption) (*http.Response, error) {
+	ctx := r.Context()
+	up, ok := ctx.Value(upstreamKey{}).(*upstreamConfig)
+	if !ok {
+		return transport.RoundTrip(r)
+	}
+	v := ctxVariables(ctx)
+	key := up.key(v, r.RemoteAddr)
+	retry := next.when&nextUpstreamOff == 0 &&
+		(idempotent(r.Method) || next.when&nextUpstreamNonIdempotent != 0) &&
+		next.buffered(r)
+	var body []byte
+	if retry && r.Body != nil && r.Body != http.NoBody {
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	tried := make(peerSet)
+	start := time.Now()
+	var (
+		res    *http.Response
+		err    error
+		addrs  []string
+		status []string
+	)
+	for {
+		peer := up.next(key, tried)
+		if peer == nil {
+			if len(tried) == 0 {
+				return nil, fmt.Errorf("%v while connecting to upstream %q", errNoLiveUpstreams, up.name)
+			}
+			break
+		}
+		tried[peer] = true
+		if res != nil {
+			res.Body.Close()
+		}
+		out := new(http.Request)
+		*out = *r
+		u := *r.URL
+		u.Host = peer.addr
+		out.URL = &u
+		if body != nil {
+			out.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		addrs = append(addrs, peer.addr)
+		peer.acquire()
+		res, err = transport.RoundTrip(out)
+		if err != nil {
+			peer.release()
+			status = append(status, "502")
+			if ctx.Err() != nil {
+				// the client went away, this says nothing about the peer
+				break
+			}
+		} else {
+			res.Body = &peerBody{ReadCloser: res.Body, peer: peer}
+			status = append(status, strconv.Itoa(res.StatusCode))
+		}
+		c, failure := next.when.check(res, err)
+		if failure {
+			peer.failed(time.Now())
+		} else if err == nil {
+			peer.succeeded()
+		}
+		if !retry || c == 0 || next.when&c == 0 {
+			break
+		}
+		if next.tries.value > 0 && int64(len(tried)) >= next.tries.value {
+			break
+		}
+		if next.timeout.value > 0 && time.Since(start) >= next.timeout.value {
+			break
+		}
+	}
+	v.Set(vUpstreamAddr, strings.Join(addrs, ", "))
+	v.Set(vUpstreamStatus, strings.Join(status, ", "))
+	return res, err
+}
+
+// peerBody releases the peer connection when the response body is closed.
+type peerBody struct {
+	io.ReadCloser
+	peer *upstreamPeer
+	once sync.Once
+}
+
+func (b *peerBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.peer.release)
+	return err
+}
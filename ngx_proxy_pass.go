@@ -3,21 +3,34 @@ package main
 import (
 	"context"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 )
 
 type proxy struct {
-	opts    proxyOption
-	bad     bool
-	rev     *httputil.ReverseProxy
-	origURL *url.URL
+	opts      proxyOption
+	bad       bool
+	rev       *httputil.ReverseProxy
+	transport http.RoundTripper
+	upstreams map[string]*upstreamConfig
+	headers   *proxyHeaders
+	caches    map[string]*cacheZone
+	// sync replicates purges to the cluster, it is nil on a single node.
+	sync *cacheSync
 }
 
+// upstreamKey stores the *upstreamConfig the request is proxied to.
+type upstreamKey struct{}
+
+// proxyURLKey stores the *url.URL of the request before it is proxied.
+type proxyURLKey struct{}
+
 type proxyOption struct {
 	bind struct {
 		address     stringValue
@@ -28,14 +41,9 @@ type proxyOption struct {
 		size   intValue
 		enable boolValue
 	}
-	cache struct {
-		enabled boolValue
-		bypass  stringSliceValue
-		key     stringValue
-	}
-	pass struct {
+	cache proxyCacheOption
+	pass  struct {
 		uri      stringTemplateValue
-		header   stringSliceValue
 		body     boolValue
 		headers  boolValue
 		method   stringValue
@@ -45,6 +53,10 @@ type proxyOption struct {
 			replace   stringSliceValue
 		}
 	}
+	next nextUpstreamOption
+	// interceptErrors is proxy_intercept_errors, responses of upstream servers
+	// with a status that has an error page are replaced by the page.
+	interceptErrors boolValue
 }
 
 func (o *proxyOption) load(location *rule) {
@@ -75,8 +87,6 @@ func (o *proxyOption) loadKey(r *rule) {
 		}
 	case "proxy_pass":
 		o.pass.uri.store(r.args[0])
-	case "proxy_pass_header":
-		o.pass.header.store(r.args[0])
 	case "proxy_pass_request_body":
 		switch r.args[0] {
 		case "on":
@@ -86,6 +96,28 @@ func (o *proxyOption) loadKey(r *rule) {
 		}
 	case "proxy_method":
 		o.pass.method.store(r.args[0])
+	case "proxy_intercept_errors":
+		o.interceptErrors.store(r.args[0] == "on")
+	case "proxy_next_upstream":
+		o.next.when, _ = parseNextUpstream(r.args)
+	case "proxy_next_upstream_tries":
+		if n, err := strconv.ParseInt(r.args[0], 10, 64); err == nil {
+			o.next.tries.store(n)
+		}
+	case "proxy_next_upstream_timeout":
+		// errors are reported by checkConfig
+		if d, err := parseDuration(r.args[0]); err == nil {
+			o.next.timeout.store(d)
+		}
+	case "client_body_buffer_size":
+		if n, err := parseSize(r.args[0]); err == nil {
+			o.next.bodyBuffer.store(n)
+		}
+	case "proxy_cache", "proxy_cache_key", "proxy_cache_methods",
+		"proxy_cache_lock", "proxy_cache_lock_timeout",
+		"proxy_cache_use_stale", "proxy_cache_background_update",
+		"proxy_cache_tag_header":
+		o.cache.loadKey(r)
 	}
 }
 
@@ -128,21 +160,53 @@ func (t *unixTransport) dialTLS(network, address string) (net.Conn, error) {
 
 func (p *proxy) init(location *rule, transport http.RoundTripper) {
 	p.opts = proxyOption{}
+	p.opts.next.defaults()
+	p.opts.cache.defaults()
 	p.opts.load(location)
+	// errors are reported by checkConfig
+	p.opts.cache.loadLists(location)
+	p.headers, _ = compileProxyHeaders(location)
+	if p.headers == nil {
+		p.headers = &proxyHeaders{}
+	}
+	p.transport = transport
 	p.rev = new(httputil.ReverseProxy)
 	p.rev.Director = p.director
-	p.rev.Transport = transport
+	p.rev.Transport = roundTripFunc(p.cacheRoundTrip)
 	p.rev.ModifyResponse = p.modifyResponse
+	p.rev.ErrorHandler = p.errorHandler
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+func (p *proxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	upstreamError(w, r, err)
+}
+
+// upstreamError responds with 504 when err is a timeout and 502 otherwise.
+func upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	logError(r.Context(), err.Error())
+	if isTimeout(err) {
+		eRender(w, http.StatusGatewayTimeout)
+		return
+	}
+	eRender(w, http.StatusBadGateway)
 }
 
 func (p *proxy) director(r *http.Request) {
 	ctx := r.Context()
-	v := ctx.Value(variables{}).(map[string]interface{})
+	v := ctxVariables(ctx)
 	target := p.opts.pass.uri.Value(v)
 	u, _ := parseProxyURL(target)
-	p.origURL = r.URL
-	if k, ok := v[vRequestMatchKind]; ok {
-		m := k.(*match)
+	v.Set(vUpstreamAddr, u.Host)
+	v.Set(vProxyHost, u.Host)
+	v.Set(vProxyPort, proxyPort(u))
+	if v != nil && v.match != nil {
+		m := v.match
 		switch m.kind {
 		case matchPrefix:
 			if u.Path == "/" && r.URL.Path != "/" {
@@ -158,6 +222,25 @@ func (p *proxy) director(r *http.Request) {
 	if p.opts.pass.method.set {
 		r.Method = p.opts.pass.method.value
 	}
+	p.headers.request(r, v)
+	if p.headers.sets(HeaderXForwardedFor) {
+		// the reverse proxy appends the client address to X-Forwarded-For
+		// unless it is nil, the value set by proxy_set_header is written by
+		// roundTrip so it is used as is.
+		r.Header[HeaderXForwardedFor] = nil
+	}
+}
+
+// proxyPort returns the port of proxied server u, it is the default port of
+// the scheme when u has none.
+func proxyPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
 }
 
 func parseProxyURL(s string) (*url.URL, error) {
@@ -174,20 +257,63 @@ func parseProxyURL(s string) (*url.URL, error) {
 	return u, nil
 }
 func (p *proxy) modifyResponse(w *http.Response) error {
+	if !p.opts.interceptErrors.value {
+		passErrorPages(w.Request.Context())
+	}
+	p.headers.response(w.Header)
+	recordTrailers(w)
 	//proxy_redirect
 	if p.opts.pass.redirect.isDefault.set {
 		if l := w.Header.Get("Location"); l != "" {
-			w.Header.Set("Location", p.origURL.RawPath)
+			w.Header.Set("Location", w.Request.Context().Value(proxyURLKey{}).(*url.URL).RawPath)
 		}
 	}
 	return nil
 }
 
+// trailerBody stores the trailers of an upstream response in the request
+// variables once its body is read.
+type trailerBody struct {
+	io.ReadCloser
+	res *http.Response
+	v   *ngxVariables
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.v.upstreamTrailer = b.res.Trailer
+	}
+	return n, err
+}
+
+// recordTrailers makes the trailers of res available as $upstream_trailer_
+// variables. The body of upgraded connections is left as is, the reverse
+// proxy writes to it.
+func recordTrailers(res *http.Response) {
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+	if v := ctxVariables(res.Request.Context()); v != nil {
+		res.Body = &trailerBody{ReadCloser: res.Body, res: res, v: v}
+	}
+}
+
 func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := p.valid(r); err != nil {
 		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 		return
 	}
+	if p.purging(r) {
+		p.purge(w, r)
+		return
+	}
+	ctx := context.WithValue(r.Context(), proxyURLKey{}, r.URL)
+	r = r.WithContext(ctx)
+	u, _ := parseProxyURL(p.opts.pass.uri.Value(ctxVariables(ctx)))
+	if up, ok := p.upstreams[u.Host]; ok {
+		r = r.WithContext(context.WithValue(ctx, upstreamKey{}, up))
+	}
 	p.rev.ServeHTTP(w, r)
 }
 
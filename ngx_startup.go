@@ -5,8 +5,10 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"regexp"
@@ -17,7 +19,6 @@ import (
 	"sync/atomic"
 	"syscall"
 
-	"github.com/ergongate/vince/templates"
 	"github.com/urfave/cli/v2"
 )
 
@@ -34,6 +35,8 @@ type rule struct {
 	name     string
 	args     []string
 	children []*rule
+	file     string
+	line     int
 }
 
 func (r rule) key() string {
@@ -47,6 +50,18 @@ func (r rule) String() string {
 	return r.key() + " [" + strings.Join(r.args, ",") + "]"
 }
 
+// wrap annotates err with the file and line where r was defined. Errors that
+// already carry a position are returned as is.
+func (r *rule) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(NgxError); ok {
+		return err
+	}
+	return newError(err.Error(), r.line, r.file)
+}
+
 func (r *rule) collect(n *rule) []*rule {
 	var v []*rule
 	if n == nil {
@@ -65,22 +80,73 @@ func (r *rule) collect(n *rule) []*rule {
 	return v
 }
 
+// inheritedOnce are directives that are inherited from the previous level only
+// if there are none defined on the current level.
+var inheritedOnce = map[string]bool{
+	"limit_req":  true,
+	"limit_conn": true,
+}
+
+// overide removes directives in inheritedOnce that are defined again in an inner
+// block. rules are ordered from the outer block to the inner one.
 func overide(rules []*rule) []*rule {
-	return rules
+	inner := make(map[string]*rule)
+	for _, r := range rules {
+		if inheritedOnce[r.name] {
+			inner[r.name] = r.parent
+		}
+	}
+	if len(inner) == 0 {
+		return rules
+	}
+	o := make([]*rule, 0, len(rules))
+	for _, r := range rules {
+		if p, ok := inner[r.name]; ok && r.parent != p {
+			continue
+		}
+		o = append(o, r)
+	}
+	return o
+}
+
+// innermost returns directives with name of the innermost level, starting from
+// block, that defines any. This is how nginx inherits array directives like
+// add_header and error_page.
+func innermost(block *rule, name string) []*rule {
+	for b := block; b != nil; b = b.parent {
+		var o []*rule
+		for _, ch := range b.children {
+			if ch.name == name {
+				o = append(o, ch)
+			}
+		}
+		if o != nil {
+			return o
+		}
+	}
+	return nil
 }
 
 func ruleFromStmt(stmt *Stmt, parent *rule) *rule {
-	r := &rule{name: stmt.Directive, parent: parent, args: stmt.Args}
+	r := &rule{
+		name:   stmt.Directive,
+		parent: parent,
+		args:   stmt.Args,
+		file:   stmt.Filename,
+		line:   stmt.Line,
+	}
 	for _, b := range stmt.Blocks {
 		r.children = append(r.children, ruleFromStmt(b, r))
 	}
 	return r
 }
 
-func process(ctx context.Context, srvCtx *serverCtx, config *vinceConfiguration) error {
+// collectServers groups http server blocks defined in core by the address they
+// listen on.
+func collectServers(core *rule, defaultPort int) (map[string]httpListenOpts, map[string][]*rule, error) {
 	var servers []*rule
 	// main block
-	for _, base := range srvCtx.core.children {
+	for _, base := range core.children {
 		if base.name == "http" {
 			// http block
 			for _, child := range base.children {
@@ -91,36 +157,36 @@ func process(ctx context.Context, srvCtx *serverCtx, config *vinceConfiguration)
 			}
 		}
 	}
-
+	address := make(map[string]httpListenOpts)
+	serverRules := make(map[string][]*rule)
 	for _, v := range servers {
-		for _, ls := range findListener(v, config.defaultPort) {
-			if _, ok := srvCtx.http.address[ls.addrPort]; !ok {
-				srvCtx.http.address[ls.addrPort] = ls
-			}
-			if a, ok := srvCtx.http.serverRules[ls.addrPort]; ok {
-				srvCtx.http.serverRules[ls.addrPort] = append(a, v)
-			} else {
-				srvCtx.http.serverRules[ls.addrPort] = []*rule{v}
+		listeners, err := findListener(v, defaultPort)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ls := range listeners {
+			if _, ok := address[ls.addrPort]; !ok {
+				address[ls.addrPort] = ls
 			}
+			serverRules[ls.addrPort] = append(serverRules[ls.addrPort], v)
 		}
 	}
+	return address, serverRules, nil
+}
+
+func process(ctx context.Context, srvCtx *serverCtx, config *vinceConfiguration) error {
+	address, serverRules, err := collectServers(srvCtx.core, config.defaultPort)
+	if err != nil {
+		return err
+	}
+	srvCtx.http.address = address
+	srvCtx.http.serverRules = serverRules
 	for k := range srvCtx.http.serverRules {
-		opts := srvCtx.http.address[k]
-		var l net.Listener
-		var err error
-		if opts.ssl {
-			c, err := opts.sslOpts.config()
-			if err != nil {
-				return err
-			}
-			l, err = tls.Listen(opts.net, opts.addrPort, c)
-		} else {
-			l, err = net.Listen(opts.net, opts.addrPort)
-		}
+		l, err := srvCtx.listen(srvCtx.http.address[k])
 		if err != nil {
 			return err
 		}
-		srvCtx.http.listeners[opts.addrPort] = l
+		srvCtx.http.listeners[k] = l
 	}
 	for k, rules := range srvCtx.http.serverRules {
 		opts := srvCtx.http.address[k]
@@ -136,20 +202,328 @@ func process(ctx context.Context, srvCtx *serverCtx, config *vinceConfiguration)
 		fmt.Printf("[vince] starting server on %q\n", srvCtx.http.listeners[opts].Addr().String())
 		go srv.Serve(srvCtx.http.listeners[opts])
 	}
+	return srvCtx.startStream(ctx)
+}
+
+// listen binds the address in opts. For ssl listeners the certificates are
+// looked up on every handshake so that reload can replace them without closing
+// the listener.
+func (s *serverCtx) listen(opts httpListenOpts) (net.Listener, error) {
+	if !opts.ssl {
+		return net.Listen(opts.net, opts.addrPort)
+	}
+	c, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	v := new(atomic.Value)
+	v.Store(c)
+	l, err := tls.Listen(opts.net, opts.addrPort, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return v.Load().(*tls.Config), nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.http.tls[opts.addrPort] = v
+	return l, nil
+}
+
+// reload re-reads configuration file and applies it to the running servers.
+// Servers listening on addresses present in both configurations keep their
+// listeners and only swap handlers, new addresses are bound and removed ones
+// are gracefully shut down.
+//
+// When the new configuration is invalid nothing is changed and the error is
+// returned.
+func (s *serverCtx) reload(ctx context.Context, config *vinceConfiguration) error {
+	d, err := loadConfig(config.confFile)
+	if err != nil {
+		return err
+	}
+	core := ruleFromStmt(d, nil)
+	if err := checkConfig(core, config.defaultPort, config.cluster.id != ""); err != nil {
+		return err
+	}
+	address, serverRules, err := collectServers(core, config.defaultPort)
+	if err != nil {
+		return err
+	}
+	upstreams, err := collectUpstreams(core, "http")
+	if err != nil {
+		return err
+	}
+	streamUpstreams, err := collectUpstreams(core, "stream")
+	if err != nil {
+		return err
+	}
+	limitReq, err := collectLimitReqZones(core, s.http.limitReq)
+	if err != nil {
+		return err
+	}
+	syncInterval, err := limitReqSyncInterval(core)
+	if err != nil {
+		return err
+	}
+	limitConn, err := collectLimitConnZones(core, "http", s.http.limitConn)
+	if err != nil {
+		return err
+	}
+	streamLimitConn, err := collectLimitConnZones(core, "stream", s.stream.limitConn)
+	if err != nil {
+		return err
+	}
+	caches, err := collectCacheZones(core, s.http.caches)
+	if err != nil {
+		return err
+	}
+	maps, err := collectMaps(core, "http")
+	if err != nil {
+		return err
+	}
+	streamMaps, err := collectMaps(core, "stream")
+	if err != nil {
+		return err
+	}
+	health, err := collectHealthChecks(core, upstreams, streamUpstreams)
+	if err != nil {
+		return err
+	}
+	streamAddress, streamServers, err := collectStreamServers(core)
+	if err != nil {
+		return err
+	}
+	proxies, err := streamProxies(streamServers, streamUpstreams, streamLimitConn, streamMaps, s.stream.logs)
+	if err != nil {
+		return err
+	}
+	tlsConfig := make(map[string]*tls.Config)
+	added := make(map[string]net.Listener)
+	streamAdded := make(map[string]io.Closer)
+	for k, opts := range streamAddress {
+		if _, ok := s.stream.servers[k]; ok {
+			continue
+		}
+		l, err := bindStream(opts)
+		if err != nil {
+			closeStreams(streamAdded)
+			return err
+		}
+		streamAdded[k] = l
+	}
+	// rebind are addresses kept by the new configuration with other ssl or
+	// http2 parameters, their listener is replaced before the configuration is
+	// committed.
+	rebind := make(map[string]bool)
+	for k := range serverRules {
+		opts := address[k]
+		if _, ok := s.http.serverRules[k]; ok {
+			if old := s.http.address[k]; old.ssl != opts.ssl || old.http2 != opts.http2 {
+				if opts.ssl {
+					if _, err := opts.tlsConfig(); err != nil {
+						s.closeListeners(added)
+						closeStreams(streamAdded)
+						return err
+					}
+				}
+				rebind[k] = true
+				continue
+			}
+			if opts.ssl && s.http.tls[k] != nil {
+				c, err := opts.tlsConfig()
+				if err != nil {
+					s.closeListeners(added)
+					closeStreams(streamAdded)
+					return err
+				}
+				tlsConfig[k] = c
+			}
+			continue
+		}
+		l, err := s.listen(opts)
+		if err != nil {
+			s.closeListeners(added)
+			closeStreams(streamAdded)
+			return err
+		}
+		added[k] = l
+	}
+	rebound, err := s.rebind(rebind, address)
+	if err != nil {
+		s.closeListeners(added)
+		closeStreams(streamAdded)
+		return err
+	}
+
+	// From here on the new configuration is committed.
+	old := s.http.serverRules
+	if config.limitSync != nil {
+		config.limitSync.setZones(limitReq, syncInterval)
+	}
+	startCacheZones(ctx, caches, s.http.caches)
+	if config.cacheSync != nil {
+		config.cacheSync.setZones(caches)
+	}
+	s.mu.Lock()
+	s.core = core
+	s.http.address = address
+	s.http.serverRules = serverRules
+	s.http.limitReq = limitReq
+	s.http.limitConn = limitConn
+	s.stream.limitConn = streamLimitConn
+	s.http.maps = maps
+	s.stream.maps = streamMaps
+	s.http.upstreams = upstreams
+	s.stream.upstreams = streamUpstreams
+	s.http.caches = caches
+	s.mu.Unlock()
+	grpcTransports.reset()
+	s.health.stop()
+	s.health = health
+	s.health.start(ctx)
+	s.reloadStream(ctx, streamAddress, proxies, streamAdded)
+	for k, c := range tlsConfig {
+		s.http.tls[k].Store(c)
+	}
+	for k, l := range rebound {
+		// the old server no longer accepts connections, it finishes the
+		// active ones.
+		s.mu.Lock()
+		srv := s.http.servers[k]
+		delete(s.http.servers, k)
+		delete(s.http.listeners, k)
+		s.mu.Unlock()
+		go srv.Shutdown(ctx)
+		added[k] = l
+	}
+	for k, rules := range serverRules {
+		opts := address[k]
+		if l, ok := added[k]; ok {
+			srv, err := createHTTPServer(ctx, s, vinceHandler(rules), opts)
+			if err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.http.listeners[k] = l
+			s.http.servers[k] = srv
+			s.mu.Unlock()
+			fmt.Printf("[vince] starting server on %q\n", l.Addr().String())
+			go srv.Serve(l)
+			continue
+		}
+		srv := s.http.servers[k]
+		srv.Handler.(*swapHandler).store(
+			vinceHandler(rules)(serverContext(ctx, s, opts)),
+		)
+	}
+	for k := range old {
+		if _, ok := serverRules[k]; ok {
+			continue
+		}
+		fmt.Printf("[vince] stopping server on %q\n", k)
+		s.stopServer(ctx, k)
+	}
 	return nil
 }
 
+// rebind replaces the listeners of addresses in keys with listeners using the
+// options of the new configuration. Old servers stop accepting connections on
+// these addresses but keep their active ones. When an address can't be bound
+// the old listeners are bound again and their servers accept connections as
+// before.
+func (s *serverCtx) rebind(keys map[string]bool, address map[string]httpListenOpts) (map[string]net.Listener, error) {
+	bound := make(map[string]net.Listener)
+	for k := range keys {
+		fmt.Printf("[vince] restarting server on %q\n", k)
+		s.mu.RLock()
+		old := s.http.listeners[k]
+		s.mu.RUnlock()
+		old.Close()
+		l, err := s.listen(address[k])
+		if err != nil {
+			bound[k] = nil
+			return nil, s.restore(bound, err)
+		}
+		bound[k] = l
+	}
+	return bound, nil
+}
+
+// restore binds again the listeners of the running configuration for the
+// addresses of bound after a rebind failed with err.
+func (s *serverCtx) restore(bound map[string]net.Listener, err error) error {
+	var lost []string
+	for k, l := range bound {
+		if l != nil {
+			l.Close()
+		}
+		l, err := s.listen(s.http.address[k])
+		if err != nil {
+			// the old server can't accept connections on k anymore.
+			lost = append(lost, k)
+			continue
+		}
+		s.mu.Lock()
+		s.http.listeners[k] = l
+		srv := s.http.servers[k]
+		s.mu.Unlock()
+		go srv.Serve(l)
+	}
+	if lost != nil {
+		sort.Strings(lost)
+		return fmt.Errorf("vince: %v, no server listens on %s anymore", err, strings.Join(lost, ", "))
+	}
+	return err
+}
+
+// stopServer removes the server listening on address k. Its listener is
+// closed now so that the address can be bound again, active connections are
+// finished in the background.
+func (s *serverCtx) stopServer(ctx context.Context, k string) {
+	s.mu.Lock()
+	srv := s.http.servers[k]
+	l := s.http.listeners[k]
+	delete(s.http.servers, k)
+	delete(s.http.listeners, k)
+	delete(s.http.tls, k)
+	s.mu.Unlock()
+	l.Close()
+	go srv.Shutdown(ctx)
+}
+
+// closeListeners releases listeners bound by a reload that failed.
+func (s *serverCtx) closeListeners(ls map[string]net.Listener) {
+	for k, l := range ls {
+		l.Close()
+		delete(s.http.tls, k)
+	}
+}
+
 func startEverything(mainCtx context.Context, config *vinceConfiguration, ready ...func()) error {
 	ctx, cancel := context.WithCancel(mainCtx)
 	defer cancel()
-	p := parse(config.confFile, templates.IncludeFS, defaultParseOpts())
-	if p.Errors != nil {
-		return fmt.Errorf("vince: parsing config %v", p.Errors)
+	d, err := loadConfig(config.confFile)
+	if err != nil {
+		return fmt.Errorf("vince: parsing config %v", err)
+	}
+	c, err := startCluster(config)
+	if err != nil {
+		return fmt.Errorf("vince: starting cluster %v", err)
+	}
+	if c != nil {
+		defer c.close()
 	}
-	d := &Stmt{Directive: "main"}
-	d.Blocks = p.Config[0].Parsed
 	var srvCtx serverCtx
 	srvCtx.init(ctx, d, config)
+	if err := checkConfig(srvCtx.core, config.defaultPort, config.cluster.id != ""); err != nil {
+		return fmt.Errorf("vince: invalid config %v", err)
+	}
+	srvCtx.health.start(ctx)
+	startCacheZones(ctx, srvCtx.http.caches, nil)
+	if config.limitSync != nil {
+		go config.limitSync.run(ctx)
+	}
 	ctx = context.WithValue(ctx, ngxLoggerKey{}, &cacheLogger{
 		cache: srvCtx.fileCache,
 	})
@@ -159,7 +533,7 @@ func startEverything(mainCtx context.Context, config *vinceConfiguration, ready
 	if config.management.enabled {
 		mopts := httpListenOpts{
 			net:      "tcp",
-			addrPort: fmt.Sprintf(":%d", config.management.port),
+			addrPort: net.JoinHostPort(config.management.addr, strconv.Itoa(config.management.port)),
 		}
 		ls, err := net.Listen(mopts.net, mopts.addrPort)
 		if err != nil {
@@ -167,7 +541,9 @@ func startEverything(mainCtx context.Context, config *vinceConfiguration, ready
 		}
 		srvCtx.http.listeners[mopts.addrPort] = ls
 		m := new(management)
-		m.init(srvCtx.with(mopts))
+		// management uses srvCtx directly so it sees upstreams of reloaded
+		// configurations.
+		m.init(&srvCtx)
 		s, err := createHTTPServer(ctx, &srvCtx,
 			func(ctx context.Context) http.Handler {
 				return m
@@ -183,9 +559,6 @@ func startEverything(mainCtx context.Context, config *vinceConfiguration, ready
 		return err
 	}
 
-	if len(ready) > 0 {
-		ready[0]()
-	}
 	ch := make(chan os.Signal, 2)
 	signal.Notify(
 		ch,
@@ -198,6 +571,10 @@ func startEverything(mainCtx context.Context, config *vinceConfiguration, ready
 		syscall.SIGUSR2,
 		syscall.SIGWINCH,
 	)
+	defer signal.Stop(ch)
+	if len(ready) > 0 {
+		ready[0]()
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -211,6 +588,11 @@ func startEverything(mainCtx context.Context, config *vinceConfiguration, ready
 				fmt.Println("Shutting down")
 				return srvCtx.shutdown(ctx)
 			case syscall.SIGHUP:
+				if err := srvCtx.reload(ctx, config); err != nil {
+					fmt.Printf("[vince] reload failed, keeping old configuration: %v\n", err)
+				} else {
+					fmt.Println("[vince] configuration reloaded")
+				}
 			case syscall.SIGUSR1:
 			case syscall.SIGUSR2:
 			case syscall.SIGWINCH:
@@ -232,18 +614,43 @@ type serverCtx struct {
 		serverRules    map[string][]*rule
 		listeners      map[string]net.Listener
 		servers        map[string]*http.Server
+		tls            map[string]*atomic.Value
+		upstreams      map[string]*upstreamConfig
+		limitReq       map[string]*limitReqZone
+		limitConn      map[string]*limitConnZone
+		caches         map[string]*cacheZone
+		maps           ngxMaps
 		connManager    *connManager
 		activeListener httpListenOpts
 	}
+	stream struct {
+		upstreams map[string]*upstreamConfig
+		limitConn map[string]*limitConnZone
+		maps      ngxMaps
+		address   map[string]httpListenOpts
+		servers   map[string]streamService
+		logs      *logFiles
+	}
+	health    *healthChecks
 	fileCache *readWriterCloserCache
+	// mu guards the configuration, servers and listeners which are replaced on
+	// reload while requests and the management api read them.
+	mu sync.RWMutex
 }
 
 func (s *serverCtx) with(active httpListenOpts) *serverCtx {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	n := new(serverCtx)
 	n.core = s.core
 	n.http.serverRules = s.http.serverRules
-	n.http.listeners = s.http.listeners
-	n.http.servers = s.http.servers
+	n.http.upstreams = s.http.upstreams
+	n.http.limitReq = s.http.limitReq
+	n.http.limitConn = s.http.limitConn
+	n.http.caches = s.http.caches
+	n.http.maps = s.http.maps
+	n.stream.upstreams = s.stream.upstreams
+	n.health = s.health
 	n.http.activeListener = active
 	n.fileCache = s.fileCache
 	n.http.connManager = s.http.connManager
@@ -256,7 +663,49 @@ func (s *serverCtx) handle(r *rule) func(handler) handler {
 	case "proxy_pass":
 		p := new(proxy)
 		p.init(r.parent, baseTransport)
+		p.upstreams = s.http.upstreams
+		p.caches = s.http.caches
+		if s.config != nil {
+			p.sync = s.config.cacheSync
+		}
 		return wrap(p, true)
+	case "fastcgi_pass":
+		f := &fastcgi{upstreams: s.http.upstreams}
+		if err := f.init(r.parent); err != nil {
+			return wrap(errorHandler(err), true)
+		}
+		return wrap(f, true)
+	case "uwsgi_pass", "scgi_pass":
+		c, err := newCGIPass(strings.TrimSuffix(r.name, "_pass"), r.parent, s.http.upstreams)
+		if err != nil {
+			return wrap(errorHandler(err), true)
+		}
+		return wrap(c, true)
+	case "grpc_pass":
+		g, err := newGRPCProxy(r.parent, s.http.upstreams)
+		if err != nil {
+			return wrap(errorHandler(err), true)
+		}
+		return wrap(g, true)
+	case "limit_req":
+		if !firstOf(r) {
+			// all limit_req of the level are applied by the first one
+			return nextHandler
+		}
+		h, err := newLimitReqHandler(r, s.http.limitReq)
+		if err != nil {
+			return wrap(errorHandler(err), true)
+		}
+		return h.handle
+	case "limit_conn":
+		if !firstOf(r) {
+			return nextHandler
+		}
+		h, err := newLimitConnHandler(r.parent, s.http.limitConn)
+		if err != nil {
+			return wrap(errorHandler(err), true)
+		}
+		return h.handle
 	case "allow":
 		a := new(nginxAccess)
 		a.init(r.args[0], true)
@@ -270,6 +719,27 @@ func (s *serverCtx) handle(r *rule) func(handler) handler {
 	}
 }
 
+// firstOf returns true if r is the first directive with its name in its block.
+func firstOf(r *rule) bool {
+	if r.parent == nil {
+		return true
+	}
+	for _, ch := range r.parent.children {
+		if ch.name == r.name {
+			return ch == r
+		}
+	}
+	return false
+}
+
+// errorHandler responds with 500 and logs err.
+func errorHandler(err error) handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logError(r.Context(), err.Error())
+		eRender(w, http.StatusInternalServerError)
+	})
+}
+
 func wrap(h handler, halt bool) func(handler) handler {
 	return func(next handler) handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -301,6 +771,15 @@ func (s *serverCtx) shutdown(ctx context.Context) error {
 	if err := s.http.connManager.Close(); err != nil {
 		errs = append(errs, err.Error())
 	}
+	// 4 stop stream servers, active sessions are drained until ctx is done.
+	for _, srv := range s.stream.servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := s.stream.logs.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
 	if errs != nil {
 		return fmt.Errorf("vince: error trying to graceful shutdown %q", strings.Join(errs, ","))
 	}
@@ -324,9 +803,29 @@ func (s *serverCtx) init(ctx context.Context, stmt *Stmt, cfg *vinceConfiguratio
 	s.http.serverRules = make(map[string][]*rule)
 	s.http.listeners = make(map[string]net.Listener)
 	s.http.servers = make(map[string]*http.Server)
+	s.http.tls = make(map[string]*atomic.Value)
 
 	core := ruleFromStmt(stmt, nil)
 	s.core = core
+	// errors are reported by checkConfig
+	s.stream.servers = make(map[string]streamService)
+	s.stream.logs = newLogFiles(cfg.dir)
+	s.http.upstreams, _ = collectUpstreams(core, "http")
+	s.http.limitReq, _ = collectLimitReqZones(core, nil)
+	if cfg.limitSync != nil {
+		d, _ := limitReqSyncInterval(core)
+		cfg.limitSync.setZones(s.http.limitReq, d)
+	}
+	s.http.limitConn, _ = collectLimitConnZones(core, "http", nil)
+	s.http.caches, _ = collectCacheZones(core, nil)
+	if cfg.cacheSync != nil {
+		cfg.cacheSync.setZones(s.http.caches)
+	}
+	s.stream.limitConn, _ = collectLimitConnZones(core, "stream", nil)
+	s.http.maps, _ = collectMaps(core, "http")
+	s.stream.maps, _ = collectMaps(core, "stream")
+	s.stream.upstreams, _ = collectUpstreams(core, "stream")
+	s.health, _ = collectHealthChecks(core, s.http.upstreams, s.stream.upstreams)
 	s.config = cfg
 	var fo readWriterCloserCacheOption
 	fo.defaults()
@@ -338,36 +837,53 @@ func (s *serverCtx) init(ctx context.Context, stmt *Stmt, cfg *vinceConfiguratio
 }
 
 func createHTTPServer(ctx context.Context, srv *serverCtx, hand func(context.Context) http.Handler, opts httpListenOpts) (*http.Server, error) {
-	servCtx := srv.with(opts)
-	ctx = context.WithValue(ctx, serverCtxKey{}, servCtx)
+	ctx = serverContext(ctx, srv, opts)
 	s := &http.Server{}
 	s.BaseContext = func(ls net.Listener) context.Context {
 		return srv.http.connManager.baseCtx(ctx, ls)
 	}
 	s.ConnState = srv.http.connManager.manageConnState
 	s.ConnContext = srv.http.connManager.connContext
-	s.Handler = hand(ctx)
+	if opts.http2 && !opts.ssl {
+		// cleartext HTTP/2 without upgrade, used by gRPC clients
+		s.Protocols = new(http.Protocols)
+		s.Protocols.SetHTTP1(true)
+		s.Protocols.SetUnencryptedHTTP2(true)
+	}
+	h := new(swapHandler)
+	h.store(hand(ctx))
+	s.Handler = h
 	return s, nil
 }
 
+func serverContext(ctx context.Context, srv *serverCtx, opts httpListenOpts) context.Context {
+	return context.WithValue(ctx, serverCtxKey{}, srv.with(opts))
+}
+
+// swapHandler is a http.Handler that can be replaced while serving requests.
+// Requests already in flight complete with the handler they started with.
+type swapHandler struct {
+	h atomic.Value
+}
+
+func (s *swapHandler) store(h http.Handler) {
+	s.h.Store(&h)
+}
+
+func (s *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.h.Load().(*http.Handler)).ServeHTTP(w, r)
+}
+
+// matchWildCard returns true if s matches name wild with a mask at the start
+// like *.example.com or at the end like mail.*.
 func matchWildCard(s string, wild string) bool {
-	wp := strings.Split(wild, ".")
-	sp := strings.Split(s, ".")
-	if len(sp) < len(wp) {
-		return false
+	switch {
+	case strings.HasPrefix(wild, "*."):
+		return len(s) > len(wild)-1 && strings.HasSuffix(s, wild[1:])
+	case strings.HasSuffix(wild, ".*"):
+		return len(s) > len(wild)-1 && strings.HasPrefix(s, wild[:len(wild)-1])
 	}
-	sidx := 0
-	widx := 0
-	for ; sidx < len(sp); sidx++ {
-		if wp[widx] == "*" {
-			continue
-		}
-		if !(widx < len(wp) && sp[sidx] == wp[widx]) {
-			return false
-		}
-		widx++
-	}
-	return true
+	return s == wild
 }
 
 func isWildCard(w string) bool {
@@ -390,107 +906,133 @@ const (
 	matchCaret
 	matchPrefix
 	matchRegexp
+	matchNamed
 )
 
 type match struct {
-	kind matchKind
-	rule *rule
-	re   *regexp.Regexp
+	kind    matchKind
+	rule    *rule
+	re      *regexp.Regexp
+	nested  *locationMatch
+	rewrite rewriteScript
+	errors  *errorPages
+	headers *responseHeaders
 }
 
-func (ls *locationMatch) match(path string) *match {
-	for i := 0; i < len(ls.rules); i++ {
-		if ls.rules[i].kind == matchExact && ls.rules[i].rule.args[1] == path {
-			return ls.rules[i]
-		}
+// prefix returns the uri prefix matched by prefix and ^~ locations.
+func (m *match) prefix() string {
+	if m.kind == matchCaret {
+		return m.rule.args[1]
 	}
-	var m []*match
-	for i := 0; i < len(ls.rules); i++ {
-		switch ls.rules[i].kind {
-		case matchPrefix:
-			if strings.HasPrefix(path, ls.rules[i].rule.args[0]) {
-				m = append(m, ls.rules[i])
+	return m.rule.args[0]
+}
+
+func (ls *locationMatch) match(path string) *match {
+	var selected *match
+	for _, m := range ls.rules {
+		switch m.kind {
+		case matchExact:
+			if m.rule.args[1] == path {
+				return m
 			}
-		case matchCaret:
-			if strings.HasPrefix(path, ls.rules[i].rule.args[1]) {
-				m = append(m, ls.rules[i])
+		case matchPrefix, matchCaret:
+			p := m.prefix()
+			if strings.HasPrefix(path, p) {
+				if selected == nil || len(p) > len(selected.prefix()) {
+					selected = m
+				}
 			}
 		}
 	}
-	var selected *match
-	if m != nil {
-		sort.Slice(m, func(i, j int) bool {
-			return m[i].rule.args[i] > m[i].rule.args[j]
-		})
-		selected = m[0]
+	if selected != nil {
 		if selected.kind == matchCaret {
 			return selected
 		}
-	}
-	var up *locationMatch
-	if selected != nil {
-		up = new(locationMatch)
-		up.load(selected.rule)
-	}
-	if up != nil {
-		for i := 0; i < len(up.rules); i++ {
-			if up.rules[i].kind == matchRegexp {
-				if up.rules[i].re.MatchString(path) {
-					return up.rules[i]
-				}
+		if n := selected.nested.match(path); n != nil {
+			if n.kind != matchPrefix {
+				return n
 			}
+			selected = n
 		}
 	}
-	if up != nil {
-		for i := 0; i < len(up.rules); i++ {
-			if ls.rules[i].kind == matchRegexp {
-				if ls.rules[i].re.MatchString(path) {
-					return ls.rules[i]
-				}
-			}
+	for _, m := range ls.rules {
+		if m.kind == matchRegexp && m.re.MatchString(path) {
+			return m
 		}
 	}
+	return selected
+}
 
-	if selected != nil {
-		return selected
+// named returns location @name defined in the server block.
+func (ls *locationMatch) named(name string) *match {
+	for _, m := range ls.rules {
+		if m.kind == matchNamed && m.rule.args[0] == name {
+			return m
+		}
 	}
 	return nil
 }
 
-func (ls *locationMatch) load(srv *rule) {
+func (ls *locationMatch) load(srv *rule) error {
 	for _, ch := range srv.children {
 		if ch.name == "location" {
-			switch len(ch.args) {
-			case 1:
-				ls.rules = append(ls.rules, &match{
-					kind: matchPrefix,
-					rule: ch,
-				})
-			case 2:
-				// with modifiers
-				switch ch.args[0] {
-				case "=":
-					ls.rules = append(ls.rules, &match{
-						kind: matchExact,
-						rule: ch,
-					})
-				case "~":
-					r := &match{rule: ch, kind: matchRegexp}
-					r.re = regexp.MustCompile(ch.args[1])
-					ls.rules = append(ls.rules, r)
-				case "~*":
-					r := &match{rule: ch, kind: matchRegexp}
-					r.re = regexp.MustCompile("(?i)" + ch.args[1])
-					ls.rules = append(ls.rules, r)
-				case "^~":
-					ls.rules = append(ls.rules, &match{
-						kind: matchCaret,
-						rule: ch,
-					})
-				}
+			m, err := newMatch(ch)
+			if err != nil {
+				return ch.wrap(err)
 			}
+			m.rewrite, err = compileRewrite(ch)
+			if err != nil {
+				return err
+			}
+			m.errors, err = compileErrorPages(ch)
+			if err != nil {
+				return err
+			}
+			m.headers, err = compileResponseHeaders(ch)
+			if err != nil {
+				return err
+			}
+			m.nested = new(locationMatch)
+			if err := m.nested.load(ch); err != nil {
+				return err
+			}
+			ls.rules = append(ls.rules, m)
 		}
 	}
+	return nil
+}
+
+// newMatch compiles location directive r.
+func newMatch(r *rule) (*match, error) {
+	switch len(r.args) {
+	case 1:
+		if strings.HasPrefix(r.args[0], "@") {
+			return &match{kind: matchNamed, rule: r}, nil
+		}
+		return &match{kind: matchPrefix, rule: r}, nil
+	case 2:
+		// with modifiers
+		switch r.args[0] {
+		case "=":
+			return &match{kind: matchExact, rule: r}, nil
+		case "~":
+			re, err := regexp.Compile(r.args[1])
+			if err != nil {
+				return nil, err
+			}
+			return &match{kind: matchRegexp, rule: r, re: re}, nil
+		case "~*":
+			re, err := regexp.Compile("(?i)" + r.args[1])
+			if err != nil {
+				return nil, err
+			}
+			return &match{kind: matchRegexp, rule: r, re: re}, nil
+		case "^~":
+			return &match{kind: matchCaret, rule: r}, nil
+		}
+		return nil, fmt.Errorf("vince: invalid location modifier %q", r.args[0])
+	}
+	return nil, errors.New("vince: invalid number of arguments in location")
 }
 
 type handlerMatch struct {
@@ -510,7 +1052,11 @@ func (h *handlerMatch) init(servers []*rule, defaultServer *rule) {
 			if ch.name == "server_name" {
 				for _, a := range ch.args {
 					if a[0] == '~' {
-						re := regexp.MustCompile(a[1:])
+						re, err := compileServerName(a)
+						if err != nil {
+							// already reported by checkConfig
+							continue
+						}
 						h.regExp[re] = srv
 						continue
 					}
@@ -530,6 +1076,12 @@ func (h *handlerMatch) init(servers []*rule, defaultServer *rule) {
 	}
 }
 
+// compileServerName compiles a regular expression server name, the leading ~
+// is stripped.
+func compileServerName(name string) (*regexp.Regexp, error) {
+	return regexp.Compile(name[1:])
+}
+
 func (h *handlerMatch) find(name string) *rule {
 	if r, ok := h.exact[name]; ok {
 		return r[0]
@@ -562,9 +1114,9 @@ func vinceHandler(servers []*rule) func(context.Context) http.Handler {
 		hm.init(servers, srvCtx.http.defaultServer[srvCtx.http.activeListener.addrPort])
 		location := new(sync.Map)
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w, r = withVariables(w, r)
 			ctx := r.Context()
-			variable := ctx.Value(variables{}).(map[string]interface{})
-			setRequestVariables(variable, r)
+			ctxVariables(ctx).maps = srvCtx.http.maps
 			var srv *rule
 			if len(servers) == 1 {
 				srv = servers[0]
@@ -574,25 +1126,238 @@ func vinceHandler(servers []*rule) func(context.Context) http.Handler {
 			if srv == nil {
 				srv = servers[0]
 			}
-			var loc *locationMatch
+			var loc *locationHandler
 			if v, ok := location.Load(srv); ok {
-				loc = v.(*locationMatch)
+				loc = v.(*locationHandler)
 			} else {
-				loc = new(locationMatch)
-				loc.load(srv)
+				loc = &locationHandler{ctx: srvCtx, server: srv}
+				if err := loc.load(); err != nil {
+					logError(ctx, err.Error())
+					eRender(w, http.StatusInternalServerError)
+					return
+				}
 				location.Store(srv, loc)
 			}
-			if l := loc.match(r.URL.Path); l != nil {
-				c := l.rule.collect(nil)
-				variable[vRequestMatchKind] = l
-				srvCtx.chain(overide(c)...).then(nil).ServeHTTP(w, r)
-				return
-			}
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			loc.ServeHTTP(w, r)
 		})
 	}
 }
 
+type (
+	locationHandlerKey  struct{}
+	internalRedirectKey struct{}
+)
+
+// maxInternalRedirects is the number of times a request can be internally
+// redirected before it is considered a loop. This is the same value used by
+// nginx.
+const maxInternalRedirects = 10
+
+// locationHandler dispatches requests to the locations of a server block.
+type locationHandler struct {
+	ctx      *serverCtx
+	server   *rule
+	location locationMatch
+	// rewrite are rewrite module directives of the server block, they are
+	// executed before searching a location.
+	rewrite rewriteScript
+	// errors and headers are error pages and response fields used until a
+	// location is found.
+	errors  *errorPages
+	headers *responseHeaders
+	// handlers are the compiled handlers of locations and if blocks by their
+	// rule, they are built once for the configuration.
+	handlers sync.Map
+}
+
+// locationHandlers are the handlers of a location or an if block.
+type locationHandlers struct {
+	// chain runs the directives of the location then content.
+	chain   handler
+	content handler
+	// errors and headers are the error pages and response fields of if
+	// blocks, err is set when they could not be compiled.
+	errors  *errorPages
+	headers *responseHeaders
+	err     error
+}
+
+// handler returns the handlers of location m.
+func (l *locationHandler) handler(m *match) *locationHandlers {
+	if v, ok := l.handlers.Load(m.rule); ok {
+		return v.(*locationHandlers)
+	}
+	h := &locationHandlers{content: l.ctx.content(m)}
+	h.chain = l.ctx.chain(overide(m.rule.collect(nil))...).then(h.content)
+	if m.rule.name == "if" {
+		h.errors, h.err = compileErrorPages(m.rule)
+		if h.err == nil {
+			h.headers, h.err = compileResponseHeaders(m.rule)
+		}
+	}
+	v, _ := l.handlers.LoadOrStore(m.rule, h)
+	return v.(*locationHandlers)
+}
+
+func (l *locationHandler) load() error {
+	s, err := compileRewrite(l.server)
+	if err != nil {
+		return err
+	}
+	l.rewrite = s
+	l.errors, err = compileErrorPages(l.server)
+	if err != nil {
+		return err
+	}
+	l.headers, err = compileResponseHeaders(l.server)
+	if err != nil {
+		return err
+	}
+	return l.location.load(l.server)
+}
+
+func (l *locationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(context.WithValue(r.Context(), locationHandlerKey{}, l))
+	ctxVariables(r.Context()).setRequest(r)
+	out, r, ep := interceptErrors(w, r, l.errors)
+	out, r, hw := withResponseHeaders(out, r, l.headers)
+	r, _, action := l.rewrite.run(out, r)
+	if action != rewriteDone {
+		l.find(out, r)
+	}
+	hw.finish()
+	sendErrorPage(w, r, ep)
+}
+
+// find serves r with the location matching its uri.
+func (l *locationHandler) find(w http.ResponseWriter, r *http.Request) {
+	if m := l.location.match(r.URL.Path); m != nil {
+		l.serve(w, r, m)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
+func (l *locationHandler) serve(w http.ResponseWriter, r *http.Request, m *match) {
+	ctx := context.WithValue(r.Context(), locationHandlerKey{}, l)
+	r = r.WithContext(ctx)
+	variable := ctxVariables(ctx)
+	variable.setRequest(r)
+	if variable != nil {
+		variable.match = m
+		if m.kind == matchRegexp {
+			variable.setMatch(m.re, m.re.FindStringSubmatch(r.URL.Path))
+		}
+	}
+	out, r, ep := interceptErrors(w, r, m.errors)
+	out, r, hw := withResponseHeaders(out, r, m.headers)
+	r, block, action := m.rewrite.run(out, r)
+	switch action {
+	case rewriteDone:
+		hw.finish()
+		sendErrorPage(w, r, ep)
+		return
+	case rewriteLast:
+		// the uri was changed, a location is searched again without running
+		// rewrite directives of the server.
+		r, ok := redirected(r)
+		if !ok {
+			eRender(w, http.StatusInternalServerError)
+			return
+		}
+		l.find(w, r)
+		return
+	}
+	if block != nil {
+		// an if block matched, its configuration is used for the rest of
+		// the request.
+		m = &match{kind: m.kind, rule: block, re: m.re, nested: m.nested}
+		if variable != nil {
+			variable.match = m
+		}
+	}
+	h := l.handler(m)
+	if block != nil {
+		if h.err != nil {
+			logError(r.Context(), h.err.Error())
+			eRender(w, http.StatusInternalServerError)
+			return
+		}
+		// error_page and add_header of the if block replace the ones of the
+		// location.
+		out, r, ep = interceptErrors(w, r, h.errors)
+		out, r, hw = withResponseHeaders(out, r, h.headers)
+	}
+	out = limitRate(out, r, m.rule)
+	h.chain.ServeHTTP(out, r)
+	hw.finish()
+	sendErrorPage(w, r, ep)
+}
+
+// redirected returns a copy of r that has gone through one more internal
+// redirect. ok is false when the redirect limit is reached.
+func redirected(r *http.Request) (*http.Request, bool) {
+	ctx := r.Context()
+	n := 0
+	if v := ctx.Value(internalRedirectKey{}); v != nil {
+		n = v.(int)
+	}
+	if n >= maxInternalRedirects {
+		logError(ctx, fmt.Sprintf("rewrite or internal redirection cycle while processing %q", r.URL.Path))
+		return nil, false
+	}
+	return r.WithContext(context.WithValue(ctx, internalRedirectKey{}, n+1)), true
+}
+
+// internalRedirect serves r as if it was requested with uri. Location matching
+// is done again for the new uri.
+func internalRedirect(w http.ResponseWriter, r *http.Request, uri string) {
+	l, ok := r.Context().Value(locationHandlerKey{}).(*locationHandler)
+	if !ok {
+		eRender(w, http.StatusInternalServerError)
+		return
+	}
+	r, ok = redirected(r)
+	if !ok {
+		eRender(w, http.StatusInternalServerError)
+		return
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		eRender(w, http.StatusInternalServerError)
+		return
+	}
+	n := *r.URL
+	n.Path = u.Path
+	n.RawPath = ""
+	if u.RawQuery != "" {
+		n.RawQuery = u.RawQuery
+	}
+	r.URL = &n
+	l.ServeHTTP(w, r)
+}
+
+// namedRedirect serves r with named location @name.
+func namedRedirect(w http.ResponseWriter, r *http.Request, name string) {
+	l, ok := r.Context().Value(locationHandlerKey{}).(*locationHandler)
+	if !ok {
+		eRender(w, http.StatusInternalServerError)
+		return
+	}
+	m := l.location.named(name)
+	if m == nil {
+		logError(r.Context(), fmt.Sprintf("could not find named location %q", name))
+		eRender(w, http.StatusInternalServerError)
+		return
+	}
+	r, ok = redirected(r)
+	if !ok {
+		eRender(w, http.StatusInternalServerError)
+		return
+	}
+	l.serve(w, r, m)
+}
+
 type handler interface {
 	ServeHTTP(http.ResponseWriter, *http.Request)
 }
@@ -615,16 +1380,19 @@ func (notFoundHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 }
 
-func findListener(r *rule, port int) []httpListenOpts {
+func findListener(r *rule, port int) ([]httpListenOpts, error) {
 	p := strconv.Itoa(port)
 	var ls []httpListenOpts
 	for _, v := range r.children {
 		if v.name == "listen" {
-			ls = append(ls, parseListen(v, p))
-			continue
+			o, err := parseListen(v, p)
+			if err != nil {
+				return nil, v.wrap(err)
+			}
+			ls = append(ls, o)
 		}
 	}
-	return ls
+	return ls, nil
 }
 
 func start(ctx *cli.Context) error {
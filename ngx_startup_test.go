@@ -1,7 +1,231 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
 
 func TesVinceHandler(t *testing.T) {
 
 }
+
+func TestReload(t *testing.T) {
+	file := `daemon off;
+events {
+}
+http {
+    server {
+        listen       127.0.0.1:8090;
+        location /reload {
+            deny all;
+        }
+    }
+}
+`
+	reloaded := `daemon off;
+events {
+}
+http {
+    server {
+        listen       127.0.0.1:8090;
+        location /reload {
+            allow all;
+        }
+    }
+    server {
+        listen       127.0.0.1:8091;
+        location /reload {
+            deny all;
+        }
+    }
+}
+`
+	invalid := `daemon off;
+events {
+}
+http {
+    server {
+        listen       127.0.0.1:8091;
+        location ~ ^/(reload {
+            allow all;
+        }
+    }
+}
+`
+	removed := `daemon off;
+events {
+}
+http {
+    server {
+        listen       127.0.0.1:8091;
+        location /reload {
+            allow all;
+        }
+    }
+}
+`
+	// the listener is bound again when http2 is added
+	http2 := `daemon off;
+events {
+}
+http {
+    server {
+        listen       127.0.0.1:8091 http2;
+        location /reload {
+            allow all;
+        }
+    }
+}
+`
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	hup := func(conf string) testKase {
+		return func(ctx context.Context, t *testing.T) {
+			if err := ioutil.WriteFile(c.confFile, []byte(conf), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitCode := func(uri string, code int) testKase {
+		return func(ctx context.Context, t *testing.T) {
+			var got int
+			for i := 0; i < 50; i++ {
+				res, err := http.Get(uri)
+				if err == nil {
+					res.Body.Close()
+					got = res.StatusCode
+					if got == code {
+						return
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			t.Errorf("%s: expected %d got %d", uri, code, got)
+		}
+	}
+	waitDown := func(uri string) testKase {
+		return func(ctx context.Context, t *testing.T) {
+			for i := 0; i < 50; i++ {
+				res, err := http.Get(uri)
+				if err != nil {
+					return
+				}
+				res.Body.Close()
+				time.Sleep(20 * time.Millisecond)
+			}
+			t.Errorf("%s: expected server to be stopped", uri)
+		}
+	}
+	runTest(t, c,
+		runHTTP(http.MethodGet, "http://127.0.0.1:8090/reload", nil, checkCode(http.StatusForbidden)),
+		hup(reloaded),
+		waitCode("http://127.0.0.1:8090/reload", http.StatusNotFound),
+		waitCode("http://127.0.0.1:8091/reload", http.StatusForbidden),
+		hup(invalid),
+		// give vince time to reject the configuration
+		func(ctx context.Context, t *testing.T) { time.Sleep(100 * time.Millisecond) },
+		runHTTP(http.MethodGet, "http://127.0.0.1:8090/reload", nil, checkCode(http.StatusNotFound)),
+		runHTTP(http.MethodGet, "http://127.0.0.1:8091/reload", nil, checkCode(http.StatusForbidden)),
+		hup(removed),
+		waitCode("http://127.0.0.1:8091/reload", http.StatusNotFound),
+		waitDown("http://127.0.0.1:8090/reload"),
+		hup(http2),
+		func(ctx context.Context, t *testing.T) {
+			p := new(http.Protocols)
+			p.SetUnencryptedHTTP2(true)
+			tr := &http.Transport{Protocols: p}
+			defer tr.CloseIdleConnections()
+			client := &http.Client{Transport: tr}
+			for i := 0; i < 50; i++ {
+				res, err := client.Get("http://127.0.0.1:8091/reload")
+				if err == nil {
+					res.Body.Close()
+					if res.StatusCode == http.StatusNotFound && res.ProtoMajor == 2 {
+						return
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			t.Error("expected the server to speak HTTP/2 after reload")
+		},
+	)
+}
+
+func TestRebindRestore(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := l.Addr().String()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})}
+	defer srv.Close()
+	go srv.Serve(l)
+	s := new(serverCtx)
+	s.http.address = map[string]httpListenOpts{k: {net: "tcp", addrPort: k}}
+	s.http.listeners = map[string]net.Listener{k: l}
+	s.http.servers = map[string]*http.Server{k: srv}
+	s.http.tls = make(map[string]*atomic.Value)
+	// the new listener can't be bound, the old server keeps serving k
+	if _, err := s.rebind(map[string]bool{k: true}, map[string]httpListenOpts{
+		k: {net: "invalid", addrPort: k},
+	}); err == nil {
+		t.Fatal("expected an error")
+	}
+	res, err := http.Get("http://" + k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTeapot {
+		t.Errorf("expected the old server to answer got %d", res.StatusCode)
+	}
+}
+
+func TestLocationHandlerCache(t *testing.T) {
+	srv := &rule{name: "server"}
+	loc := &rule{name: "location", args: []string{"/"}, parent: srv}
+	loc.children = []*rule{{name: "grpc_pass", args: []string{"127.0.0.1:50051"}, parent: loc}}
+	srv.children = []*rule{loc}
+	l := &locationHandler{ctx: new(serverCtx), server: srv}
+	if err := l.load(); err != nil {
+		t.Fatal(err)
+	}
+	m := l.location.match("/")
+	if m == nil {
+		t.Fatal("expected location / to match")
+	}
+	// handlers are compiled once for the configuration
+	if a, b := l.handler(m), l.handler(m); a != b {
+		t.Error("expected the handlers of the location to be reused")
+	}
+	// error pages and response fields of if blocks are compiled with them
+	block := &rule{name: "if", args: []string{"$arg_a"}, parent: loc}
+	block.children = []*rule{{name: "add_header", args: []string{"X-If", "1"}, parent: block}}
+	h := l.handler(&match{kind: m.kind, rule: block})
+	if h.err != nil || h.headers == nil || len(h.headers.headers) != 1 {
+		t.Fatalf("expected the fields of the if block got %v", h.err)
+	}
+	if l.handler(&match{kind: m.kind, rule: block}).headers != h.headers {
+		t.Error("expected the fields of the if block to be reused")
+	}
+	invalid := &rule{name: "if", args: []string{"$arg_b"}, parent: loc}
+	invalid.children = []*rule{{name: "expires", args: []string{"soon"}, parent: invalid}}
+	if h := l.handler(&match{kind: m.kind, rule: invalid}); h.err == nil {
+		t.Error("expected an error for the invalid if block")
+	}
+}
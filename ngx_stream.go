@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultStreamLogFormat = `$remote_addr [$time_local] $protocol $status $bytes_sent $bytes_received $session_time "$upstream_addr"`
+
+// streamOption is the configuration of a server in the stream block.
+type streamOption struct {
+	pass           stringTemplateValue
+	connectTimeout durationValue
+	timeout        durationValue
+	responses      intValue
+	sslPreread     boolValue
+	prereadTimeout durationValue
+	prereadBuffer  intValue
+	uploadRate     intValue
+	downloadRate   intValue
+	accessLog      streamAccessLog
+	formats        map[string]string
+}
+
+type streamAccessLog struct {
+	set    bool
+	off    bool
+	path   string
+	format string
+}
+
+func (o *streamOption) defaults() {
+	o.connectTimeout.store(60 * time.Second)
+	o.timeout.store(10 * time.Minute)
+	o.prereadTimeout.store(defaultPrereadTimeout)
+	o.prereadBuffer.store(defaultPrereadBufferSize)
+	o.formats = make(map[string]string)
+}
+
+// load loads directives of the stream server r, directives in the stream block
+// are loaded first.
+func (o *streamOption) load(r *rule) error {
+	if r.name == "server" && r.parent != nil {
+		if err := o.load(r.parent); err != nil {
+			return err
+		}
+	}
+	for _, ch := range r.children {
+		if err := o.loadKey(ch); err != nil {
+			return ch.wrap(err)
+		}
+	}
+	return nil
+}
+
+func (o *streamOption) loadKey(r *rule) error {
+	switch r.name {
+	case "proxy_pass":
+		o.pass.store(r.args[0])
+	case "proxy_connect_timeout":
+		d, err := parseDuration(r.args[0])
+		if err != nil {
+			return err
+		}
+		o.connectTimeout.store(d)
+	case "proxy_timeout":
+		d, err := parseDuration(r.args[0])
+		if err != nil {
+			return err
+		}
+		o.timeout.store(d)
+	case "proxy_responses":
+		n, err := strconv.ParseInt(r.args[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("vince: invalid proxy_responses %q", r.args[0])
+		}
+		o.responses.store(n)
+	case "ssl_preread":
+		o.sslPreread.store(r.args[0] == "on")
+	case "preread_timeout":
+		d, err := parseDuration(r.args[0])
+		if err != nil {
+			return err
+		}
+		o.prereadTimeout.store(d)
+	case "preread_buffer_size":
+		n, err := parseSize(r.args[0])
+		if err != nil {
+			return err
+		}
+		o.prereadBuffer.store(n)
+	case "proxy_upload_rate":
+		n, err := parseSize(r.args[0])
+		if err != nil {
+			return err
+		}
+		o.uploadRate.store(n)
+	case "proxy_download_rate":
+		n, err := parseSize(r.args[0])
+		if err != nil {
+			return err
+		}
+		o.downloadRate.store(n)
+	case "log_format":
+		if len(r.args) < 2 {
+			return errors.New("vince: log_format requires name and format")
+		}
+		args := r.args[1:]
+		if strings.HasPrefix(args[0], "escape=") {
+			args = args[1:]
+		}
+		if o.formats == nil {
+			o.formats = make(map[string]string)
+		}
+		o.formats[r.args[0]] = strings.Join(args, "")
+	case "access_log":
+		o.accessLog = streamAccessLog{set: true}
+		if r.args[0] == "off" {
+			o.accessLog.off = true
+			return nil
+		}
+		o.accessLog.path = r.args[0]
+		if len(r.args) > 1 {
+			o.accessLog.format = r.args[1]
+		}
+	}
+	return nil
+}
+
+// format returns the template used by access_log.
+func (o *streamOption) format() (string, error) {
+	if o.accessLog.format == "" {
+		return defaultStreamLogFormat, nil
+	}
+	f, ok := o.formats[o.accessLog.format]
+	if !ok {
+		return "", fmt.Errorf("vince: unknown log format %q", o.accessLog.format)
+	}
+	return f, nil
+}
+
+// collectStreamServers groups server blocks in the stream block by the address
+// they listen on. Unlike http, only one stream server can listen on an address.
+func collectStreamServers(core *rule) (map[string]httpListenOpts, map[string]*rule, error) {
+	address := make(map[string]httpListenOpts)
+	servers := make(map[string]*rule)
+	for _, base := range core.children {
+		if base.name != "stream" {
+			continue
+		}
+		for _, srv := range base.children {
+			if srv.name != "server" {
+				continue
+			}
+			for _, l := range srv.children {
+				if l.name != "listen" {
+					continue
+				}
+				ls, err := parseListen(l, "")
+				if err != nil {
+					return nil, nil, l.wrap(err)
+				}
+				if ls.ssl {
+					return nil, nil, l.wrap(errors.New("vince: ssl is not supported in stream listen"))
+				}
+				// tcp and udp servers can share the same port
+				key := ls.addrPort
+				if ls.net == "udp" {
+					key = "udp:" + key
+				}
+				if _, ok := servers[key]; ok {
+					return nil, nil, l.wrap(fmt.Errorf("vince: duplicate %q address and port pair", ls.addrPort))
+				}
+				address[key] = ls
+				servers[key] = srv
+			}
+		}
+	}
+	return address, servers, nil
+}
+
+// streamProxy passes connections of a stream server to proxy_pass.
+type streamProxy struct {
+	opts      streamOption
+	upstreams map[string]*upstreamConfig
+	limitConn *limitConnHandler
+	maps      ngxMaps
+	logs      *logFiles
+	format    *stringTemplateValue
+}
+
+func newStreamProxy(r *rule, upstreams map[string]*upstreamConfig, zones map[string]*limitConnZone, maps ngxMaps, logs *logFiles) (*streamProxy, error) {
+	p := &streamProxy{upstreams: upstreams, maps: maps, logs: logs}
+	p.opts.defaults()
+	if err := p.opts.load(r); err != nil {
+		return nil, err
+	}
+	l, err := newLimitConnHandler(r, zones)
+	if err != nil {
+		return nil, err
+	}
+	if l.limits != nil {
+		p.limitConn = l
+	}
+	if !p.opts.pass.set {
+		return nil, r.wrap(errors.New("vince: no proxy_pass in stream server"))
+	}
+	if p.opts.accessLog.set && !p.opts.accessLog.off {
+		f, err := p.opts.format()
+		if err != nil {
+			return nil, r.wrap(err)
+		}
+		p.format = new(stringTemplateValue)
+		p.format.store(f)
+	}
+	return p, nil
+}
+
+// streamProxies creates proxies for stream servers.
+func streamProxies(servers map[string]*rule, upstreams map[string]*upstreamConfig, zones map[string]*limitConnZone, maps ngxMaps, logs *logFiles) (map[string]*streamProxy, error) {
+	o := make(map[string]*streamProxy)
+	for k, r := range servers {
+		p, err := newStreamProxy(r, upstreams, zones, maps, logs)
+		if err != nil {
+			return nil, err
+		}
+		o[k] = p
+	}
+	return o, nil
+}
+
+func (p *streamProxy) serveConn(ctx context.Context, conn net.Conn) {
+	v := newStreamVariables(conn.LocalAddr(), conn.RemoteAddr(), "TCP")
+	v.maps = p.maps
+	var stats proxyStats
+	status := p.proxy(ctx, conn, v, &stats)
+	v.Set(vStatus, strconv.Itoa(status))
+	v.Set(vBytesSent, strconv.FormatInt(stats.localWrite, 10))
+	v.Set(vBytesReceived, strconv.FormatInt(stats.localRead, 10))
+	v.Set(vUpstreamBytesSent, strconv.FormatInt(stats.remoteWrite, 10))
+	v.Set(vUpstreamBytesReceived, strconv.FormatInt(stats.remoteRead, 10))
+	v.Set(vSessionTime, formatSessionTime(time.Since(v.start)))
+	p.log(ctx, v)
+}
+
+// proxy passes conn to proxy_pass and returns the session status.
+func (p *streamProxy) proxy(ctx context.Context, conn net.Conn, v *ngxVariables, stats *proxyStats) int {
+	if p.limitConn != nil {
+		status, release, ok := p.limitConn.acquire(ctx, v)
+		v.Set(vLimitConnStatus, status)
+		if !ok {
+			return 503
+		}
+		defer release()
+	}
+	if p.opts.sslPreread.value {
+		var err error
+		conn, err = p.preread(conn, v)
+		if err != nil {
+			show(ctx, err)
+			return 400
+		}
+	}
+	remote, err := p.connect(ctx, "tcp", conn.RemoteAddr(), v)
+	if err != nil {
+		show(ctx, err)
+		return 502
+	}
+	v.Set(vUpstreamConnectTime, formatSessionTime(time.Since(v.start)))
+	*stats, _ = proxyConn(ctx, proxyConnOpts{
+		local: connConfig{
+			readTimeout:  p.opts.timeout.value,
+			writeTimeout: p.opts.timeout.value,
+			readRate:     p.opts.uploadRate.value,
+		},
+		remote: connConfig{
+			readTimeout:  p.opts.timeout.value,
+			writeTimeout: p.opts.timeout.value,
+			readRate:     p.opts.downloadRate.value,
+		},
+	}, conn, remote)
+	return 200
+}
+
+// formatSessionTime formats d in seconds with millisecond resolution.
+func formatSessionTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// connect connects to proxy_pass for a client at remote, network is tcp or
+// udp. When proxy_pass is an upstream peers are tried in turn until one accepts
+// the connection.
+func (p *streamProxy) connect(ctx context.Context, network string, remote net.Addr, v *ngxVariables) (net.Conn, error) {
+	target := p.opts.pass.Value(v)
+	d := net.Dialer{Timeout: p.opts.connectTimeout.value}
+	u, ok := p.upstreams[target]
+	if !ok {
+		v.Set(vUpstreamAddr, target)
+		return dialStream(ctx, &d, network, target)
+	}
+	key := u.key(v, remote.String())
+	tried := make(peerSet)
+	var addrs []string
+	var err error
+	defer func() {
+		v.Set(vUpstreamAddr, strings.Join(addrs, ", "))
+	}()
+	for {
+		peer := u.next(key, tried)
+		if peer == nil {
+			if err == nil {
+				err = fmt.Errorf("%v while connecting to upstream %q", errNoLiveUpstreams, u.name)
+			}
+			return nil, err
+		}
+		tried[peer] = true
+		addrs = append(addrs, peer.addr)
+		peer.acquire()
+		var c net.Conn
+		c, err = dialStream(ctx, &d, network, peer.addr)
+		if err != nil {
+			peer.release()
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			peer.failed(time.Now())
+			continue
+		}
+		peer.succeeded()
+		return &peerConn{Conn: c, peer: peer}, nil
+	}
+}
+
+// dialStream connects to proxy_pass address a, this can be host:port or a
+// unix: socket path.
+func dialStream(ctx context.Context, d *net.Dialer, network, a string) (net.Conn, error) {
+	if strings.HasPrefix(a, "unix:") {
+		if network == "udp" {
+			network = "unixgram"
+		} else {
+			network = "unix"
+		}
+		return d.DialContext(ctx, network, strings.TrimPrefix(a, "unix:"))
+	}
+	return d.DialContext(ctx, network, a)
+}
+
+// peerConn releases the peer when the connection is closed.
+type peerConn struct {
+	net.Conn
+	peer *upstreamPeer
+	once sync.Once
+}
+
+func (c *peerConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.peer.release)
+	return err
+}
+
+func (p *streamProxy) log(ctx context.Context, v *ngxVariables) {
+	if p.format == nil {
+		return
+	}
+	line := p.format.Value(v)
+	if err := p.logs.write(p.opts.accessLog.path, line); err != nil {
+		show(ctx, err)
+	}
+}
+
+// logFiles are access log files opened for appending. Relative paths are
+// resolved against dir.
+type logFiles struct {
+	dir   string
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+func newLogFiles(dir string) *logFiles {
+	return &logFiles{dir: dir, files: make(map[string]*os.File)}
+}
+
+func (l *logFiles) write(name, line string) error {
+	if name == "/dev/null" {
+		return nil
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(l.dir, name)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.files[name]
+	if !ok {
+		var err error
+		f, err = os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		l.files[name] = f
+	}
+	_, err := f.WriteString(line + "\n")
+	return err
+}
+
+// Close closes all files, they are opened again on the next write.
+func (l *logFiles) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var errs []string
+	for k, f := range l.files {
+		if err := f.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+		delete(l.files, k)
+	}
+	if errs != nil {
+		return errors.New(strings.Join(errs, ","))
+	}
+	return nil
+}
+
+// startStream binds stream listeners and starts serving them.
+func (s *serverCtx) startStream(ctx context.Context) error {
+	address, servers, err := collectStreamServers(s.core)
+	if err != nil {
+		return err
+	}
+	proxies, err := streamProxies(servers, s.stream.upstreams, s.stream.limitConn, s.stream.maps, s.stream.logs)
+	if err != nil {
+		return err
+	}
+	s.stream.address = address
+	for k, p := range proxies {
+		l, err := bindStream(address[k])
+		if err != nil {
+			return err
+		}
+		s.serveStream(ctx, k, l, p)
+	}
+	return nil
+}
+
+// streamService is a running tcp or udp stream server.
+type streamService interface {
+	store(sm stream)
+	Shutdown(ctx context.Context) error
+}
+
+// bindStream binds the stream listen address opts. This returns a
+// net.PacketConn for udp and net.Listener otherwise.
+func bindStream(opts httpListenOpts) (io.Closer, error) {
+	if opts.net == "udp" {
+		return net.ListenPacket(opts.net, opts.addrPort)
+	}
+	return net.Listen(opts.net, opts.addrPort)
+}
+
+// closeStreams releases stream sockets bound by a reload that failed.
+func closeStreams(ls map[string]io.Closer) {
+	for _, l := range ls {
+		l.Close()
+	}
+}
+
+// reloadStream applies stream servers of a new configuration. Servers on
+// addresses present in both configurations swap their proxy, sessions that
+// are already established are not interrupted. added are listeners bound for
+// new addresses.
+func (s *serverCtx) reloadStream(ctx context.Context, address map[string]httpListenOpts, proxies map[string]*streamProxy, added map[string]io.Closer) {
+	for k, p := range proxies {
+		if l, ok := added[k]; ok {
+			s.serveStream(ctx, k, l, p)
+			continue
+		}
+		s.stream.servers[k].store(p)
+	}
+	for k, srv := range s.stream.servers {
+		if _, ok := proxies[k]; ok {
+			continue
+		}
+		delete(s.stream.servers, k)
+		fmt.Printf("[vince] stopping stream server on %q\n", k)
+		go srv.Shutdown(ctx)
+	}
+	s.stream.address = address
+}
+
+func (s *serverCtx) serveStream(ctx context.Context, k string, l io.Closer, p *streamProxy) {
+	switch l := l.(type) {
+	case net.Listener:
+		srv := new(streamServer)
+		srv.init(ctx, p, s.http.connManager)
+		s.stream.servers[k] = srv
+		fmt.Printf("[vince] starting stream server on %q\n", l.Addr().String())
+		go srv.Serve(l)
+	case net.PacketConn:
+		srv := new(udpServer)
+		srv.init(ctx, p)
+		s.stream.servers[k] = srv
+		fmt.Printf("[vince] starting udp stream server on %q\n", l.LocalAddr().String())
+		go srv.Serve(l)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	tlsRecordHeaderLen      = 5
+	tlsRecordTypeHandshake  = 22
+	tlsHandshakeClientHello = 1
+
+	tlsExtensionServerName        = 0
+	tlsExtensionALPN              = 16
+	tlsExtensionSupportedVersions = 43
+
+	defaultPrereadBufferSize = 16 << 10
+	defaultPrereadTimeout    = 30 * time.Second
+)
+
+var errNotClientHello = errors.New("vince: not a tls ClientHello")
+
+var tlsVersionNames = map[uint16]string{
+	0x0300: "SSLv3",
+	0x0301: "TLSv1",
+	0x0302: "TLSv1.1",
+	0x0303: "TLSv1.2",
+	0x0304: "TLSv1.3",
+}
+
+// clientHello is the information ssl_preread extracts from a ClientHello.
+type clientHello struct {
+	serverName string
+	alpn       []string
+	versions   []string
+}
+
+// readClientHello reads tls records from r until a complete ClientHello is
+// read. The bytes that were read are returned even on errors so they can be
+// passed to the upstream. At most limit bytes of handshake data are read.
+func readClientHello(r io.Reader, limit int) (*clientHello, []byte, error) {
+	var raw, msg []byte
+	header := make([]byte, tlsRecordHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, append(raw, header...), err
+		}
+		raw = append(raw, header...)
+		if header[0] != tlsRecordTypeHandshake || header[1] != 3 {
+			return nil, raw, errNotClientHello
+		}
+		n := int(binary.BigEndian.Uint16(header[3:]))
+		if len(msg)+n > limit {
+			return nil, raw, errors.New("vince: ClientHello is larger than preread_buffer_size")
+		}
+		rec := make([]byte, n)
+		m, err := io.ReadFull(r, rec)
+		raw = append(raw, rec[:m]...)
+		if err != nil {
+			return nil, raw, err
+		}
+		msg = append(msg, rec...)
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != tlsHandshakeClientHello {
+			return nil, raw, errNotClientHello
+		}
+		size := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if size > limit {
+			return nil, raw, errors.New("vince: ClientHello is larger than preread_buffer_size")
+		}
+		if len(msg) < 4+size {
+			// the message continues in the next record
+			continue
+		}
+		h, err := parseClientHello(msg[4 : 4+size])
+		return h, raw, err
+	}
+}
+
+// tlsReader reads length prefixed fields of tls messages.
+type tlsReader struct {
+	b   []byte
+	err bool
+}
+
+func (t *tlsReader) bytes(n int) []byte {
+	if t.err || len(t.b) < n {
+		t.err = true
+		return nil
+	}
+	v := t.b[:n]
+	t.b = t.b[n:]
+	return v
+}
+
+func (t *tlsReader) uint8() int {
+	v := t.bytes(1)
+	if v == nil {
+		return 0
+	}
+	return int(v[0])
+}
+
+func (t *tlsReader) uint16() int {
+	v := t.bytes(2)
+	if v == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(v))
+}
+
+// vector reads a field prefixed with its length in size bytes.
+func (t *tlsReader) vector(size int) *tlsReader {
+	var n int
+	if size == 1 {
+		n = t.uint8()
+	} else {
+		n = t.uint16()
+	}
+	return &tlsReader{b: t.bytes(n), err: t.err}
+}
+
+func parseClientHello(b []byte) (*clientHello, error) {
+	h := new(clientHello)
+	r := &tlsReader{b: b}
+	legacy := uint16(r.uint16())
+	r.bytes(32) // random
+	r.vector(1) // session id
+	r.vector(2) // cipher suites
+	r.vector(1) // compression methods
+	if r.err {
+		return nil, errNotClientHello
+	}
+	if len(r.b) > 0 {
+		ext := r.vector(2)
+		for len(ext.b) > 0 && !ext.err {
+			typ := ext.uint16()
+			data := ext.vector(2)
+			switch typ {
+			case tlsExtensionServerName:
+				list := data.vector(2)
+				for len(list.b) > 0 && !list.err {
+					kind := list.uint8()
+					name := list.vector(2)
+					if kind == 0 && !name.err {
+						h.serverName = strings.ToLower(string(name.b))
+					}
+				}
+			case tlsExtensionALPN:
+				list := data.vector(2)
+				for len(list.b) > 0 && !list.err {
+					p := list.vector(1)
+					if !p.err {
+						h.alpn = append(h.alpn, string(p.b))
+					}
+				}
+			case tlsExtensionSupportedVersions:
+				list := data.vector(1)
+				for len(list.b) > 0 && !list.err {
+					if name, ok := tlsVersionNames[uint16(list.uint16())]; ok {
+						h.versions = append(h.versions, name)
+					}
+				}
+			}
+		}
+		if ext.err {
+			return nil, errNotClientHello
+		}
+	}
+	if len(h.versions) == 0 {
+		// clients without supported_versions support versions up to the
+		// legacy version.
+		for v := legacy; v >= 0x0301; v-- {
+			if name, ok := tlsVersionNames[v]; ok {
+				h.versions = append(h.versions, name)
+			}
+		}
+	}
+	return h, nil
+}
+
+// prereadConn is a connection that returns the bytes read by ssl_preread
+// before reading from the underlying connection.
+type prereadConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prereadConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// preread peeks at the ClientHello sent on conn and sets the $ssl_preread_*
+// variables. The returned connection must be used instead of conn. Clients that
+// don't speak tls are passed through with empty variables.
+func (p *streamProxy) preread(conn net.Conn, v *ngxVariables) (net.Conn, error) {
+	if p.opts.prereadTimeout.value > 0 {
+		conn.SetReadDeadline(time.Now().Add(p.opts.prereadTimeout.value))
+	}
+	h, raw, err := readClientHello(conn, int(p.opts.prereadBuffer.value))
+	conn.SetReadDeadline(time.Time{})
+	c := &prereadConn{Conn: conn, r: io.MultiReader(bytes.NewReader(raw), conn)}
+	if err != nil {
+		if err == errNotClientHello {
+			return c, nil
+		}
+		return nil, err
+	}
+	v.Set(vSSLPrereadServerName, h.serverName)
+	v.Set(vSSLPrereadAlpnProtocols, strings.Join(h.alpn, ","))
+	v.Set(vSSLPrereadProtocols, strings.Join(h.versions, ","))
+	return c, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientHelloBytes returns the ClientHello sent by a tls client using config.
+func clientHelloBytes(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		tls.Client(client, config).Handshake()
+	}()
+	defer client.Close()
+	defer server.Close()
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	_, raw, err := readClientHello(server, defaultPrereadBufferSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestReadClientHello(t *testing.T) {
+	raw := clientHelloBytes(t, &tls.Config{
+		ServerName: "DB.example.com",
+		NextProtos: []string{"h2", "http/1.1"},
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+	})
+	h, got, err := readClientHello(bytes.NewReader(raw), defaultPrereadBufferSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Error("expected the read bytes to be returned")
+	}
+	expect := &clientHello{
+		serverName: "db.example.com",
+		alpn:       []string{"h2", "http/1.1"},
+		versions:   []string{"TLSv1.3", "TLSv1.2"},
+	}
+	if !reflect.DeepEqual(h, expect) {
+		t.Errorf("expected %+v got %+v", expect, h)
+	}
+
+	t.Run("split records", func(t *testing.T) {
+		// the handshake message may be fragmented across records
+		var b bytes.Buffer
+		for _, part := range [][]byte{raw[5:15], raw[15:]} {
+			b.Write([]byte{tlsRecordTypeHandshake, 3, 1, byte(len(part) >> 8), byte(len(part))})
+			b.Write(part)
+		}
+		h, _, err := readClientHello(&b, defaultPrereadBufferSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.serverName != "db.example.com" {
+			t.Errorf("expected db.example.com got %q", h.serverName)
+		}
+	})
+	t.Run("unknown legacy version", func(t *testing.T) {
+		b := []byte{0x03, 0x05}
+		b = append(b, make([]byte, 32)...)
+		b = append(b, 0, 0, 2, 0x13, 0x01, 1, 0)
+		h, err := parseClientHello(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := []string{"TLSv1.3", "TLSv1.2", "TLSv1.1", "TLSv1"}
+		if !reflect.DeepEqual(h.versions, expect) {
+			t.Errorf("expected %q got %q", expect, h.versions)
+		}
+	})
+	t.Run("limit", func(t *testing.T) {
+		if _, _, err := readClientHello(bytes.NewReader(raw), 16); err == nil {
+			t.Error("expected an error")
+		}
+	})
+	t.Run("not tls", func(t *testing.T) {
+		_, got, err := readClientHello(strings.NewReader("GET / HTTP/1.1\r\n"), defaultPrereadBufferSize)
+		if err != errNotClientHello {
+			t.Errorf("expected %v got %v", errNotClientHello, err)
+		}
+		if string(got) != "GET /" {
+			t.Errorf("expected read bytes to be returned got %q", got)
+		}
+	})
+}
+
+func TestStreamSSLPreread(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+	}
+	one := backend("one")
+	defer one.Close()
+	two := backend("two")
+	defer two.Close()
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+stream {
+    log_format sni "$ssl_preread_server_name $ssl_preread_alpn_protocols $ssl_preread_protocols";
+    upstream one.test {
+        server %s;
+    }
+    upstream two.test {
+        server %s;
+    }
+    server {
+        listen 127.0.0.1:8099;
+        ssl_preread on;
+        proxy_pass $ssl_preread_server_name;
+        access_log {{.dir}}/sni.log sni;
+    }
+}
+`, one.Listener.Addr(), two.Listener.Addr())
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	get := func(host string) (string, error) {
+		client := &http.Client{
+			Timeout: time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					MinVersion:         tls.VersionTLS12,
+				},
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, "127.0.0.1:8099")
+				},
+			},
+		}
+		defer client.CloseIdleConnections()
+		res, err := client.Get("https://" + host + "/")
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		return string(b), err
+	}
+	runTest(t, c, func(_ context.Context, t *testing.T) {
+		for _, host := range []string{"one", "two"} {
+			got, err := get(host + ".test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != host {
+				t.Errorf("expected %s.test to be routed to %s got %q", host, host, got)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		b, err := ioutil.ReadFile(c.dir + "/sni.log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "one.test ") {
+			t.Fatalf("unexpected log %q", lines)
+		}
+		if !strings.HasSuffix(lines[0], " TLSv1.3,TLSv1.2") {
+			t.Errorf("expected client protocols in %q", lines[0])
+		}
+	})
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoBackend starts a tcp server that replies to each line with name:line.
+func echoBackend(t *testing.T, name string) net.Listener {
+	t.Helper()
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s := bufio.NewScanner(conn)
+				for s.Scan() {
+					fmt.Fprintf(conn, "%s:%s\n", name, s.Text())
+				}
+			}()
+		}
+	}()
+	return ls
+}
+
+// streamRoundTrip sends line to addr and returns the first line of the reply.
+func streamRoundTrip(addr, line string) (string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := fmt.Fprintln(conn, line); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func TestStream(t *testing.T) {
+	one := echoBackend(t, "one")
+	defer one.Close()
+	two := echoBackend(t, "two")
+	defer two.Close()
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+stream {
+    log_format main "$remote_addr $protocol $status $bytes_sent $bytes_received $upstream_addr";
+    upstream backend {
+        server %s;
+        server %s;
+    }
+    server {
+        listen 127.0.0.1:8095;
+        proxy_pass backend;
+        access_log {{.dir}}/stream.log main;
+    }
+    server {
+        listen 127.0.0.1:8096;
+        proxy_pass %s;
+        proxy_connect_timeout 1s;
+        proxy_timeout 200ms;
+    }
+}
+`, one.Addr(), two.Addr(), one.Addr())
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	runTest(t, c, func(_ context.Context, t *testing.T) {
+		seen := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			line, err := streamRoundTrip("127.0.0.1:8095", "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[strings.TrimSpace(line)]++
+		}
+		if seen["one:hello"] != 2 || seen["two:hello"] != 2 {
+			t.Errorf("expected sessions to be balanced got %v", seen)
+		}
+		// sessions are logged when they end
+		time.Sleep(100 * time.Millisecond)
+		b, err := ioutil.ReadFile(filepath.Join(c.dir, "stream.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != 4 {
+			t.Fatalf("expected 4 log lines got %q", lines)
+		}
+		expect := fmt.Sprintf("127.0.0.1 TCP 200 10 6 %s", one.Addr())
+		if lines[0] != expect && lines[1] != expect {
+			t.Errorf("expected log line %q got %q", expect, lines)
+		}
+	}, func(_ context.Context, t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:8096")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintln(conn, "ping")
+		r := bufio.NewReader(conn)
+		if line, _ := r.ReadString('\n'); line != "one:ping\n" {
+			t.Errorf("expected one:ping got %q", line)
+		}
+		// proxy_timeout closes the idle session
+		start := time.Now()
+		if _, err := r.ReadByte(); err == nil {
+			t.Error("expected session to be closed")
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("expected session to be closed by proxy_timeout after %v", d)
+		}
+	})
+}
+
+func TestStreamServerShutdown(t *testing.T) {
+	backend := echoBackend(t, "b")
+	defer backend.Close()
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &streamProxy{}
+	p.opts.defaults()
+	p.opts.pass.store(backend.Addr().String())
+	srv := new(streamServer)
+	srv.init(context.Background(), p, nil)
+	go srv.Serve(ls)
+
+	conn, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(conn, "x")
+	r := bufio.NewReader(conn)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- srv.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := net.Dial("tcp", ls.Addr().String()); err == nil {
+		t.Error("expected listener to be closed")
+	}
+	// the active session is drained
+	fmt.Fprintln(conn, "y")
+	if line, _ := r.ReadString('\n'); line != "b:y\n" {
+		t.Errorf("expected b:y got %q", line)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the session ended")
+	default:
+	}
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not return after the session ended")
+	}
+}
+
+// udpEchoBackend starts a udp server that replies to each datagram with
+// name:datagram.
+func udpEchoBackend(t *testing.T, name string) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo([]byte(name+":"+string(buf[:n])), addr)
+		}
+	}()
+	return pc
+}
+
+func TestStreamUDP(t *testing.T) {
+	one := udpEchoBackend(t, "one")
+	defer one.Close()
+	two := udpEchoBackend(t, "two")
+	defer two.Close()
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+stream {
+    log_format main "$protocol $status $bytes_received $bytes_sent $upstream_addr";
+    upstream dns {
+        hash $remote_addr;
+        server %s;
+        server %s;
+    }
+    server {
+        listen 127.0.0.1:8097 udp;
+        proxy_pass dns;
+        proxy_responses 1;
+        access_log {{.dir}}/udp.log main;
+    }
+    server {
+        listen 127.0.0.1:8098 udp;
+        proxy_pass dns;
+        proxy_timeout 200ms;
+        access_log {{.dir}}/timeout.log main;
+    }
+    server {
+        listen 127.0.0.1:8108 udp;
+        proxy_pass %s;
+        proxy_responses 0;
+    }
+}
+`, one.LocalAddr(), two.LocalAddr(), sink.LocalAddr())
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	exchange := func(conn net.Conn, msg string) string {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	runTest(t, c, func(_ context.Context, t *testing.T) {
+		var first string
+		for i := 0; i < 3; i++ {
+			conn, err := net.Dial("udp", "127.0.0.1:8097")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := exchange(conn, "q")
+			conn.Close()
+			if i == 0 {
+				first = got
+			}
+			if got != first {
+				t.Errorf("expected all clients of 127.0.0.1 to use the same peer got %q and %q", first, got)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		b, err := ioutil.ReadFile(filepath.Join(c.dir, "udp.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("expected a session per client got %q", lines)
+		}
+		if !strings.HasPrefix(lines[0], "UDP 200 1 5 127.0.0.1:") {
+			t.Errorf("unexpected log line %q", lines[0])
+		}
+	}, func(_ context.Context, t *testing.T) {
+		conn, err := net.Dial("udp", "127.0.0.1:8098")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// datagrams of the same client share a session
+		exchange(conn, "a")
+		exchange(conn, "b")
+		name := filepath.Join(c.dir, "timeout.log")
+		if _, err := os.Stat(name); err == nil {
+			t.Fatal("expected session to be active")
+		}
+		time.Sleep(400 * time.Millisecond)
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := strings.TrimSpace(string(b)); !strings.HasPrefix(s, "UDP 200 2 10 ") {
+			t.Errorf("expected session to expire after proxy_timeout got %q", s)
+		}
+	}, func(_ context.Context, t *testing.T) {
+		conn, err := net.Dial("udp", "127.0.0.1:8108")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// each datagram ends its session, the next one starts a new session
+		for _, msg := range []string{"a", "b", "c", "d"} {
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var got []string
+		buf := make([]byte, 1024)
+		sink.SetReadDeadline(time.Now().Add(time.Second))
+		for len(got) < 4 {
+			n, _, err := sink.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("expected all datagrams to reach the upstream got %q: %v", got, err)
+			}
+			got = append(got, string(buf[:n]))
+		}
+		sort.Strings(got)
+		if s := strings.Join(got, ""); s != "abcd" {
+			t.Errorf("expected abcd got %q", s)
+		}
+	})
+}
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ergongate/vince/version"
+	"github.com/mikioh/tcpinfo"
+)
+
+// variableGetter computes the value of a variable from the request or session
+// being processed. ok is false when the variable has no value.
+type variableGetter func(v *ngxVariables) (value string, ok bool)
+
+// prefixGetter computes the value of a variable of a prefix family like $arg_,
+// name is what comes after the prefix.
+type prefixGetter func(v *ngxVariables, name string) (value string, ok bool)
+
+// variableDef is a variable known when the configuration is loaded. Its value
+// is stored at index in the storage of every request.
+type variableDef struct {
+	name  string
+	index int
+	get   variableGetter
+}
+
+type variablePrefix struct {
+	prefix string
+	get    prefixGetter
+}
+
+var (
+	variableDefs     = make(map[string]*variableDef)
+	variablePrefixes []variablePrefix
+)
+
+// registerVariable adds a built in variable, get is used when the variable was
+// not set explicitly and can be nil. This must only be called from init, the
+// storage of requests is sized with the number of registered variables.
+func registerVariable(name string, get variableGetter) {
+	name = variableName(name)
+	if d, ok := variableDefs[name]; ok {
+		d.get = get
+		return
+	}
+	variableDefs[name] = &variableDef{name: name, index: len(variableDefs), get: get}
+}
+
+// registerVariablePrefix adds a family of variables that start with prefix.
+func registerVariablePrefix(prefix string, get prefixGetter) {
+	variablePrefixes = append(variablePrefixes, variablePrefix{
+		prefix: variableName(prefix),
+		get:    get,
+	})
+}
+
+// variableName returns name without the leading $.
+func variableName(name string) string {
+	return strings.TrimPrefix(strings.TrimSpace(name), "$")
+}
+
+// ngxVariables holds variables of one request or stream session. Values set
+// explicitly take precedence over the getters. It must not be shared between
+// requests and is not safe for concurrent use.
+type ngxVariables struct {
+	values   []variableValue
+	dynamic  map[string]string
+	captures []string
+	start    time.Time
+
+	// match is the location selected for the request.
+	match *match
+	// maps are variables defined with map blocks.
+	maps    ngxMaps
+	mapping map[*ngxMap]bool
+
+	request  *http.Request
+	response *responseVariables
+	conn     net.Conn
+	local    string
+	remote   string
+	query    url.Values
+	rawQuery string
+	// upstreamTrailer are the trailers of the upstream response, they are
+	// set once its body is read.
+	upstreamTrailer http.Header
+	// limitRate is the limit_rate of the location, it is the value of
+	// $limit_rate unless the variable is set.
+	limitRate int64
+}
+
+type variableValue struct {
+	set   bool
+	value string
+}
+
+func newVariables() *ngxVariables {
+	return &ngxVariables{
+		values: make([]variableValue, len(variableDefs)),
+		start:  time.Now(),
+	}
+}
+
+// newRequestVariables returns variables of http request r.
+func newRequestVariables(r *http.Request) *ngxVariables {
+	v := newVariables()
+	v.request = r
+	v.remote = r.RemoteAddr
+	ctx := r.Context()
+	if a, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+		v.local = a.String()
+	}
+	v.conn, _ = ctx.Value(connKey{}).(net.Conn)
+	return v
+}
+
+// newStreamVariables returns variables of a stream session between local and
+// remote. protocol is TCP or UDP.
+func newStreamVariables(local, remote net.Addr, protocol string) *ngxVariables {
+	v := newVariables()
+	v.local = local.String()
+	v.remote = remote.String()
+	v.Set(vProtocol, protocol)
+	return v
+}
+
+// clone returns a copy of v that can be used by another goroutine.
+func (v *ngxVariables) clone() *ngxVariables {
+	n := *v
+	n.values = append([]variableValue(nil), v.values...)
+	n.captures = append([]string(nil), v.captures...)
+	n.dynamic = make(map[string]string, len(v.dynamic))
+	for k, s := range v.dynamic {
+		n.dynamic[k] = s
+	}
+	n.mapping = nil
+	n.query = nil
+	return &n
+}
+
+// ctxVariables returns the variables of the request or session handled with
+// ctx, this is nil if there is none.
+func ctxVariables(ctx context.Context) *ngxVariables {
+	v, _ := ctx.Value(variables{}).(*ngxVariables)
+	return v
+}
+
+// Set stores the value of variable name, the leading $ is optional.
+func (v *ngxVariables) Set(name, value string) {
+	if v == nil {
+		return
+	}
+	name = variableName(name)
+	if d, ok := variableDefs[name]; ok {
+		v.values[d.index] = variableValue{set: true, value: value}
+		return
+	}
+	if v.dynamic == nil {
+		v.dynamic = make(map[string]string)
+	}
+	v.dynamic[name] = value
+}
+
+// Get returns the value of variable name, the leading $ is optional.
+func (v *ngxVariables) Get(name string) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	name = variableName(name)
+	if d, ok := variableDefs[name]; ok {
+		return v.def(d)
+	}
+	return v.lookup(name)
+}
+
+// String returns the value of variable name or an empty string.
+func (v *ngxVariables) String(name string) string {
+	s, _ := v.Get(name)
+	return s
+}
+
+func (v *ngxVariables) def(d *variableDef) (string, bool) {
+	if s := v.values[d.index]; s.set {
+		return s.value, true
+	}
+	if d.get != nil {
+		return d.get(v)
+	}
+	return "", false
+}
+
+// lookup finds variables that are not registered.
+func (v *ngxVariables) lookup(name string) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	if s, ok := v.dynamic[name]; ok {
+		return s, true
+	}
+	if m, ok := v.maps[name]; ok {
+		return v.mapValue(m), true
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		return v.capture(n)
+	}
+	for _, p := range variablePrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			return p.get(v, name[len(p.prefix):])
+		}
+	}
+	return "", false
+}
+
+// mapValue evaluates map variable m. Values of maps that are not volatile are
+// kept for the rest of the request.
+func (v *ngxVariables) mapValue(m *ngxMap) string {
+	if v.mapping[m] {
+		// the source of the map depends on the map itself
+		return ""
+	}
+	if v.mapping == nil {
+		v.mapping = make(map[*ngxMap]bool)
+	}
+	v.mapping[m] = true
+	s := m.value(v)
+	delete(v.mapping, m)
+	if !m.volatile {
+		v.Set(m.name, s)
+	}
+	return s
+}
+
+// setCaptures stores groups matched by a regular expression, they are
+// available as $1, $2 ...
+func (v *ngxVariables) setCaptures(c []string) {
+	if v != nil {
+		v.captures = c
+	}
+}
+
+// setMatch stores groups of sub matched by re. Named groups are also available
+// as variables with the name of the group.
+func (v *ngxVariables) setMatch(re *regexp.Regexp, sub []string) {
+	if v == nil {
+		return
+	}
+	v.setCaptures(sub)
+	for i, name := range re.SubexpNames() {
+		if name != "" && i < len(sub) {
+			v.Set(name, sub[i])
+		}
+	}
+}
+
+func (v *ngxVariables) capture(n int) (string, bool) {
+	if v == nil || n < 0 || n >= len(v.captures) {
+		return "", false
+	}
+	return v.captures[n], true
+}
+
+// setRequest updates the request the variables are computed from, this
+// happens on internal redirects.
+func (v *ngxVariables) setRequest(r *http.Request) {
+	if v != nil {
+		v.request = r
+	}
+}
+
+func (v *ngxVariables) queryArgs() url.Values {
+	if v.query == nil || v.rawQuery != v.request.URL.RawQuery {
+		v.rawQuery = v.request.URL.RawQuery
+		v.query = v.request.URL.Query()
+	}
+	return v.query
+}
+
+// responseVariables records the response sent for a request.
+type responseVariables struct {
+	status      int
+	headerBytes int64
+	bodyBytes   int64
+	header      http.Header
+}
+
+// variableWriter records the status and size of the response in the request
+// variables.
+type variableWriter struct {
+	http.ResponseWriter
+	res *responseVariables
+}
+
+func (w *variableWriter) WriteHeader(code int) {
+	if w.res.status == 0 {
+		w.res.status = code
+		var c countWriter
+		w.Header().Write(&c)
+		w.res.headerBytes = int64(c)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *variableWriter) Write(b []byte) (int, error) {
+	if w.res.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.res.bodyBytes += int64(n)
+	return n, err
+}
+
+func (w *variableWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *variableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("vince: connection does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+func (w *variableWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countWriter counts bytes written to it.
+type countWriter int64
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	*c += countWriter(len(b))
+	return len(b), nil
+}
+
+// withVariables returns r with new variables stored in its context. w records
+// the response in the variables.
+func withVariables(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	res := &responseVariables{header: w.Header()}
+	v := newRequestVariables(r)
+	v.response = res
+	r = r.WithContext(context.WithValue(r.Context(), variables{}, v))
+	v.request = r
+	return &variableWriter{ResponseWriter: w, res: res}, r
+}
+
+func init() {
+	for _, name := range []string{
+		vLimitConnStatus, vLimitReqStatus,
+		vProtocol,
+		vSSLPrereadServerName, vSSLPrereadAlpnProtocols, vSSLPrereadProtocols,
+		vUpstreamAddr, vUpstreamStatus, vUpstreamConnectTime,
+		vUpstreamBytesSent, vUpstreamBytesReceived, vUpstreamResponseTime,
+		vUpstreamHeaderTime, vUpstreamResponseLength, vUpstreamCacheStatu,
+		vUpstreamQueueTime, vUpstreamFirstByteTime, vUpstreamSessionTime,
+		vBytesReceived, vFastCGIPathInfo, vFastCGIScriptName, vRemoteUser,
+		vProxyHost, vProxyPort,
+	} {
+		registerVariable(name, nil)
+	}
+	registerVariable(vLimitRate, func(v *ngxVariables) (string, bool) {
+		return strconv.FormatInt(v.limitRate, 10), true
+	})
+	registerVariable(vDocumentRoot, func(v *ngxVariables) (string, bool) {
+		root, _, ok := staticFilename(v)
+		return root, ok
+	})
+	registerVariable(vRequestFilename, func(v *ngxVariables) (string, bool) {
+		_, name, ok := staticFilename(v)
+		return name, ok
+	})
+	request := func(fn func(r *http.Request) string) variableGetter {
+		return func(v *ngxVariables) (string, bool) {
+			if v.request == nil {
+				return "", false
+			}
+			return fn(v.request), true
+		}
+	}
+	registerVariable(vArgs, request(func(r *http.Request) string { return r.URL.RawQuery }))
+	registerVariable(vQueryString, request(func(r *http.Request) string { return r.URL.RawQuery }))
+	registerVariable(vIsArgs, request(func(r *http.Request) string {
+		if r.URL.RawQuery != "" {
+			return "?"
+		}
+		return ""
+	}))
+	registerVariable(vURI, request(func(r *http.Request) string { return r.URL.Path }))
+	registerVariable(vDocumentURI, request(func(r *http.Request) string { return r.URL.Path }))
+	registerVariable(vRequestURI, request(func(r *http.Request) string { return r.RequestURI }))
+	registerVariable(vRequestMethod, request(func(r *http.Request) string { return r.Method }))
+	registerVariable(vServerProtocol, request(func(r *http.Request) string { return r.Proto }))
+	registerVariable(vRequest, request(func(r *http.Request) string {
+		return r.Method + " " + r.RequestURI + " " + r.Proto
+	}))
+	registerVariable(vContentLength, request(func(r *http.Request) string {
+		return r.Header.Get("Content-Length")
+	}))
+	registerVariable(vContentType, request(func(r *http.Request) string {
+		return r.Header.Get("Content-Type")
+	}))
+	registerVariable(vScheme, request(func(r *http.Request) string {
+		if r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	}))
+	registerVariable(vHTTPS, request(func(r *http.Request) string {
+		if r.TLS != nil {
+			return "on"
+		}
+		return ""
+	}))
+	registerVariable(vHTTP2, request(func(r *http.Request) string {
+		if r.ProtoMajor == 2 {
+			if r.TLS != nil {
+				return "h2"
+			}
+			return "h2c"
+		}
+		return ""
+	}))
+	registerVariable(vHost, request(func(r *http.Request) string {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			if v := r.Context().Value(serverNameKey{}); v != nil {
+				host = v.(string)
+			}
+		}
+		return strings.ToLower(host)
+	}))
+	registerVariable(vConnection, request(func(r *http.Request) string {
+		if id, ok := r.Context().Value(requestID{}).(int64); ok {
+			return strconv.FormatInt(id, 10)
+		}
+		return ""
+	}))
+	registerVariable(vRequestID, func(v *ngxVariables) (string, bool) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", false
+		}
+		id := hex.EncodeToString(b)
+		// the id must not change for the rest of the request
+		v.Set(vRequestID, id)
+		return id, true
+	})
+
+	// addresses
+	registerVariable(vRemoteAddr, func(v *ngxVariables) (string, bool) {
+		host, _, err := net.SplitHostPort(v.remote)
+		return host, err == nil
+	})
+	registerVariable(vRemotePort, func(v *ngxVariables) (string, bool) {
+		_, port, err := net.SplitHostPort(v.remote)
+		return port, err == nil
+	})
+	registerVariable(vBinaryRemoteAddress, func(v *ngxVariables) (string, bool) {
+		host, _, err := net.SplitHostPort(v.remote)
+		return binaryAddr(host), err == nil
+	})
+	registerVariable(vProxyAddXForwardFor, func(v *ngxVariables) (string, bool) {
+		host, _, err := net.SplitHostPort(v.remote)
+		if err != nil {
+			return "", false
+		}
+		if v.request != nil {
+			if prior := v.request.Header[HeaderXForwardedFor]; len(prior) > 0 {
+				return strings.Join(prior, ", ") + ", " + host, true
+			}
+		}
+		return host, true
+	})
+	registerVariable(vServerAddr, func(v *ngxVariables) (string, bool) {
+		host, _, err := net.SplitHostPort(v.local)
+		return host, err == nil
+	})
+	registerVariable(vServerPort, func(v *ngxVariables) (string, bool) {
+		_, port, err := net.SplitHostPort(v.local)
+		return port, err == nil
+	})
+
+	// response
+	response := func(fn func(r *responseVariables) string) variableGetter {
+		return func(v *ngxVariables) (string, bool) {
+			if v.response == nil {
+				return "", false
+			}
+			return fn(v.response), true
+		}
+	}
+	registerVariable(vStatus, response(func(r *responseVariables) string {
+		if r.status == 0 {
+			return "000"
+		}
+		return strconv.Itoa(r.status)
+	}))
+	registerVariable(vBodyBytesSent, response(func(r *responseVariables) string {
+		return strconv.FormatInt(r.bodyBytes, 10)
+	}))
+	registerVariable(vBytesSent, response(func(r *responseVariables) string {
+		return strconv.FormatInt(r.headerBytes+r.bodyBytes, 10)
+	}))
+
+	// time
+	registerVariable(vRequestTime, func(v *ngxVariables) (string, bool) {
+		return formatSessionTime(time.Since(v.start)), true
+	})
+	registerVariable(vSessionTime, func(v *ngxVariables) (string, bool) {
+		return formatSessionTime(time.Since(v.start)), true
+	})
+	registerVariable(vMsec, func(*ngxVariables) (string, bool) {
+		now := time.Now()
+		return fmt.Sprintf("%d.%03d", now.Unix(), now.Nanosecond()/int(time.Millisecond)), true
+	})
+	registerVariable(vTimeLocal, func(*ngxVariables) (string, bool) {
+		return time.Now().Format(commonLogFormatTime), true
+	})
+	registerVariable(vTimeISO8601, func(*ngxVariables) (string, bool) {
+		return time.Now().Format(time.RFC3339), true
+	})
+	registerVariable(vDateGMT, func(*ngxVariables) (string, bool) {
+		return time.Now().UTC().Format(http.TimeFormat), true
+	})
+	registerVariable(vDateLocal, func(*ngxVariables) (string, bool) {
+		return time.Now().Format(time.RFC1123), true
+	})
+
+	// process
+	hostname, _ := os.Hostname()
+	registerVariable(vHostname, func(*ngxVariables) (string, bool) {
+		return hostname, true
+	})
+	registerVariable(vPid, func(*ngxVariables) (string, bool) {
+		return strconv.Itoa(os.Getpid()), true
+	})
+	registerVariable(vNginxVersion, func(*ngxVariables) (string, bool) {
+		return version.Version, true
+	})
+
+	// tls
+	state := func(fn func(c *tls.ConnectionState) string) variableGetter {
+		return func(v *ngxVariables) (string, bool) {
+			if v.request == nil || v.request.TLS == nil {
+				return "", false
+			}
+			return fn(v.request.TLS), true
+		}
+	}
+	registerVariable(vSSLProtocol, state(func(c *tls.ConnectionState) string {
+		return tlsVersionName(c.Version)
+	}))
+	registerVariable(vSSLCipher, state(func(c *tls.ConnectionState) string {
+		return tls.CipherSuiteName(c.CipherSuite)
+	}))
+	registerVariable(vSSLServerName, state(func(c *tls.ConnectionState) string {
+		return c.ServerName
+	}))
+	registerVariable(vSSLSessionReused, state(func(c *tls.ConnectionState) string {
+		if c.DidResume {
+			return "r"
+		}
+		return "."
+	}))
+	registerVariable(vSSLClientVerify, state(func(c *tls.ConnectionState) string {
+		if len(c.PeerCertificates) == 0 {
+			return "NONE"
+		}
+		return "SUCCESS"
+	}))
+	client := func(fn func(c *tls.ConnectionState) string) variableGetter {
+		return state(func(c *tls.ConnectionState) string {
+			if len(c.PeerCertificates) == 0 {
+				return ""
+			}
+			return fn(c)
+		})
+	}
+	registerVariable(vSSLClientSDN, client(func(c *tls.ConnectionState) string {
+		return c.PeerCertificates[0].Subject.String()
+	}))
+	registerVariable(vSSLClientIDN, client(func(c *tls.ConnectionState) string {
+		return c.PeerCertificates[0].Issuer.String()
+	}))
+	registerVariable(vSSLClientSerial, client(func(c *tls.ConnectionState) string {
+		return fmt.Sprintf("%X", c.PeerCertificates[0].SerialNumber)
+	}))
+	registerVariable(vSSLClientFingerprint, client(func(c *tls.ConnectionState) string {
+		sum := sha1.Sum(c.PeerCertificates[0].Raw)
+		return hex.EncodeToString(sum[:])
+	}))
+	registerVariable(vSSLClientVStart, client(func(c *tls.ConnectionState) string {
+		return c.PeerCertificates[0].NotBefore.UTC().Format(http.TimeFormat)
+	}))
+	registerVariable(vSSLClientVEnd, client(func(c *tls.ConnectionState) string {
+		return c.PeerCertificates[0].NotAfter.UTC().Format(http.TimeFormat)
+	}))
+
+	// tcp_info of the client connection
+	info := func(fn func(i *tcpinfo.Info) string) variableGetter {
+		return func(v *ngxVariables) (string, bool) {
+			if v.conn == nil {
+				return "", false
+			}
+			i, err := getTCPConnInfo(v.conn)
+			if err != nil {
+				return "", false
+			}
+			return fn(i), true
+		}
+	}
+	registerVariable(vTCPInfoRtt, info(func(i *tcpinfo.Info) string {
+		return strconv.FormatInt(int64(i.RTT/time.Microsecond), 10)
+	}))
+	registerVariable(vTCPInfoRttVar, info(func(i *tcpinfo.Info) string {
+		return strconv.FormatInt(int64(i.RTTVar/time.Microsecond), 10)
+	}))
+	registerVariable(vTCPInfoSndCwnd, info(func(i *tcpinfo.Info) string {
+		if i.CongestionControl == nil {
+			return ""
+		}
+		return strconv.FormatUint(uint64(i.CongestionControl.SenderWindowSegs), 10)
+	}))
+	registerVariable(vTCPInfoRcvSpace, info(func(i *tcpinfo.Info) string {
+		if i.FlowControl == nil {
+			return ""
+		}
+		return strconv.FormatUint(uint64(i.FlowControl.ReceiverWindow), 10)
+	}))
+
+	// prefix families
+	registerVariablePrefix(vArg+"_", func(v *ngxVariables, name string) (string, bool) {
+		if v.request == nil {
+			return "", false
+		}
+		a, ok := v.queryArgs()[name]
+		if !ok || len(a) == 0 {
+			return "", false
+		}
+		return a[0], true
+	})
+	registerVariablePrefix(vHTTP+"_", func(v *ngxVariables, name string) (string, bool) {
+		if v.request == nil {
+			return "", false
+		}
+		return headerVariable(v.request.Header, name)
+	})
+	registerVariablePrefix(vSentHTTP+"_", func(v *ngxVariables, name string) (string, bool) {
+		if v.response == nil {
+			return "", false
+		}
+		return headerVariable(v.response.header, name)
+	})
+	registerVariablePrefix(vUpstreamTrailer+"_", func(v *ngxVariables, name string) (string, bool) {
+		return headerVariable(v.upstreamTrailer, name)
+	})
+	registerVariablePrefix(vCookie+"_", func(v *ngxVariables, name string) (string, bool) {
+		if v.request == nil {
+			return "", false
+		}
+		c, err := v.request.Cookie(name)
+		if err != nil {
+			return "", false
+		}
+		return c.Value, true
+	})
+}
+
+// headerVariable returns header name of h, name is the variable suffix where
+// dashes are replaced by underscores.
+func headerVariable(h http.Header, name string) (string, bool) {
+	a, ok := h[http.CanonicalHeaderKey(strings.Replace(name, "_", "-", -1))]
+	if !ok || len(a) == 0 {
+		return "", false
+	}
+	return strings.Join(a, ", "), true
+}
+
+// tlsVersionName returns the name of a tls version as shown by nginx.
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return ""
+}
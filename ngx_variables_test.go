@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testVariables returns variables with pairs of name and value set.
+func testVariables(pairs ...string) *ngxVariables {
+	v := newVariables()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		v.Set(pairs[i], pairs[i+1])
+	}
+	return v
+}
+
+func TestRequestVariables(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://Example.com:8080/a/b?x=1&y=2", nil)
+	r.Header.Set("User-Agent", "test")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	rec := httptest.NewRecorder()
+	w, r := withVariables(rec, r)
+	v := ctxVariables(r.Context())
+	if v == nil {
+		t.Fatal("expected variables in the request context")
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("hello"))
+
+	expect := map[string]string{
+		vArgs:                       "x=1&y=2",
+		vIsArgs:                     "?",
+		vArg + "_x":                 "1",
+		vArg + "_y":                 "2",
+		vURI:                        "/a/b",
+		vRequestMethod:              "GET",
+		vRequest:                    "GET http://Example.com:8080/a/b?x=1&y=2 HTTP/1.1",
+		vHost:                       "example.com",
+		vRemoteAddr:                 "192.0.2.1",
+		vHTTP + "_user_agent":       "test",
+		vHTTP + "_x_forwarded_for":  "10.0.0.1",
+		vCookie + "_session":        "abc",
+		vSentHTTP + "_content_type": "text/plain",
+		vStatus:                     "201",
+		vBodyBytesSent:              "5",
+		vScheme:                     "http",
+		vProxyAddXForwardFor:        "10.0.0.1, 192.0.2.1",
+	}
+	for name, value := range expect {
+		if got := v.String(name); got != value {
+			t.Errorf("%s: expected %q got %q", name, value, got)
+		}
+	}
+	if _, ok := v.Get(vArg + "_z"); ok {
+		t.Error("expected missing argument to have no value")
+	}
+	id := v.String(vRequestID)
+	if len(id) != 32 || v.String(vRequestID) != id {
+		t.Errorf("expected a stable request id got %q", id)
+	}
+	// values set explicitly take precedence
+	v.Set(vURI, "/c")
+	if got := v.String(vURI); got != "/c" {
+		t.Errorf("expected /c got %q", got)
+	}
+	v.Set("$custom", "value")
+	if got := v.String("custom"); got != "value" {
+		t.Errorf("expected value got %q", got)
+	}
+}
+
+func TestVariablesPerRequest(t *testing.T) {
+	tpl := new(stringTemplateValue)
+	tpl.store("$arg_id")
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r = withVariables(w, r)
+		w.Write([]byte(tpl.Value(ctxVariables(r.Context()))))
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := string(rune('a' + i%26))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/?id="+id, nil))
+			if rec.Body.String() != id {
+				t.Errorf("expected %q got %q", id, rec.Body.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+}
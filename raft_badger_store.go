@@ -4,8 +4,8 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"io"
 	"math"
-	"sync"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/hashicorp/raft"
@@ -18,14 +18,16 @@ var statePrefix = []byte("/state")
 var _ raft.StableStore = (*store)(nil)
 var _ raft.LogStore = (*store)(nil)
 var _ raft.FSMSnapshot = (*fsmSnapshot)(nil)
+var _ raft.FSM = (*fsm)(nil)
 
 var errUnknownCommand = errors.New("fsm: Unknown command")
 
-type firstKey struct{}
+// errKeyNotFound is returned by Get for missing keys, raft matches the message
+// to tell a new node from a failing store.
+var errKeyNotFound = errors.New("not found")
 
 type store struct {
-	db    *badger.DB
-	cache *sync.Map
+	db *badger.DB
 }
 
 func (s *store) Set(key, value []byte) error {
@@ -44,6 +46,9 @@ func (s *store) Get(key []byte) (value []byte, err error) {
 		_, err = i.ValueCopy(value)
 		return err
 	})
+	if err == badger.ErrKeyNotFound {
+		return nil, errKeyNotFound
+	}
 	return
 }
 
@@ -77,19 +82,22 @@ func joinSlice(a, b []byte) []byte {
 	return k
 }
 
+// FirstIndex returns the index of the first log or 0 when there are no logs.
 func (s *store) FirstIndex() (uint64, error) {
-	if v, ok := s.cache.Load(firstKey{}); ok {
-		return v.(uint64), nil
-	}
 	index, err := s.seekEntry(nil, 0, false)
-	if err == nil {
-		s.cache.Store(firstKey{}, index+1)
+	if err == raft.ErrLogNotFound {
+		return 0, nil
 	}
-	return index + 1, err
+	return index, err
 }
 
+// LastIndex returns the index of the last log or 0 when there are no logs.
 func (s *store) LastIndex() (uint64, error) {
-	return s.seekEntry(nil, math.MaxUint64, true)
+	index, err := s.seekEntry(nil, math.MaxUint64, true)
+	if err == raft.ErrLogNotFound {
+		return 0, nil
+	}
+	return index, err
 }
 
 func (s *store) seekEntry(e *raft.Log, seekTo uint64, reverse bool) (uint64, error) {
@@ -226,6 +234,10 @@ func (s *store) deleteKeys(batch *badger.WriteBatch, keys []string) error {
 
 type fsm struct {
 	db *badger.DB
+	// limits receives limit_req counters shared by other nodes.
+	limits *limitSync
+	// caches receives cache purges done on other nodes.
+	caches *cacheSync
 }
 
 func (f *fsm) Apply(e *raft.Log) interface{} {
@@ -254,11 +266,46 @@ func (f *fsm) Apply(e *raft.Log) interface{} {
 			return err
 		}
 		return result
+	case "limit_req":
+		if f.limits == nil {
+			return nil
+		}
+		return f.limits.apply(&c)
+	case "cache_purge":
+		if f.caches == nil {
+			return nil
+		}
+		return f.caches.apply(&c)
 	default:
 		return errUnknownCommand
 	}
 }
 
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &fsmSnapshot{stream: f.db.NewStream(), since: fullSnapshot{}}, nil
+}
+
+// Restore replaces the database with the snapshot read from r.
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	if err := f.db.DropAll(); err != nil {
+		return err
+	}
+	return f.db.Load(r, maxPendingWrites)
+}
+
+// maxPendingWrites is the number of pending writes allowed while restoring a
+// snapshot.
+const maxPendingWrites = 256
+
+// fullSnapshot makes snapshots include all keys, restoring a snapshot discards
+// the previous state so they can't be incremental.
+type fullSnapshot struct{}
+
+func (fullSnapshot) since() uint64 { return 0 }
+
+func (fullSnapshot) save(uint64) {}
+
 type snapostSince interface {
 	since() uint64
 	save(uint64)
@@ -41,7 +41,7 @@ func (f *readWriterCloserCache) deleteUnsafe(node *list.Element) {
 		return
 	}
 	v := node.Value.(*list.Element).Value.(*fileObject)
-	v.file.Close()
+	v.evict()
 	delete(f.hash, v.path)
 	f.uses.Delete(v.path)
 	f.list.Remove(node)
@@ -120,19 +120,66 @@ func (f *readWriterCloserCache) initFile(ctx context.Context, opts readWriterClo
 type fileObject struct {
 	path string
 	file io.ReadWriteCloser
+	// refs is the number of users that acquired the file, an evicted file is
+	// closed once they all released it.
+	refs    int
+	evicted bool
+}
+
+// evict removes o from the cache, the file is closed now unless it is in use.
+// The cache lock must be held.
+func (o *fileObject) evict() {
+	o.evicted = true
+	if o.refs == 0 {
+		o.file.Close()
+	}
 }
 
 func (f *readWriterCloserCache) Get(key string) (io.ReadWriteCloser, bool) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	v, ok := f.lookup(key)
+	if !ok {
+		return nil, ok
+	}
+	return v.file, true
+}
+
+func (f *readWriterCloserCache) lookup(key string) (*fileObject, bool) {
 	node, ok := f.hash[key]
 	if !ok {
 		return nil, ok
 	}
-	v := node.Value.(*list.Element).Value.(*fileObject)
 	f.list.MoveToFront(node)
 	f.hit(key)
-	return v.file, true
+	return node.Value.(*list.Element).Value.(*fileObject), true
+}
+
+// Acquire is like Get but the file is not closed by the cache until release
+// is called, even when it is evicted in the meantime.
+func (f *readWriterCloserCache) Acquire(key string) (file io.ReadWriteCloser, release func(), ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.lookup(key)
+	if !ok {
+		return nil, nil, ok
+	}
+	v.refs++
+	return v.file, f.release(v), true
+}
+
+func (f *readWriterCloserCache) release(v *fileObject) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.mu.Lock()
+			v.refs--
+			if v.refs == 0 && v.evicted {
+				v.file.Close()
+			}
+			f.mu.Unlock()
+		})
+	}
 }
 
 func (f *readWriterCloserCache) hit(path string) {
@@ -144,28 +191,45 @@ func (f *readWriterCloserCache) hit(path string) {
 }
 
 func (f *readWriterCloserCache) Put(path string) (io.WriteCloser, error) {
+	v, err := f.put(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	return v.file, nil
+}
+
+// PutAcquire is like Put but the file is acquired as with Acquire.
+func (f *readWriterCloserCache) PutAcquire(path string) (file io.ReadWriteCloser, release func(), err error) {
+	v, err := f.put(path, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v.file, f.release(v), nil
+}
+
+// put opens path and stores it in the cache, the returned object is acquired
+// refs times.
+func (f *readWriterCloserCache) put(path string, refs int) (*fileObject, error) {
 	file, err := f.opener(path)
 	if err != nil {
 		return nil, err
 	}
 	f.mu.Lock()
 	defer f.mu.Unlock()
-
+	n := &fileObject{path: path, file: file, refs: refs}
 	if node, ok := f.hash[path]; ok {
 		f.list.MoveToFront(node)
 		v := node.Value.(*list.Element).Value.(*fileObject)
-		node.Value.(*list.Element).Value = &fileObject{path: path, file: file}
-		v.file.Close()
+		node.Value.(*list.Element).Value = n
+		v.evict()
 	} else {
 		if f.list.Len() >= int(f.opts.max.value) {
 			f.deleteUnsafe(f.list.Back())
 		}
-		f.hash[path] = f.list.PushFront(&list.Element{
-			Value: &fileObject{path: path, file: file},
-		})
+		f.hash[path] = f.list.PushFront(&list.Element{Value: n})
 	}
 	f.hit(path)
-	return file, nil
+	return n, nil
 }
 
 func (f *readWriterCloserCache) Close() error {
@@ -174,6 +238,10 @@ func (f *readWriterCloserCache) Close() error {
 	var errs []string
 	for e := f.list.Front(); e != nil; e = e.Next() {
 		v := e.Value.(*list.Element).Value.(*fileObject)
+		v.evicted = true
+		if v.refs > 0 {
+			continue
+		}
 		if err := v.file.Close(); err != nil {
 			errs = append(errs, err.Error())
 		}
@@ -63,3 +63,58 @@ func BenchmarkCache_Rand(b *testing.B) {
 	}
 	b.Logf("hit: %d miss: %d ratio: %f", hit, miss, float64(hit)/float64(miss))
 }
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	noopReadWriteCloser
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCache_Acquire(t *testing.T) {
+	var o readWriterCloserCacheOption
+	o.defaults()
+	o.max.store(1)
+	c := new(readWriterCloserCache)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.init(ctx, o)
+	files := make(map[string]*closeRecorder)
+	c.opener = func(path string) (io.ReadWriteCloser, error) {
+		f := new(closeRecorder)
+		files[path] = f
+		return f, nil
+	}
+	_, release, err := c.PutAcquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, again, ok := c.Acquire("a")
+	if !ok {
+		t.Fatal("expected a to be cached")
+	}
+	// a is evicted by b but still in use
+	c.Put("b")
+	if files["a"].closed {
+		t.Fatal("expected a to stay open while in use")
+	}
+	release()
+	release()
+	if files["a"].closed {
+		t.Fatal("expected a to stay open until every user released it")
+	}
+	again()
+	if !files["a"].closed {
+		t.Error("expected a to be closed once released")
+	}
+	// b is not in use, replacing it closes it right away
+	b := files["b"]
+	c.Put("b")
+	if !b.closed {
+		t.Error("expected replaced b to be closed")
+	}
+}
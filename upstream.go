@@ -2,42 +2,90 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/smallnest/weighted"
 )
 
 type loadBalanceAlgorithm uint
 
 const (
-	roundRobing loadBalanceAlgorithm = iota
+	roundRobin loadBalanceAlgorithm = iota
+	hashKey
+	ipHash
+	leastConn
+	random
 )
 
+// loadBalancer picks the peer to use for a request. key is only used by hash
+// based algorithms, peers in tried are skipped. It returns nil when no peer is
+// available.
 type loadBalancer interface {
-	next() string
+	next(key string, tried peerSet) *upstreamPeer
+}
+
+// peerSet is the set of peers already used by a request.
+type peerSet map[*upstreamPeer]bool
+
+// usable returns true if p can be used by a request that already tried peers
+// in s.
+func (s peerSet) usable(p *upstreamPeer) bool {
+	return !s[p] && p.available()
 }
 
 type upstreamConfig struct {
-	name     string
-	servers  []upstreamServer
-	state    stringValue
-	hash     upstreamHashConfig
+	name      string
+	servers   []upstreamServer
+	state     stringValue
+	hash      upstreamHashConfig
+	ipHash    boolValue
+	leastConn boolValue
+	random    upstreamRandomConfig
+
+	// mu protects peers and balancers which can be changed at runtime by the
+	// management api.
+	mu       sync.RWMutex
+	peers    []*upstreamPeer
+	backup   []*upstreamPeer
 	balancer loadBalancer
+	fallback loadBalancer
 	once     sync.Once
+	lastID   int
+	health   []*healthCheck
 }
 
 type upstreamHashConfig struct {
 	set        bool
 	consistent boolValue
-	key        string
+	key        stringTemplateValue
+}
+
+type upstreamRandomConfig struct {
+	set bool
+	two bool
 }
 
 func (u *upstreamConfig) algorithm() loadBalanceAlgorithm {
-	var a loadBalanceAlgorithm
-	return a
+	switch {
+	case u.hash.set:
+		return hashKey
+	case u.ipHash.value:
+		return ipHash
+	case u.leastConn.value:
+		return leastConn
+	case u.random.set:
+		return random
+	default:
+		return roundRobin
+	}
 }
 
 func (u *upstreamConfig) load(r *rule) error {
@@ -50,19 +98,47 @@ func (u *upstreamConfig) load(r *rule) error {
 		case "server":
 			var s upstreamServer
 			if err := s.init(c); err != nil {
-				return err
+				return c.wrap(err)
 			}
 			u.servers = append(u.servers, s)
 		case "state":
 			u.state.store(c.args[0])
 		case "hash":
 			u.hash.set = true
-			u.hash.key = c.args[0]
-			if len(c.args) > 0 && c.args[1] == "consistent" {
+			u.hash.key.store(c.args[0])
+			if len(c.args) > 1 && c.args[1] == "consistent" {
 				u.hash.consistent.store(true)
 			}
+		case "ip_hash":
+			u.ipHash.store(true)
+		case "least_conn":
+			u.leastConn.store(true)
+		case "random":
+			u.random.set = true
+			if len(c.args) > 0 {
+				if c.args[0] != "two" {
+					return c.wrap(fmt.Errorf("vince: invalid random parameter %q", c.args[0]))
+				}
+				u.random.two = true
+				if len(c.args) > 1 && c.args[1] != "least_conn" {
+					return c.wrap(fmt.Errorf("vince: unsupported random method %q", c.args[1]))
+				}
+			}
+		}
+	}
+	if u.state.set {
+		servers, err := readUpstreamState(u.state.value)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return r.wrap(err)
+			}
+		} else {
+			u.servers = servers
 		}
 	}
+	if len(u.servers) == 0 && !u.state.set {
+		return r.wrap(fmt.Errorf("vince: no servers are inside upstream %q", u.name))
+	}
 	return nil
 }
 
@@ -80,12 +156,18 @@ func (s *upstreamServer) init(r *rule) error {
 			s.drain.store(true)
 		default:
 			parts := strings.Split(param, "=")
+			if len(parts) != 2 {
+				return fmt.Errorf("vince: invalid parameter %q", param)
+			}
 			switch parts[0] {
 			case "weight":
 				n, err := strconv.Atoi(parts[1])
 				if err != nil {
 					return err
 				}
+				if n <= 0 {
+					return fmt.Errorf("vince: invalid weight %q", param)
+				}
 				s.weight.store(int64(n))
 			case "max_conns":
 				n, err := strconv.Atoi(parts[1])
@@ -98,10 +180,9 @@ func (s *upstreamServer) init(r *rule) error {
 				if err != nil {
 					return err
 				}
-				s.maxConn.store(int64(n))
-
+				s.maxFails.store(int64(n))
 			case "fail_timeout":
-				n, err := time.ParseDuration(parts[1])
+				n, err := parseDuration(parts[1])
 				if err != nil {
 					return err
 				}
@@ -111,7 +192,7 @@ func (s *upstreamServer) init(r *rule) error {
 			case "service":
 				s.service.store(parts[1])
 			case "slow_start":
-				n, err := time.ParseDuration(parts[1])
+				n, err := parseDuration(parts[1])
 				if err != nil {
 					return err
 				}
@@ -123,22 +204,102 @@ func (s *upstreamServer) init(r *rule) error {
 }
 
 func (u *upstreamConfig) init() {
+	u.peers, u.backup = nil, nil
+	for _, s := range u.servers {
+		u.push(newUpstreamPeer(s))
+	}
+	u.build()
+}
+
+// push adds p to the peers, this must be called with mu held.
+func (u *upstreamConfig) push(p *upstreamPeer) {
+	p.id = u.lastID
+	u.lastID++
+	if p.server.backup.value {
+		u.backup = append(u.backup, p)
+		return
+	}
+	u.peers = append(u.peers, p)
+}
+
+// build creates balancers for the current peers, this must be called with mu
+// held.
+func (u *upstreamConfig) build() {
+	u.fallback = nil
 	switch u.algorithm() {
-	case roundRobing:
-		w := &roundRobinWeighted{}
-		for _, s := range u.servers {
-			if s.down.value || s.backup.value {
-				continue
-			}
-			w.add(s, int(s.weight.value))
+	case hashKey:
+		if u.hash.consistent.value {
+			u.balancer = newKetama(u.peers)
+		} else {
+			u.balancer = newHashBalancer(u.peers)
+		}
+	case ipHash:
+		u.balancer = newHashBalancer(u.peers)
+	case leastConn:
+		u.balancer = newLeastConn(u.peers)
+	case random:
+		u.balancer = newRandomBalancer(u.peers, u.random.two)
+	default:
+		u.balancer = newRoundRobinSmooth(u.peers)
+	}
+	if len(u.backup) > 0 {
+		// like nginx backup servers are balanced with the method of the
+		// primary servers, round robin unless it is least_conn.
+		if u.algorithm() == leastConn {
+			u.fallback = newLeastConn(u.backup)
+		} else {
+			u.fallback = newRoundRobinSmooth(u.backup)
 		}
-		u.balancer = w
 	}
 }
 
-func (u *upstreamConfig) next() string {
+// next returns the peer to use. Backup servers are only used when none of the
+// primary servers is available.
+func (u *upstreamConfig) next(key string, tried peerSet) *upstreamPeer {
 	u.once.Do(u.init)
-	return u.balancer.next()
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if p := u.balancer.next(key, tried); p != nil {
+		return p
+	}
+	if u.fallback != nil {
+		return u.fallback.next(key, tried)
+	}
+	return nil
+}
+
+// all returns primary and backup peers.
+func (u *upstreamConfig) all() []*upstreamPeer {
+	u.once.Do(u.init)
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	var o []*upstreamPeer
+	o = append(o, u.peers...)
+	return append(o, u.backup...)
+}
+
+// key returns the key used by hash based algorithms. vars are the request
+// variables and remoteAddr is the client address.
+func (u *upstreamConfig) key(vars *ngxVariables, remoteAddr string) string {
+	switch u.algorithm() {
+	case hashKey:
+		return u.hash.key.Value(vars)
+	case ipHash:
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return host
+		}
+		if v4 := ip.To4(); v4 != nil {
+			// nginx uses the first three octets of IPv4 addresses
+			return string(v4[:3])
+		}
+		return string(ip)
+	}
+	return ""
 }
 
 type upstreamServer struct {
@@ -156,36 +317,361 @@ type upstreamServer struct {
 	drain       boolValue
 }
 
-type roundRobinWeighted struct {
-	mu sync.Mutex
-	rw *weighted.RRW
+// address returns the host:port to connect to. Port 80 is used when the server
+// has no port.
+func (s *upstreamServer) address() string {
+	if strings.HasPrefix(s.url, "unix:") {
+		return s.url
+	}
+	if _, _, err := net.SplitHostPort(s.url); err == nil {
+		return s.url
+	}
+	return net.JoinHostPort(strings.Trim(s.url, "[]"), "80")
 }
 
-func (r *roundRobinWeighted) add(s interface{}, w int) {
-	r.mu.Lock()
-	r.rw.Add(s, w)
+// upstreamPeer is a server of an upstream block.
+//
+// server and weight can be changed by the management api, this is done while
+// holding both the upstream lock and mu.
+type upstreamPeer struct {
+	// active connections, accessed atomically.
+	conns int64
+	// 1 after the peer was removed from the upstream, accessed atomically.
+	removed int32
+
+	id     int
+	server upstreamServer
+	addr   string
+	weight int
+
+	mu        sync.Mutex
+	fails     int64
+	lastFail  time.Time
+	recovered time.Time
+
+	health peerHealth
 }
 
-func (r *roundRobinWeighted) next() string {
-	r.mu.Lock()
-	nxt := r.rw.Next()
-	r.mu.Unlock()
-	return nxt.(string)
+func newUpstreamPeer(s upstreamServer) *upstreamPeer {
+	w := 1
+	if s.weight.set {
+		w = int(s.weight.value)
+	}
+	if !s.maxFails.set {
+		s.maxFails.store(1)
+	}
+	if !s.failTimeout.set {
+		s.failTimeout.store(10 * time.Second)
+	}
+	return &upstreamPeer{server: s, addr: s.address(), weight: w}
+}
+
+func (p *upstreamPeer) available() bool {
+	if p.server.down.value || p.server.drain.value || p.health.isDown() {
+		return false
+	}
+	if p.server.maxConn.value > 0 && atomic.LoadInt64(&p.conns) >= p.server.maxConn.value {
+		return false
+	}
+	return !p.unhealthy(time.Now())
+}
+
+// unhealthy returns true when the peer had max_fails failures and fail_timeout
+// has not passed since the last one.
+func (p *upstreamPeer) unhealthy(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	max := p.server.maxFails.value
+	if max == 0 {
+		return false
+	}
+	return p.fails >= max && now.Sub(p.lastFail) < p.server.failTimeout.value
+}
+
+// failed records a failed attempt to communicate with the peer. Failures older
+// than fail_timeout are forgotten.
+func (p *upstreamPeer) failed(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.server.maxFails.value == 0 {
+		return
+	}
+	if now.Sub(p.lastFail) >= p.server.failTimeout.value {
+		p.fails = 0
+	}
+	p.fails++
+	p.lastFail = now
+}
+
+// succeeded resets failures of the peer.
+func (p *upstreamPeer) succeeded() {
+	p.mu.Lock()
+	if max := p.server.maxFails.value; max > 0 && p.fails >= max {
+		p.recovered = time.Now()
+	}
+	p.fails = 0
+	p.mu.Unlock()
+}
+
+// recover marks the time the peer became available again after being down,
+// this starts slow_start.
+func (p *upstreamPeer) recover(now time.Time) {
+	p.mu.Lock()
+	p.recovered = now
+	p.mu.Unlock()
+}
+
+// effectiveWeight returns the weight of the peer. During slow_start the weight
+// grows from 1 to the configured weight.
+func (p *upstreamPeer) effectiveWeight(now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	slow := p.server.slowStart.value
+	since := now.Sub(p.recovered)
+	if slow <= 0 || since >= slow {
+		return p.weight
+	}
+	w := int(int64(p.weight) * int64(since) / int64(slow))
+	if w < 1 {
+		w = 1
+	}
+	return w
 }
 
+func (p *upstreamPeer) acquire() {
+	atomic.AddInt64(&p.conns, 1)
+}
+
+func (p *upstreamPeer) release() {
+	atomic.AddInt64(&p.conns, -1)
+}
+
+// roundRobinSmooth implements nginx smooth weighted round robin. Effective
+// weights of peers are used so that slow_start is respected.
 type roundRobinSmooth struct {
-	mu sync.Mutex
-	rw *weighted.SW
+	mu      sync.Mutex
+	peers   []*upstreamPeer
+	current []int
 }
 
-func (r *roundRobinSmooth) add(s string, w int) {
+func newRoundRobinSmooth(peers []*upstreamPeer) *roundRobinSmooth {
+	return &roundRobinSmooth{peers: peers, current: make([]int, len(peers))}
+}
+
+func (r *roundRobinSmooth) next(_ string, tried peerSet) *upstreamPeer {
 	r.mu.Lock()
-	r.rw.Add(s, w)
+	defer r.mu.Unlock()
+	now := time.Now()
+	best, total := -1, 0
+	for i, p := range r.peers {
+		if !tried.usable(p) {
+			continue
+		}
+		w := p.effectiveWeight(now)
+		r.current[i] += w
+		total += w
+		if best == -1 || r.current[i] > r.current[best] {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	r.current[best] -= total
+	return r.peers[best]
+}
+
+// hashBalancer maps keys to peers proportionally to their weight. Like nginx
+// the key is rehashed up to 20 times before falling back to round robin.
+type hashBalancer struct {
+	peers    []*upstreamPeer
+	total    int
+	fallback loadBalancer
+}
+
+func newHashBalancer(peers []*upstreamPeer) *hashBalancer {
+	h := &hashBalancer{peers: peers, fallback: newRoundRobinSmooth(peers)}
+	for _, p := range peers {
+		h.total += p.weight
+	}
+	return h
+}
+
+func (h *hashBalancer) next(key string, tried peerSet) *upstreamPeer {
+	if h.total == 0 {
+		return nil
+	}
+	k := key
+	for i := 0; i < 20; i++ {
+		w := int(crc32.ChecksumIEEE([]byte(k)) % uint32(h.total))
+		for _, p := range h.peers {
+			w -= p.weight
+			if w < 0 {
+				if tried.usable(p) {
+					return p
+				}
+				break
+			}
+		}
+		k = strconv.Itoa(i) + key
+	}
+	return h.fallback.next(key, tried)
+}
+
+// ketama is a consistent hash ring. Each peer gets 160 points per weight so
+// adding or removing a peer only remaps a small portion of keys.
+type ketama struct {
+	points []ketamaPoint
+}
+
+type ketamaPoint struct {
+	hash uint32
+	peer *upstreamPeer
+}
+
+func newKetama(peers []*upstreamPeer) *ketama {
+	k := new(ketama)
+	for _, p := range peers {
+		for i := 0; i < 160*p.weight; i++ {
+			k.points = append(k.points, ketamaPoint{
+				hash: crc32.ChecksumIEEE([]byte(p.addr + "-" + strconv.Itoa(i))),
+				peer: p,
+			})
+		}
+	}
+	sort.Slice(k.points, func(i, j int) bool {
+		return k.points[i].hash < k.points[j].hash
+	})
+	return k
+}
+
+func (k *ketama) next(key string, tried peerSet) *upstreamPeer {
+	n := len(k.points)
+	if n == 0 {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(n, func(i int) bool {
+		return k.points[i].hash >= h
+	})
+	for j := 0; j < n; j++ {
+		if p := k.points[(i+j)%n].peer; tried.usable(p) {
+			return p
+		}
+	}
+	return nil
 }
 
-func (r *roundRobinSmooth) next() string {
+// leastConnBalancer picks the peer with the least number of active connections
+// taking weights into account. Ties are resolved in round robin.
+type leastConnBalancer struct {
+	peers []*upstreamPeer
+	tick  uint64
+}
+
+func newLeastConn(peers []*upstreamPeer) *leastConnBalancer {
+	return &leastConnBalancer{peers: peers}
+}
+
+func (l *leastConnBalancer) next(_ string, tried peerSet) *upstreamPeer {
+	n := len(l.peers)
+	if n == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint64(&l.tick, 1) % uint64(n))
+	now := time.Now()
+	var best *upstreamPeer
+	var bestConns, bestWeight int64
+	for i := 0; i < n; i++ {
+		p := l.peers[(start+i)%n]
+		if !tried.usable(p) {
+			continue
+		}
+		c, w := atomic.LoadInt64(&p.conns), int64(p.effectiveWeight(now))
+		if best == nil || c*bestWeight < bestConns*w {
+			best, bestConns, bestWeight = p, c, w
+		}
+	}
+	return best
+}
+
+// randomBalancer picks a random peer taking weights into account. With two set
+// it picks two peers and uses the one with least connections.
+type randomBalancer struct {
+	mu    sync.Mutex
+	rand  *rand.Rand
+	peers []*upstreamPeer
+	total int
+	two   bool
+}
+
+func newRandomBalancer(peers []*upstreamPeer, two bool) *randomBalancer {
+	r := &randomBalancer{
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		peers: peers,
+		two:   two,
+	}
+	for _, p := range peers {
+		r.total += p.weight
+	}
+	return r
+}
+
+func (r *randomBalancer) pick(skip *upstreamPeer, tried peerSet) *upstreamPeer {
 	r.mu.Lock()
-	nxt := r.rw.Next()
-	r.mu.Unlock()
-	return nxt.(string)
+	defer r.mu.Unlock()
+	// like nginx give up after 20 attempts to find an available peer
+	for i := 0; i < 20; i++ {
+		w := r.rand.Intn(r.total)
+		for _, p := range r.peers {
+			w -= p.weight
+			if w < 0 {
+				if p != skip && tried.usable(p) {
+					return p
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (r *randomBalancer) next(_ string, tried peerSet) *upstreamPeer {
+	if r.total == 0 {
+		return nil
+	}
+	a := r.pick(nil, tried)
+	if !r.two || a == nil || len(r.peers) == 1 {
+		return a
+	}
+	b := r.pick(a, tried)
+	if b == nil {
+		return a
+	}
+	if atomic.LoadInt64(&b.conns)*int64(a.weight) < atomic.LoadInt64(&a.conns)*int64(b.weight) {
+		return b
+	}
+	return a
+}
+
+// collectUpstreams loads all upstream blocks in the http or stream block of
+// core.
+func collectUpstreams(core *rule, block string) (map[string]*upstreamConfig, error) {
+	m := make(map[string]*upstreamConfig)
+	for _, ch := range core.children {
+		if ch.name != block {
+			continue
+		}
+		for _, u := range ch.children {
+			if u.name != "upstream" {
+				continue
+			}
+			c := new(upstreamConfig)
+			if err := c.load(u); err != nil {
+				return nil, err
+			}
+			m[c.name] = c
+		}
+	}
+	return m, nil
 }
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultHealthCheckTimeout is how long a single probe can take.
+const defaultHealthCheckTimeout = 5 * time.Second
+
+// maxHealthCheckBody is the amount of response data checked by match blocks.
+const maxHealthCheckBody = 256 << 10
+
+// peerHealth is the state of active health checks of a peer.
+type peerHealth struct {
+	// 1 when the peer failed health checks, accessed atomically.
+	down int32
+	// 1 when the peer is actively checked, accessed atomically.
+	checked int32
+
+	mu        sync.Mutex
+	fails     int
+	passes    int
+	lastCheck time.Time
+	lastErr   string
+}
+
+func (h *peerHealth) isDown() bool {
+	return atomic.LoadInt32(&h.down) == 1
+}
+
+// setDown marks the peer down or up, it returns true if the state changed.
+func (h *peerHealth) setDown(down bool) bool {
+	var v int32
+	if down {
+		v = 1
+	}
+	return atomic.SwapInt32(&h.down, v) != v
+}
+
+// healthCheckConfig is the health_check directive.
+type healthCheckConfig struct {
+	interval  time.Duration
+	jitter    time.Duration
+	fails     int
+	passes    int
+	uri       string
+	port      string
+	mandatory bool
+	udp       bool
+	timeout   time.Duration
+	match     *healthMatch
+}
+
+func (c *healthCheckConfig) load(r *rule, matches map[string]*healthMatch) error {
+	c.interval = 5 * time.Second
+	c.fails = 1
+	c.passes = 1
+	c.uri = "/"
+	c.timeout = defaultHealthCheckTimeout
+	for _, a := range r.args {
+		switch a {
+		case "mandatory":
+			c.mandatory = true
+			continue
+		case "persistent":
+			continue
+		case "udp":
+			c.udp = true
+			continue
+		}
+		parts := strings.SplitN(a, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("vince: invalid health_check parameter %q", a)
+		}
+		var err error
+		switch parts[0] {
+		case "interval":
+			c.interval, err = parseDuration(parts[1])
+		case "jitter":
+			c.jitter, err = parseDuration(parts[1])
+		case "fails":
+			c.fails, err = strconv.Atoi(parts[1])
+		case "passes":
+			c.passes, err = strconv.Atoi(parts[1])
+		case "uri":
+			c.uri = parts[1]
+		case "port":
+			_, err = strconv.ParseUint(parts[1], 10, 16)
+			c.port = parts[1]
+		case "match":
+			m, ok := matches[parts[1]]
+			if !ok {
+				return fmt.Errorf("vince: match %q is not defined", parts[1])
+			}
+			c.match = m
+		default:
+			return fmt.Errorf("vince: unsupported health_check parameter %q", a)
+		}
+		if err != nil {
+			return fmt.Errorf("vince: invalid health_check parameter %q", a)
+		}
+	}
+	if c.interval <= 0 || c.fails <= 0 || c.passes <= 0 {
+		return errors.New("vince: health_check interval, fails and passes must be positive")
+	}
+	return nil
+}
+
+// healthMatch is a match block. http checks use status, header and body while
+// stream checks use send and expect.
+type healthMatch struct {
+	name    string
+	status  []statusMatch
+	headers []headerMatch
+	body    []valueMatch
+	send    []byte
+	expect  *valueMatch
+}
+
+type statusMatch struct {
+	not    bool
+	ranges [][2]int
+}
+
+func (s statusMatch) ok(code int) bool {
+	in := false
+	for _, r := range s.ranges {
+		if code >= r[0] && code <= r[1] {
+			in = true
+			break
+		}
+	}
+	return in != s.not
+}
+
+// valueMatch compares a value with a string or a regular expression.
+type valueMatch struct {
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func newValueMatch(op, value string) (*valueMatch, error) {
+	v := &valueMatch{op: op, value: value}
+	switch op {
+	case "=", "!=":
+	case "~", "!~":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		v.re = re
+	default:
+		return nil, fmt.Errorf("vince: invalid match operator %q", op)
+	}
+	return v, nil
+}
+
+func (v *valueMatch) ok(s []byte) bool {
+	switch v.op {
+	case "=":
+		return string(s) == v.value
+	case "!=":
+		return string(s) != v.value
+	case "~":
+		return v.re.Match(s)
+	default:
+		return !v.re.Match(s)
+	}
+}
+
+type headerMatch struct {
+	name string
+	// missing is true for "header ! name", otherwise the header must be present.
+	missing bool
+	value   *valueMatch
+}
+
+func (h headerMatch) ok(header http.Header) bool {
+	_, present := header[http.CanonicalHeaderKey(h.name)]
+	if h.missing {
+		return !present
+	}
+	if !present {
+		return false
+	}
+	if h.value == nil {
+		return true
+	}
+	return h.value.ok([]byte(header.Get(h.name)))
+}
+
+func (m *healthMatch) load(r *rule) error {
+	m.name = r.args[0]
+	for _, ch := range r.children {
+		if err := m.loadKey(ch); err != nil {
+			return ch.wrap(err)
+		}
+	}
+	return nil
+}
+
+func (m *healthMatch) loadKey(r *rule) error {
+	switch r.name {
+	case "status":
+		var s statusMatch
+		args := r.args
+		if len(args) > 0 && args[0] == "!" {
+			s.not = true
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			return errors.New("vince: missing status code")
+		}
+		for _, a := range args {
+			parts := strings.SplitN(a, "-", 2)
+			lo, err := strconv.Atoi(parts[0])
+			if err != nil {
+				return fmt.Errorf("vince: invalid status %q", a)
+			}
+			hi := lo
+			if len(parts) == 2 {
+				hi, err = strconv.Atoi(parts[1])
+				if err != nil || hi < lo {
+					return fmt.Errorf("vince: invalid status %q", a)
+				}
+			}
+			s.ranges = append(s.ranges, [2]int{lo, hi})
+		}
+		m.status = append(m.status, s)
+	case "header":
+		var h headerMatch
+		switch len(r.args) {
+		case 1:
+			h.name = r.args[0]
+		case 2:
+			if r.args[0] != "!" {
+				return errors.New("vince: invalid header match")
+			}
+			h.name = r.args[1]
+			h.missing = true
+		case 3:
+			h.name = r.args[0]
+			v, err := newValueMatch(r.args[1], r.args[2])
+			if err != nil {
+				return err
+			}
+			h.value = v
+		default:
+			return errors.New("vince: invalid header match")
+		}
+		m.headers = append(m.headers, h)
+	case "body":
+		if len(r.args) != 2 || (r.args[0] != "~" && r.args[0] != "!~") {
+			return errors.New("vince: invalid body match")
+		}
+		v, err := newValueMatch(r.args[0], r.args[1])
+		if err != nil {
+			return err
+		}
+		m.body = append(m.body, *v)
+	case "send":
+		m.send = []byte(unescape(r.args[0]))
+	case "expect":
+		var err error
+		switch len(r.args) {
+		case 1:
+			m.expect, err = newValueMatch("=", unescape(r.args[0]))
+		case 2:
+			m.expect, err = newValueMatch(r.args[0], unescape(r.args[1]))
+		default:
+			err = errors.New("vince: invalid expect")
+		}
+		return err
+	}
+	return nil
+}
+
+// unescape interprets C like escape sequences like \r\n in s.
+func unescape(s string) string {
+	v, err := strconv.Unquote(`"` + strings.Replace(s, `"`, `\"`, -1) + `"`)
+	if err != nil {
+		return s
+	}
+	return v
+}
+
+func (m *healthMatch) http(res *http.Response, body []byte) error {
+	for _, s := range m.status {
+		if !s.ok(res.StatusCode) {
+			return fmt.Errorf("vince: unexpected status %d", res.StatusCode)
+		}
+	}
+	for _, h := range m.headers {
+		if !h.ok(res.Header) {
+			return fmt.Errorf("vince: header %q did not match", h.name)
+		}
+	}
+	for _, b := range m.body {
+		if !b.ok(body) {
+			return errors.New("vince: body did not match")
+		}
+	}
+	return nil
+}
+
+// collectMatches returns match blocks defined in block (http or stream).
+func collectMatches(block *rule) (map[string]*healthMatch, error) {
+	m := make(map[string]*healthMatch)
+	for _, ch := range block.children {
+		if ch.name != "match" {
+			continue
+		}
+		h := new(healthMatch)
+		if err := h.load(ch); err != nil {
+			return nil, err
+		}
+		m[h.name] = h
+	}
+	return m, nil
+}
+
+// healthCheck probes all peers of an upstream.
+type healthCheck struct {
+	// ctx is the context checks were started with, peers added at runtime are
+	// checked with it.
+	ctx      context.Context
+	upstream *upstreamConfig
+	conf     healthCheckConfig
+	// stream is true for stream upstreams.
+	stream bool
+	// scheme of the proxy_pass of http checks.
+	scheme string
+	client *http.Client
+}
+
+// healthChecks are all health checks of a configuration.
+type healthChecks struct {
+	checks []*healthCheck
+	cancel context.CancelFunc
+}
+
+// collectHealthChecks finds health_check directives in core. upstreams and
+// streamUpstreams are http and stream upstreams.
+func collectHealthChecks(core *rule, upstreams, streamUpstreams map[string]*upstreamConfig) (*healthChecks, error) {
+	hc := new(healthChecks)
+	for _, block := range core.children {
+		if block.name != "http" && block.name != "stream" {
+			continue
+		}
+		matches, err := collectMatches(block)
+		if err != nil {
+			return nil, err
+		}
+		var walk func(r *rule) error
+		walk = func(r *rule) error {
+			for _, ch := range r.children {
+				if ch.name == "health_check" {
+					c, err := newHealthCheck(ch, matches, upstreams, streamUpstreams)
+					if err != nil {
+						return ch.wrap(err)
+					}
+					hc.checks = append(hc.checks, c)
+					continue
+				}
+				if err := walk(ch); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := walk(block); err != nil {
+			return nil, err
+		}
+	}
+	return hc, nil
+}
+
+func newHealthCheck(r *rule, matches map[string]*healthMatch, upstreams, streamUpstreams map[string]*upstreamConfig) (*healthCheck, error) {
+	c := new(healthCheck)
+	if err := c.conf.load(r, matches); err != nil {
+		return nil, err
+	}
+	var pass *rule
+	for _, ch := range r.parent.children {
+		if ch.name == "proxy_pass" {
+			pass = ch
+			break
+		}
+	}
+	if pass == nil {
+		return nil, errors.New("vince: health_check requires proxy_pass to an upstream")
+	}
+	if r.parent.name == "server" {
+		// stream servers pass to upstream name or address
+		c.stream = true
+		c.upstream = streamUpstreams[pass.args[0]]
+		if t, err := findHealthCheckTimeout(r.parent); err != nil {
+			return nil, err
+		} else if t > 0 {
+			c.conf.timeout = t
+		}
+	} else {
+		u, err := parseProxyURL(pass.args[0])
+		if err != nil {
+			return nil, err
+		}
+		c.scheme = u.Scheme
+		c.upstream = upstreams[u.Host]
+		c.client = &http.Client{
+			Transport: &unixTransport{},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		if c.scheme == "https" {
+			c.client.Transport = &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}
+		}
+	}
+	if c.upstream == nil {
+		return nil, fmt.Errorf("vince: health_check requires proxy_pass to an upstream, %q is not an upstream", pass.args[0])
+	}
+	return c, nil
+}
+
+// findHealthCheckTimeout returns health_check_timeout for stream server srv.
+func findHealthCheckTimeout(srv *rule) (time.Duration, error) {
+	for r := srv; r != nil; r = r.parent {
+		for _, ch := range r.children {
+			if ch.name == "health_check_timeout" {
+				return parseDuration(ch.args[0])
+			}
+		}
+	}
+	return 0, nil
+}
+
+// start begins probing peers in the background until stop is called or ctx
+// is cancelled.
+func (hc *healthChecks) start(ctx context.Context) {
+	if hc == nil {
+		return
+	}
+	ctx, hc.cancel = context.WithCancel(ctx)
+	for _, c := range hc.checks {
+		c.ctx = ctx
+		c.upstream.watch(c)
+	}
+}
+
+// check starts probing p.
+func (c *healthCheck) check(p *upstreamPeer) {
+	atomic.StoreInt32(&p.health.checked, 1)
+	if c.conf.mandatory {
+		// peers are not used until they pass the first check.
+		p.health.setDown(true)
+	}
+	upstreamPeerHealthy.WithLabelValues(c.upstream.name, p.addr).Set(boolFloat(!p.health.isDown()))
+	go c.run(c.ctx, p)
+}
+
+func (hc *healthChecks) stop() {
+	if hc != nil && hc.cancel != nil {
+		hc.cancel()
+	}
+}
+
+func (c *healthCheck) run(ctx context.Context, p *upstreamPeer) {
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if p.isRemoved() {
+				return
+			}
+			err := c.probe(ctx, p)
+			if ctx.Err() != nil {
+				return
+			}
+			c.record(p, err)
+			d := c.conf.interval
+			if c.conf.jitter > 0 {
+				d += time.Duration(rand.Int63n(int64(c.conf.jitter)))
+			}
+			t.Reset(d)
+		}
+	}
+}
+
+// record updates health of p with the result of a probe.
+func (c *healthCheck) record(p *upstreamPeer, err error) {
+	h := &p.health
+	h.mu.Lock()
+	h.lastCheck = time.Now()
+	result := "pass"
+	if err != nil {
+		result = "fail"
+		h.lastErr = err.Error()
+		h.passes = 0
+		h.fails++
+		if h.fails >= c.conf.fails {
+			h.setDown(true)
+		}
+	} else {
+		h.lastErr = ""
+		h.fails = 0
+		h.passes++
+		if h.passes >= c.conf.passes && h.setDown(false) {
+			p.recover(h.lastCheck)
+		}
+	}
+	h.mu.Unlock()
+	upstreamHealthChecks.WithLabelValues(c.upstream.name, p.addr, result).Inc()
+	upstreamPeerHealthy.WithLabelValues(c.upstream.name, p.addr).Set(boolFloat(!h.isDown()))
+}
+
+func boolFloat(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// addr returns the address to probe, the port parameter overrides the port of
+// the peer.
+func (c *healthCheck) addr(p *upstreamPeer) string {
+	if c.conf.port == "" || strings.HasPrefix(p.addr, "unix:") {
+		return p.addr
+	}
+	host, _, err := net.SplitHostPort(p.addr)
+	if err != nil {
+		return p.addr
+	}
+	return net.JoinHostPort(host, c.conf.port)
+}
+
+func (c *healthCheck) probe(ctx context.Context, p *upstreamPeer) error {
+	ctx, cancel := context.WithTimeout(ctx, c.conf.timeout)
+	defer cancel()
+	if c.stream {
+		return c.probeStream(ctx, p)
+	}
+	return c.probeHTTP(ctx, p)
+}
+
+func (c *healthCheck) probeHTTP(ctx context.Context, p *upstreamPeer) error {
+	u, err := url.Parse(c.conf.uri)
+	if err != nil {
+		return err
+	}
+	u.Scheme = c.scheme
+	u.Host = c.addr(p)
+	r, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	// url.String can't represent unix socket hosts
+	r.URL = u
+	r.Host = c.upstream.name
+	res, err := c.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if c.conf.match == nil {
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxHealthCheckBody))
+		if res.StatusCode < 200 || res.StatusCode >= 400 {
+			return fmt.Errorf("vince: unexpected status %d", res.StatusCode)
+		}
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxHealthCheckBody))
+	if err != nil {
+		return err
+	}
+	return c.conf.match.http(res, body)
+}
+
+func (c *healthCheck) probeStream(ctx context.Context, p *upstreamPeer) error {
+	network, addr := "tcp", c.addr(p)
+	if c.conf.udp {
+		network = "udp"
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", addr[5:]
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	m := c.conf.match
+	if m == nil {
+		if !c.conf.udp {
+			return nil
+		}
+		m = &healthMatch{send: []byte("vince health check")}
+	}
+	if len(m.send) > 0 {
+		if _, err := conn.Write(m.send); err != nil {
+			return err
+		}
+	}
+	if m.expect == nil {
+		if c.conf.udp {
+			// an unreachable udp port is reported on the next read, no
+			// response before the deadline means the peer is alive.
+			conn.SetReadDeadline(time.Now().Add(c.conf.timeout / 5))
+			_, err := conn.Read(make([]byte, 1))
+			if err != nil && !isTimeout(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	chunk := make([]byte, 4096)
+	for buf.Len() < maxHealthCheckBody {
+		n, err := conn.Read(chunk)
+		buf.Write(chunk[:n])
+		if m.expect.op == "=" && buf.Len() >= len(m.expect.value) {
+			break
+		}
+		if m.expect.op == "~" && m.expect.ok(buf.Bytes()) {
+			return nil
+		}
+		if err != nil {
+			if err == io.EOF || c.conf.udp {
+				break
+			}
+			return err
+		}
+		if c.conf.udp {
+			break
+		}
+	}
+	data := buf.Bytes()
+	if m.expect.op == "=" && len(data) > len(m.expect.value) {
+		data = data[:len(m.expect.value)]
+	}
+	if !m.expect.ok(data) {
+		return errors.New("vince: response did not match expect")
+	}
+	return nil
+}
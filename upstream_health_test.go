@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthMatch(t *testing.T) {
+	core := testRules(t, `http {
+    match ok {
+        status 200-399;
+        status ! 301 302;
+        header Content-Type ~ text;
+        header ! X-Broken;
+        body ~ "hello";
+    }
+}`)
+	m, err := collectMatches(core.children[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := m["ok"]
+	kases := []struct {
+		code   int
+		header http.Header
+		body   string
+		ok     bool
+	}{
+		{200, http.Header{"Content-Type": {"text/plain"}}, "hello world", true},
+		{204, http.Header{"Content-Type": {"text/plain"}}, "hello", true},
+		{302, http.Header{"Content-Type": {"text/plain"}}, "hello", false},
+		{500, http.Header{"Content-Type": {"text/plain"}}, "hello", false},
+		{200, http.Header{"Content-Type": {"application/json"}}, "hello", false},
+		{200, http.Header{"Content-Type": {"text/plain"}, "X-Broken": {"1"}}, "hello", false},
+		{200, http.Header{"Content-Type": {"text/plain"}}, "bye", false},
+	}
+	for _, k := range kases {
+		err := match.http(&http.Response{StatusCode: k.code, Header: k.header}, []byte(k.body))
+		if (err == nil) != k.ok {
+			t.Errorf("%d %v %q: expected ok=%v got %v", k.code, k.header, k.body, k.ok, err)
+		}
+	}
+}
+
+// waitState waits until peer p has the expected health.
+func waitState(t *testing.T, p *upstreamPeer, down bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if p.health.isDown() == down {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("peer %s: expected down=%v", p.addr, down)
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	var broken int32
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || r.Host != "backend" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if atomic.LoadInt32(&broken) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(w, "healthy")
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "sick")
+	}))
+	defer bad.Close()
+	core := testRules(t, fmt.Sprintf(`http {
+    match ok {
+        status 200;
+        body ~ healthy;
+    }
+    upstream backend {
+        server %s;
+        server %s;
+    }
+    server {
+        location / {
+            proxy_pass http://backend;
+            health_check interval=50ms passes=2 uri=/health match=ok;
+        }
+    }
+}`, good.Listener.Addr(), bad.Listener.Addr()))
+	upstreams, err := collectUpstreams(core, "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc, err := collectHealthChecks(core, upstreams, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hc.start(ctx)
+	u := upstreams["backend"]
+	peers := u.all()
+	waitState(t, peers[1], true)
+	for i := 0; i < 4; i++ {
+		if p := u.next("", nil); p != peers[0] {
+			t.Fatalf("expected healthy peer got %s", p.addr)
+		}
+	}
+	atomic.StoreInt32(&broken, 1)
+	waitState(t, peers[0], true)
+	if p := u.next("", nil); p != nil {
+		t.Errorf("expected no peer got %s", p.addr)
+	}
+	atomic.StoreInt32(&broken, 0)
+	waitState(t, peers[0], false)
+	hc.stop()
+}
+
+func TestHealthCheckStream(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				if strings.TrimSpace(line) == "PING" {
+					conn.Write([]byte("PONG\r\n"))
+				}
+			}()
+		}
+	}()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	core := testRules(t, fmt.Sprintf(`stream {
+    match pong {
+        send "PING\r\n";
+        expect ~ "^PONG";
+    }
+    upstream backend {
+        server %s;
+        server %s;
+    }
+    server {
+        listen 127.0.0.1:0;
+        proxy_pass backend;
+        health_check interval=50ms match=pong;
+        health_check_timeout 1s;
+    }
+}`, ls.Addr(), dead.Addr()))
+	upstreams, err := collectUpstreams(core, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc, err := collectHealthChecks(core, nil, upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.checks[0].conf.timeout != time.Second {
+		t.Errorf("expected health_check_timeout to be used got %v", hc.checks[0].conf.timeout)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hc.start(ctx)
+	peers := upstreams["backend"].all()
+	waitState(t, peers[1], true)
+	waitState(t, peers[0], false)
+	// make sure the live peer was actually probed
+	peers[0].health.mu.Lock()
+	checked := !peers[0].health.lastCheck.IsZero()
+	peers[0].health.mu.Unlock()
+	if !checked {
+		t.Error("expected peer to be checked")
+	}
+	hc.stop()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errPeerExists   = errors.New("vince: server already exists in upstream")
+	errPeerNotFound = errors.New("vince: server not found in upstream")
+)
+
+// watch registers health check c with the upstream and starts probing all
+// peers. Peers added later are probed by c too.
+func (u *upstreamConfig) watch(c *healthCheck) {
+	u.once.Do(u.init)
+	u.mu.Lock()
+	u.health = append(u.health, c)
+	peers := append(append([]*upstreamPeer{}, u.peers...), u.backup...)
+	u.mu.Unlock()
+	for _, p := range peers {
+		c.check(p)
+	}
+}
+
+// peer returns the peer with id.
+func (u *upstreamConfig) peer(id int) *upstreamPeer {
+	for _, p := range u.all() {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// add adds a server to the upstream at runtime. The server is not added when
+// the state file can't be saved.
+func (u *upstreamConfig) add(s upstreamServer) (*upstreamPeer, error) {
+	u.once.Do(u.init)
+	p := newUpstreamPeer(s)
+	u.mu.Lock()
+	for _, o := range append(append([]*upstreamPeer{}, u.peers...), u.backup...) {
+		if o.addr == p.addr {
+			u.mu.Unlock()
+			return nil, errPeerExists
+		}
+	}
+	u.push(p)
+	if err := u.saveState(); err != nil {
+		if p.server.backup.value {
+			u.backup = u.backup[:len(u.backup)-1]
+		} else {
+			u.peers = u.peers[:len(u.peers)-1]
+		}
+		u.mu.Unlock()
+		return nil, err
+	}
+	u.build()
+	checks := u.health
+	u.mu.Unlock()
+	for _, c := range checks {
+		c.check(p)
+	}
+	return p, nil
+}
+
+// remove removes the server with id from the upstream. Requests that are
+// using the peer are not interrupted.
+func (u *upstreamConfig) remove(id int) error {
+	u.once.Do(u.init)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	del := func(peers []*upstreamPeer) ([]*upstreamPeer, bool) {
+		for i, p := range peers {
+			if p.id == id {
+				atomic.StoreInt32(&p.removed, 1)
+				return append(peers[:i:i], peers[i+1:]...), true
+			}
+		}
+		return peers, false
+	}
+	var ok bool
+	if u.peers, ok = del(u.peers); !ok {
+		if u.backup, ok = del(u.backup); !ok {
+			return errPeerNotFound
+		}
+	}
+	u.build()
+	return u.saveState()
+}
+
+// update calls fn with the server of peer id. The balancers are rebuilt
+// afterwards so weight changes take effect.
+func (u *upstreamConfig) update(id int, fn func(s *upstreamServer) error) error {
+	u.once.Do(u.init)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var p *upstreamPeer
+	for _, o := range append(append([]*upstreamPeer{}, u.peers...), u.backup...) {
+		if o.id == id {
+			p = o
+			break
+		}
+	}
+	if p == nil {
+		return errPeerNotFound
+	}
+	p.mu.Lock()
+	s := p.server
+	if err := fn(&s); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	if s.backup.value != p.server.backup.value {
+		p.mu.Unlock()
+		return errors.New("vince: backup parameter can't be changed")
+	}
+	if (p.server.down.value || p.server.drain.value) && !s.down.value && !s.drain.value {
+		p.recovered = time.Now()
+	}
+	p.server = s
+	p.weight = 1
+	if s.weight.set {
+		p.weight = int(s.weight.value)
+	}
+	p.mu.Unlock()
+	u.build()
+	return u.saveState()
+}
+
+func (p *upstreamPeer) isRemoved() bool {
+	return atomic.LoadInt32(&p.removed) == 1
+}
+
+// saveState writes servers of the upstream to the state file, this must be
+// called with mu held. Nothing is saved when the upstream has no state
+// directive.
+func (u *upstreamConfig) saveState() error {
+	if !u.state.set {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, peers := range [][]*upstreamPeer{u.peers, u.backup} {
+		for _, p := range peers {
+			p.mu.Lock()
+			buf.WriteString(p.server.String())
+			p.mu.Unlock()
+			buf.WriteByte('\n')
+		}
+	}
+	// write to a temporary file first so a crash never leaves a partial state
+	// file behind.
+	f, err := ioutil.TempFile(filepath.Dir(u.state.value), ".state")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), u.state.value)
+}
+
+// String returns the server directive for s, this is the format used by state
+// files.
+func (s upstreamServer) String() string {
+	o := []string{"server", s.url}
+	if s.weight.set {
+		o = append(o, fmt.Sprintf("weight=%d", s.weight.value))
+	}
+	if s.maxConn.set {
+		o = append(o, fmt.Sprintf("max_conns=%d", s.maxConn.value))
+	}
+	if s.maxFails.set {
+		o = append(o, fmt.Sprintf("max_fails=%d", s.maxFails.value))
+	}
+	if s.failTimeout.set {
+		o = append(o, "fail_timeout="+formatDuration(s.failTimeout.value))
+	}
+	if s.slowStart.set {
+		o = append(o, "slow_start="+formatDuration(s.slowStart.value))
+	}
+	if s.route.set {
+		o = append(o, "route="+s.route.value)
+	}
+	if s.service.set {
+		o = append(o, "service="+s.service.value)
+	}
+	for _, f := range []struct {
+		name string
+		v    boolValue
+	}{
+		{"backup", s.backup},
+		{"down", s.down},
+		{"drain", s.drain},
+		{"resolve", s.resolve},
+	} {
+		if f.v.value {
+			o = append(o, f.name)
+		}
+	}
+	return strings.Join(o, " ") + ";"
+}
+
+// formatDuration formats d in seconds when possible so it can be read back by
+// parseDuration.
+func formatDuration(d time.Duration) string {
+	if d%time.Second == 0 {
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	}
+	return d.String()
+}
+
+// readUpstreamState reads servers from state file name.
+func readUpstreamState(name string) ([]upstreamServer, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var servers []upstreamServer
+	s := bufio.NewScanner(f)
+	line := 0
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		args := strings.Fields(strings.TrimSuffix(text, ";"))
+		if len(args) < 2 || args[0] != "server" || !strings.HasSuffix(text, ";") {
+			return nil, newError(fmt.Sprintf("vince: invalid state %q", text), line, name)
+		}
+		var srv upstreamServer
+		if err := srv.init(&rule{name: args[0], args: args[1:]}); err != nil {
+			return nil, newError(err.Error(), line, name)
+		}
+		servers = append(servers, srv)
+	}
+	return servers, s.Err()
+}
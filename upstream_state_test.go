@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpstreamRuntimeChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vince-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "backend.state")
+	conf := fmt.Sprintf(`http {
+    upstream backend {
+        state %s;
+        server a;
+        server b;
+    }
+}`, state)
+	u := testUpstream(t, conf)
+	if _, err := u.add(upstreamServer{url: "a"}); err != errPeerExists {
+		t.Errorf("expected %v got %v", errPeerExists, err)
+	}
+	var c upstreamServer
+	c.url = "c:8080"
+	c.weight.store(3)
+	c.slowStart.store(30 * time.Second)
+	p, err := u.add(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.id != 2 {
+		t.Errorf("expected id 2 got %d", p.id)
+	}
+	if err := u.update(0, func(s *upstreamServer) error {
+		s.drain.store(true)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.remove(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.remove(1); err != errPeerNotFound {
+		t.Errorf("expected %v got %v", errPeerNotFound, err)
+	}
+	for i := 0; i < 3; i++ {
+		if p := u.next("", nil); p == nil || p.server.url != "c:8080" {
+			t.Fatalf("expected c:8080 got %v", p)
+		}
+	}
+	b, err := ioutil.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `server a max_fails=1 fail_timeout=10s drain;
+server c:8080 weight=3 max_fails=1 fail_timeout=10s slow_start=30s;
+`
+	if string(b) != expect {
+		t.Errorf("expected state\n%s\ngot\n%s", expect, string(b))
+	}
+
+	// the state file replaces servers in the configuration
+	u = testUpstream(t, conf)
+	var got []string
+	for _, p := range u.all() {
+		got = append(got, p.server.String())
+	}
+	want := "[server a max_fails=1 fail_timeout=10s drain; server c:8080 weight=3 max_fails=1 fail_timeout=10s slow_start=30s;]"
+	if s := fmt.Sprint(got); s != want {
+		t.Errorf("expected %s got %s", want, s)
+	}
+}
+
+func TestUpstreamAddNotSaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vince-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the state file can't be written in a missing directory
+	u := testUpstream(t, fmt.Sprintf(`http {
+    upstream backend {
+        state %s;
+        server a;
+    }
+}`, filepath.Join(dir, "missing", "backend.state")))
+	for i := 0; i < 2; i++ {
+		if _, err := u.add(upstreamServer{url: "b"}); err == nil || err == errPeerExists {
+			t.Fatalf("expected the state file error got %v", err)
+		}
+	}
+	if n := len(u.all()); n != 1 {
+		t.Errorf("expected the server not to be added got %d servers", n)
+	}
+}
+
+func TestUpstreamSlowStart(t *testing.T) {
+	var s upstreamServer
+	s.url = "a"
+	s.weight.store(10)
+	s.slowStart.store(10 * time.Second)
+	p := newUpstreamPeer(s)
+	now := time.Now()
+	p.recover(now)
+	kases := []struct {
+		after  time.Duration
+		weight int
+	}{
+		{0, 1},
+		{time.Second, 1},
+		{5 * time.Second, 5},
+		{10 * time.Second, 10},
+		{time.Minute, 10},
+	}
+	for _, k := range kases {
+		if w := p.effectiveWeight(now.Add(k.after)); w != k.weight {
+			t.Errorf("after %v: expected weight %d got %d", k.after, k.weight, w)
+		}
+	}
+
+	// a peer that comes back from being marked down ramps up again
+	var u upstreamConfig
+	u.servers = []upstreamServer{s}
+	if err := u.update(0, func(s *upstreamServer) error {
+		s.down.store(true)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.update(0, func(s *upstreamServer) error {
+		s.down.store(false)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if w := u.peers[0].effectiveWeight(time.Now()); w != 1 {
+		t.Errorf("expected weight 1 after recovery got %d", w)
+	}
+}
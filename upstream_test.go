@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRules returns the rule tree of configuration file.
+func testRules(t *testing.T, file string) *rule {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "vince-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "vince.conf")
+	if err := ioutil.WriteFile(name, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d, err := loadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ruleFromStmt(d, nil)
+}
+
+func testUpstream(t *testing.T, block string) *upstreamConfig {
+	t.Helper()
+	m, err := collectUpstreams(testRules(t, block), "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m["backend"]
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	u := testUpstream(t, `http {
+    upstream backend {
+        server a weight=5;
+        server b;
+        server c;
+        server d down;
+        server e backup;
+    }
+}`)
+	var got []string
+	for i := 0; i < 7; i++ {
+		got = append(got, u.next("", nil).server.url)
+	}
+	expect := "[a a b a c a a]"
+	if s := fmt.Sprint(got); s != expect {
+		t.Errorf("expected %s got %s", expect, s)
+	}
+	for _, p := range u.peers {
+		p.server.down.store(true)
+	}
+	if p := u.next("", nil); p == nil || p.server.url != "e" {
+		t.Errorf("expected backup server got %v", p)
+	}
+	u.backup[0].server.down.store(true)
+	if p := u.next("", nil); p != nil {
+		t.Errorf("expected no peer got %v", p.server.url)
+	}
+}
+
+func TestUpstreamBackup(t *testing.T) {
+	u := testUpstream(t, `http {
+    upstream backend {
+        server a down;
+        server b weight=2 backup;
+        server c backup;
+    }
+}`)
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, u.next("", nil).server.url)
+	}
+	// backup servers are balanced with weights like primary servers
+	expect := "[b c b]"
+	if s := fmt.Sprint(got); s != expect {
+		t.Errorf("expected %s got %s", expect, s)
+	}
+	u = testUpstream(t, `http {
+    upstream backend {
+        least_conn;
+        server a down;
+        server b backup;
+        server c backup;
+    }
+}`)
+	busy := u.next("", nil)
+	busy.acquire()
+	for i := 0; i < 2; i++ {
+		if p := u.next("", nil); p == busy {
+			t.Errorf("expected the backup server with the least connections got %s", p.server.url)
+		}
+	}
+}
+
+func TestUpstreamHash(t *testing.T) {
+	for _, kase := range []string{"hash $request_uri", "hash $request_uri consistent"} {
+		u := testUpstream(t, fmt.Sprintf(`http {
+    upstream backend {
+        %s;
+        server a;
+        server b;
+        server c;
+    }
+}`, kase))
+		t.Run(kase, func(t *testing.T) {
+			vars := testVariables(vRequestURI, "/some/path")
+			key := u.key(vars, "")
+			if key != "/some/path" {
+				t.Fatalf("expected key to be evaluated got %q", key)
+			}
+			first := u.next(key, nil)
+			for i := 0; i < 10; i++ {
+				if p := u.next(key, nil); p != first {
+					t.Fatalf("expected %s got %s", first.server.url, p.server.url)
+				}
+			}
+			first.server.down.store(true)
+			if p := u.next(key, nil); p == nil || p == first {
+				t.Errorf("expected a different peer")
+			}
+		})
+	}
+}
+
+func TestUpstreamKetama(t *testing.T) {
+	var peers []*upstreamPeer
+	for _, s := range []string{"a:80", "b:80", "c:80", "d:80"} {
+		peers = append(peers, newUpstreamPeer(upstreamServer{url: s}))
+	}
+	all := newKetama(peers)
+	less := newKetama(peers[:3])
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("key", i)
+		a, b := all.next(key, nil), less.next(key, nil)
+		if a != peers[3] && a != b {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Errorf("expected keys of remaining peers to stay, %d moved", moved)
+	}
+}
+
+func TestUpstreamIPHash(t *testing.T) {
+	u := testUpstream(t, `http {
+    upstream backend {
+        ip_hash;
+        server a;
+        server b;
+        server c;
+    }
+}`)
+	a := u.next(u.key(nil, "192.168.1.10:4000"), nil)
+	b := u.next(u.key(nil, "192.168.1.200:5000"), nil)
+	if a != b {
+		t.Errorf("expected clients on the same network to use the same peer")
+	}
+}
+
+func TestUpstreamLeastConn(t *testing.T) {
+	u := testUpstream(t, `http {
+    upstream backend {
+        least_conn;
+        server a;
+        server b;
+        server c max_conns=1;
+    }
+}`)
+	a := u.next("", nil)
+	a.acquire()
+	b := u.next("", nil)
+	b.acquire()
+	if a == b {
+		t.Fatal("expected different peers")
+	}
+	c := u.next("", nil)
+	c.acquire()
+	if c == a || c == b {
+		t.Fatal("expected the idle peer")
+	}
+	// c reached max_conns so it is never picked
+	for i := 0; i < 10; i++ {
+		if p := u.next("", nil); p.server.url == "c" {
+			t.Fatal("expected c to be skipped")
+		}
+	}
+}
+
+func TestUpstreamRandomTwo(t *testing.T) {
+	u := testUpstream(t, `http {
+    upstream backend {
+        random two least_conn;
+        server a;
+        server b;
+    }
+}`)
+	u.next("", nil)
+	u.peers[0].acquire()
+	for i := 0; i < 10; i++ {
+		if p := u.next("", nil); p != u.peers[1] {
+			t.Fatalf("expected peer with least connections got %s", p.server.url)
+		}
+	}
+}
+
+func TestProxyPassUpstream(t *testing.T) {
+	var backends []string
+	for _, name := range []string{"one", "two"} {
+		ls, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ls.Close()
+		name := name
+		go http.Serve(ls, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		backends = append(backends, ls.Addr().String())
+	}
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    upstream backend {
+        server %s;
+        server %s;
+        server 127.0.0.1:1 down;
+    }
+    server {
+        listen       127.0.0.1:8093;
+        location / {
+            proxy_pass http://backend;
+        }
+    }
+}
+`, backends[0], backends[1])
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	runTest(t, c, func(_ context.Context, t *testing.T) {
+		seen := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			res, err := http.Get("http://127.0.0.1:8093/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			seen[string(b)]++
+		}
+		if seen["one"] != 2 || seen["two"] != 2 {
+			t.Errorf("expected requests to be balanced got %v", seen)
+		}
+	})
+}
+
+func TestProxyPassIPHashForwardedFor(t *testing.T) {
+	var backends []string
+	for _, name := range []string{"one", "two"} {
+		ls, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ls.Close()
+		name := name
+		go http.Serve(ls, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.Header.Get("X-Forwarded-For"))
+		}))
+		backends = append(backends, ls.Addr().String())
+	}
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    upstream backend {
+        ip_hash;
+        server %s;
+        server %s;
+    }
+    server {
+        listen       127.0.0.1:8116;
+        location / {
+            proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+            proxy_pass http://backend;
+        }
+    }
+}
+`, backends[0], backends[1])
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	// get sends a request from ip, clients of different /24 networks are
+	// different ip_hash clients.
+	get := func(t *testing.T, ip string) (backend, xff string) {
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}).DialContext,
+		}}
+		defer client.CloseIdleConnections()
+		r, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:8116/", nil)
+		r.Header.Set("X-Forwarded-For", "10.0.0.1")
+		res, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		p := strings.SplitN(string(b), " ", 2)
+		return p[0], p[1]
+	}
+	runTest(t, c, func(_ context.Context, t *testing.T) {
+		seen := make(map[string]bool)
+		for i := 1; i <= 8; i++ {
+			ip := fmt.Sprintf("127.0.%d.1", i)
+			backend, xff := get(t, ip)
+			if xff != "10.0.0.1, "+ip {
+				t.Errorf("expected X-Forwarded-For %q got %q", "10.0.0.1, "+ip, xff)
+			}
+			if again, _ := get(t, ip); again != backend {
+				t.Errorf("expected %s to stay on %s got %s", ip, backend, again)
+			}
+			seen[backend] = true
+		}
+		if len(seen) != 2 {
+			t.Errorf("expected clients to be hashed to both backends got %v", seen)
+		}
+	})
+}
+
+func TestUpstreamPassiveHealth(t *testing.T) {
+	p := newUpstreamPeer(upstreamServer{url: "a"})
+	p.server.maxFails.store(2)
+	p.server.failTimeout.store(time.Second)
+	now := time.Now()
+	p.failed(now)
+	if p.unhealthy(now) {
+		t.Fatal("expected peer to be healthy before max_fails")
+	}
+	p.failed(now)
+	if !p.unhealthy(now) {
+		t.Fatal("expected peer to be unhealthy after max_fails")
+	}
+	if p.unhealthy(now.Add(time.Second)) {
+		t.Error("expected peer to be tried again after fail_timeout")
+	}
+	// failures older than fail_timeout are not counted
+	p.failed(now.Add(2 * time.Second))
+	if p.unhealthy(now.Add(2 * time.Second)) {
+		t.Error("expected old failures to be forgotten")
+	}
+	p.failed(now.Add(2 * time.Second))
+	p.succeeded()
+	if p.unhealthy(now.Add(2 * time.Second)) {
+		t.Error("expected success to reset failures")
+	}
+}
+
+func TestProxyNextUpstream(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	var backends []string
+	for _, code := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		ls, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ls.Close()
+		code := code
+		go http.Serve(ls, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			w.WriteHeader(code)
+			fmt.Fprintf(w, "%d %s", code, b)
+		}))
+		backends = append(backends, ls.Addr().String())
+	}
+	file := fmt.Sprintf(`daemon off;
+events {
+}
+http {
+    {{test_http_globals .dir}}
+    upstream backend {
+        server %s max_fails=1 fail_timeout=1h;
+        server %s max_fails=0;
+        server %s backup;
+    }
+    server {
+        listen       127.0.0.1:8094;
+        location / {
+            proxy_pass http://backend;
+            proxy_next_upstream error http_503;
+        }
+        location /once {
+            proxy_pass http://backend;
+            proxy_next_upstream_tries 1;
+        }
+        location /small {
+            proxy_pass http://backend;
+            proxy_next_upstream error http_503;
+            proxy_next_upstream_timeout 10;
+            client_body_buffer_size 4;
+        }
+    }
+}
+`, dead.Addr(), backends[0], backends[1])
+	c, clear, err := setup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clear()
+	host := "http://127.0.0.1:8094"
+	runTest(t, c,
+		runHTTP(http.MethodPut, host+"/", strings.NewReader("body"),
+			checkCode(http.StatusOK), checkBodyString("200 body"),
+		),
+		runHTTP(http.MethodGet, host+"/", nil, checkCode(http.StatusOK)),
+		// non idempotent requests are not retried
+		runHTTP(http.MethodPost, host+"/", strings.NewReader("body"),
+			checkCode(http.StatusServiceUnavailable),
+		),
+		// the dead server is out of rotation
+		runHTTP(http.MethodGet, host+"/once", nil, checkCode(http.StatusServiceUnavailable)),
+		// bodies larger than client_body_buffer_size are not kept to retry
+		runHTTP(http.MethodPut, host+"/small", strings.NewReader("body"),
+			checkCode(http.StatusOK), checkBodyString("200 body"),
+		),
+		runHTTP(http.MethodPut, host+"/small", strings.NewReader("large body"),
+			checkCode(http.StatusServiceUnavailable),
+		),
+	)
+}
+
+func checkBodyString(s string) httpCheckFn {
+	return func(ctx context.Context, t *testing.T, res *http.Response) {
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(b) != s {
+			t.Errorf("check body: expected %q got %q", s, string(b))
+		}
+	}
+}
@@ -3,21 +3,34 @@ package main
 import "testing"
 
 func TestStringTemplateValue(t *testing.T) {
+	v := testVariables("$key", "1", vRemoteAddr, "10.0.0.1")
+	v.setCaptures([]string{"/a/b", "a", "b"})
 	sample := []struct {
 		src    string
-		ctx    interface{}
 		expect string
 	}{
-		{"empty", nil, "empty"},
-		{"empty $key", map[string]string{"key": "1"}, "empty 1"},
-		{"empty $1", map[string]string{"n_1": "1"}, "empty 1"},
+		{"empty", "empty"},
+		{"empty $key", "empty 1"},
+		{"empty $1", "empty a"},
+		{"$2$1", "ba"},
+		{"${key}s", "1s"},
+		{"$remote_addr:80", "10.0.0.1:80"},
+		{"$unknown.", "."},
+		{"$9", ""},
+		{"cost $", "cost $"},
+		{"${unterminated", "${unterminated"},
 	}
-	for _, v := range sample {
-		s := new(stringTemplateValue)
-		s.store(v.src)
-		got := s.Value(v.ctx)
-		if got != v.expect {
-			t.Errorf("%s: expected %q got %q", v.src, v.expect, got)
+	for _, s := range sample {
+		tpl := new(stringTemplateValue)
+		tpl.store(s.src)
+		got := tpl.Value(v)
+		if got != s.expect {
+			t.Errorf("%s: expected %q got %q", s.src, s.expect, got)
 		}
 	}
+	tpl := new(stringTemplateValue)
+	tpl.store("a $key")
+	if got := tpl.Value(nil); got != "a " {
+		t.Errorf("expected missing variables to be empty got %q", got)
+	}
 }
@@ -1,15 +1,12 @@
 package main
 
 import (
-	"regexp"
+	"fmt"
+	"strconv"
 	"strings"
-	"text/template"
 	"time"
-	"unicode"
-	"unicode/utf8"
 
-	"github.com/ergongate/vince/buffers"
-	"github.com/ergongate/vince/templates"
+	"code.cloudfoundry.org/bytefmt"
 )
 
 type stringValue struct {
@@ -63,6 +60,76 @@ func (s boolValue) merge(other boolValue) boolValue {
 	return s
 }
 
+// parseDuration parses nginx time values. Like nginx a value without unit is
+// in seconds, days, weeks, months and years are accepted along with the units
+// of time.ParseDuration.
+func parseDuration(s string) (time.Duration, error) {
+	if _, err := strconv.ParseUint(s, 10, 64); err == nil {
+		s += "s"
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil {
+		return d, nil
+	}
+	if n, ok := parseNgxTime(s); ok {
+		return n, nil
+	}
+	return 0, err
+}
+
+var ngxTimeUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"M":  30 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+// parseNgxTime parses values like 1y6M and 1d12h.
+func parseNgxTime(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	var d time.Duration
+	for s != "" {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		j := i
+		for j < len(s) && (s[j] < '0' || s[j] > '9') {
+			j++
+		}
+		unit, ok := ngxTimeUnits[s[i:j]]
+		if i == 0 || !ok {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		d += time.Duration(n) * unit
+		s = s[j:]
+	}
+	return d, true
+}
+
+// parseSize parses nginx size values like 512, 16k and 1m into bytes. Like
+// nginx a value without unit is in bytes.
+func parseSize(s string) (int64, error) {
+	if _, err := strconv.ParseUint(s, 10, 64); err == nil {
+		s += "b"
+	}
+	n, err := bytefmt.ToBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("vince: invalid size %q", s)
+	}
+	return int64(n), nil
+}
+
 type stringSliceValue struct {
 	set   bool
 	value []string
@@ -115,52 +182,124 @@ func (s interfaceValue) merge(other interfaceValue) interfaceValue {
 }
 
 // stringTemplateValue stores templated string. This allows adding strings with
-// nginx variables, i.e variables with $prefix.
+// nginx variables, i.e variables with $prefix. Names can be enclosed in braces
+// like ${name} to separate them from the text that follows.
 //
-// Matching groups are also supported, so $1 and $2 will work, however this
-// translates to {{.n_1}} and {{.n_2}} respectively so be careful to pass data
-// with appropriate keys.
+// Matching groups are also supported, so $1 and $2 are replaced with captures
+// of the last regular expression that matched.
 type stringTemplateValue struct {
 	value string
 	set   bool
-	tpl   *template.Template
+	parts []templatePart
 }
 
-var variableRegexp = regexp.MustCompile(`\$([a-z_\d]\w*)`)
+// templatePart is either text or a variable of a compiled template.
+type templatePart struct {
+	text    string
+	name    string
+	def     *variableDef
+	capture int
+}
 
 func (s *stringTemplateValue) store(v string) {
+	s.set = true
+	s.value = v
+	s.parts = compileTemplate(v)
+}
+
+// compileTemplate splits v into text and variables. Registered variables are
+// resolved now so that evaluating them is a lookup by index. nil is returned
+// when v has no variables.
+func compileTemplate(v string) []templatePart {
 	if !strings.Contains(v, "$") {
-		s.set = true
-		s.value = v
-		return
-	}
-	x := variableRegexp.ReplaceAllFunc([]byte(v), func(name []byte) []byte {
-		var o []byte
-		if templates.IsVariableFunc(string(name[1:])) {
-			o = append(o, []byte("{{")...)
+		return nil
+	}
+	var parts []templatePart
+	var text strings.Builder
+	for i := 0; i < len(v); {
+		if v[i] != '$' {
+			text.WriteByte(v[i])
+			i++
+			continue
+		}
+		name, n := scanVariable(v[i+1:])
+		if name == "" {
+			text.WriteByte('$')
+			i++
+			continue
+		}
+		if text.Len() > 0 {
+			parts = append(parts, templatePart{text: text.String(), capture: -1})
+			text.Reset()
+		}
+		p := templatePart{name: name, capture: -1}
+		if c, err := strconv.Atoi(name); err == nil {
+			p.capture = c
 		} else {
-			o = append(o, []byte("{{.")...)
-			r, _ := utf8.DecodeRune(name[1:])
-			if unicode.IsDigit(r) {
-				o = append(o, 'n', '_')
-			}
+			p.def = variableDefs[name]
 		}
-		o = append(o, name[1:]...)
-		o = append(o, []byte("}}")...)
-		return o
-	})
-	s.tpl = template.Must(template.New("variable").Parse(string(x)))
-	s.set = true
+		parts = append(parts, p)
+		i += 1 + n
+	}
+	if text.Len() > 0 {
+		parts = append(parts, templatePart{text: text.String(), capture: -1})
+	}
+	return parts
 }
 
-func (s *stringTemplateValue) Value(ctx interface{}) string {
-	buf := buffers.GetBytes()
-	defer buffers.PutBytes(buf)
-	if s.tpl == nil {
+// scanVariable returns the variable name at the start of s and the number of
+// bytes it takes, s is what follows the $.
+func scanVariable(s string) (string, int) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end == -1 {
+			return "", 0
+		}
+		return s[1:end], end + 1
+	}
+	if s != "" && isDigit(s[0]) {
+		n := 1
+		for n < len(s) && isDigit(s[n]) {
+			n++
+		}
+		return s[:n], n
+	}
+	n := 0
+	for n < len(s) && (isDigit(s[n]) || s[n] == '_' ||
+		('a' <= s[n] && s[n] <= 'z') || ('A' <= s[n] && s[n] <= 'Z')) {
+		n++
+	}
+	return s[:n], n
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+// Value evaluates the template with variables v. Variables without value are
+// replaced by an empty string.
+func (s *stringTemplateValue) Value(v *ngxVariables) string {
+	if s.parts == nil {
 		return s.value
 	}
-	if err := s.tpl.Execute(buf, ctx); err != nil {
-		panic(err)
+	var b strings.Builder
+	for i := range s.parts {
+		p := &s.parts[i]
+		switch {
+		case p.name == "":
+			b.WriteString(p.text)
+		case p.capture >= 0:
+			c, _ := v.capture(p.capture)
+			b.WriteString(c)
+		case p.def != nil:
+			if v != nil {
+				c, _ := v.def(p.def)
+				b.WriteString(c)
+			}
+		default:
+			c, _ := v.lookup(p.name)
+			b.WriteString(c)
+		}
 	}
-	return buf.String()
+	return b.String()
 }
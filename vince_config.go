@@ -28,8 +28,32 @@ type vinceConfiguration struct {
 	defaultPort int
 	management  struct {
 		enabled bool
-		port    int
-	}
+		// addr is the address the management api listens on, it is loopback
+		// unless set otherwise as the api changes upstreams.
+		addr string
+		port int
+	}
+	// cluster configures the raft node of vince, vince is not part of a cluster
+	// when id is empty.
+	cluster struct {
+		id string
+		// addr is the address raft listens on, it defaults to the address of
+		// this node in peers.
+		addr string
+		// peers are all the nodes of the cluster, this node included, as
+		// id=host:port.
+		peers []string
+		// dir stores raft logs and snapshots, it defaults to raft in the
+		// working directory.
+		dir string
+	}
+	// limitSync shares limit_req zones with other nodes, it is set by
+	// startCluster and is nil when vince is not part of a cluster.
+	limitSync *limitSync
+	// cacheSync replicates cache purges to other nodes, it is set by
+	// startCluster and is nil when vince is not part of a cluster, purges only
+	// remove responses of this node then.
+	cacheSync *cacheSync
 }
 
 func (c *vinceConfiguration) setup() error {
@@ -91,7 +115,7 @@ func (db *vinceDatabases) init(dir string, opts badger.Options) (err error) {
 	if err != nil {
 		return
 	}
-	db.raft.logs, err = db.open(opts, dir, "raft", "snaps")
+	db.raft.snap, err = db.open(opts, dir, "raft", "snaps")
 	if err != nil {
 		return
 	}
@@ -109,6 +133,7 @@ func (db *vinceDatabases) init(dir string, opts badger.Options) (err error) {
 
 func (db *vinceDatabases) open(opts badger.Options, dir ...string) (*badger.DB, error) {
 	opts.Dir = filepath.Join(dir...)
+	opts.ValueDir = opts.Dir
 	opts.Logger = nil // don't log its very verbose
 	return badger.Open(opts)
 }
@@ -155,8 +180,13 @@ func getConfig(ctx *cli.Context) (*vinceConfiguration, error) {
 	file := ctx.String("c")
 	var c vinceConfiguration
 	c.management.enabled = true // TODO make this configurable
+	c.management.addr = ctx.String("management-addr")
 	c.management.port = 9000
 	c.defaultPort = ctx.Int("p")
+	c.cluster.id = ctx.String("cluster-id")
+	c.cluster.addr = ctx.String("cluster-addr")
+	c.cluster.peers = ctx.StringSlice("cluster-peers")
+	c.cluster.dir = ctx.String("cluster-dir")
 	if file != "" {
 		stat, err := os.Stat(file)
 		if err != nil {